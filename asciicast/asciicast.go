@@ -0,0 +1,264 @@
+// Package asciicast reads and writes terminal recordings in the asciicast v2
+// format (https://docs.asciinema.org/manual/asciicast/v2/), which can also be
+// played with asciinema.
+package asciicast
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Event types
+const (
+	Output = "o"
+	Input  = "i"
+	Resize = "r"
+)
+
+// Header is the first line of a recording
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Event is one line after the header: the seconds since the start, the event
+// type and its data.
+type Event struct {
+	Time float64
+	Type string
+	Data string
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{e.Time, e.Type, e.Data})
+}
+
+func (e *Event) UnmarshalJSON(b []byte) error {
+	var fields []interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 3 {
+		return errors.New("event needs 3 fields")
+	}
+	var ok1, ok2, ok3 bool
+	e.Time, ok1 = fields[0].(float64)
+	e.Type, ok2 = fields[1].(string)
+	e.Data, ok3 = fields[2].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return errors.New("invalid event")
+	}
+	return nil
+}
+
+// Writer records events to a file. It is safe for concurrent use.
+type Writer struct {
+	mu      sync.Mutex
+	file    io.WriteCloser
+	buf     *bufio.Writer
+	start   time.Time
+	pending map[string][]byte
+	err     error
+}
+
+// Create starts a new recording at path with the given header. Version and
+// Timestamp are filled in.
+func Create(path string, h Header) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{file: f, buf: bufio.NewWriter(f), start: time.Now(),
+		pending: make(map[string][]byte)}
+	h.Version = 2
+	h.Timestamp = w.start.Unix()
+	line, err := json.Marshal(h)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.buf.Write(append(line, '\n'))
+	if err := w.buf.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Output records data written to the terminal
+func (w *Writer) Output(data []byte) {
+	w.write(Output, data)
+}
+
+// Input records data typed by the user
+func (w *Writer) Input(data []byte) {
+	w.write(Input, data)
+}
+
+// Resize records a change of the terminal size
+func (w *Writer) Resize(width, height int) {
+	w.event(Event{Type: Resize, Data: strconv.Itoa(width) + "x" + strconv.Itoa(height)})
+}
+
+// write records data, keeping back an incomplete UTF-8 sequence at its end
+// until the rest of it is written.
+func (w *Writer) write(typ string, data []byte) {
+	w.mu.Lock()
+	data = append(w.pending[typ], data...)
+	cut := incompleteSuffix(data)
+	w.pending[typ] = append([]byte(nil), data[len(data)-cut:]...)
+	w.mu.Unlock()
+	if len(data) > cut {
+		w.event(Event{Type: typ, Data: string(data[:len(data)-cut])})
+	}
+}
+
+func (w *Writer) event(e Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	e.Time = time.Since(w.start).Seconds()
+	line, err := json.Marshal(e)
+	if err == nil {
+		w.buf.Write(append(line, '\n'))
+		err = w.buf.Flush()
+	}
+	w.err = err
+}
+
+// Err returns the first error that happened while writing. Events after it
+// are dropped.
+func (w *Writer) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close writes what is still pending and closes the file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = make(map[string][]byte)
+	w.mu.Unlock()
+	for typ, data := range pending {
+		if len(data) > 0 {
+			w.event(Event{Type: typ, Data: string(data)})
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.file.Close()
+	if w.err != nil {
+		return w.err
+	}
+	w.err = errors.New("recording closed")
+	return err
+}
+
+// incompleteSuffix returns the length of a UTF-8 sequence that was cut off at
+// the end of b.
+func incompleteSuffix(b []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		c := b[len(b)-i]
+		if c < 0x80 {
+			return 0
+		}
+		if utf8.RuneStart(c) {
+			if utf8.FullRune(b[len(b)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+// Reader reads the events of a recording
+type Reader struct {
+	Header Header
+	scan   *bufio.Scanner
+	line   int
+}
+
+// NewReader reads the header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	rd := &Reader{scan: bufio.NewScanner(r)}
+	rd.scan.Buffer(nil, 16*1024*1024)
+	if !rd.scan.Scan() {
+		if err := rd.scan.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("empty recording")
+	}
+	rd.line++
+	if err := json.Unmarshal(rd.scan.Bytes(), &rd.Header); err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	if rd.Header.Version != 2 {
+		return nil, fmt.Errorf("unsupported asciicast version %d", rd.Header.Version)
+	}
+	return rd, nil
+}
+
+// Next returns the next event, or io.EOF at the end.
+func (rd *Reader) Next() (Event, error) {
+	var e Event
+	for rd.scan.Scan() {
+		rd.line++
+		if len(rd.scan.Bytes()) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(rd.scan.Bytes(), &e); err != nil {
+			return e, fmt.Errorf("line %d: %v", rd.line, err)
+		}
+		return e, nil
+	}
+	if err := rd.scan.Err(); err != nil {
+		return e, err
+	}
+	return e, io.EOF
+}
+
+// Prune deletes the oldest recordings in dir, so that at most keep are left.
+func Prune(dir string, keep int) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var casts []os.FileInfo
+	for _, f := range files {
+		if f.Mode().IsRegular() && strings.HasSuffix(f.Name(), ".cast") {
+			casts = append(casts, f)
+		}
+	}
+	if len(casts) <= keep {
+		return nil
+	}
+	sort.Slice(casts, func(i, j int) bool {
+		return casts[i].ModTime().Before(casts[j].ModTime())
+	})
+	for _, f := range casts[:len(casts)-keep] {
+		if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
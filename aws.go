@@ -67,6 +67,7 @@ func importAWS(conf *types.Configuration) error {
 				conn.Info.Description += *t.Key + ": " + *t.Value
 			}
 			conn.Login.User = "centos"
+			conn.KnownHosts = &types.KnownHosts{}
 			container.Connections = append(container.Connections, conn)
 		}
 	}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/ssh"
+	"github.com/cfstras/pcm/types"
+	ct "github.com/daviddengcn/go-colortext"
+	ui "github.com/gizak/termui"
+)
+
+const browserHelp = "tab other side  enter open  c copy  r rename  m mkdir  d delete  q back"
+
+// fileBrowser shows the local files next to the ones on a host, to copy them
+// from one side to the other, rename, delete and create directories.
+type fileBrowser struct {
+	conn *types.Connection
+
+	panes  [2]*browserPane
+	active int
+	status *ui.Par
+	grid   *ui.Grid
+
+	session *ssh.SFTP
+	// what is typed while logging in, for passwords and the like
+	login *inputQueue
+
+	// the last message, e.g. an error or how far a copy is
+	message string
+	// a question asked in the status line and what was typed so far
+	asking   bool
+	question string
+	answer   string
+	secret   bool
+	answered func(answer string)
+
+	// work running in the background, like a copy
+	busy     bool
+	done     chan func()
+	messages chan string
+	quit     chan struct{}
+}
+
+// browserPane is one side of the file browser.
+type browserPane struct {
+	name    string
+	fs      fileSystem
+	dir     string
+	entries []os.FileInfo
+	list    *SelectList
+}
+
+// browseFiles logs in to conn and shows its files next to the local ones,
+// until the user goes back to the connection list.
+func browseFiles(conf *types.Configuration, conn *types.Connection, events <-chan ui.Event) {
+	b := &fileBrowser{
+		conn:     conn,
+		status:   ui.NewPar(""),
+		login:    newInputQueue(),
+		done:     make(chan func()),
+		messages: make(chan string),
+		quit:     make(chan struct{}),
+	}
+	local := &browserPane{name: "Local", fs: localFS{}, list: NewSelectList()}
+	if dir, err := os.Getwd(); err == nil {
+		local.dir = dir
+	} else {
+		local.dir = replaceHome("~")
+	}
+	remote := &browserPane{name: conn.Path(), list: NewSelectList()}
+	b.panes = [2]*browserPane{local, remote}
+	b.grid = ui.NewGrid(
+		ui.NewRow(
+			ui.NewCol(6, 0, local.list),
+			ui.NewCol(6, 0, remote.list)),
+		ui.NewRow(
+			ui.NewCol(12, 0, b.status)))
+	b.resize()
+	b.refresh()
+
+	// messages like the ones about host keys would mess up the screen, show
+	// them in the status line instead. Copies show their progress on stderr.
+	out, errOut := os.Stdout, os.Stderr
+	messages, messagesIn, err := os.Pipe()
+	p(err, "creating pipe")
+	os.Stdout, os.Stderr, ct.Writer = messagesIn, messagesIn, messagesIn
+	defer func() {
+		os.Stdout, os.Stderr, ct.Writer = out, errOut, out
+		messagesIn.Close()
+		close(b.quit)
+		if b.session != nil {
+			b.session.Close()
+		}
+	}()
+	go func() {
+		readMessages(messages, func(line string) {
+			select {
+			case b.messages <- line:
+			case <-b.quit:
+			}
+		})
+		messages.Close()
+	}()
+
+	b.message = "Connecting to " + conn.Info.Host + "..."
+	b.ask("", true, b.loginAnswer)
+	b.busy = true
+	terminal := &browserTerminal{input: b.login, out: messagesIn}
+	go func() {
+		session, err := ssh.OpenSFTP(conn, sshSettings, terminal, func(c *types.Connection) {
+			saveConn(conf, c)
+		})
+		select {
+		case b.done <- func() { b.connected(session, err) }:
+		case <-b.quit:
+			if session != nil {
+				session.Close()
+			}
+		}
+	}()
+
+	for {
+		b.draw()
+		ui.Render(b.grid)
+		select {
+		case ev := <-events:
+			if !b.handle(ev) {
+				return
+			}
+		case line := <-b.messages:
+			b.message = line
+		case f := <-b.done:
+			b.busy = false
+			f()
+		}
+	}
+}
+
+func (b *fileBrowser) connected(session *ssh.SFTP, err error) {
+	b.asking = false
+	if err != nil {
+		b.message = "Error: " + err.Error()
+		return
+	}
+	remote := b.panes[1]
+	remote.dir, err = session.Getwd()
+	if err != nil {
+		session.Close()
+		b.message = "Error: " + err.Error()
+		return
+	}
+	b.session = session
+	remote.fs = remoteFS{session}
+	b.message = "Connected to " + b.conn.Info.Host
+	b.refresh()
+}
+
+// loginAnswer passes what was typed on to the login, and waits for the next
+// question.
+func (b *fileBrowser) loginAnswer(answer string) {
+	io.WriteString(b.login, answer+"\r")
+	if b.busy {
+		b.ask("", true, b.loginAnswer)
+	}
+}
+
+// ask shows question in the status line and calls answered with what the
+// user typed, unless the question was cancelled.
+func (b *fileBrowser) ask(question string, secret bool, answered func(answer string)) {
+	b.asking, b.question, b.answer, b.secret = true, question, "", secret
+	b.answered = answered
+}
+
+// background runs work without blocking the screen. Afterwards, both sides
+// are listed again.
+func (b *fileBrowser) background(work func()) {
+	b.busy = true
+	go func() {
+		work()
+		select {
+		case b.done <- b.refresh:
+		case <-b.quit:
+		}
+	}()
+}
+
+// handle reacts on an event, and returns false when the browser should close.
+func (b *fileBrowser) handle(ev ui.Event) bool {
+	if ev.Type == ui.EventResize {
+		b.resize()
+		return true
+	}
+	if ev.Type != ui.EventKey {
+		return true
+	}
+	if b.asking {
+		return b.typeAnswer(ev)
+	}
+
+	pane := b.panes[b.active]
+	list := pane.list
+	switch {
+	case ev.Key == ui.KeyArrowDown:
+		list.CurrentSelection++
+	case ev.Key == ui.KeyArrowUp:
+		list.CurrentSelection--
+	case ev.Key == ui.KeyPgdn:
+		list.CurrentSelection += list.Height - 3
+	case ev.Key == ui.KeyPgup:
+		list.CurrentSelection -= list.Height - 3
+	case ev.Key == ui.KeyHome:
+		list.CurrentSelection = 0
+	case ev.Key == ui.KeyEnd:
+		list.CurrentSelection = len(list.Items) - 1
+	case ev.Key == ui.KeyTab:
+		b.active = 1 - b.active
+	case ev.Key == ui.KeyEnter || ev.Key == ui.KeyArrowRight:
+		b.open()
+	case ev.Key == ui.KeyBackspace || ev.Key == ui.KeyBackspace2 || ev.Key == ui.KeyArrowLeft:
+		b.changeDir(pane, "..")
+	case ev.Key == ui.KeyEsc || ev.Key == ui.KeyCtrlC || ev.Ch == 'q':
+		if b.busy && b.session != nil {
+			b.message = "Wait until the copy is done"
+			return true
+		}
+		return false
+	case ev.Ch == 'c':
+		b.copySelected()
+	case ev.Ch == 'r':
+		b.renameSelected()
+	case ev.Ch == 'm':
+		b.mkdir()
+	case ev.Ch == 'd' || ev.Key == ui.KeyDelete:
+		b.deleteSelected()
+	}
+	if list.CurrentSelection > len(list.Items)-1 {
+		list.CurrentSelection = len(list.Items) - 1
+	}
+	if list.CurrentSelection < 0 {
+		list.CurrentSelection = 0
+	}
+	return true
+}
+
+func (b *fileBrowser) typeAnswer(ev ui.Event) bool {
+	switch {
+	case ev.Key == ui.KeyEnter:
+		b.asking = false
+		b.answered(b.answer)
+	case ev.Key == ui.KeyEsc || ev.Key == ui.KeyCtrlC:
+		if b.session == nil {
+			// still logging in, give up
+			return false
+		}
+		b.asking = false
+	case ev.Key == ui.KeyBackspace || ev.Key == ui.KeyBackspace2:
+		if answer := []rune(b.answer); len(answer) > 0 {
+			b.answer = string(answer[:len(answer)-1])
+		}
+	case ev.Key == ui.KeySpace:
+		b.answer += " "
+	case ev.Ch != 0:
+		b.answer += string(ev.Ch)
+	}
+	return true
+}
+
+// selected returns the file selected on the active side, or nil for "..".
+func (b *fileBrowser) selected() (*browserPane, os.FileInfo) {
+	pane := b.panes[b.active]
+	i := pane.list.CurrentSelection - 1
+	if pane.fs == nil || i < 0 || i >= len(pane.entries) {
+		return pane, nil
+	}
+	return pane, pane.entries[i]
+}
+
+// ready returns whether the files can be changed, and says why not otherwise.
+func (b *fileBrowser) ready() bool {
+	if b.session == nil {
+		b.message = "Not connected"
+		return false
+	}
+	if b.busy {
+		b.message = "Wait until the copy is done"
+		return false
+	}
+	return true
+}
+
+func (b *fileBrowser) open() {
+	pane, entry := b.selected()
+	if pane.fs == nil {
+		return
+	}
+	if entry == nil {
+		b.changeDir(pane, "..")
+		return
+	}
+	name := pane.fs.Join(pane.dir, entry.Name())
+	if entry.Mode()&os.ModeSymlink != 0 {
+		info, err := pane.fs.Stat(name)
+		if err != nil {
+			b.message = "Error: " + err.Error()
+			return
+		}
+		entry = info
+	}
+	if entry.IsDir() {
+		b.changeDir(pane, entry.Name())
+	}
+}
+
+// changeDir goes into the directory name, relative to the current one.
+func (b *fileBrowser) changeDir(pane *browserPane, name string) {
+	if pane.fs == nil {
+		return
+	}
+	old := pane.dir
+	dir := pane.fs.Join(old, name)
+	pane.dir = dir
+	if !pane.read() {
+		pane.dir = old
+		b.message = "Can't open " + dir
+		return
+	}
+	pane.list.CurrentSelection = 0
+	pane.list.scroll = 0
+	for i, e := range pane.entries {
+		if pane.fs.Join(dir, e.Name()) == old {
+			// coming from there
+			pane.list.CurrentSelection = i + 1
+		}
+	}
+}
+
+func (b *fileBrowser) copySelected() {
+	if !b.ready() {
+		return
+	}
+	from, entry := b.selected()
+	if entry == nil {
+		return
+	}
+	to := b.panes[1-b.active]
+	src := from.fs.Join(from.dir, entry.Name())
+	dst := to.fs.Join(to.dir, entry.Name())
+	t := &transfer{src: from.fs, dst: to.fs, progress: true}
+	start := func() {
+		b.background(func() {
+			started := time.Now()
+			t.copy(src, dst, entry)
+			t.summary(time.Since(started))
+		})
+	}
+	if _, err := to.fs.Stat(dst); err == nil {
+		b.ask("Overwrite "+dst+" [Ny]? ", false, func(answer string) {
+			if yes(answer) {
+				start()
+			}
+		})
+		return
+	}
+	start()
+}
+
+func (b *fileBrowser) renameSelected() {
+	if !b.ready() {
+		return
+	}
+	pane, entry := b.selected()
+	if entry == nil {
+		return
+	}
+	b.ask("Rename to: ", false, func(answer string) {
+		if answer == "" || answer == entry.Name() {
+			return
+		}
+		b.background(func() {
+			err := pane.fs.Rename(pane.fs.Join(pane.dir, entry.Name()), pane.fs.Join(pane.dir, answer))
+			if err != nil {
+				color.Redln(err)
+			}
+		})
+	})
+	b.answer = entry.Name()
+}
+
+func (b *fileBrowser) mkdir() {
+	if !b.ready() {
+		return
+	}
+	pane := b.panes[b.active]
+	b.ask("New directory: ", false, func(answer string) {
+		if answer == "" {
+			return
+		}
+		b.background(func() {
+			if err := pane.fs.Mkdir(pane.fs.Join(pane.dir, answer)); err != nil {
+				color.Redln(err)
+			}
+		})
+	})
+}
+
+func (b *fileBrowser) deleteSelected() {
+	if !b.ready() {
+		return
+	}
+	pane, entry := b.selected()
+	if entry == nil {
+		return
+	}
+	name := pane.fs.Join(pane.dir, entry.Name())
+	question := "Delete " + name + " [Ny]? "
+	if entry.IsDir() {
+		question = "Delete " + name + " and everything in it [Ny]? "
+	}
+	b.ask(question, false, func(answer string) {
+		if !yes(answer) {
+			return
+		}
+		b.background(func() {
+			t := &transfer{dst: pane.fs}
+			if entry.IsDir() {
+				t.deleteExtra(name, nil)
+			}
+			if err := pane.fs.Remove(name); err != nil {
+				t.fail(err)
+			}
+			if t.failed == 0 {
+				color.Greenln("Deleted", name)
+			}
+		})
+	})
+}
+
+func yes(answer string) bool {
+	answer = strings.TrimSpace(strings.ToLower(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// refresh lists both sides again, keeping the selection where it can.
+func (b *fileBrowser) refresh() {
+	for _, pane := range b.panes {
+		if pane.fs == nil {
+			continue
+		}
+		selected := ""
+		if i := pane.list.CurrentSelection - 1; i >= 0 && i < len(pane.entries) {
+			selected = pane.entries[i].Name()
+		}
+		if !pane.read() {
+			b.message = "Can't list " + pane.dir
+			continue
+		}
+		for i, e := range pane.entries {
+			if e.Name() == selected {
+				pane.list.CurrentSelection = i + 1
+			}
+		}
+	}
+}
+
+// read lists the directory, directories first.
+func (pane *browserPane) read() bool {
+	entries, err := pane.fs.ReadDir(pane.dir)
+	if err != nil {
+		return false
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir() != entries[j].IsDir() {
+			return entries[i].IsDir()
+		}
+		return entries[i].Name() < entries[j].Name()
+	})
+	pane.entries = entries
+	return true
+}
+
+func (b *fileBrowser) resize() {
+	b.status.Height = 4
+	for _, pane := range b.panes {
+		pane.list.Height = ui.TermHeight() - b.status.Height
+	}
+	b.grid.Width = ui.TermWidth()
+	b.grid.Align()
+}
+
+func (b *fileBrowser) draw() {
+	for i, pane := range b.panes {
+		list := pane.list
+		list.Border.Label = " " + pane.name + " "
+		if pane.fs == nil {
+			list.Items = []string{"not connected"}
+			if b.busy {
+				list.Items = []string{"connecting..."}
+			}
+			continue
+		}
+		list.Border.Label += pane.dir + " "
+		width := list.InnerWidth()
+		list.Items = []string{"../"}
+		for _, e := range pane.entries {
+			list.Items = append(list.Items, entryLine(e, width))
+		}
+		if i == b.active {
+			list.middle.TextBgColor = ui.ColorBlue
+		} else {
+			list.middle.TextBgColor = ui.ColorDefault
+		}
+	}
+
+	second := browserHelp
+	if b.asking {
+		second = b.question + b.answer
+		if b.secret {
+			second = b.question + strings.Repeat("*", len([]rune(b.answer)))
+		}
+	}
+	width := b.status.InnerWidth()
+	b.status.Text = cutLine(b.message, width) + "\n" + cutLine(second, width)
+}
+
+// entryLine shows a file with its size, fitting into width.
+func entryLine(e os.FileInfo, width int) string {
+	name, size := e.Name(), formatBytes(e.Size())
+	if e.IsDir() {
+		name, size = name+"/", ""
+	} else if e.Mode()&os.ModeSymlink != 0 {
+		name, size = name+"@", ""
+	}
+	nameWidth := width - 11
+	if nameWidth < 1 {
+		nameWidth = 1
+	}
+	name = cutLine(name, nameWidth)
+	return name + strings.Repeat(" ", nameWidth-len([]rune(name))) + " " +
+		strings.Repeat(" ", 10-len(size)) + size
+}
+
+// cutLine shortens line to width characters, keeping the end.
+func cutLine(line string, width int) string {
+	r := []rune(line)
+	if width < 1 || len(r) <= width {
+		return line
+	}
+	return "…" + string(r[len(r)-width+1:])
+}
+
+// browserTerminal lets the login ask its questions in the status line of the
+// file browser.
+type browserTerminal struct {
+	input io.Reader
+	out   io.Writer
+}
+
+// GetSize returns a fixed size, there is no session to size.
+func (t *browserTerminal) GetSize() (width, height int, err error) { return 80, 24, nil }
+func (t *browserTerminal) Stdin() io.Reader                        { return t.input }
+func (t *browserTerminal) Stdout() io.Writer                       { return t.out }
+func (t *browserTerminal) Stderr() io.Writer                       { return t.out }
+func (t *browserTerminal) ExitRequests() <-chan bool               { return nil }
+func (t *browserTerminal) Signals() <-chan os.Signal               { return nil }
+func (t *browserTerminal) MakeRaw()                                {}
+func (t *browserTerminal) RestoreRaw()                             {}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/ssh"
+	"github.com/cfstras/pcm/types"
+)
+
+// charsetTerminal converts between UTF-8 on the terminal and the character set
+// of the host.
+type charsetTerminal struct {
+	types.Terminal
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+// Code pages as PuTTY names them, "CP437" etc., which htmlindex doesn't know
+var codePages = map[string]encoding.Encoding{
+	"cp437": charmap.CodePage437,
+	"cp850": charmap.CodePage850,
+	"cp852": charmap.CodePage852,
+	"cp855": charmap.CodePage855,
+	"cp858": charmap.CodePage858,
+	"cp860": charmap.CodePage860,
+	"cp862": charmap.CodePage862,
+	"cp863": charmap.CodePage863,
+	"cp865": charmap.CodePage865,
+	"cp866": charmap.CodePage866,
+}
+
+// findCharset returns the encoding for a character set name, as in
+// types.Options.Charset. PuTTY's names like "ISO-8859-1:1998 (Latin-1, West
+// Europe)" and "Win1252 (Western)" are understood, too.
+func findCharset(name string) (encoding.Encoding, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if i := strings.IndexAny(name, " :"); i != -1 {
+		name = name[:i]
+	}
+	if strings.HasPrefix(name, "win") && !strings.HasPrefix(name, "windows") {
+		name = "windows-" + strings.TrimPrefix(name, "win")
+	}
+	if e, ok := codePages[name]; ok {
+		return e, nil
+	}
+	return htmlindex.Get(name)
+}
+
+// withCharset returns terminal converting to and from charset, or terminal
+// itself for UTF-8.
+func withCharset(terminal types.Terminal, charset string) types.Terminal {
+	if charset == "" {
+		return terminal
+	}
+	e, err := findCharset(charset)
+	if err != nil {
+		color.Yellowln("Warning: unknown character set", charset+", using UTF-8")
+		return terminal
+	}
+	if name, _ := htmlindex.Name(e); name == "utf-8" {
+		return terminal
+	}
+	return &charsetTerminal{Terminal: terminal,
+		stdin:  transform.NewReader(terminal.Stdin(), encoding.ReplaceUnsupported(e.NewEncoder())),
+		stdout: transform.NewWriter(terminal.Stdout(), e.NewDecoder()),
+	}
+}
+
+func (c *charsetTerminal) Stdin() io.Reader {
+	return c.stdin
+}
+
+// RawStdin is the input for pcm's own prompts, which read the keyboard as it
+// is.
+func (c *charsetTerminal) RawStdin() io.Reader {
+	return ssh.RawStdin(c.Terminal)
+}
+
+func (c *charsetTerminal) Stdout() io.Writer {
+	return c.stdout
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cfstras/pcm/types"
+	"github.com/cfstras/pcm/util"
+	"github.com/cfstras/pcm/vterm"
+	ct "github.com/daviddengcn/go-colortext"
+	"github.com/tevino/abool"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Key starting a cluster mode command: Ctrl+]
+const clusterPrefix = 0x1d
+
+const clusterHelp = "Ctrl+] then: 1-9 toggle input to a pane, a all on, i invert, q quit all, Ctrl+] send it"
+
+// clusterPane is one session of cluster mode. It is the terminal of the
+// session, showing its output in a part of the real one.
+type clusterPane struct {
+	number int
+	conn   *types.Connection
+	screen *vterm.Screen
+	input  *inputQueue
+
+	exit    chan bool
+	signals chan os.Signal
+	closed  *abool.AtomicBool
+	// whether typed keys are sent here, guarded by the cluster lock
+	active bool
+
+	// where the pane is on the real terminal
+	x, y, width, height int
+
+	redraw func()
+}
+
+func (p *clusterPane) GetSize() (width, height int, err error) {
+	width, height = p.screen.Size()
+	return
+}
+func (p *clusterPane) Stdin() io.Reader          { return p.input }
+func (p *clusterPane) Stdout() io.Writer         { return p }
+func (p *clusterPane) Stderr() io.Writer         { return p }
+func (p *clusterPane) ExitRequests() <-chan bool { return p.exit }
+func (p *clusterPane) Signals() <-chan os.Signal { return p.signals }
+func (p *clusterPane) MakeRaw()                  {}
+func (p *clusterPane) RestoreRaw()               {}
+
+func (p *clusterPane) Write(data []byte) (int, error) {
+	n, err := p.screen.Write(data)
+	p.redraw()
+	return n, err
+}
+
+// inputQueue is an unbounded buffer of input for a session, so one slow
+// host doesn't hold up the others.
+type inputQueue struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+}
+
+func newInputQueue() *inputQueue {
+	q := &inputQueue{}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+func (q *inputQueue) Write(data []byte) (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.buf = append(q.buf, data...)
+	q.cond.Signal()
+	return len(data), nil
+}
+
+func (q *inputQueue) Read(data []byte) (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.buf) == 0 {
+		q.cond.Wait()
+	}
+	n := copy(data, q.buf)
+	q.buf = q.buf[n:]
+	return n, nil
+}
+
+// cluster shows sessions to several hosts side by side. What is typed goes
+// to all of them, or to the ones selected with the Ctrl+] commands.
+type cluster struct {
+	lock   sync.Mutex
+	panes  []*clusterPane
+	status string
+	prefix bool
+	dirty  chan struct{}
+
+	out           *os.File
+	width, height int
+	frame         [][]vterm.Cell
+}
+
+// clusterConnect opens a session to each of conns and shows them tiled.
+func clusterConnect(conns []*types.Connection) {
+	out := os.Stdout
+	width, height, err := terminal.GetSize(int(out.Fd()))
+	p(err, "getting terminal size")
+	if width == 0 || height == 0 {
+		width, height = 80, 24
+	}
+	c := &cluster{out: out, dirty: make(chan struct{}, 1), status: clusterHelp}
+	for i, conn := range conns {
+		pane := &clusterPane{
+			number: i + 1, conn: conn, active: true,
+			screen:  vterm.New(80, 24),
+			input:   newInputQueue(),
+			exit:    make(chan bool, 1),
+			signals: make(chan os.Signal, 1),
+			closed:  abool.New(),
+			redraw:  c.redraw,
+		}
+		pane.screen.Respond = func(answer []byte) { pane.input.Write(answer) }
+		c.panes = append(c.panes, pane)
+	}
+	c.layout(width, height)
+
+	state, err := util.SetupTerminal()
+	p(err, "making terminal raw")
+	defer util.RestoreTerminal(state)
+	io.WriteString(out, "\x1b[?1049h\x1b[H\x1b[2J")
+	defer io.WriteString(out, "\x1b[0m\x1b[?25h\x1b[?1049l")
+
+	// messages of the sessions would mess up the screen, show them in the
+	// status line instead
+	messages, messagesIn, err := os.Pipe()
+	p(err, "creating pipe")
+	os.Stdout, ct.Writer = messagesIn, messagesIn
+	defer func() {
+		os.Stdout, ct.Writer = out, out
+		messagesIn.Close()
+	}()
+	go c.showMessages(messages)
+
+	var saveLock sync.Mutex
+	save := func(changed *types.Connection) {
+		saveLock.Lock()
+		defer saveLock.Unlock()
+		saveConn(sshSettings.Config, changed)
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, pane := range c.panes {
+		wg.Add(1)
+		go func(pane *clusterPane) {
+			defer wg.Done()
+			connectSession(pane.conn, pane, save)
+			pane.closed.Set()
+			io.WriteString(pane, "\r\n[Connection closed]")
+		}(pane)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	input := make(chan []byte)
+	go func() {
+		for {
+			buf := make([]byte, 1024)
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(input)
+				return
+			}
+			input <- buf[:n]
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second / 30)
+	defer ticker.Stop()
+	dirty, allClosed := true, false
+	for {
+		select {
+		case buf, ok := <-input:
+			if allClosed {
+				return
+			}
+			if !ok || !c.handleInput(buf) {
+				c.quit(done)
+				return
+			}
+		case <-c.dirty:
+			dirty = true
+		case <-ticker.C:
+			if w, h, err := terminal.GetSize(int(out.Fd())); err == nil && w > 0 && h > 0 &&
+				(w != c.width || h != c.height) {
+				c.layout(w, h)
+				dirty = true
+			}
+			if dirty {
+				c.render()
+				dirty = false
+			}
+		case <-done:
+			done, allClosed = nil, true
+			c.lock.Lock()
+			c.status = "All connections closed, press any key to quit."
+			c.lock.Unlock()
+			dirty = true
+		}
+	}
+}
+
+// quit ends all sessions and waits a bit for them to close.
+func (c *cluster) quit(done chan struct{}) {
+	for _, pane := range c.panes {
+		select {
+		case pane.exit <- true:
+		default:
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+	}
+}
+
+func (c *cluster) redraw() {
+	select {
+	case c.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// handleInput sends what was typed to the active panes, and runs Ctrl+]
+// commands. It returns false if cluster mode should end.
+func (c *cluster) handleInput(buf []byte) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	defer c.redraw()
+	for len(buf) > 0 {
+		if c.prefix {
+			c.prefix = false
+			c.status = ""
+			cmd := buf[0]
+			buf = buf[1:]
+			switch {
+			case cmd == clusterPrefix:
+				c.broadcast([]byte{clusterPrefix})
+			case cmd >= '1' && cmd <= '9':
+				if i := int(cmd - '1'); i < len(c.panes) {
+					c.panes[i].active = !c.panes[i].active
+				}
+			case cmd == 'a':
+				for _, pane := range c.panes {
+					pane.active = true
+				}
+			case cmd == 'i':
+				for _, pane := range c.panes {
+					pane.active = !pane.active
+				}
+			case cmd == 'q':
+				return false
+			default:
+				c.status = clusterHelp
+			}
+			continue
+		}
+		i := bytes.IndexByte(buf, clusterPrefix)
+		if i == -1 {
+			c.broadcast(buf)
+			break
+		}
+		c.broadcast(buf[:i])
+		buf = buf[i+1:]
+		c.prefix = true
+		c.status = "Ctrl+]: " + strings.TrimPrefix(clusterHelp, "Ctrl+] then: ")
+	}
+	return true
+}
+
+func (c *cluster) broadcast(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	for _, pane := range c.panes {
+		if pane.active && !pane.closed.IsSet() {
+			pane.input.Write(data)
+		}
+	}
+}
+
+// ansiColors matches the colour codes of the color package
+var ansiColors = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// showMessages puts the last line written to r into the status line.
+func (c *cluster) showMessages(r io.Reader) {
+	readMessages(r, func(line string) {
+		c.lock.Lock()
+		c.status = line
+		c.lock.Unlock()
+		c.redraw()
+	})
+}
+
+// readMessages calls show with the last line of each write to r, without
+// colours, until r is closed.
+func readMessages(r io.Reader, show func(line string)) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		lines := strings.FieldsFunc(ansiColors.ReplaceAllString(string(buf[:n]), ""),
+			func(r rune) bool { return r == '\n' || r == '\r' })
+		for i := len(lines) - 1; i >= 0; i-- {
+			if line := strings.TrimSpace(lines[i]); line != "" {
+				show(line)
+				break
+			}
+		}
+	}
+}
+
+// layout tiles the panes on a terminal of the given size, with a title line
+// for each pane and a status line at the bottom. Sessions are told about
+// the new size of their pane.
+func (c *cluster) layout(width, height int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.width, c.height = width, height
+	c.frame = nil
+
+	n := len(c.panes)
+	cols := 1
+	for cols*cols < n {
+		cols++
+	}
+	rows := (n + cols - 1) / cols
+	for i, pane := range c.panes {
+		col, row := i%cols, i/cols
+		x0, x1 := col*width/cols, (col+1)*width/cols
+		y0, y1 := row*(height-1)/rows, (row+1)*(height-1)/rows
+		if col < cols-1 && i < n-1 {
+			x1-- // separator
+		}
+		if i == n-1 {
+			x1 = width // the last pane takes the rest of its row
+		}
+		pane.x, pane.y = x0, y0+1
+		pane.width, pane.height = x1-x0, y1-y0-1
+		pane.screen.Resize(pane.width, pane.height)
+		if sigwinch := util.GetSigwinch(); sigwinch != nil {
+			select {
+			case pane.signals <- sigwinch:
+			default:
+			}
+		}
+	}
+}
+
+// render draws the panes, writing only what changed since the last time.
+func (c *cluster) render() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	blank := vterm.Cell{Ch: ' ', Attr: vterm.Attr{Fg: vterm.DefaultColor, Bg: vterm.DefaultColor}}
+	frame := make([][]vterm.Cell, c.height)
+	for y := range frame {
+		frame[y] = make([]vterm.Cell, c.width)
+		for x := range frame[y] {
+			frame[y][x] = blank
+		}
+	}
+	set := func(x, y int, cell vterm.Cell) {
+		if y >= 0 && y < c.height && x >= 0 && x < c.width {
+			frame[y][x] = cell
+		}
+	}
+
+	cursorX, cursorY, cursorShown := 0, 0, false
+	for _, pane := range c.panes {
+		title := fmt.Sprintf(" %d %s ", pane.number, pane.conn.Path())
+		titleAttr := vterm.Attr{Fg: 0, Bg: 2} // black on green
+		if pane.closed.IsSet() {
+			title += "[closed] "
+			titleAttr.Bg = 1
+		} else if !pane.active {
+			title += "[input off] "
+			titleAttr = vterm.Attr{Fg: vterm.DefaultColor, Bg: vterm.DefaultColor, Reverse: true}
+		}
+		x := pane.x
+		for _, r := range title {
+			if x >= pane.x+pane.width {
+				break
+			}
+			set(x, pane.y-1, vterm.Cell{Ch: r, Attr: titleAttr})
+			x++
+		}
+		for ; x < pane.x+pane.width; x++ {
+			set(x, pane.y-1, vterm.Cell{Ch: '─', Attr: titleAttr})
+		}
+		for y := 0; y < pane.height; y++ {
+			for x := 0; x < pane.width; x++ {
+				set(pane.x+x, pane.y+y, pane.screen.Cell(x, y))
+			}
+		}
+		for y := pane.y - 1; y < pane.y+pane.height; y++ {
+			set(pane.x+pane.width, y, vterm.Cell{Ch: '│', Attr: blank.Attr})
+		}
+		if !cursorShown && pane.active && !pane.closed.IsSet() {
+			x, y, visible := pane.screen.Cursor()
+			if visible {
+				cursorX, cursorY, cursorShown = pane.x+x, pane.y+y, true
+			}
+		}
+	}
+	statusAttr := vterm.Attr{Fg: vterm.DefaultColor, Bg: vterm.DefaultColor, Reverse: true}
+	x := 0
+	for _, r := range c.status {
+		set(x, c.height-1, vterm.Cell{Ch: r, Attr: statusAttr})
+		x++
+	}
+	for ; x < c.width; x++ {
+		set(x, c.height-1, vterm.Cell{Ch: ' ', Attr: statusAttr})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[?25l")
+	if c.frame == nil {
+		buf.WriteString("\x1b[0m\x1b[2J")
+	}
+	var attr vterm.Attr
+	attrSet := false
+	for y, line := range frame {
+		lastX := -2
+		for x, cell := range line {
+			if c.frame != nil && c.frame[y][x] == cell {
+				continue
+			}
+			if y == c.height-1 && x == c.width-1 {
+				// writing the last cell would scroll some terminals
+				continue
+			}
+			if x != lastX+1 {
+				fmt.Fprintf(&buf, "\x1b[%d;%dH", y+1, x+1)
+			}
+			if !attrSet || attr != cell.Attr {
+				buf.WriteString(sgr(cell.Attr))
+				attr, attrSet = cell.Attr, true
+			}
+			var r [utf8.UTFMax]byte
+			buf.Write(r[:utf8.EncodeRune(r[:], cell.Ch)])
+			lastX = x
+		}
+	}
+	c.frame = frame
+	if cursorShown {
+		fmt.Fprintf(&buf, "\x1b[%d;%dH\x1b[?25h", cursorY+1, cursorX+1)
+	}
+	c.out.Write(buf.Bytes())
+}
+
+// sgr returns the escape sequence for drawing with attr.
+func sgr(attr vterm.Attr) string {
+	s := "\x1b[0"
+	if attr.Bold {
+		s += ";1"
+	}
+	if attr.Underline {
+		s += ";4"
+	}
+	if attr.Reverse {
+		s += ";7"
+	}
+	if attr.Fg >= 8 {
+		s += fmt.Sprintf(";%d", 90+attr.Fg-8)
+	} else if attr.Fg >= 0 {
+		s += fmt.Sprintf(";%d", 30+attr.Fg)
+	}
+	if attr.Bg >= 8 {
+		s += fmt.Sprintf(";%d", 100+attr.Bg-8)
+	} else if attr.Bg >= 0 {
+		s += fmt.Sprintf(";%d", 40+attr.Bg)
+	}
+	return s + "m"
+}
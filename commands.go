@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// A subcommand is invoked as "pcm [flags] <name> [args...]" and replaces the
+// interactive connection selection. Subcommands without usage are used by pcm
+// itself and not listed.
+type subcommand struct {
+	usage string
+	run   func(args []string)
+}
+
+var subcommands = make(map[string]subcommand)
+
+func printSubcommands() {
+	names := make([]string, 0, len(subcommands))
+	for n, cmd := range subcommands {
+		if cmd.usage != "" {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, n := range names {
+		fmt.Fprintf(os.Stderr, "  pcm %s\n", subcommands[n].usage)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/go-utils/lock"
+	"github.com/cfstras/pcm/types"
+	"github.com/cfstras/pcm/vault"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// How often the passphrase is asked for before giving up
+const passphraseTries = 3
+
+// How connections.xml is encrypted, as found when loading it. Saving keeps it
+// that way.
+var encryption struct {
+	// nil if connections.xml is not encrypted
+	key *vault.Key
+	// whether the whole file is encrypted, or just the secrets in it
+	wholeFile bool
+
+	// The encrypted file and its contents as loaded, and the encrypted secrets
+	// by the secret they were decrypted into. Unchanged ones are saved as they
+	// were, so saving without changes leaves the file as it is.
+	file, plain []byte
+	sealed      map[*string]sealedSecret
+}
+
+type sealedSecret struct {
+	plain, sealed string
+}
+
+// Set with -passphrase-cache; 0 to not keep the key
+var passphraseCache time.Duration
+
+func init() {
+	subcommands["encrypt"] = subcommand{
+		usage: "encrypt [-passwords-only]",
+		run:   encryptCommand,
+	}
+	subcommands["decrypt"] = subcommand{
+		usage: "decrypt",
+		run:   decryptCommand,
+	}
+	subcommands["rekey"] = subcommand{
+		usage: "rekey [-passwords-only | -whole-file]",
+		run:   rekeyCommand,
+	}
+}
+
+// decryptFile returns the contents of connections.xml, decrypted if needed.
+func decryptFile(data []byte) []byte {
+	encryption.wholeFile = vault.IsEncryptedFile(data)
+	encryption.file, encryption.plain = nil, nil
+	if !encryption.wholeFile {
+		return data
+	}
+	salt, err := vault.FileSalt(data)
+	p(err, "reading "+connectionsPath)
+	var plain []byte
+	unlock(salt, func(k *vault.Key) (err error) {
+		plain, err = k.DecryptFile(data)
+		return err
+	})
+	encryption.file, encryption.plain = data, plain
+	return plain
+}
+
+// encryptFile encrypts the contents of connections.xml for saving.
+func encryptFile(plain []byte) []byte {
+	if bytes.Equal(plain, encryption.plain) && sameKey(vault.FileSalt(encryption.file)) {
+		return encryption.file
+	}
+	return encryption.key.EncryptFile(plain)
+}
+
+// sameKey returns whether salt belongs to the key used for saving.
+func sameKey(salt []byte, err error) bool {
+	return err == nil && bytes.Equal(salt, encryption.key.Salt())
+}
+
+// secretsOf returns pointers to the secrets of conn which are encrypted in a
+// file with just the secrets encrypted, by the name of their element.
+func secretsOf(conn *types.Connection) map[string]*string {
+	return map[string]*string{"password": &conn.Login.Password,
+		"totp_secret": &conn.Login.TOTPSecret}
+}
+
+// decryptSecrets decrypts the secrets of the connections and returns whether
+// there were encrypted ones.
+func decryptSecrets(conf *types.Configuration) (encrypted bool) {
+	encryption.sealed = make(map[*string]sealedSecret)
+	for path, conn := range conf.AllConnections() {
+		for field, s := range secretsOf(conn) {
+			if !vault.IsEncryptedValue(*s) {
+				continue
+			}
+			salt, err := vault.ValueSalt(*s)
+			p(err, "reading the "+field+" of "+path)
+			if k := encryption.key; k != nil && bytes.Equal(k.Salt(), salt) {
+				// with the right key, asking for the passphrase again won't help
+				_, err := k.DecryptValue(*s, path, field)
+				p(err, "decrypting the "+field+" of "+path+
+					", it might have been copied from another connection")
+			}
+			var plain string
+			unlock(salt, func(k *vault.Key) (err error) {
+				plain, err = k.DecryptValue(*s, path, field)
+				return err
+			})
+			encryption.sealed[s] = sealedSecret{plain, *s}
+			*s = plain
+			encrypted = true
+		}
+	}
+	return
+}
+
+// encryptSecrets encrypts the secrets of the connections in place, for
+// saving. The returned function restores them.
+func encryptSecrets(conf *types.Configuration) (restore func()) {
+	var secrets []*string
+	var plain []string
+	for path, conn := range conf.AllConnections() {
+		for field, s := range secretsOf(conn) {
+			if *s == "" || vault.IsEncryptedValue(*s) {
+				continue
+			}
+			secrets, plain = append(secrets, s), append(plain, *s)
+			if o, ok := encryption.sealed[s]; ok && o.plain == *s && sameKey(vault.ValueSalt(o.sealed)) {
+				*s = o.sealed
+			} else {
+				*s = encryption.key.EncryptValue(*s, path, field)
+			}
+		}
+	}
+	return func() {
+		for i, s := range secrets {
+			*s = plain[i]
+		}
+	}
+}
+
+// unlock finds the key for salt for which check succeeds: the one already
+// used, the one from the key cache, or one from a passphrase asked for.
+func unlock(salt []byte, check func(*vault.Key) error) {
+	if k := encryption.key; k != nil && bytes.Equal(k.Salt(), salt) && check(k) == nil {
+		return
+	}
+	if k := cachedKey(salt); k != nil && check(k) == nil {
+		encryption.key = k
+		return
+	}
+	for i := 0; i < passphraseTries; i++ {
+		passphrase, err := readPassphrase("Passphrase for " + connectionsPath + ": ")
+		p(err, "reading the passphrase")
+		k, err := vault.DeriveKey(passphrase, salt)
+		p(err, "deriving the key")
+		err = check(k)
+		if err == nil {
+			encryption.key = k
+			if passphraseCache > 0 {
+				cacheKey(k, passphraseCache)
+			}
+			return
+		}
+		if err != vault.ErrWrongPassphrase {
+			p(err, "decrypting "+connectionsPath)
+		}
+		color.Redln("Wrong passphrase.")
+	}
+	panic("Could not decrypt " + connectionsPath)
+}
+
+// readPassphrase asks for a passphrase on the terminal, or reads a line from
+// stdin if it is not a terminal.
+func readPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return terminal.ReadPassword(int(os.Stdin.Fd()))
+	}
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 1 && (b[0] == '\n' || b[0] == '\r') {
+			return line, nil
+		}
+		line = append(line, b[:n]...)
+		if err != nil {
+			return line, err
+		}
+	}
+}
+
+// newKey asks for a new passphrase, twice, and derives a new key from it.
+func newKey() *vault.Key {
+	passphrase, err := readPassphrase("New passphrase: ")
+	p(err, "reading the passphrase")
+	if len(passphrase) == 0 {
+		panic("The passphrase must not be empty.")
+	}
+	repeated, err := readPassphrase("Repeat the passphrase: ")
+	p(err, "reading the passphrase")
+	if !bytes.Equal(passphrase, repeated) {
+		panic("The passphrases differ.")
+	}
+	k, err := vault.NewKey(passphrase)
+	p(err, "deriving the key")
+	return k
+}
+
+// rewriteConns loads connections.xml, lets change modify how it is encrypted
+// and saves it again.
+func rewriteConns(change func()) {
+	flock, err := lock.Try(connectionsPath, true)
+	p(err, "locking "+connectionsPath)
+	defer flock.Unlock()
+	conf := loadConns()
+	change()
+	saveConns(&conf)
+	if encryption.key != nil && passphraseCache > 0 {
+		cacheKey(encryption.key, passphraseCache)
+	}
+}
+
+func encryptCommand(args []string) {
+	flags := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	passwordsOnly := flags.Bool("passwords-only", false,
+		"only encrypt the passwords and TOTP secrets, so PuTTYCM can still read the rest")
+	flags.Parse(args)
+	rewriteConns(func() {
+		if encryption.key != nil {
+			panic(connectionsPath + " is encrypted already, see pcm rekey.")
+		}
+		encryption.key, encryption.wholeFile = newKey(), !*passwordsOnly
+	})
+	color.Yellowln("Encrypted", connectionsPath)
+}
+
+func decryptCommand(args []string) {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	flags.Parse(args)
+	rewriteConns(func() {
+		if encryption.key == nil {
+			panic(connectionsPath + " is not encrypted.")
+		}
+		encryption.key = nil
+	})
+	color.Yellowln("Decrypted", connectionsPath)
+}
+
+func rekeyCommand(args []string) {
+	flags := flag.NewFlagSet("rekey", flag.ExitOnError)
+	passwordsOnly := flags.Bool("passwords-only", false,
+		"from now on, only encrypt the passwords and TOTP secrets")
+	wholeFile := flags.Bool("whole-file", false, "from now on, encrypt the whole file")
+	flags.Parse(args)
+	rewriteConns(func() {
+		if encryption.key == nil {
+			panic(connectionsPath + " is not encrypted, see pcm encrypt.")
+		}
+		encryption.key = newKey()
+		if *passwordsOnly {
+			encryption.wholeFile = false
+		} else if *wholeFile {
+			encryption.wholeFile = true
+		}
+	})
+	color.Yellowln("Changed the passphrase of", connectionsPath)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cfstras/pcm/types"
+	"github.com/cfstras/pcm/vault"
+)
+
+// useConnections makes a copy of testdata/connections.xml, a file written by
+// PuTTYCM, the connections.xml of the test.
+func useConnections(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "connections.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "pcm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := connectionsPath
+	connectionsPath = filepath.Join(dir, "connections.xml")
+	t.Cleanup(func() {
+		connectionsPath = old
+		encryption.key, encryption.wholeFile = nil, false
+		os.RemoveAll(dir)
+	})
+	if err := ioutil.WriteFile(connectionsPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	encryption.key, encryption.wholeFile = nil, false
+}
+
+// withStdin lets the passphrases be read from input.
+func withStdin(t *testing.T, input string) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString(input)
+	w.Close()
+	old := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = old
+		r.Close()
+	})
+}
+
+func readConnections(t *testing.T) []byte {
+	data, err := ioutil.ReadFile(connectionsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testKey(t *testing.T, passphrase string) *vault.Key {
+	k, err := vault.NewKey([]byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// checkPasswords checks the passwords of conf are the ones in the test file.
+func checkPasswords(t *testing.T, conf *types.Configuration) {
+	all := conf.AllConnections()
+	for path, want := range map[string]string{"/servers/web": "web-secret",
+		"/servers/db": "db-secret"} {
+		if all[path] == nil {
+			t.Errorf("%s missing", path)
+		} else if all[path].Login.Password != want {
+			t.Errorf("%s: password %q, want %q", path, all[path].Login.Password, want)
+		}
+	}
+}
+
+func TestLoadPlain(t *testing.T) {
+	useConnections(t)
+	original := readConnections(t)
+	conf := loadConns()
+	if encryption.key != nil || encryption.wholeFile {
+		t.Error("plain file taken for encrypted")
+	}
+	checkPasswords(t, &conf)
+
+	saveConns(&conf)
+	if !bytes.Equal(readConnections(t), original) {
+		t.Error("saving without changes changed the file")
+	}
+}
+
+func TestEncryptWholeFile(t *testing.T) {
+	useConnections(t)
+	conf := loadConns()
+	k := testKey(t, "correct horse")
+	encryption.key, encryption.wholeFile = k, true
+	saveConns(&conf)
+
+	sealed := readConnections(t)
+	if !vault.IsEncryptedFile(sealed) || bytes.Contains(sealed, []byte("<")) {
+		t.Fatalf("not encrypted:\n%s", sealed)
+	}
+	encryption.key, encryption.wholeFile = nil, false
+	withStdin(t, "correct horse\n")
+	conf = loadConns()
+	if !encryption.wholeFile || encryption.key == nil {
+		t.Error("the encryption was not detected")
+	}
+	checkPasswords(t, &conf)
+
+	saveConns(&conf)
+	if !bytes.Equal(readConnections(t), sealed) {
+		t.Error("saving without changes encrypted the file again")
+	}
+	conf.AllConnections()["/servers/db"].Login.Password = "changed"
+	saveConns(&conf)
+	plain, err := k.DecryptFile(readConnections(t))
+	if err != nil || !bytes.Contains(plain, utf16("<password>changed</password>")) {
+		t.Errorf("change not saved: %v", err)
+	}
+}
+
+func TestEncryptPasswordsOnly(t *testing.T) {
+	useConnections(t)
+	conf := loadConns()
+	k := testKey(t, "correct horse")
+	encryption.key = k
+	saveConns(&conf)
+
+	sealed := readConnections(t)
+	if vault.IsEncryptedFile(sealed) || bytes.Contains(sealed, utf16("web-secret")) ||
+		!bytes.Contains(sealed, utf16("<password>pcm1:")) {
+		t.Fatal("passwords not encrypted")
+	}
+	// everything else stays readable for PuTTYCM
+	if !bytes.Contains(sealed, utf16("<host>web.example.com</host>")) {
+		t.Error("host encrypted")
+	}
+
+	encryption.key = nil
+	withStdin(t, "correct horse\n")
+	conf = loadConns()
+	if encryption.wholeFile || encryption.key == nil {
+		t.Error("the encryption was not detected")
+	}
+	checkPasswords(t, &conf)
+	saveConns(&conf)
+	if !bytes.Equal(readConnections(t), sealed) {
+		t.Error("saving without changes encrypted the passwords again")
+	}
+}
+
+func TestWrongPassphrase(t *testing.T) {
+	useConnections(t)
+	conf := loadConns()
+	encryption.key, encryption.wholeFile = testKey(t, "correct horse"), true
+	saveConns(&conf)
+
+	encryption.key = nil
+	withStdin(t, "wrong\nbattery staple\ncorrect horse\n")
+	conf = loadConns()
+	checkPasswords(t, &conf)
+
+	encryption.key = nil
+	withStdin(t, "wrong\nwrong\nwrong\ncorrect horse\n")
+	defer func() {
+		if recover() == nil {
+			t.Error("no error after three wrong passphrases")
+		}
+	}()
+	loadConns()
+}
+
+func TestRekey(t *testing.T) {
+	useConnections(t)
+	conf := loadConns()
+	old := testKey(t, "correct horse")
+	encryption.key = old
+	saveConns(&conf)
+
+	// like pcm rekey -whole-file
+	conf = loadConns()
+	encryption.key, encryption.wholeFile = testKey(t, "battery staple"), true
+	saveConns(&conf)
+	sealed := readConnections(t)
+	if _, err := old.DecryptFile(sealed); err != vault.ErrWrongPassphrase {
+		t.Errorf("old key: got %v, want ErrWrongPassphrase", err)
+	}
+
+	encryption.key = nil
+	withStdin(t, "correct horse\nbattery staple\n")
+	conf = loadConns()
+	checkPasswords(t, &conf)
+
+	// and back, like pcm decrypt
+	encryption.key = nil
+	saveConns(&conf)
+	if data := readConnections(t); vault.IsEncryptedFile(data) ||
+		!bytes.Contains(data, utf16("<password>web-secret</password>")) {
+		t.Error("not decrypted")
+	}
+}
+
+// utf16 encodes ASCII s like the test file is encoded.
+func utf16(s string) []byte {
+	var b []byte
+	for _, c := range []byte(s) {
+		b = append(b, c, 0)
+	}
+	return b
+}
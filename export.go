@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/go-utils/fileutil"
+	"github.com/cfstras/pcm/sshconfig"
+	"github.com/cfstras/pcm/types"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	aliasInvalidChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+func init() {
+	subcommands["export-ssh-config"] = subcommand{
+		usage: "export-ssh-config [-o ~/.ssh/config] [-known-hosts ~/.ssh/pcm_known_hosts]",
+		run:   exportSSHConfig,
+	}
+}
+
+func exportSSHConfig(args []string) {
+	flags := flag.NewFlagSet("export-ssh-config", flag.ExitOnError)
+	configOut := flags.String("o", "~/.ssh/config",
+		"ssh_config file to update. Only the block managed by pcm is changed")
+	knownHostsOut := flags.String("known-hosts", "~/.ssh/pcm_known_hosts",
+		"known_hosts file to generate from the stored host keys")
+	flags.Parse(args)
+	*configOut = replaceHome(*configOut)
+	*knownHostsOut = replaceHome(*knownHostsOut)
+
+	conf := loadConns()
+	p(applyPuttySettings(&conf), "loading PuTTY sessions")
+	block, knownHosts := renderSSHConfig(&conf, *knownHostsOut)
+
+	existing, err := ioutil.ReadFile(*configOut)
+	if err != nil && !os.IsNotExist(err) {
+		p(err, "reading "+*configOut)
+	}
+	writeIfChanged(*knownHostsOut, []byte(knownHosts))
+	writeIfChanged(*configOut, sshconfig.ReplaceManagedBlock(existing, block))
+}
+
+// renderSSHConfig returns the managed block for the ssh_config and the
+// contents of the known_hosts file.
+func renderSSHConfig(conf *types.Configuration, knownHostsPath string) (string, string) {
+	conns := conf.AllConnections()
+	paths := make([]string, 0, len(conns))
+	for path, c := range conns {
+		if c.Info.Protocol == "" || strings.EqualFold(c.Info.Protocol, "ssh") {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	aliases := make(map[string]string)
+	used := make(map[string]bool)
+	for _, path := range paths {
+		alias := sshAlias(path)
+		unique := alias
+		for i := 2; used[unique]; i++ {
+			unique = fmt.Sprint(alias, "-", i)
+		}
+		used[unique] = true
+		aliases[path] = unique
+	}
+
+	knownHostsFile, knownHostsOK := configValue(nil, "UserKnownHostsFile", knownHostsPath)
+	var config, knownHosts bytes.Buffer
+	for _, path := range paths {
+		c := conns[path]
+		alias := aliases[path]
+		if strings.ContainsAny(c.Info.Host, configUnsafe) {
+			color.Yellowln("Skipping", c.Path()+": its host has a line break or a quote")
+			continue
+		}
+		hostName, _ := configValue(c, "HostName", c.Info.Host)
+		fmt.Fprintf(&config, "# %s\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(path))
+		fmt.Fprintf(&config, "Host %s\n", alias)
+		fmt.Fprintf(&config, "  HostName %s\n", hostName)
+		option := func(name string, values ...string) {
+			for i, v := range values {
+				var ok bool
+				if values[i], ok = configValue(c, name, v); !ok {
+					return
+				}
+			}
+			fmt.Fprintf(&config, "  %s %s\n", name, strings.Join(values, " "))
+		}
+		if c.Info.Port != 0 {
+			fmt.Fprintf(&config, "  Port %d\n", c.Info.Port)
+		}
+		if c.Login.User != "" {
+			option("User", c.Login.User)
+		}
+		for _, f := range c.Options.IdentityFiles {
+			option("IdentityFile", f)
+		}
+		if jumps, ok := proxyJump(c, aliases); ok && len(jumps) > 0 {
+			option("ProxyJump", strings.Join(jumps, ","))
+		}
+		for _, f := range c.Options.Forwards {
+			switch f.Type {
+			case types.ForwardLocal:
+				option("LocalForward", f.Listen, f.Target)
+			case types.ForwardRemote:
+				option("RemoteForward", f.Listen, f.Target)
+			case types.ForwardDynamic:
+				option("DynamicForward", f.Listen)
+			}
+		}
+		switch c.Options.X11 {
+		case types.X11Trusted:
+			config.WriteString("  ForwardX11 yes\n  ForwardX11Trusted yes\n")
+		case types.X11Untrusted:
+			config.WriteString("  ForwardX11 yes\n  ForwardX11Trusted no\n")
+		}
+		remoteCommand := c.Options.RemoteCommand
+		if strings.ContainsAny(remoteCommand, "\r\n\x00") {
+			// it would end the line, and the rest would be read as options
+			color.Yellowln("Skipping the remote command of", c.Path()+": it has more than one line")
+			remoteCommand = ""
+		}
+		if remoteCommand != "" {
+			// ssh expands %-tokens in it
+			fmt.Fprintf(&config, "  RemoteCommand %s\n", strings.Replace(remoteCommand, "%", "%%", -1))
+		}
+		for _, e := range c.Options.Env {
+			option("SetEnv", e.Name+"="+e.Value)
+		}
+		if c.Options.NoPty {
+			config.WriteString("  RequestTTY no\n")
+		} else if remoteCommand != "" {
+			// ssh only asks for a pty for commands with -t
+			config.WriteString("  RequestTTY yes\n")
+		}
+		if line := knownHostsLine(alias, c); line != "" && knownHostsOK {
+			knownHosts.WriteString(line)
+			fmt.Fprintf(&config, "  HostKeyAlias %s\n", alias)
+			fmt.Fprintf(&config, "  UserKnownHostsFile %s\n", knownHostsFile)
+		}
+		config.WriteString("\n")
+	}
+	return config.String(), knownHosts.String()
+}
+
+// proxyJump returns the jump hosts of c for ProxyJump. Connections in the tree
+// are looked up like ssh does for pcm's own client, and given by their alias.
+// If one of them is missing, there is a warning and ok is false.
+func proxyJump(c *types.Connection, aliases map[string]string) (jumps []string, ok bool) {
+	for _, j := range c.Options.JumpHosts {
+		j = strings.TrimSpace(j)
+		path := j
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		if a, ok := aliases[path]; ok {
+			jumps = append(jumps, a)
+		} else if strings.Contains(j, "/") {
+			color.Yellowln("Skipping the jump hosts of", c.Path()+": jump host", j, "not found")
+			return nil, false
+		} else {
+			jumps = append(jumps, j)
+		}
+	}
+	return jumps, true
+}
+
+// sshAlias turns a connection path into something usable as a Host alias, for
+// example "/Customer A/db 01" becomes "Customer-A.db-01".
+func sshAlias(path string) string {
+	var parts []string
+	for _, p := range strings.Split(path, "/") {
+		p = strings.Trim(aliasInvalidChars.ReplaceAllString(p, "-"), "-.")
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) == 0 {
+		return "host"
+	}
+	return strings.Join(parts, ".")
+}
+
+func knownHostsLine(alias string, c *types.Connection) string {
+	if c.Options.SSHPublicKey == "" {
+		return ""
+	}
+	raw, err := hex.DecodeString(c.Options.SSHPublicKey)
+	if err != nil {
+		color.Yellowln("Skipping corrupt host key of", c.Path()+":", err)
+		return ""
+	}
+	key, err := ssh.ParsePublicKey(raw)
+	if err != nil {
+		color.Yellowln("Skipping host key of", c.Path()+":", err)
+		return ""
+	}
+	return alias + " " + string(ssh.MarshalAuthorizedKey(key))
+}
+
+// Characters that can't be written in an ssh_config value
+const configUnsafe = "\r\n\x00\""
+
+// configValue returns s quoted for an option of c in ssh_config if needed. A
+// line break would end the option and start another one, and there is no way
+// to escape a quote, so values with those are skipped with a warning.
+func configValue(c *types.Connection, option, s string) (string, bool) {
+	if strings.ContainsAny(s, configUnsafe) {
+		where := "the -known-hosts file"
+		if c != nil {
+			where = c.Path()
+		}
+		color.Yellowln("Skipping", option, "of", where+": it has a line break or a quote")
+		return "", false
+	}
+	if s == "" || strings.ContainsAny(s, " \t#") {
+		return `"` + s + `"`, true
+	}
+	return s, true
+}
+
+func writeIfChanged(filename string, data []byte) {
+	if e, _ := fileutil.Exists(filename); e {
+		old, err := ioutil.ReadFile(filename)
+		p(err, "reading "+filename)
+		if bytes.Equal(old, data) {
+			color.Yellowln(filename, "is up to date.")
+			return
+		}
+	}
+	p(os.MkdirAll(filepath.Dir(filename), 0700), "creating directory for "+filename)
+	tmp := filename + ".tmp"
+	p(ioutil.WriteFile(tmp, data, 0600), "writing "+tmp)
+	p(os.Rename(tmp, filename), "overwriting "+filename)
+	color.Yellowln("Wrote", filename)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cfstras/pcm/types"
+)
+
+func exportConn(name, host string) types.Connection {
+	c := types.Connection{}
+	c.Name, c.Info.Name, c.Info.Host = name, name, host
+	return c
+}
+
+func TestRenderSSHConfig(t *testing.T) {
+	conf := &types.Configuration{}
+	conf.Root.Name = "root"
+	bastion := exportConn("bastion", "bastion.example.com")
+	web := exportConn("web", "web.example.com")
+	web.Options.JumpHosts = []string{"net/bastion", "admin@other.example.com:2022"}
+	web.Options.RemoteCommand = "date +%s"
+	lost := exportConn("lost", "lost.example.com")
+	lost.Options.JumpHosts = []string{"/net/missing"}
+	injected := exportConn("injected", "injected.example.com")
+	injected.Options.RemoteCommand = "true\nProxyCommand evil"
+	conf.Root.Containers = []types.Container{{Connections: []types.Connection{
+		bastion, web, lost, injected}}}
+	conf.Root.Containers[0].Name = "net"
+
+	config, _ := renderSSHConfig(conf, "/tmp/known_hosts")
+	for _, want := range []string{
+		"Host net.web\n  HostName web.example.com\n" +
+			"  ProxyJump net.bastion,admin@other.example.com:2022\n",
+		"  RemoteCommand date +%%s\n  RequestTTY yes\n",
+		"Host net.lost\n  HostName lost.example.com\n\n",
+		"Host net.injected\n  HostName injected.example.com\n\n",
+	} {
+		if !strings.Contains(config, want) {
+			t.Errorf("%q missing in\n%s", want, config)
+		}
+	}
+	if strings.Contains(config, "evil") {
+		t.Errorf("remote command with a line break written:\n%s", config)
+	}
+}
+
+// Values which would end the line of their option, or the quotes around them,
+// are not written.
+func TestRenderSSHConfigInjection(t *testing.T) {
+	conf := &types.Configuration{}
+	conf.Root.Name = "root"
+	host := exportConn("host", "evil.example.com\n  ProxyCommand evil")
+	name := exportConn("name\n  ProxyCommand evil", "name.example.com")
+	fields := exportConn("fields", "fields.example.com")
+	fields.Login.User = "admin\n  ProxyCommand evil"
+	fields.Options.IdentityFiles = []string{`key" ProxyCommand "evil`, "my key"}
+	fields.Options.Forwards = []types.Forward{{Type: types.ForwardLocal, Listen: "8080",
+		Target: "localhost:80\n  ProxyCommand evil"}}
+	fields.Options.Env = []types.EnvVar{{Name: "A", Value: "1\rProxyCommand evil"},
+		{Name: "B", Value: "2"}}
+	conf.Root.Containers = []types.Container{{Connections: []types.Connection{
+		host, name, fields}}}
+	conf.Root.Containers[0].Name = "net"
+
+	config, _ := renderSSHConfig(conf, "/tmp/known\nhosts")
+	for _, line := range strings.Split(config, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "ProxyCommand") || strings.Contains(line, `"evil`) {
+			t.Errorf("injected line %q in\n%s", line, config)
+		}
+	}
+	if strings.Contains(config, "evil.example.com") {
+		t.Errorf("connection with an invalid host written:\n%s", config)
+	}
+	for _, want := range []string{
+		"Host net.fields\n  HostName fields.example.com\n" +
+			"  IdentityFile \"my key\"\n  SetEnv B=2\n\n",
+		"# /net/name   ProxyCommand evil\nHost net.name-ProxyCommand-evil\n  HostName name.example.com\n",
+	} {
+		if !strings.Contains(config, want) {
+			t.Errorf("%q missing in\n%s", want, config)
+		}
+	}
+}
@@ -0,0 +1,437 @@
+// Package keepass reads the entries of KeePass databases, in the KDBX 3.1 and
+// KDBX 4 formats. Only databases protected with just a password are
+// supported, not ones with a key file.
+package keepass
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/cfstras/pcm/util/argon2"
+)
+
+const (
+	signature1 = 0x9aa2d903
+	signature2 = 0xb54bfb67
+)
+
+// Header fields
+const (
+	hdrEnd                = 0
+	hdrCipherID           = 2
+	hdrCompression        = 3
+	hdrMasterSeed         = 4
+	hdrTransformSeed      = 5
+	hdrTransformRounds    = 6
+	hdrEncryptionIV       = 7
+	hdrProtectedStreamKey = 8
+	hdrStreamStartBytes   = 9
+	hdrInnerRandomStream  = 10
+	hdrKdfParameters      = 11
+)
+
+// Inner header fields, KDBX 4 only
+const (
+	innerEnd          = 0
+	innerStreamID     = 1
+	innerStreamKey    = 2
+	innerBinary       = 3
+	innerStreamSalsa  = 2
+	innerStreamChaCha = 3
+)
+
+var (
+	cipherAES      = mustUUID("31c1f2e6bf714350be5805216afc5aff")
+	cipherChaCha20 = mustUUID("d6038a2b8b6f4cb5a524339a31dbb59a")
+	kdfAES3        = mustUUID("c9d9f39a628a4460bf740d08c18a4fea")
+	kdfAES4        = mustUUID("7c02bb8279a74ac0927d114a00648238")
+	kdfArgon2d     = mustUUID("ef636ddf8c29444b91f7a9a403e30a0c")
+	kdfArgon2id    = mustUUID("9e298b1956db4773b23dfc3ec6f0a1e6")
+
+	salsa20Nonce = []byte{0xe8, 0x30, 0x09, 0x4b, 0x97, 0x20, 0x5d, 0x2a}
+)
+
+var (
+	ErrWrongPassword = errors.New("wrong password, or the database is damaged")
+	errDamaged       = errors.New("the database is damaged")
+)
+
+func mustUUID(s string) string {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 16 {
+		panic("invalid UUID " + s)
+	}
+	return string(b)
+}
+
+// Open reads the KeePass database at path.
+func Open(path string, password []byte) (*Database, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data, password)
+}
+
+// Parse decrypts a KeePass database.
+func Parse(data []byte, password []byte) (*Database, error) {
+	r := bytes.NewReader(data)
+	var sig1, sig2, version uint32
+	for _, v := range []*uint32{&sig1, &sig2, &version} {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return nil, errors.New("not a KeePass database")
+		}
+	}
+	if sig1 != signature1 || sig2 != signature2 {
+		return nil, errors.New("not a KeePass 2 database")
+	}
+	major := version >> 16
+	if major != 3 && major != 4 {
+		return nil, fmt.Errorf("unsupported KDBX version %d.%d", major, version&0xffff)
+	}
+
+	header, err := readFields(r, func() (uint32, error) {
+		if major == 3 {
+			var size uint16
+			err := binary.Read(r, binary.LittleEndian, &size)
+			return uint32(size), err
+		}
+		var size uint32
+		err := binary.Read(r, binary.LittleEndian, &size)
+		return size, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	headerBytes := data[:len(data)-r.Len()]
+	payload := data[len(headerBytes):]
+
+	transformed, err := transformKey(header, major, password)
+	if err != nil {
+		return nil, err
+	}
+	masterSeed := header[hdrMasterSeed]
+	key := sha256.Sum256(append(append([]byte{}, masterSeed...), transformed...))
+
+	var body []byte
+	var stream *keyStream
+	if major == 3 {
+		plain, err := decrypt(header, key[:], payload)
+		if err != nil {
+			return nil, err
+		}
+		start := header[hdrStreamStartBytes]
+		if len(start) == 0 || !bytes.HasPrefix(plain, start) {
+			return nil, ErrWrongPassword
+		}
+		if body, err = readHashedBlocks(plain[len(start):]); err != nil {
+			return nil, err
+		}
+		if body, err = decompress(header, body); err != nil {
+			return nil, err
+		}
+		id := header[hdrInnerRandomStream]
+		if len(id) != 4 {
+			return nil, errDamaged
+		}
+		stream, err = innerStream(binary.LittleEndian.Uint32(id), header[hdrProtectedStreamKey])
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if len(payload) < 64 {
+			return nil, errDamaged
+		}
+		if hash := sha256.Sum256(headerBytes); !bytes.Equal(hash[:], payload[:32]) {
+			return nil, errDamaged
+		}
+		hmacBase := sha512.Sum512(append(append(append([]byte{}, masterSeed...), transformed...), 1))
+		if !hmac.Equal(blockHMAC(hmacBase[:], ^uint64(0), headerBytes), payload[32:64]) {
+			return nil, ErrWrongPassword
+		}
+		encrypted, err := readHMACBlocks(payload[64:], hmacBase[:])
+		if err != nil {
+			return nil, err
+		}
+		plain, err := decrypt(header, key[:], encrypted)
+		if err != nil {
+			return nil, err
+		}
+		if plain, err = decompress(header, plain); err != nil {
+			return nil, err
+		}
+		inner := bytes.NewReader(plain)
+		fields, err := readFields(inner, func() (uint32, error) {
+			var size uint32
+			err := binary.Read(inner, binary.LittleEndian, &size)
+			return size, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		id := fields[innerStreamID]
+		if len(id) != 4 {
+			return nil, errDamaged
+		}
+		stream, err = innerStream(binary.LittleEndian.Uint32(id), fields[innerStreamKey])
+		if err != nil {
+			return nil, err
+		}
+		body = plain[len(plain)-inner.Len():]
+	}
+	return parseXML(body, stream)
+}
+
+// readFields reads header fields of a type byte, a size and the data, up to
+// the end field. Repeated fields (binaries in the inner header) are dropped.
+func readFields(r *bytes.Reader, readSize func() (uint32, error)) (map[byte][]byte, error) {
+	fields := make(map[byte][]byte)
+	for {
+		id, err := r.ReadByte()
+		if err != nil {
+			return nil, errDamaged
+		}
+		size, err := readSize()
+		if err != nil || int64(size) > int64(r.Len()) {
+			return nil, errDamaged
+		}
+		value := make([]byte, size)
+		io.ReadFull(r, value)
+		if id == hdrEnd {
+			return fields, nil
+		}
+		fields[id] = value
+	}
+}
+
+// transformKey derives the key from the password with the key derivation
+// function of the database.
+func transformKey(header map[byte][]byte, major uint32, password []byte) ([]byte, error) {
+	hash := sha256.Sum256(password)
+	composite := sha256.Sum256(hash[:])
+
+	if major == 3 {
+		rounds := header[hdrTransformRounds]
+		if len(rounds) != 8 {
+			return nil, errDamaged
+		}
+		return aesKDF(composite[:], header[hdrTransformSeed], binary.LittleEndian.Uint64(rounds))
+	}
+
+	params, err := parseVariantDict(header[hdrKdfParameters])
+	if err != nil {
+		return nil, err
+	}
+	uuid, _ := params["$UUID"].([]byte)
+	switch string(uuid) {
+	case kdfAES3, kdfAES4:
+		seed, _ := params["S"].([]byte)
+		rounds, _ := params["R"].(uint64)
+		return aesKDF(composite[:], seed, rounds)
+	case kdfArgon2d, kdfArgon2id:
+		salt, _ := params["S"].([]byte)
+		secret, _ := params["K"].([]byte)
+		data, _ := params["A"].([]byte)
+		parallelism, _ := params["P"].(uint32)
+		memory, _ := params["M"].(uint64)
+		iterations, _ := params["I"].(uint64)
+		version, _ := params["V"].(uint32)
+		if version != 0x13 {
+			return nil, fmt.Errorf("unsupported Argon2 version %#x", version)
+		}
+		if parallelism == 0 || parallelism > 255 || iterations == 0 ||
+			memory/1024 > 1<<32-1 || iterations > 1<<32-1 {
+			return nil, errDamaged
+		}
+		mode := argon2.Argon2d
+		if string(uuid) == kdfArgon2id {
+			mode = argon2.Argon2id
+		}
+		return argon2.Key(mode, composite[:], salt, secret, data, uint32(iterations),
+			uint32(memory/1024), uint8(parallelism), 32), nil
+	}
+	return nil, fmt.Errorf("unsupported key derivation function %x", uuid)
+}
+
+func aesKDF(composite, seed []byte, rounds uint64) ([]byte, error) {
+	block, err := aes.NewCipher(seed)
+	if err != nil {
+		return nil, errDamaged
+	}
+	key := append([]byte{}, composite...)
+	for i := uint64(0); i < rounds; i++ {
+		block.Encrypt(key[:16], key[:16])
+		block.Encrypt(key[16:], key[16:])
+	}
+	hash := sha256.Sum256(key)
+	return hash[:], nil
+}
+
+// parseVariantDict parses the key derivation parameters of KDBX 4.
+func parseVariantDict(data []byte) (map[string]interface{}, error) {
+	if len(data) < 2 || data[1] != 1 {
+		return nil, errors.New("unsupported key derivation parameters")
+	}
+	data = data[2:]
+	dict := make(map[string]interface{})
+	for len(data) > 0 && data[0] != 0 {
+		if len(data) < 5 {
+			return nil, errDamaged
+		}
+		kind, nameLen := data[0], binary.LittleEndian.Uint32(data[1:])
+		data = data[5:]
+		if int64(nameLen)+4 > int64(len(data)) {
+			return nil, errDamaged
+		}
+		name := string(data[:nameLen])
+		valueLen := binary.LittleEndian.Uint32(data[nameLen:])
+		data = data[nameLen+4:]
+		if int64(valueLen) > int64(len(data)) {
+			return nil, errDamaged
+		}
+		value := data[:valueLen]
+		data = data[valueLen:]
+		switch {
+		case (kind == 0x04 || kind == 0x0c) && len(value) == 4:
+			dict[name] = binary.LittleEndian.Uint32(value)
+		case (kind == 0x05 || kind == 0x0d) && len(value) == 8:
+			dict[name] = binary.LittleEndian.Uint64(value)
+		case kind == 0x08 && len(value) == 1:
+			dict[name] = value[0] != 0
+		case kind == 0x18:
+			dict[name] = string(value)
+		case kind == 0x42:
+			dict[name] = value
+		default:
+			return nil, errDamaged
+		}
+	}
+	return dict, nil
+}
+
+// decrypt decrypts the payload with the cipher of the database.
+func decrypt(header map[byte][]byte, key, data []byte) ([]byte, error) {
+	iv := header[hdrEncryptionIV]
+	switch string(header[hdrCipherID]) {
+	case cipherAES:
+		block, _ := aes.NewCipher(key)
+		if len(iv) != aes.BlockSize || len(data) == 0 || len(data)%aes.BlockSize != 0 {
+			return nil, errDamaged
+		}
+		plain := make([]byte, len(data))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+		pad := int(plain[len(plain)-1])
+		if pad == 0 || pad > aes.BlockSize {
+			return nil, ErrWrongPassword
+		}
+		return plain[:len(plain)-pad], nil
+	case cipherChaCha20:
+		if len(iv) != 12 {
+			return nil, errDamaged
+		}
+		plain := append([]byte{}, data...)
+		chacha20Stream(key, iv).xor(plain)
+		return plain, nil
+	}
+	return nil, fmt.Errorf("unsupported cipher %x", header[hdrCipherID])
+}
+
+func decompress(header map[byte][]byte, data []byte) ([]byte, error) {
+	compression := header[hdrCompression]
+	if len(compression) != 4 {
+		return nil, errDamaged
+	}
+	switch binary.LittleEndian.Uint32(compression) {
+	case 0:
+		return data, nil
+	case 1:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errDamaged
+		}
+		return ioutil.ReadAll(r)
+	}
+	return nil, errors.New("unsupported compression")
+}
+
+// readHashedBlocks reads the blocks of KDBX 3.1, each with its SHA-256.
+func readHashedBlocks(data []byte) ([]byte, error) {
+	var out []byte
+	for {
+		if len(data) < 40 {
+			return nil, errDamaged
+		}
+		hash, size := data[4:36], binary.LittleEndian.Uint32(data[36:])
+		data = data[40:]
+		if size == 0 {
+			return out, nil
+		}
+		if int64(size) > int64(len(data)) {
+			return nil, errDamaged
+		}
+		if sum := sha256.Sum256(data[:size]); !bytes.Equal(sum[:], hash) {
+			return nil, errDamaged
+		}
+		out = append(out, data[:size]...)
+		data = data[size:]
+	}
+}
+
+// readHMACBlocks reads the blocks of KDBX 4, each with its HMAC.
+func readHMACBlocks(data, hmacBase []byte) ([]byte, error) {
+	var out []byte
+	for i := uint64(0); ; i++ {
+		if len(data) < 36 {
+			return nil, errDamaged
+		}
+		mac, size := data[:32], binary.LittleEndian.Uint32(data[32:])
+		if int64(size) > int64(len(data)-36) {
+			return nil, errDamaged
+		}
+		if !hmac.Equal(blockHMAC(hmacBase, i, data[32:36+size]), mac) {
+			return nil, errDamaged
+		}
+		if size == 0 {
+			return out, nil
+		}
+		out = append(out, data[36:36+size]...)
+		data = data[36+size:]
+	}
+}
+
+// blockHMAC returns the HMAC of block i; the header is block 2^64-1.
+func blockHMAC(hmacBase []byte, i uint64, data []byte) []byte {
+	var index [8]byte
+	binary.LittleEndian.PutUint64(index[:], i)
+	key := sha512.Sum512(append(index[:], hmacBase...))
+	mac := hmac.New(sha256.New, key[:])
+	if i != ^uint64(0) {
+		mac.Write(index[:])
+	}
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// innerStream returns the key stream protected values are encrypted with.
+func innerStream(id uint32, key []byte) (*keyStream, error) {
+	switch id {
+	case innerStreamSalsa:
+		k := sha256.Sum256(key)
+		return salsa20Stream(k[:], salsa20Nonce), nil
+	case innerStreamChaCha:
+		k := sha512.Sum512(key)
+		return chacha20Stream(k[:32], k[32:44]), nil
+	}
+	return nil, fmt.Errorf("unsupported inner random stream %d", id)
+}
@@ -0,0 +1,71 @@
+package keepass
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// The databases in testdata have the same entries:
+//
+//	Infra/db01     db01-secret, with old-db01-secret in its history
+//	Infra/web & co wéb-pass
+//	Other/db01     other-db01
+var testDatabases = []struct {
+	file, password string
+}{
+	{"kdbx31-aes.kdbx", "master3"},
+	{"kdbx31-chacha20.kdbx", "master3"},
+	{"kdbx4-aeskdf.kdbx", "master4"},
+	{"kdbx4-argon2d.kdbx", "master4"},
+	{"kdbx4-argon2id.kdbx", "master4"},
+}
+
+func TestOpen(t *testing.T) {
+	for _, test := range testDatabases {
+		db, err := Open(filepath.Join("testdata", test.file), []byte(test.password))
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+			continue
+		}
+		for ref, want := range map[string]string{
+			"Infra/db01":       "db01-secret",
+			"/Root/Other/db01": "other-db01",
+			"web & co":         "wéb-pass",
+		} {
+			e, err := db.Find(ref)
+			if err != nil {
+				t.Errorf("%s: %s: %v", test.file, ref, err)
+			} else if e.Fields["Password"] != want {
+				t.Errorf("%s: %s: password %q, want %q", test.file, ref,
+					e.Fields["Password"], want)
+			}
+		}
+		if e, err := db.Find("Infra/db01"); err == nil && e.Fields["UserName"] != "admin" {
+			t.Errorf("%s: user name %q", test.file, e.Fields["UserName"])
+		}
+		if _, err := db.Find("db01"); err == nil {
+			t.Errorf("%s: ambiguous title db01 found", test.file)
+		}
+		if _, err := db.Find("nothing"); err == nil {
+			t.Errorf("%s: missing entry found", test.file)
+		}
+	}
+}
+
+func TestOpenWrongPassword(t *testing.T) {
+	for _, test := range testDatabases {
+		_, err := Open(filepath.Join("testdata", test.file), []byte("wrong"))
+		if err != ErrWrongPassword {
+			t.Errorf("%s: got %v, want ErrWrongPassword", test.file, err)
+		}
+	}
+}
+
+func TestParseDamaged(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("not a database"),
+		{0x03, 0xd9, 0xa2, 0x9a, 0x67, 0xfb, 0x4b, 0xb5, 0x01, 0x00, 0x09, 0x00}} {
+		if _, err := Parse(data, []byte("master4")); err == nil {
+			t.Errorf("%q: no error", data)
+		}
+	}
+}
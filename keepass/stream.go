@@ -0,0 +1,92 @@
+package keepass
+
+import (
+	"encoding/binary"
+	"math/bits"
+
+	"golang.org/x/crypto/salsa20/salsa"
+)
+
+// keyStream XORs data with the key stream of a stream cipher, continuing
+// where the last call stopped. KeePass uses one for the protected values in
+// the XML, in the order they appear.
+type keyStream struct {
+	block   func(counter uint64, out *[64]byte)
+	counter uint64
+	buf     [64]byte
+	pos     int
+}
+
+func newKeyStream(block func(counter uint64, out *[64]byte)) *keyStream {
+	return &keyStream{block: block, pos: len(keyStream{}.buf)}
+}
+
+func (s *keyStream) xor(data []byte) {
+	for i := range data {
+		if s.pos == len(s.buf) {
+			s.block(s.counter, &s.buf)
+			s.counter++
+			s.pos = 0
+		}
+		data[i] ^= s.buf[s.pos]
+		s.pos++
+	}
+}
+
+// salsa20Stream returns the key stream of Salsa20 with a 32 byte key and an 8
+// byte nonce.
+func salsa20Stream(key, nonce []byte) *keyStream {
+	var k [32]byte
+	var counter [16]byte
+	var zero [64]byte
+	copy(k[:], key)
+	copy(counter[:8], nonce)
+	return newKeyStream(func(n uint64, out *[64]byte) {
+		binary.LittleEndian.PutUint64(counter[8:], n)
+		salsa.XORKeyStream(out[:], zero[:], &counter, &k)
+	})
+}
+
+// chacha20Stream returns the key stream of ChaCha20 (RFC 7539) with a 32 byte
+// key and a 12 byte nonce, starting at block 0.
+func chacha20Stream(key, nonce []byte) *keyStream {
+	var state [16]uint32
+	state[0], state[1], state[2], state[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	for i := 0; i < 8; i++ {
+		state[4+i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+	for i := 0; i < 3; i++ {
+		state[13+i] = binary.LittleEndian.Uint32(nonce[i*4:])
+	}
+	return newKeyStream(func(n uint64, out *[64]byte) {
+		state[12] = uint32(n)
+		chacha20Block(&state, out)
+	})
+}
+
+func chacha20Block(state *[16]uint32, out *[64]byte) {
+	x := *state
+	quarter := func(a, b, c, d int) {
+		x[a] += x[b]
+		x[d] = bits.RotateLeft32(x[d]^x[a], 16)
+		x[c] += x[d]
+		x[b] = bits.RotateLeft32(x[b]^x[c], 12)
+		x[a] += x[b]
+		x[d] = bits.RotateLeft32(x[d]^x[a], 8)
+		x[c] += x[d]
+		x[b] = bits.RotateLeft32(x[b]^x[c], 7)
+	}
+	for i := 0; i < 10; i++ {
+		quarter(0, 4, 8, 12)
+		quarter(1, 5, 9, 13)
+		quarter(2, 6, 10, 14)
+		quarter(3, 7, 11, 15)
+		quarter(0, 5, 10, 15)
+		quarter(1, 6, 11, 12)
+		quarter(2, 7, 8, 13)
+		quarter(3, 4, 9, 14)
+	}
+	for i := range x {
+		binary.LittleEndian.PutUint32(out[i*4:], x[i]+state[i])
+	}
+}
@@ -0,0 +1,126 @@
+package keepass
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A Database holds the entries of a KeePass database.
+type Database struct {
+	Entries []*Entry
+}
+
+// An Entry is a KeePass entry, without its history.
+type Entry struct {
+	// Names of the groups the entry is in, from the root group down
+	Groups []string
+	// Title, UserName, Password, URL, Notes and custom fields
+	Fields map[string]string
+}
+
+// Title returns the title of the entry.
+func (e *Entry) Title() string {
+	return e.Fields["Title"]
+}
+
+// Path returns the groups and title of the entry, separated by slashes.
+func (e *Entry) Path() string {
+	return strings.Join(append(append([]string{}, e.Groups...), e.Title()), "/")
+}
+
+// Find returns the one entry with the title or path ref. Paths may leave out
+// groups at the start, like the root group.
+func (db *Database) Find(ref string) (*Entry, error) {
+	ref = strings.TrimPrefix(ref, "/")
+	var found []*Entry
+	for _, e := range db.Entries {
+		if e.Title() == ref || e.Path() == ref || strings.HasSuffix(e.Path(), "/"+ref) {
+			found = append(found, e)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no entry %q", ref)
+	case 1:
+		return found[0], nil
+	}
+	return nil, fmt.Errorf("%d entries match %q, use the group path", len(found), ref)
+}
+
+// parseXML reads the entries from the XML of a database. Protected values are
+// decrypted with stream, in document order.
+func parseXML(data []byte, stream *keyStream) (*Database, error) {
+	db := &Database{}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var stack []string
+	var groups []string
+	var entry *Entry
+	var key string
+	var text []byte
+	protected := false
+	// the name of the element n levels above the current one
+	up := func(n int) string {
+		if len(stack) <= n {
+			return ""
+		}
+		return stack[len(stack)-1-n]
+	}
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return db, nil
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			text = text[:0]
+			protected = false
+			for _, a := range t.Attr {
+				if a.Name.Local == "Protected" && strings.EqualFold(a.Value, "true") {
+					protected = true
+				}
+			}
+			switch {
+			case up(0) == "Group":
+				groups = append(groups, "")
+			case up(0) == "Entry" && up(1) == "Group":
+				entry = &Entry{Groups: append([]string{}, groups...), Fields: make(map[string]string)}
+			}
+		case xml.CharData:
+			text = append(text, t...)
+		case xml.EndElement:
+			value := string(text)
+			if protected {
+				raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+				if err != nil {
+					return nil, errDamaged
+				}
+				stream.xor(raw)
+				value = string(raw)
+				protected = false
+			}
+			inEntry := entry != nil && up(1) == "String" && up(2) == "Entry" && up(3) == "Group"
+			switch {
+			case up(0) == "Name" && up(1) == "Group":
+				groups[len(groups)-1] = value
+			case up(0) == "Key" && inEntry:
+				key = value
+			case up(0) == "Value" && inEntry:
+				entry.Fields[key] = value
+			case up(0) == "Entry" && up(1) == "Group" && entry != nil:
+				db.Entries = append(db.Entries, entry)
+				entry = nil
+			case up(0) == "Group":
+				groups = groups[:len(groups)-1]
+			}
+			text = text[:0]
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
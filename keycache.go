@@ -0,0 +1,202 @@
+// +build !windows
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/vault"
+)
+
+// The key cache is a pcm process in the background, which keeps the keys of
+// encrypted connections.xml files for a while. It is asked on a unix socket in
+// a directory only the user can access:
+//
+//	get <salt>                -> <key>, or an empty line
+//	put <salt> <key> <secs>   -> ok
+//
+// Salts and keys are in base64. It exits once all keys expired.
+
+func init() {
+	subcommands["keycache"] = subcommand{
+		run: serveKeyCache,
+	}
+}
+
+// keyCacheSocket returns the path of the key cache's socket, creating its
+// directory if needed.
+func keyCacheSocket() (string, error) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("pcm-%d", os.Getuid()))
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || fi.Mode().Perm() != 0700 || !ok || int(stat.Uid) != os.Getuid() {
+		return "", fmt.Errorf("%s must be a directory only you can access", dir)
+	}
+	return filepath.Join(dir, "keys.sock"), nil
+}
+
+// askKeyCache sends a request to the key cache and returns the answer.
+func askKeyCache(request string) (string, error) {
+	path, err := keyCacheSocket()
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintln(conn, request); err != nil {
+		return "", err
+	}
+	answer, err := bufio.NewReader(conn).ReadString('\n')
+	return strings.TrimSpace(answer), err
+}
+
+// cachedKey returns the key for salt from the key cache, or nil.
+func cachedKey(salt []byte) *vault.Key {
+	answer, err := askKeyCache("get " + base64.StdEncoding.EncodeToString(salt))
+	if err != nil || answer == "" {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(answer)
+	if err != nil {
+		return nil
+	}
+	k, err := vault.RestoreKey(salt, key)
+	if err != nil {
+		return nil
+	}
+	return k
+}
+
+// cacheKey keeps k in the key cache for ttl, starting the cache if it is not
+// running.
+func cacheKey(k *vault.Key, ttl time.Duration) {
+	request := fmt.Sprintf("put %s %s %d", base64.StdEncoding.EncodeToString(k.Salt()),
+		base64.StdEncoding.EncodeToString(k.Bytes()), int(ttl.Seconds()))
+	if answer, err := askKeyCache(request); err == nil && answer == "ok" {
+		return
+	}
+	if err := startKeyCache(request); err != nil {
+		color.Yellowln("Warning: could not start the key cache:", err)
+	}
+}
+
+// startKeyCache starts the key cache in the background, with its first
+// request on stdin.
+func startKeyCache(request string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, "keycache")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.Stdin = strings.NewReader(request + "\n")
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+type keyCache struct {
+	mu sync.Mutex
+	// by salt
+	keys     map[string]*cachedKeyEntry
+	listener net.Listener
+}
+
+type cachedKeyEntry struct {
+	key     string
+	expires time.Time
+}
+
+// serveKeyCache runs the key cache, see above.
+func serveKeyCache(args []string) {
+	path, err := keyCacheSocket()
+	p(err, "creating the key cache socket")
+	if _, err := askKeyCache("get -"); err == nil {
+		// one is running already
+		return
+	}
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	p(err, "listening on "+path)
+	defer os.Remove(path)
+
+	c := &keyCache{keys: make(map[string]*cachedKeyEntry), listener: listener}
+	first, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	p(err, "reading the key")
+	c.handle(strings.TrimSpace(first))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			request, err := bufio.NewReader(conn).ReadString('\n')
+			if err == nil {
+				fmt.Fprintln(conn, c.handle(strings.TrimSpace(request)))
+			}
+		}()
+	}
+}
+
+func (c *keyCache) handle(request string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fields := strings.Fields(request)
+	switch {
+	case len(fields) == 2 && fields[0] == "get":
+		if e := c.keys[fields[1]]; e != nil {
+			return e.key
+		}
+		return ""
+	case len(fields) == 4 && fields[0] == "put":
+		secs, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return "invalid lifetime"
+		}
+		ttl := time.Duration(secs) * time.Second
+		c.keys[fields[1]] = &cachedKeyEntry{key: fields[2], expires: time.Now().Add(ttl)}
+		time.AfterFunc(ttl, c.expire)
+		return "ok"
+	}
+	return "invalid request"
+}
+
+// expire drops the expired keys, and stops the key cache once it is empty.
+func (c *keyCache) expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for salt, e := range c.keys {
+		if !now.Before(e.expires) {
+			delete(c.keys, salt)
+		}
+	}
+	if len(c.keys) == 0 {
+		c.listener.Close()
+	}
+}
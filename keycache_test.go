@@ -0,0 +1,55 @@
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener, err := net.Listen("unix", filepath.Join(dir, "keys.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &keyCache{keys: make(map[string]*cachedKeyEntry), listener: listener}
+
+	for _, test := range []struct{ request, answer string }{
+		{"get c2FsdA==", ""},
+		{"put c2FsdA== a2V5 60", "ok"},
+		{"get c2FsdA==", "a2V5"},
+		{"get b3RoZXI=", ""},
+		{"put c2FsdA== a2V5", "invalid request"},
+		{"put c2FsdA== a2V5 soon", "invalid lifetime"},
+		{"forget everything", "invalid request"},
+	} {
+		if answer := c.handle(test.request); answer != test.answer {
+			t.Errorf("%s: got %q, want %q", test.request, answer, test.answer)
+		}
+	}
+
+	c.handle("put b3RoZXI= a2V5 0")
+	time.Sleep(100 * time.Millisecond)
+	if answer := c.handle("get b3RoZXI="); answer != "" {
+		t.Errorf("expired key returned: %q", answer)
+	}
+	if answer := c.handle("get c2FsdA=="); answer != "a2V5" {
+		t.Errorf("key dropped before it expired: %q", answer)
+	}
+
+	// once all keys expired, the cache stops
+	c.keys["c2FsdA=="].expires = time.Now()
+	c.expire()
+	if _, err := listener.Accept(); err == nil {
+		t.Error("still listening without keys")
+	}
+}
@@ -0,0 +1,18 @@
+// +build windows
+
+package main
+
+import (
+	"time"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/vault"
+)
+
+func cachedKey(salt []byte) *vault.Key {
+	return nil
+}
+
+func cacheKey(k *vault.Key, ttl time.Duration) {
+	color.Yellowln("Warning: the key cache is not supported on Windows")
+}
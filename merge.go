@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/types"
+)
+
+// The connections from connections.xml as loaded when pcm started, by path.
+// Saving a connection merges what was changed since into connections.xml as it
+// is then, and records the saved changes here.
+var loadedConns map[string]*types.Connection
+
+// Fields not to show the values of when reporting a conflict
+var secretFields = map[string]bool{"login/password": true, "login/totp_secret": true}
+
+// keepLoadedConns copies the connections of conf as they were loaded.
+func keepLoadedConns(conf *types.Configuration) {
+	loadedConns = make(map[string]*types.Connection)
+	for path, conn := range conf.AllConnections() {
+		c := clone(reflect.ValueOf(*conn)).Interface().(types.Connection)
+		loadedConns[path] = &c
+	}
+}
+
+// findConn finds the connection at path in conf, or the one connection with
+// the same host, port and user as original if it moved.
+func findConn(conf *types.Configuration, path string,
+	original *types.Connection) (*types.Connection, error) {
+
+	all := conf.AllConnections()
+	if conn, ok := all[path]; ok {
+		return conn, nil
+	} else if original == nil || original.Info.Host == "" {
+		return nil, errors.New("it was deleted")
+	}
+	var found []*types.Connection
+	for _, conn := range all {
+		if conn.Info.Host == original.Info.Host && conn.Info.Port == original.Info.Port &&
+			conn.Login.User == original.Login.User {
+			found = append(found, conn)
+		}
+	}
+	if len(found) > 1 {
+		return nil, fmt.Errorf("it moved, and %d connections have its host, port and user",
+			len(found))
+	} else if len(found) == 0 {
+		return nil, errors.New("it was deleted")
+	}
+	color.Yellowln(path, "moved to", found[0].Path()+"\r")
+	return found[0], nil
+}
+
+// mergeConn merges the changes to a connection into the one in
+// connections.xml, field by field: original is the connection as loaded, mine
+// the one to save and theirs the one in connections.xml now, which is changed.
+// Fields changed in both to different values stay as they are in theirs and are
+// returned as conflicts. The saved fields are updated in original.
+func mergeConn(original, mine, theirs *types.Connection) (conflicts []string) {
+	mergeFields("", reflect.ValueOf(original).Elem(), reflect.ValueOf(mine).Elem(),
+		reflect.ValueOf(theirs).Elem(), &conflicts)
+	return
+}
+
+func mergeFields(path string, original, mine, theirs reflect.Value, conflicts *[]string) {
+	if original.Kind() == reflect.Struct {
+		t := original.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("xml"), ",")[0]
+			if name == "-" || f.PkgPath != "" && !f.Anonymous {
+				continue
+			}
+			if path != "" && name != "" {
+				name = path + "/" + name
+			} else if name == "" {
+				name = path
+			}
+			mergeFields(name, original.Field(i), mine.Field(i), theirs.Field(i), conflicts)
+		}
+		return
+	}
+	same := func(a, b reflect.Value) bool { return reflect.DeepEqual(a.Interface(), b.Interface()) }
+	switch {
+	case same(mine, original):
+	case same(mine, theirs):
+		original.Set(clone(mine))
+	case same(theirs, original):
+		theirs.Set(clone(mine))
+		original.Set(clone(mine))
+	default:
+		conflict := fmt.Sprintf("%s: it is %s here, but was changed to %s in connections.xml",
+			path, describe(mine), describe(theirs))
+		if secretFields[path] {
+			conflict = path + ": it was changed here and in connections.xml"
+		}
+		*conflicts = append(*conflicts, conflict)
+	}
+}
+
+// clone returns a deep copy of v.
+func clone(v reflect.Value) reflect.Value {
+	c := reflect.New(v.Type()).Elem()
+	c.Set(v)
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			c.Set(clone(v.Elem()).Addr())
+		}
+	case reflect.Slice:
+		if !v.IsNil() {
+			c.Set(reflect.MakeSlice(v.Type(), v.Len(), v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				c.Index(i).Set(clone(v.Index(i)))
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(clone(v.Field(i)))
+			}
+		}
+	}
+	return c
+}
+
+// describe formats the value of a field for the user.
+func describe(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Ptr:
+		if v.IsNil() {
+			return "nothing"
+		}
+		return describe(v.Elem())
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return "nothing"
+		}
+	}
+	return fmt.Sprintf("%+v", v.Interface())
+}
@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -14,16 +15,17 @@ import (
 	"sort"
 	"strings"
 
-	"golang.org/x/text/encoding/unicode"
-
 	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/go-utils/fileutil"
 	"github.com/cfstras/go-utils/lock"
 	"github.com/cfstras/pcm/ssh"
+	"github.com/cfstras/pcm/telnet"
 	"github.com/cfstras/pcm/types"
 	"github.com/cfstras/pcm/util"
+	"github.com/cfstras/pcm/xmldoc"
+	ct "github.com/daviddengcn/go-colortext"
 	"github.com/renstrom/fuzzysearch/fuzzy"
 	"golang.org/x/crypto/ssh/terminal"
-	"golang.org/x/net/html/charset"
 )
 
 var (
@@ -36,8 +38,22 @@ func (l StringList) Len() int           { return len(l) }
 func (l StringList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
 func (l StringList) Less(i, j int) bool { return strings.Compare(l[i], l[j]) < 0 }
 
+// StringList can also be used as a flag which may be given multiple times
+func (l *StringList) String() string { return strings.Join(*l, ",") }
+func (l *StringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
 var DEBUG = false
 
+// Set from the command line flags, also for subcommands
+var (
+	sshSettings       ssh.Settings
+	doImportAWS       = false
+	doImportSSHConfig = true
+)
+
 func main() {
 	defer func() {
 		if err := recover(); err != nil {
@@ -53,21 +69,51 @@ func main() {
 	verbose := false
 	useFuzzySimple := false
 	useOwnSSH := false
-	doImportAWS := false
-	agentForwarding := false
+	record := false
+	recordInput := false
+	recordDir := "~/.pcm/recordings"
+	recordKeep := 100
 	flag.BoolVar(&verbose, "verbose", false, "Display more info, such as hostnames and passwords")
 	flag.BoolVar(&verbose, "v", false, "Display more info, such as hostnames and passwords")
 	flag.BoolVar(&useFuzzySimple, "simple", false, "Use simple interface")
 	flag.BoolVar(&useOwnSSH, "ssh", true, "Use golang ssh client instead of os-client")
 	flag.BoolVar(&DEBUG, "debug", false, "enable debug server on :3000")
 	flag.BoolVar(&doImportAWS, "import-aws", false, "also load hosts from aws")
-	flag.BoolVar(&agentForwarding, "A", false, "enable agent-forwarding")
+	flag.BoolVar(&doImportSSHConfig, "import-ssh-config", true, "also load hosts from the OpenSSH client config")
+	flag.StringVar(&sshConfigPath, "sshConfigPath", sshConfigPath, "Path to OpenSSH client config")
+	flag.StringVar(&puttySessionsPath, "puttySessionsPath", puttySessionsPath, "Path to the saved sessions of PuTTY, for connections naming a session")
+	flag.Var(&puttyRegPaths, "puttyRegPath", "registry export (.reg) of the saved sessions of PuTTY, can be given multiple times")
+	flag.BoolVar(&sshSettings.AgentForwarding, "A", false, "enable agent-forwarding")
+	flag.DurationVar(&sshSettings.AgentLifetime, "agent-lifetime", 0, "without an SSH agent running, pcm keeps the keys it used in its own; drop them after this time, 0 to keep them")
+	flag.BoolVar(&sshSettings.AgentConfirm, "agent-confirm", false, "ask before each use of a key in pcm's own SSH agent")
+	flag.BoolVar(&sshSettings.AgentSocket, "agent-socket", false, "expose pcm's own SSH agent on a unix socket while connected")
+	flag.BoolVar(&sshSettings.NoShell, "N", false, "only set up the port forwardings of the connection, don't start a shell")
+	flag.StringVar(&sshSettings.Proxy, "proxy", "", "proxy for connections that have none: socks5://host:port, http://host:port or a command")
+	flag.BoolVar(&record, "record", false, "record the session into an asciicast file, see \"pcm replay\"")
+	flag.BoolVar(&recordInput, "record-input", false, "also record what is typed, including passwords")
+	flag.StringVar(&recordDir, "record-dir", recordDir, "directory for recordings")
+	flag.IntVar(&recordKeep, "record-keep", recordKeep, "keep at most this many recordings, 0 to keep all")
+	flag.DurationVar(&passphraseCache, "passphrase-cache", 0, "keep the key of an encrypted connections.xml in a background process for this long, so the passphrase is asked for only once")
+	flag.Var((*StringList)(&sshSettings.IdentityFiles), "i", "private key file (OpenSSH or PuTTY .ppk) to try for all connections, can be given multiple times")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		printSubcommands()
+	}
 	flag.Parse()
 	if pathP != nil {
 		connectionsPath = *pathP
 	}
 	connectionsPath = replaceHome(connectionsPath)
+	sshConfigPath = replaceHome(sshConfigPath)
+	for i, f := range sshSettings.IdentityFiles {
+		sshSettings.IdentityFiles[i] = replaceHome(f)
+	}
 
+	if cmd, ok := subcommands[flag.Arg(0)]; ok {
+		cmd.run(flag.Args()[1:])
+		return
+	}
 	if flag.NArg() > 1 {
 		flag.Usage()
 		color.Yellowln("Usage: pcm [search term]")
@@ -81,24 +127,31 @@ func main() {
 		go http.ListenAndServe(":3000", nil)
 	}
 
-	conf := loadConns()
+	conf := loadConfiguration()
+	sshSettings.Config = &conf
 
-	if doImportAWS {
-		if err := importAWS(&conf); err != nil {
-			color.Redln("loading configuration from AWS:", err)
-			return
-		}
-	}
-
-	var conn *types.Connection
+	var conns []*types.Connection
 	if useFuzzySimple {
-		conn = fuzzySimple(&conf, searchFor)
+		if conn := fuzzySimple(&conf, searchFor); conn != nil {
+			conns = append(conns, conn)
+		}
 	} else {
-		conn = selectConnection(&conf, searchFor)
+		conns = selectConnection(&conf, searchFor)
 	}
 
-	if conn == nil {
+	if len(conns) == 0 {
 		return
+	} else if len(conns) > 1 {
+		if record || !useOwnSSH {
+			color.Yellowln("Cluster mode always uses the golang ssh client and doesn't record.")
+		}
+		clusterConnect(conns)
+		return
+	}
+	conn := conns[0]
+	if p := conn.Info.Protocol; p != "" && !strings.EqualFold(p, "ssh") && !telnet.Handles(conn) {
+		color.Redln("The", p, "protocol is not supported.")
+		os.Exit(1)
 	}
 
 	color.Yellowln("Using", conn.Info.Name)
@@ -108,37 +161,67 @@ func main() {
 		fmt.Println(conn.Login.User)
 		color.Yellow("Password: ")
 		fmt.Println(conn.Login.Password)
-		color.Yellowln("Commands:")
-		f := util.GetCommandFunc(conn, nil, func() *string { return nil })
-		for {
-			if v := f(); v == nil {
-				break
-			} else {
-				fmt.Println(*v)
-			}
+		color.Yellowln("Script:")
+		for _, s := range conn.LoginScript().Steps {
+			fmt.Println(s)
 		}
 	}
 	//fmt.Println(conn.Login)
 	//fmt.Println(conn.Command)
 
+	// exit with the status of the session, after the recording is closed
+	exitStatus := 0
+	defer func() {
+		if exitStatus != 0 {
+			os.Exit(exitStatus)
+		}
+	}()
+
 	var console types.Terminal = &consoleTerminal{
 		exit: make(chan bool),
 	}
-	var changed bool
-	if useOwnSSH {
-		changed = ssh.Connect(conn, agentForwarding, console, func() *string { return nil },
-			func(a *types.Connection) {
-				saveConn(&conf, conn)
-			})
+	if record {
+		rec, err := startRecording(conn, replaceHome(recordDir), recordKeep, console, recordInput)
+		if err != nil {
+			color.Redln("Could not start recording:", err)
+			return
+		}
+		defer rec.Close()
+		console = rec
+	}
+	if useOwnSSH || telnet.Handles(conn) {
+		exitStatus = connectSession(conn, console, func(a *types.Connection) {
+			saveConn(&conf, a)
+		})
 	} else {
-		changed = connect(conn, agentForwarding, console, func() *string { return nil })
+		warnPuttyCommandLine(conn, false)
+		changed := connect(conn, sshSettings, withCharset(console, conn.Options.Charset),
+			func() *string { return nil })
 		if changed {
-			saveConns(&conf)
+			saveConn(&conf, conn)
 		}
 	}
 
 }
 
+// connectSession opens an interactive session to conn with pcm's own client
+// for its protocol, and returns the exit status.
+func connectSession(conn *types.Connection, terminal types.Terminal,
+	saveChanges func(*types.Connection)) int {
+	more := func() *string { return nil }
+	terminal = withCharset(terminal, conn.Options.Charset)
+	warnPuttyCommandLine(conn, true)
+	settings := sshSettings
+	if cl := puttyCommandLines[conn.Path()]; cl != nil && cl.NoShell {
+		settings.NoShell = true
+	}
+	if telnet.Handles(conn) {
+		return telnet.Connect(conn, settings, terminal, more, saveChanges)
+	}
+	_, status := ssh.Connect(conn, settings, terminal, more, saveChanges)
+	return status
+}
+
 type consoleTerminal struct {
 	exit     chan bool
 	signals  chan os.Signal
@@ -176,6 +259,34 @@ func (c *consoleTerminal) RestoreRaw() {
 	util.RestoreTerminal(c.oldState)
 }
 
+// loadConfiguration loads connections.xml and the hosts imported from other
+// sources, as enabled by the flags.
+func loadConfiguration() (conf types.Configuration) {
+	if e, _ := fileutil.Exists(connectionsPath); e || !doImportSSHConfig {
+		conf = loadConns()
+		keepLoadedConns(&conf)
+	} else {
+		color.Yellowln("No connections.xml found at", connectionsPath)
+		conf.Root.Expanded = true
+	}
+
+	if doImportSSHConfig {
+		if e, _ := fileutil.Exists(sshConfigPath); e {
+			// connections.xml is still usable without it
+			if err := importSSHConfig(&conf); err != nil {
+				color.Yellowln("Warning: not loading", sshConfigPath+":", err)
+			}
+		}
+	}
+
+	if doImportAWS {
+		p(importAWS(&conf), "loading configuration from AWS")
+	}
+
+	p(applyPuttySettings(&conf), "loading PuTTY sessions")
+	return
+}
+
 func fuzzySimple(conf *types.Configuration, searchFor string) *types.Connection {
 	words := listWords(conf.AllConnections())
 
@@ -219,10 +330,6 @@ func fuzzySimple(conf *types.Configuration, searchFor string) *types.Connection
 	return conn
 }
 
-func DummyReader(label string, input io.Reader) (io.Reader, error) {
-	return input, nil
-}
-
 func replaceHome(in string) string {
 	if strings.Contains(in, "~") {
 		homeDir := os.Getenv("HOME")
@@ -237,87 +344,129 @@ func replaceHome(in string) string {
 	return in
 }
 
+// connections.xml as loaded, so saving only changes what was changed
+var loaded struct {
+	doc *xmldoc.Document
+	// the configuration as loaded, encoded again to compare with when saving
+	base *xmldoc.Node
+}
+
 func loadConns() (result types.Configuration) {
 	filename := connectionsPath
-	rd, err := os.Open(filename)
+	data, err := ioutil.ReadFile(filename)
 	p(err, "opening "+filename)
-	defer rd.Close()
-	rd2, err := charset.NewReaderLabel("utf-16", rd)
-	p(err, "loading charset")
-
-	decoder := xml.NewDecoder(rd2)
-	decoder.CharsetReader = DummyReader
-	p(decoder.Decode(&result), "decoding xml")
-
+	data = decryptFile(data)
+	doc, err := xmldoc.Parse(data)
+	p(err, "reading "+filename)
+	p(doc.Decode(&result), "decoding xml")
 	result.Root.Expanded = true
+	loaded.doc, loaded.base = doc, encodeConns(&result)
+
+	if !decryptSecrets(&result) && !encryption.wholeFile {
+		encryption.key = nil
+	}
 	return
 }
 
+// encodeConns encodes conf the way it is written to connections.xml.
+func encodeConns(conf *types.Configuration) *xmldoc.Node {
+	data, err := xml.Marshal(conf)
+	p(err, "encoding xml")
+	doc, err := xmldoc.Parse(data)
+	p(err, "encoding xml")
+	puttyBools(doc.Root)
+	return doc.Root
+}
+
+// puttyBools capitalizes booleans like PuTTYCM does.
+func puttyBools(n *xmldoc.Node) {
+	capitalize := strings.NewReplacer("true", "True", "false", "False")
+	for i, a := range n.Attrs {
+		if a.Name.Local == "expanded" || a.Name.Local == "savepassword" {
+			n.Attrs[i].Value = capitalize.Replace(a.Value)
+		}
+	}
+	for _, c := range n.Elements() {
+		switch c.Name {
+		case "loginmacro", "postcommands":
+			for _, t := range c.Children {
+				t.Text = capitalize.Replace(t.Text)
+			}
+		default:
+			puttyBools(c)
+		}
+	}
+}
+
 func saveConn(conf *types.Configuration, conn *types.Connection) {
+	saveConnTo(nil, conf, conn)
+}
+
+// saveConnTo is saveConn writing its messages to messages without color, or
+// in color to stdout if it is nil.
+func saveConnTo(messages io.Writer, conf *types.Configuration, conn *types.Connection) {
+	say := func(c ct.Color, msg ...interface{}) {
+		if messages == nil {
+			color.Colorln(c, msg...)
+		} else {
+			line := strings.Replace(fmt.Sprintln(msg...), "\r", "", -1)
+			io.WriteString(messages, strings.TrimSpace(line)+"\n")
+		}
+	}
 	if conn == nil {
 		return
 	}
+	if isImported(conn) {
+		say(ct.Yellow, "Not saving", conn.Path(), "- it was not loaded from connections.xml\r")
+		return
+	}
 	filename := connectionsPath
-	color.Yellowln("Saving connections.xml...\r")
+	say(ct.Yellow, "Saving connections.xml...\r")
 	flock, err := lock.Try(filename, true)
 	if err != nil {
-		color.Redln("Error: ", err)
+		say(ct.Red, "Error: ", err)
 		return
 	}
 	defer flock.Unlock()
 	currentConf := loadConns()
 	searchPath := strings.TrimSpace(conn.Path())
-	ptr, exists := currentConf.AllConnections()[searchPath]
-	if !exists {
-		color.Redln("Not saving a connection that was already deleted...\r")
+	original := loadedConns[searchPath]
+	ptr, err := findConn(&currentConf, searchPath, original)
+	if err != nil {
+		say(ct.Red, "Not saving", searchPath+":", err.Error()+"\r")
 		return
 	}
-	*ptr = *conn
+	mine := withoutPuttySettings(conn)
+	if original == nil {
+		*ptr = mine
+	} else {
+		for _, conflict := range mergeConn(original, &mine, ptr) {
+			say(ct.Red, "Not saving "+conflict+"\r")
+		}
+	}
 	saveConns(&currentConf)
-	color.Yellowln("done.\r")
+	say(ct.Yellow, "done.\r")
 }
 func saveConns(conf *types.Configuration) {
 	filename := connectionsPath
 	tmp := filename + ".tmp"
-	wr, err := os.Create(tmp)
-	p(err, "opening "+filename)
-	defer func() {
-		if err := os.Rename(tmp, filename); err != nil {
-			p(os.Remove(filename), "deleting old connections.xml")
-			p(os.Rename(tmp, filename), "overwriting connections.xml")
-		}
-	}()
-	defer wr.Close()
-
-	encoding := unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM)
-	textEncoder := encoding.NewEncoder()
-
-	rawWriter := textEncoder.Writer(wr)
-	replacer := strings.NewReplacer("\n", "\r\n",
-		"<commandline></commandline>", "<commandline />",
-		"<description></description>", "<description />",
-		"<prompt></prompt>", "<prompt />",
-		"<command1></command1>", "<command1 />",
-		"<command2></command2>", "<command2 />",
-		"<command3></command3>", "<command3 />",
-		"<command4></command4>", "<command4 />",
-		"<command5></command5>", "<command5 />",
-		">true<", ">True<", ">false<", ">False<",
-		`"true"`, `"True"`, `"false"`, `"False"`,
-	)
-	writer := util.ReplaceWriter{rawWriter, replacer}
-
-	fmt.Fprintln(writer, `<?xml version="1.0" encoding="utf-16"?>
-<!-- ****************************************************************-->
-<!-- *                                                              *-->
-<!-- * PuTTY Configuration Manager save file - All right reserved.  *-->
-<!-- *                                                              *-->
-<!-- ****************************************************************-->
-<!-- The following lines can be modified at your own risks.  -->`)
-
-	encoder := xml.NewEncoder(writer)
-	encoder.Indent("", "  ")
-	p(encoder.Encode(&conf), "encoding xml")
+	if encryption.key != nil && !encryption.wholeFile {
+		defer encryptSecrets(conf)()
+	}
+	updated := encodeConns(conf)
+	loaded.doc.Update(loaded.base, updated)
+	loaded.base = updated
+
+	data, err := loaded.doc.Bytes()
+	p(err, "encoding xml")
+	if encryption.key != nil && encryption.wholeFile {
+		data = encryptFile(data)
+	}
+	p(ioutil.WriteFile(tmp, data, 0666), "writing "+tmp)
+	if err := os.Rename(tmp, filename); err != nil {
+		p(os.Remove(filename), "deleting old connections.xml")
+		p(os.Rename(tmp, filename), "overwriting connections.xml")
+	}
 }
 
 func p(err error, where string) {
@@ -6,12 +6,16 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
 
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/ssh"
 	"github.com/cfstras/pcm/types"
 	"github.com/cfstras/pcm/util"
 	"github.com/kr/pty"
@@ -44,43 +48,37 @@ void setsize(int fd, int rows, int cols) {
 */
 import "C"
 
-func connect(c *types.Connection, agentForwarding bool, terminal types.Terminal, moreCommands func() *string) bool {
+func init() {
+	subcommands["proxy-connect"] = subcommand{
+		run: proxyConnect,
+	}
+}
+
+func connect(c *types.Connection, settings ssh.Settings, terminal types.Terminal, moreCommands func() *string) bool {
 
 	cmd := &exec.Cmd{}
 	cmd.Path = "/usr/bin/ssh"
-	cmd.Args = []string{"-v", "-p", fmt.Sprint(c.Info.Port), "-l", c.Login.User}
-	if agentForwarding {
-		cmd.Args = append(cmd.Args, "-A")
+	args, env, warnings := sshArgs(c, settings)
+	cmd.Args = append([]string{"-v"}, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	for _, w := range warnings {
+		color.Yellowln("Warning: ignoring " + w + "\r")
 	}
-	cmd.Args = append(cmd.Args, c.Info.Host)
 	procExit := abool.New()
 
-	outFunc := func(pipe *os.File, name string, nextCommand func() *string,
-		startWait *sync.Cond) {
+	outFunc := func(pipe *os.File, name string, script *util.ScriptRunner) {
 		buf := make([]byte, 1024)
-		wrotePassword := false
 		for {
 			if procExit.IsSet() {
 				return
 			}
 			n, err := pipe.Read(buf)
-			str := string(buf[:n])
-			fmt.Fprint(terminal.Stdout(), str)
-			if strings.HasSuffix(str, "assword: ") && !wrotePassword && c.Options.LoginMacro {
-				pipe.Write([]byte(c.Login.Password))
-				pipe.Write([]byte("\n"))
-				wrotePassword = true
-			} else if strings.HasSuffix(str, "assword: ") || strings.HasSuffix(str, "$ ") ||
-				strings.HasSuffix(str, "# ") {
-				if answer := nextCommand(); answer != nil {
-					pipe.Write([]byte(*answer))
-					pipe.Write([]byte("\n"))
-				}
-			}
-			if strings.HasSuffix(str, "Are you sure you want to continue connecting (yes/no)? ") {
-				pipe.Write([]byte("yes\n"))
-			}
+			terminal.Stdout().Write(buf[:n])
+			script.Output(buf[:n])
 			if err != nil {
+				script.Stop()
 				if err != io.EOF {
 					return
 				}
@@ -90,13 +88,13 @@ func connect(c *types.Connection, agentForwarding bool, terminal types.Terminal,
 		}
 	}
 
-	inFunc := func(pipe io.WriteCloser, inputConsole io.Reader, startWait *sync.Cond) {
+	inFunc := func(pipe io.WriteCloser, inputConsole io.Reader, script *util.ScriptRunner) {
 		input := make(chan []byte, 32)
 		buffers := &sync.Pool{
 			New: func() interface{} { return make([]byte, 1024) },
 		}
 
-		go func(pipe io.WriteCloser, input chan []byte, startWait *sync.Cond,
+		go func(pipe io.WriteCloser, input chan []byte, script *util.ScriptRunner,
 			buffers *sync.Pool) {
 			for {
 				buf := buffers.Get().([]byte)
@@ -105,14 +103,14 @@ func connect(c *types.Connection, agentForwarding bool, terminal types.Terminal,
 				if err != nil && err != io.EOF {
 					fmt.Fprintln(terminal.Stderr(), "my stdin got error", err)
 					input <- nil
-					startWait.Broadcast()
+					script.Stop()
 					return
 				}
 				var write []byte
 				if err == io.EOF {
 					write = []byte{0x04}
 					input <- nil
-					startWait.Broadcast()
+					script.Stop()
 					return
 				}
 				for _, c := range []byte{0x04, 0x03, 0x1a} {
@@ -125,18 +123,16 @@ func connect(c *types.Connection, agentForwarding bool, terminal types.Terminal,
 					if err != nil {
 						fmt.Fprintln(terminal.Stderr(), "stdin got error", err)
 						input <- nil
-						startWait.Broadcast()
+						script.Stop()
 						return
 					}
 				} else {
 					input <- buf[:n]
 				}
 			}
-		}(pipe, input, startWait, buffers)
+		}(pipe, input, script, buffers)
 
-		startWait.L.Lock()
-		startWait.Wait()
-		startWait.L.Unlock()
+		<-script.Done()
 		for buf := range input {
 			if buf == nil {
 				fmt.Fprintln(terminal.Stderr(), "closing stdIn:", pipe.Close())
@@ -155,9 +151,6 @@ func connect(c *types.Connection, agentForwarding bool, terminal types.Terminal,
 		}
 	}
 
-	startWait := sync.NewCond(&sync.Mutex{})
-	nextCommand := util.GetCommandFunc(c, startWait, moreCommands)
-
 	sendSize := func(out *os.File, cmd *exec.Cmd) {
 		var row, col C.int
 		C.getsize(&row, &col)
@@ -177,11 +170,15 @@ func connect(c *types.Connection, agentForwarding bool, terminal types.Terminal,
 		}
 	}
 
+	login := loginScript(c)
+	util.ResolvePassword(c, login, ssh.PasswordPrompt(terminal))
+
 	pty, err := pty.Start(cmd)
 	p(err, "starting ssh")
 
-	go outFunc(pty, "pty", nextCommand, startWait)
-	go inFunc(pty, terminal.Stdin(), startWait)
+	script := util.RunScript(c, login, pty, moreCommands)
+	go outFunc(pty, "pty", script)
+	go inFunc(pty, terminal.Stdin(), script)
 	go signalWatcher(pty, cmd)
 	sendSize(pty, cmd)
 
@@ -198,8 +195,203 @@ func connect(c *types.Connection, agentForwarding bool, terminal types.Terminal,
 
 	err = cmd.Wait()
 	procExit.Set()
+	script.Stop()
 	if err != nil {
 		fmt.Fprintln(terminal.Stderr(), "SSH Process ended:", err)
 	}
 	return false
 }
+
+// sshArgs returns the arguments for ssh to connect to c with its options,
+// including the ones from its PuTTY command line, and the environment ssh
+// needs on top of pcm's. The settings ssh can't be given are returned as
+// warnings.
+func sshArgs(c *types.Connection, settings ssh.Settings) (args, env, warnings []string) {
+	warn := func(what, why string) { warnings = append(warnings, what+": "+why) }
+	args = []string{"-p", fmt.Sprint(c.Info.Port), "-l", c.Login.User}
+
+	policy := c.Options.AgentForwarding
+	if policy != nil && (len(policy.Keys) > 0 || policy.MaxUses > 0 || policy.Confirm ||
+		policy.Log != "") {
+		warn("the agent forwarding policy", "ssh can only forward the whole agent, see -A")
+		policy = nil
+	}
+	if settings.AgentForwarding || policy != nil {
+		args = append(args, "-A")
+	}
+	if settings.AgentLifetime != 0 || settings.AgentConfirm || settings.AgentSocket {
+		warn("-agent-lifetime, -agent-confirm and -agent-socket",
+			"pcm's own agent is only used by the built-in client")
+	}
+	switch c.Options.X11 {
+	case types.X11Trusted:
+		args = append(args, "-Y")
+	case types.X11Untrusted:
+		args = append(args, "-X")
+	}
+	if c.Options.NoPty {
+		args = append(args, "-T")
+	} else if c.Options.RemoteCommand != "" {
+		// ssh only asks for a pty for commands with -t
+		args = append(args, "-t")
+	}
+	if e := c.Options.EscapeChar; e == "^?" {
+		warn("the escape character ^?", "ssh doesn't take it")
+	} else if e != "" {
+		args = append(args, "-e", e)
+	}
+	for _, f := range append(append([]string{}, c.Options.IdentityFiles...),
+		settings.IdentityFiles...) {
+		if strings.EqualFold(filepath.Ext(f), ".ppk") {
+			warn("the key "+f, "ssh can't read PuTTY keys")
+			continue
+		}
+		args = append(args, "-i", f)
+	}
+	for _, f := range c.Options.Forwards {
+		switch f.Type {
+		case types.ForwardLocal:
+			args = append(args, "-L", f.Listen+":"+f.Target)
+		case types.ForwardRemote:
+			args = append(args, "-R", f.Listen+":"+f.Target)
+		case types.ForwardDynamic:
+			args = append(args, "-D", f.Listen)
+		}
+	}
+	if len(c.Options.Env) > 0 {
+		// ssh only uses the first SetEnv
+		var vars []string
+		for _, v := range c.Options.Env {
+			vars = append(vars, setEnvQuote(v.Name+"="+v.Value))
+		}
+		args = append(args, "-o", "SetEnv="+strings.Join(vars, " "))
+	}
+	if c.Options.Term != "" {
+		env = append(env, "TERM="+c.Options.Term)
+	}
+
+	chain, err := ssh.JumpHosts(c, settings)
+	if err != nil {
+		warn("the jump hosts", err.Error())
+		chain = nil
+	}
+	var jumps []string
+	for _, hop := range chain {
+		port := hop.Info.Port
+		if port == 0 {
+			port = 22
+		}
+		jump := net.JoinHostPort(hop.Info.Host, fmt.Sprint(port))
+		if hop.Login.User != "" {
+			jump = hop.Login.User + "@" + jump
+		}
+		jumps = append(jumps, jump)
+		if len(hop.Options.IdentityFiles) > 0 {
+			warn("the keys of jump host "+hop.Info.Name, "ssh only uses its default keys for it")
+		}
+		if hop.Login.Password != "" {
+			warn("the password of jump host "+hop.Info.Name, "ssh asks for it")
+		}
+	}
+	if len(jumps) > 0 {
+		args = append(args, "-J", strings.Join(jumps, ","))
+		if proxy := ssh.ProxyFor(chain[0], settings); proxy != "" {
+			warn("the proxy of jump host "+chain[0].Info.Name,
+				"ssh can't combine a proxy with jump hosts")
+		}
+	} else if proxy := ssh.ProxyFor(c, settings); proxy != "" {
+		if _, ok := ssh.ProxyURL(proxy); !ok {
+			args = append(args, "-o", "ProxyCommand="+proxy)
+		} else if exe, err := os.Executable(); err != nil {
+			warn("the proxy", err.Error())
+		} else {
+			// ssh only runs commands, so pcm connects through the proxy for it
+			args = append(args, "-o", "ProxyCommand="+
+				shellQuote(strings.Replace(exe, "%", "%%", -1))+" proxy-connect %h %p")
+			env = append(env, proxyConnectEnv+"="+proxy)
+		}
+	}
+
+	if c.Login.Password != "" && !util.SendsSecret(loginScript(c), types.AnswerPassword) {
+		warn("the password", "ssh only gets it with the login macro, or a script sending it")
+	}
+	if c.Login.TOTPSecret != "" && !util.SendsSecret(loginScript(c), types.AnswerTOTP) {
+		warn("the TOTP secret", "ssh only gets codes from a script sending them")
+	}
+	if len(c.Login.Answers) > 0 {
+		warn("the answers", "only the built-in client answers questions")
+	}
+
+	cl := puttyCommandLines[c.Path()]
+	if cl != nil && cl.Compression {
+		args = append(args, "-C")
+	}
+	if settings.NoShell || cl != nil && cl.NoShell {
+		args = append(args, "-N")
+	}
+	args = append(args, c.Info.Host)
+	if c.Options.RemoteCommand != "" {
+		args = append(args, c.Options.RemoteCommand)
+	}
+	return args, env, warnings
+}
+
+// The environment variable with the proxy for "pcm proxy-connect"
+const proxyConnectEnv = "PCM_PROXY"
+
+// proxyConnect connects stdin and stdout to host and port through the proxy
+// in $PCM_PROXY, for ssh's ProxyCommand.
+func proxyConnect(args []string) {
+	u, ok := ssh.ProxyURL(os.Getenv(proxyConnectEnv))
+	if len(args) != 2 || !ok {
+		fmt.Fprintln(os.Stderr, "Usage: "+proxyConnectEnv+"=<proxy url> pcm proxy-connect <host> <port>")
+		os.Exit(2)
+	}
+	conn, err := ssh.DialProxy(u, net.JoinHostPort(args[0], args[1]))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	go func() {
+		io.Copy(conn, os.Stdin)
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		}
+	}()
+	io.Copy(os.Stdout, conn)
+}
+
+// shellQuote quotes s for /bin/sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// setEnvQuote quotes a NAME=value pair for ssh's SetEnv, if needed.
+func setEnvQuote(s string) string {
+	if !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// loginScript returns the script to run with the ssh command: it accepts new
+// host keys and, with LoginMacro, sends the password before the connection's
+// own script.
+func loginScript(c *types.Connection) *types.Script {
+	password := []types.ScriptStep{}
+	if c.Options.LoginMacro {
+		password = append(password, types.SendSecret(types.AnswerPassword))
+	}
+	login := types.Expect("", c.Timeout.ConnectionTimeout+c.Timeout.LoginTimeout, true)
+	login.Cases = []types.ScriptCase{
+		{Match: `\(yes/no[^)]*\)\? $`, Steps: []types.ScriptStep{
+			types.Send("yes"),
+			{XMLName: login.XMLName, Timeout: c.Timeout.PasswordTimeout, Optional: true,
+				Cases: []types.ScriptCase{{Match: types.PasswordPattern, Steps: password}}},
+		}},
+		{Match: types.PasswordPattern, Steps: password},
+		{Match: types.PromptPattern},
+	}
+	script := c.LoginScript()
+	return &types.Script{Steps: append([]types.ScriptStep{login}, script.Steps...)}
+}
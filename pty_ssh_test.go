@@ -0,0 +1,182 @@
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cfstras/pcm/putty"
+	"github.com/cfstras/pcm/ssh"
+	"github.com/cfstras/pcm/types"
+)
+
+// commandLineConn returns a connection with the command line applied, like
+// applyPuttySettings does.
+func commandLineConn(t *testing.T, line string) *types.Connection {
+	conn := &types.Connection{}
+	conn.Info.Name, conn.Path_ = "srv", "/test/srv"
+	conn.Info.Host, conn.Info.Port, conn.Login.User = "old.example.com", 22, "old"
+	cl, err := putty.ParseCommandLine(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl.Apply(conn)
+	puttyCommandLines[conn.Path()] = cl
+	t.Cleanup(func() { delete(puttyCommandLines, conn.Path()) })
+	return conn
+}
+
+// hasArgs returns whether want appears in args in a row.
+func hasArgs(args []string, want ...string) bool {
+	for i := 0; i+len(want) <= len(args); i++ {
+		if reflect.DeepEqual(args[i:i+len(want)], want) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasWarning(warnings []string, prefix string) bool {
+	for _, w := range warnings {
+		if strings.HasPrefix(w, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Every option of the command line ends up in the arguments of ssh, or in a
+// warning.
+func TestSSHArgsCommandLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	command := filepath.Join(dir, "command")
+	if err := ioutil.WriteFile(command, []byte("uptime\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := commandLineConn(t, `-ssh -l admin -P 2222 -pw secret -i key.pem -i key.ppk `+
+		`-L 8080:localhost:80 -R 9090:localhost:90 -D 1080 -A -X -T -C -N `+
+		`-proxycmd "nc %host %port" -m "`+command+`" admin@srv.example.com`)
+	args, env, warnings := sshArgs(conn, ssh.Settings{})
+
+	for _, want := range [][]string{
+		{"-p", "2222"},
+		{"-l", "admin"},
+		{"-i", "key.pem"},
+		{"-L", "8080:localhost:80"},
+		{"-R", "9090:localhost:90"},
+		{"-D", "1080"},
+		{"-A"},
+		{"-Y"},
+		{"-T"},
+		{"-C"},
+		{"-N"},
+		{"-o", "ProxyCommand=nc %h %p"},
+		{"srv.example.com", "uptime"},
+	} {
+		if !hasArgs(args, want...) {
+			t.Errorf("%q missing in %q", want, args)
+		}
+	}
+	if hasArgs(args, "-t") {
+		t.Errorf("pty requested despite -T: %q", args)
+	}
+	if hasArgs(args, "key.ppk") {
+		t.Errorf("PuTTY key given to ssh: %q", args)
+	}
+	if len(env) != 0 {
+		t.Errorf("unexpected environment %q", env)
+	}
+	for _, want := range []string{"the password", "the key key.ppk"} {
+		if !hasWarning(warnings, want) {
+			t.Errorf("no warning about %s in %q", want, warnings)
+		}
+	}
+
+	conn.Options.LoginMacro = true
+	if _, _, warnings = sshArgs(conn, ssh.Settings{}); hasWarning(warnings, "the password") {
+		t.Errorf("password warned about although the login macro sends it: %q", warnings)
+	}
+}
+
+func TestSSHArgsOptions(t *testing.T) {
+	conn := commandLineConn(t, "")
+	conn.Options.EscapeChar = "^]"
+	conn.Options.Term = "vt100"
+	conn.Options.Env = []types.EnvVar{{Name: "LANG", Value: "C"},
+		{Name: "GREETING", Value: `say "hi"`}}
+	conn.Options.AgentForwarding = &types.AgentPolicy{Confirm: true}
+	conn.Login.TOTPSecret = "JBSWY3DPEHPK3PXP"
+	conn.Login.Answers = []types.Answer{{Question: "Token", Source: types.AnswerTOTP}}
+	conn.Options.Proxy = "socks5://127.0.0.1:1080"
+	conn.Options.RemoteCommand = "top"
+
+	args, env, warnings := sshArgs(conn, ssh.Settings{})
+	for _, want := range [][]string{
+		{"-e", "^]"},
+		{"-t"},
+		{"old.example.com", "top"},
+		{"-o", `SetEnv=LANG=C "GREETING=say \"hi\""`},
+	} {
+		if !hasArgs(args, want...) {
+			t.Errorf("%q missing in %q", want, args)
+		}
+	}
+	if hasArgs(args, "-A") {
+		t.Errorf("agent forwarded despite its policy: %q", args)
+	}
+	proxied := false
+	for _, a := range args {
+		if strings.HasPrefix(a, "ProxyCommand=") && strings.HasSuffix(a, " proxy-connect %h %p") {
+			proxied = true
+		}
+	}
+	if !proxied || !hasArgs(env, "PCM_PROXY=socks5://127.0.0.1:1080") {
+		t.Errorf("proxy not passed: %q, environment %q", args, env)
+	}
+	if !hasArgs(env, "TERM=vt100") {
+		t.Errorf("TERM missing in %q", env)
+	}
+	for _, want := range []string{"the agent forwarding policy", "the TOTP secret", "the answers"} {
+		if !hasWarning(warnings, want) {
+			t.Errorf("no warning about %s in %q", want, warnings)
+		}
+	}
+}
+
+func TestSSHArgsJumpHosts(t *testing.T) {
+	conf := &types.Configuration{}
+	conf.Root.Name = "root"
+	bastion := types.Connection{}
+	bastion.Name, bastion.Info.Name = "bastion", "bastion"
+	bastion.Info.Host, bastion.Info.Port, bastion.Login.User = "bastion.example.com", 2200, "jump"
+	bastion.Options.Proxy = "nc proxy %h %p"
+	conf.Root.Containers = []types.Container{{Connections: []types.Connection{bastion}}}
+	conf.Root.Containers[0].Name = "net"
+
+	conn := commandLineConn(t, "")
+	conn.Options.JumpHosts = []string{"net/bastion", "admin@[2001:db8::1]:2022"}
+	conn.Options.Proxy = "nc other %h %p"
+	args, _, warnings := sshArgs(conn, ssh.Settings{Config: conf})
+
+	if !hasArgs(args, "-J", "jump@bastion.example.com:2200,admin@[2001:db8::1]:2022") {
+		t.Errorf("jump hosts missing in %q", args)
+	}
+	for _, a := range args {
+		if strings.HasPrefix(a, "ProxyCommand=") {
+			t.Errorf("proxy given to ssh with jump hosts: %q", args)
+		}
+	}
+	if !hasWarning(warnings, "the proxy of jump host bastion") {
+		t.Errorf("no warning about the proxy of the jump host in %q", warnings)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/go-utils/fileutil"
+	"github.com/cfstras/pcm/putty"
+	"github.com/cfstras/pcm/types"
+)
+
+var (
+	puttySessionsPath string = "~/.putty/sessions"
+	puttyRegPaths     StringList
+)
+
+// puttyOriginals has the connections that got settings from a PuTTY session
+// or their command line, by path, as they were before. These settings are not
+// saved to connections.xml.
+var puttyOriginals = make(map[string]types.Connection)
+
+// puttyCommandLines has the parsed command lines of the connections, by path.
+var puttyCommandLines = make(map[string]*putty.CommandLine)
+
+// loadPuttySessions reads the saved sessions of the PuTTY on Unix and the
+// given registry exports. Sessions from registry exports come first.
+func loadPuttySessions() ([]*putty.Session, error) {
+	var sessions []*putty.Session
+	for _, path := range puttyRegPaths {
+		s, err := putty.LoadReg(replaceHome(path))
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s...)
+	}
+	dir := replaceHome(puttySessionsPath)
+	if e, _ := fileutil.Exists(dir); e {
+		s, err := putty.LoadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s...)
+	}
+	return sessions, nil
+}
+
+// applyPuttySettings fills in the settings of the connections from the PuTTY
+// sessions they name, then applies the options in their command line. Like
+// with PuTTY, the command line overrides the connection, and the connection
+// overrides the session.
+func applyPuttySettings(conf *types.Configuration) error {
+	sessions, err := loadPuttySessions()
+	if err != nil {
+		return err
+	}
+	for path, conn := range conf.AllConnections() {
+		if isImported(conn) || (conn.Info.Session == "" && conn.Info.Commandline == "") {
+			continue
+		}
+		orig := *conn
+		cl, err := putty.ParseCommandLine(conn.Info.Commandline)
+		if err != nil {
+			cl = &putty.CommandLine{Warnings: []string{"the command line: " + err.Error()}}
+		}
+		name := conn.Info.Session
+		if cl.Session != "" {
+			name = cl.Session
+		}
+		if s := findPuttySession(sessions, name); s != nil {
+			if err := applyPuttySession(conn, s); err != nil {
+				cl.Warnings = append(cl.Warnings, "the proxy of session "+s.Name+": "+err.Error())
+			}
+		} else if cl.Session != "" {
+			cl.Warnings = append(cl.Warnings, "-load "+cl.Session+": session not found")
+		}
+		cl.Apply(conn)
+		puttyOriginals[path] = orig
+		puttyCommandLines[path] = cl
+	}
+	return nil
+}
+
+// warnPuttyCommandLine shows the options of conn's command line which are
+// ignored. ownClient is whether pcm's own client is used, rather than ssh.
+func warnPuttyCommandLine(conn *types.Connection, ownClient bool) {
+	cl := puttyCommandLines[conn.Path()]
+	if cl == nil {
+		return
+	}
+	warnings := cl.Warnings
+	if cl.Compression && ownClient {
+		warnings = append(warnings, "-C: compression is not supported by the built-in client")
+	}
+	for _, w := range warnings {
+		color.Yellowln("Warning: ignoring", w+"\r")
+	}
+}
+
+func findPuttySession(sessions []*putty.Session, name string) *putty.Session {
+	for _, s := range sessions {
+		if s.Name == name {
+			return s
+		}
+	}
+	for _, s := range sessions {
+		if strings.EqualFold(s.Name, name) {
+			return s
+		}
+	}
+	return nil
+}
+
+// applyPuttySession fills in the settings of conn from s. An error is returned
+// for a proxy that is not supported, the other settings are applied anyway.
+func applyPuttySession(conn *types.Connection, s *putty.Session) error {
+	if conn.Info.Host == "" {
+		conn.Info.Host = s.HostName
+	}
+	if conn.Info.Port == 0 {
+		conn.Info.Port = s.Port
+	}
+	if conn.Info.Protocol == "" {
+		conn.Info.Protocol = putty.Protocols[s.Protocol]
+	}
+	if conn.Login.User == "" {
+		conn.Login.User = s.UserName
+	}
+	if conn.Options.Term == "" {
+		conn.Options.Term = s.TerminalType
+	}
+	if conn.Options.Charset == "" {
+		conn.Options.Charset = s.LineCodePage
+	}
+	if s.PublicKeyFile != "" {
+		conn.Options.IdentityFiles = append(conn.Options.IdentityFiles, s.PublicKeyFile)
+	}
+	conn.Options.Forwards = append(conn.Options.Forwards, s.Forwards()...)
+	if conn.Options.Proxy != "" {
+		return nil
+	}
+	proxy, err := s.Proxy()
+	conn.Options.Proxy = proxy
+	return err
+}
+
+// withoutPuttySettings returns conn for saving, with the settings that came
+// from its PuTTY session or command line taken out again.
+func withoutPuttySettings(conn *types.Connection) types.Connection {
+	c := *conn
+	orig, ok := puttyOriginals[conn.Path()]
+	if !ok {
+		return c
+	}
+	c.Info.Host, c.Info.Port, c.Info.Protocol = orig.Info.Host, orig.Info.Port, orig.Info.Protocol
+	c.Login.User, c.Login.Password = orig.Login.User, orig.Login.Password
+	c.Options.Term, c.Options.Charset = orig.Options.Term, orig.Options.Charset
+	c.Options.IdentityFiles = orig.Options.IdentityFiles
+	c.Options.Forwards = orig.Options.Forwards
+	c.Options.Proxy = orig.Options.Proxy
+	c.Options.AgentForwarding, c.Options.X11 = orig.Options.AgentForwarding, orig.Options.X11
+	c.Options.NoPty, c.Options.RemoteCommand = orig.Options.NoPty, orig.Options.RemoteCommand
+	return c
+}
@@ -0,0 +1,325 @@
+package putty
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/cfstras/pcm/types"
+)
+
+// CommandLine has the options of a PuTTY or plink command line, as PuTTYCM
+// keeps them in a connection's <commandline>.
+type CommandLine struct {
+	// The saved session to load, from -load
+	Session string
+	// -C: compression, which pcm's own client doesn't support
+	Compression bool
+	// -N: don't start a shell or command
+	NoShell bool
+	// Options that were ignored, with the reason
+	Warnings []string
+
+	apply []func(*types.Connection)
+}
+
+// options with an argument that pcm ignores
+var ignoredWithArg = map[string]string{
+	"-loghost":    "the logical host name is not used",
+	"-hostkey":    "host keys are checked against connections.xml",
+	"-sercfg":     "serial connections are not supported",
+	"-sessionlog": "logging is not supported, see -record",
+	"-sshlog":     "logging is not supported, see -record",
+	"-sshrawlog":  "logging is not supported, see -record",
+	"-nc":         "forwarding the session to a port is not supported",
+	"-cert":       "certificates are not supported",
+}
+
+// options without an argument that pcm ignores
+var ignored = map[string]string{
+	"-1":               "SSH-1 is not supported",
+	"-4":               "the address family can't be chosen",
+	"-6":               "the address family can't be chosen",
+	"-noagent":         "the SSH agent is always used",
+	"-share":           "connection sharing is not supported",
+	"-noshare":         "",
+	"-shareexists":     "connection sharing is not supported",
+	"-logoverwrite":    "logging is not supported",
+	"-logappend":       "logging is not supported",
+	"-restrict-acl":    "",
+	"-no-antispoof":    "",
+	"-no-trivial-auth": "",
+	"-s":               "subsystems are not supported",
+	"-v":               "",
+	"-2":               "",
+	"-batch":           "",
+	"-agent":           "",
+}
+
+// ParseCommandLine parses PuTTY command line options, see
+// https://the.earth.li/~sgtatham/putty/0.76/htmldoc/Chapter3.html#using-cmdline.
+// Unsupported options are listed in Warnings.
+func ParseCommandLine(line string) (*CommandLine, error) {
+	args, err := SplitCommandLine(line)
+	if err != nil {
+		return nil, err
+	}
+	c := &CommandLine{}
+	// arguments that may belong to unknown options
+	var stray []string
+	hasHost := false
+	for i := 0; i < len(args); i++ {
+		opt := args[i]
+		if !strings.HasPrefix(opt, "-") {
+			c.host(opt)
+			hasHost = true
+			continue
+		}
+		if why, ok := ignored[opt]; ok {
+			if why != "" {
+				c.warn(opt, why)
+			}
+			continue
+		}
+		if !takesArg(opt) {
+			if c.option(opt) {
+				continue
+			}
+			// skip the argument it may have, like -J host
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				opt += " " + args[i]
+				stray = append(stray, args[i])
+			}
+			c.warn(opt, "unknown option")
+			continue
+		}
+		if i+1 == len(args) {
+			return nil, fmt.Errorf("%s needs an argument", opt)
+		}
+		i++
+		if why, ok := ignoredWithArg[opt]; ok {
+			c.warn(opt+" "+args[i], why)
+			continue
+		}
+		if err := c.optionWithArg(opt, args[i]); err != nil {
+			return nil, fmt.Errorf("%s %s: %v", opt, args[i], err)
+		}
+	}
+	if !hasHost && len(stray) > 0 {
+		// the last one could be the host after an unknown option without
+		// argument, but it is only used if there is no other
+		host := stray[len(stray)-1]
+		c.set(func(conn *types.Connection) {
+			if conn.Info.Host == "" {
+				setHost(conn, host)
+			}
+		})
+	}
+	return c, nil
+}
+
+func takesArg(opt string) bool {
+	switch opt {
+	case "-load", "-l", "-P", "-pw", "-pwfile", "-i", "-L", "-R", "-D", "-m", "-proxycmd":
+		return true
+	}
+	_, ok := ignoredWithArg[opt]
+	return ok
+}
+
+func (c *CommandLine) warn(opt, why string) {
+	c.Warnings = append(c.Warnings, opt+": "+why)
+}
+
+func (c *CommandLine) set(f func(*types.Connection)) {
+	c.apply = append(c.apply, f)
+}
+
+// host handles the [user@]host argument.
+func (c *CommandLine) host(arg string) {
+	c.set(func(conn *types.Connection) { setHost(conn, arg) })
+}
+
+func setHost(conn *types.Connection, arg string) {
+	user, host := "", arg
+	if i := strings.LastIndex(arg, "@"); i != -1 {
+		user, host = arg[:i], arg[i+1:]
+	}
+	conn.Info.Host = host
+	if user != "" {
+		conn.Login.User = user
+	}
+}
+
+// option handles an option without argument, and returns whether it is known.
+func (c *CommandLine) option(opt string) bool {
+	switch opt {
+	case "-ssh", "-telnet", "-raw", "-rlogin", "-serial":
+		protocol := Protocols[opt[1:]]
+		c.set(func(conn *types.Connection) { conn.Info.Protocol = protocol })
+	case "-A":
+		c.set(func(conn *types.Connection) {
+			if conn.Options.AgentForwarding == nil {
+				conn.Options.AgentForwarding = &types.AgentPolicy{}
+			}
+		})
+	case "-a":
+		c.set(func(conn *types.Connection) { conn.Options.AgentForwarding = nil })
+	case "-X":
+		// PuTTY gives the host full access to the display
+		c.set(func(conn *types.Connection) { conn.Options.X11 = types.X11Trusted })
+	case "-x":
+		c.set(func(conn *types.Connection) { conn.Options.X11 = "" })
+	case "-t":
+		c.set(func(conn *types.Connection) { conn.Options.NoPty = false })
+	case "-T":
+		c.set(func(conn *types.Connection) { conn.Options.NoPty = true })
+	case "-C":
+		c.Compression = true
+	case "-N":
+		c.NoShell = true
+	default:
+		return false
+	}
+	return true
+}
+
+func (c *CommandLine) optionWithArg(opt, arg string) error {
+	switch opt {
+	case "-load":
+		c.Session = arg
+	case "-l":
+		c.set(func(conn *types.Connection) { conn.Login.User = arg })
+	case "-P":
+		port, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return err
+		}
+		c.set(func(conn *types.Connection) { conn.Info.Port = uint16(port) })
+	case "-pw":
+		c.set(func(conn *types.Connection) { conn.Login.Password = arg })
+	case "-pwfile":
+		data, err := ioutil.ReadFile(arg)
+		if err != nil {
+			return err
+		}
+		password := strings.SplitN(string(data), "\n", 2)[0]
+		password = strings.TrimSuffix(password, "\r")
+		c.set(func(conn *types.Connection) { conn.Login.Password = password })
+	case "-i":
+		c.set(func(conn *types.Connection) {
+			conn.Options.IdentityFiles = append(conn.Options.IdentityFiles, arg)
+		})
+	case "-L", "-R", "-D":
+		forward, err := parseForward(opt[1], arg)
+		if err != nil {
+			return err
+		}
+		c.set(func(conn *types.Connection) {
+			conn.Options.Forwards = append(conn.Options.Forwards, forward)
+		})
+	case "-m":
+		data, err := ioutil.ReadFile(arg)
+		if err != nil {
+			return err
+		}
+		command := strings.TrimSpace(string(data))
+		c.set(func(conn *types.Connection) { conn.Options.RemoteCommand = command })
+	case "-proxycmd":
+		proxy := proxyCommand(arg, &Session{})
+		c.set(func(conn *types.Connection) { conn.Options.Proxy = proxy })
+	}
+	return nil
+}
+
+// Apply sets the options of the command line on conn.
+func (c *CommandLine) Apply(conn *types.Connection) {
+	for _, f := range c.apply {
+		f(conn)
+	}
+}
+
+// parseForward parses the argument of -L and -R, [srcaddr:]srcport:host:port,
+// and of -D, [srcaddr:]srcport.
+func parseForward(kind byte, arg string) (types.Forward, error) {
+	parts := splitHostPorts(arg)
+	if kind == 'D' {
+		if len(parts) > 2 {
+			return types.Forward{}, errors.New("expected [address:]port")
+		}
+		return types.Forward{Type: types.ForwardDynamic, Listen: arg}, nil
+	}
+	var listen string
+	switch len(parts) {
+	case 3:
+		listen = parts[0]
+	case 4:
+		listen = parts[0] + ":" + parts[1]
+	default:
+		return types.Forward{}, errors.New("expected [address:]port:host:port")
+	}
+	target := parts[len(parts)-2] + ":" + parts[len(parts)-1]
+	if kind == 'L' {
+		return types.Forward{Type: types.ForwardLocal, Listen: listen, Target: target}, nil
+	}
+	return types.Forward{Type: types.ForwardRemote, Listen: listen, Target: target}, nil
+}
+
+// splitHostPorts splits s at the colons outside of [brackets].
+func splitHostPorts(s string) []string {
+	var parts []string
+	start, depth := 0, 0
+	for i, r := range s {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// SplitCommandLine splits a command line into arguments like Windows does:
+// at spaces, except inside double quotes. \" is a literal quote, other
+// backslashes are kept, so paths need no escaping.
+func SplitCommandLine(line string) ([]string, error) {
+	var args []string
+	var arg []byte
+	inArg, quoted := false, false
+	for i := 0; i < len(line); i++ {
+		b := line[i]
+		switch {
+		case b == '\\' && i+1 < len(line) && line[i+1] == '"':
+			arg = append(arg, '"')
+			inArg = true
+			i++
+		case b == '"':
+			quoted = !quoted
+			inArg = true
+		case (b == ' ' || b == '\t' || b == '\r' || b == '\n') && !quoted:
+			if inArg {
+				args = append(args, string(arg))
+				arg, inArg = nil, false
+			}
+		default:
+			arg = append(arg, b)
+			inArg = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote in command line")
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	return args, nil
+}
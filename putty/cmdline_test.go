@@ -0,0 +1,88 @@
+package putty
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cfstras/pcm/types"
+)
+
+func applied(t *testing.T, line string, conn *types.Connection) *CommandLine {
+	c, err := ParseCommandLine(line)
+	if err != nil {
+		t.Fatalf("%s: %v", line, err)
+	}
+	c.Apply(conn)
+	return c
+}
+
+func TestParseCommandLine(t *testing.T) {
+	conn := &types.Connection{}
+	c := applied(t, `-ssh -P 2222 -l admin -pw secret -i "C:\keys\my key.ppk" `+
+		`-L 8080:localhost:80 -R [::1]:9090:db:5432 -D 1080 -A -X -T -C -N -load web `+
+		`root@srv.example.com`, conn)
+
+	if conn.Info.Host != "srv.example.com" || conn.Info.Port != 2222 ||
+		conn.Login.User != "root" || conn.Login.Password != "secret" {
+		t.Errorf("got %s@%s:%d password %q", conn.Login.User, conn.Info.Host,
+			conn.Info.Port, conn.Login.Password)
+	}
+	if !reflect.DeepEqual(conn.Options.IdentityFiles, []string{`C:\keys\my key.ppk`}) {
+		t.Errorf("identity files %q", conn.Options.IdentityFiles)
+	}
+	want := []types.Forward{
+		{Type: types.ForwardLocal, Listen: "8080", Target: "localhost:80"},
+		{Type: types.ForwardRemote, Listen: "[::1]:9090", Target: "db:5432"},
+		{Type: types.ForwardDynamic, Listen: "1080"},
+	}
+	if !reflect.DeepEqual(conn.Options.Forwards, want) {
+		t.Errorf("forwards %+v, want %+v", conn.Options.Forwards, want)
+	}
+	if conn.Options.AgentForwarding == nil || conn.Options.X11 != types.X11Trusted ||
+		!conn.Options.NoPty {
+		t.Errorf("options %+v", conn.Options)
+	}
+	if !c.Compression || !c.NoShell || c.Session != "web" || len(c.Warnings) != 0 {
+		t.Errorf("command line %+v", c)
+	}
+}
+
+func TestParseCommandLineUnknownOption(t *testing.T) {
+	for _, test := range []struct {
+		line, host, warning string
+	}{
+		// the argument of an unknown option is not the host
+		{"-J bastion srv.example.com", "srv.example.com", "-J bastion: unknown option"},
+		{"srv.example.com -J bastion", "srv.example.com", "-J bastion: unknown option"},
+		{"-sercfg 9600 srv.example.com", "srv.example.com", "-sercfg 9600: serial"},
+		// nor does it replace the connection's host
+		{"-J bastion", "old.example.com", "-J bastion: unknown option"},
+		{"-frobnicate", "old.example.com", "-frobnicate: unknown option"},
+	} {
+		conn := &types.Connection{}
+		conn.Info.Host = "old.example.com"
+		c := applied(t, test.line, conn)
+		if conn.Info.Host != test.host {
+			t.Errorf("%s: host %q, want %q", test.line, conn.Info.Host, test.host)
+		}
+		if len(c.Warnings) != 1 || !strings.HasPrefix(c.Warnings[0], test.warning) {
+			t.Errorf("%s: warnings %q, want %q", test.line, c.Warnings, test.warning)
+		}
+	}
+
+	// with no other host, it may be the host after all
+	conn := &types.Connection{}
+	applied(t, "-frobnicate srv.example.com", conn)
+	if conn.Info.Host != "srv.example.com" {
+		t.Errorf("host %q, want srv.example.com", conn.Info.Host)
+	}
+}
+
+func TestParseCommandLineErrors(t *testing.T) {
+	for _, line := range []string{"-P", "-P notaport", "-L 8080", `-i "unterminated`} {
+		if _, err := ParseCommandLine(line); err == nil {
+			t.Errorf("%s: no error", line)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// Package putty reads PuTTY's saved sessions, from registry exports (.reg
+// files) of the Windows version or the ~/.putty/sessions directory of the Unix
+// version.
+package putty
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding/unicode"
+
+	"github.com/cfstras/pcm/types"
+)
+
+// Proxy types, as in ProxyMethod
+const (
+	ProxyNone    = 0
+	ProxySOCKS4  = 1
+	ProxySOCKS5  = 2
+	ProxyHTTP    = 3
+	ProxyTelnet  = 4
+	ProxyCommand = 5
+)
+
+// Protocols maps PuTTY's protocol names to the ones of PuTTYCM
+var Protocols = map[string]string{
+	"ssh":    "SSH",
+	"telnet": "Telnet",
+	"raw":    "RAW",
+	"rlogin": "RLogin",
+	"serial": "Serial",
+}
+
+// The registry key holding the sessions, below HKEY_CURRENT_USER
+const sessionsKey = `\software\simontatham\putty\sessions\`
+
+// Session has the settings of a saved session which pcm can use.
+type Session struct {
+	Name string
+
+	HostName string
+	Port     uint16
+	// "ssh", "telnet", "raw", ...
+	Protocol      string
+	UserName      string
+	PublicKeyFile string
+	// e.g. "L8080=localhost:80,D1080"
+	PortForwardings string
+	TerminalType    string
+	// e.g. "UTF-8" or "ISO-8859-1:1998 (Latin-1, West Europe)"
+	LineCodePage string
+
+	ProxyMethod   int
+	ProxyHost     string
+	ProxyPort     int
+	ProxyUsername string
+	ProxyPassword string
+	// the command for ProxyCommand, with %host, %port, %proxyhost, %user
+	// (of the proxy) etc.
+	ProxyTelnetCommand string
+}
+
+// set stores a value of the session, ignoring the settings pcm has no use for.
+func (s *Session) set(key, value string) {
+	number := func() int {
+		n, _ := strconv.Atoi(value)
+		return n
+	}
+	switch key {
+	case "HostName":
+		s.HostName = value
+	case "PortNumber":
+		s.Port = uint16(number())
+	case "Protocol":
+		s.Protocol = value
+	case "UserName":
+		s.UserName = value
+	case "PublicKeyFile":
+		s.PublicKeyFile = value
+	case "PortForwardings":
+		s.PortForwardings = value
+	case "TerminalType":
+		s.TerminalType = value
+	case "LineCodePage":
+		s.LineCodePage = value
+	case "ProxyMethod":
+		s.ProxyMethod = number()
+	case "ProxyHost":
+		s.ProxyHost = value
+	case "ProxyPort":
+		s.ProxyPort = number()
+	case "ProxyUsername":
+		s.ProxyUsername = value
+	case "ProxyPassword":
+		s.ProxyPassword = value
+	case "ProxyTelnetCommand":
+		s.ProxyTelnetCommand = value
+	}
+}
+
+// Forwards returns the port forwardings of the session. Entries pcm can't
+// parse are skipped.
+func (s *Session) Forwards() []types.Forward {
+	var forwards []types.Forward
+	for _, spec := range strings.Split(s.PortForwardings, ",") {
+		// "4" or "6" restrict the address family
+		spec = strings.TrimLeft(strings.TrimSpace(spec), "46")
+		if len(spec) < 2 {
+			continue
+		}
+		listen, target := spec[1:], ""
+		if i := strings.Index(listen, "="); i != -1 {
+			listen, target = listen[:i], listen[i+1:]
+		}
+		switch spec[0] {
+		case 'L':
+			forwards = append(forwards, types.Forward{Type: types.ForwardLocal,
+				Listen: listen, Target: target})
+		case 'R':
+			forwards = append(forwards, types.Forward{Type: types.ForwardRemote,
+				Listen: listen, Target: target})
+		case 'D':
+			forwards = append(forwards, types.Forward{Type: types.ForwardDynamic,
+				Listen: listen})
+		}
+	}
+	return forwards
+}
+
+// Proxy returns the proxy of the session in the form of types.Options.Proxy,
+// "" for none, or an error for proxy types pcm doesn't support.
+func (s *Session) Proxy() (string, error) {
+	var auth string
+	if s.ProxyUsername != "" {
+		auth = url.UserPassword(s.ProxyUsername, s.ProxyPassword).String() + "@"
+	}
+	host := s.ProxyHost + ":" + strconv.Itoa(s.ProxyPort)
+	switch s.ProxyMethod {
+	case ProxyNone:
+		return "", nil
+	case ProxySOCKS5:
+		return "socks5://" + auth + host, nil
+	case ProxyHTTP:
+		return "http://" + auth + host, nil
+	case ProxyCommand:
+		return proxyCommand(s.ProxyTelnetCommand, s), nil
+	case ProxySOCKS4:
+		return "", errors.New("SOCKS 4 proxies are not supported")
+	case ProxyTelnet:
+		return "", errors.New("telnet proxies are not supported")
+	}
+	return "", fmt.Errorf("unknown proxy type %d", s.ProxyMethod)
+}
+
+// proxyCommand converts a proxy command from PuTTY's syntax to the one of
+// types.Options.Proxy, filling in the proxy settings of s.
+func proxyCommand(command string, s *Session) string {
+	return strings.NewReplacer("%%", "%%", "%host", "%h", "%port", "%p",
+		"%proxyhost", s.ProxyHost, "%proxyport", strconv.Itoa(s.ProxyPort),
+		"%user", s.ProxyUsername, "%pass", s.ProxyPassword).Replace(command)
+}
+
+// LoadReg reads the sessions from a registry export, as written by
+// "regedit /e putty.reg HKEY_CURRENT_USER\Software\SimonTatham\PuTTY\Sessions".
+func LoadReg(path string) ([]*Session, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// regedit writes UTF-16 with a byte order mark
+	if bytes.HasPrefix(data, []byte{0xff, 0xfe}) || bytes.HasPrefix(data, []byte{0xfe, 0xff}) {
+		decoder := unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM).NewDecoder()
+		if data, err = decoder.Bytes(data); err != nil {
+			return nil, err
+		}
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	var sessions []*Session
+	var current *Session
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		// long (hex) values are continued on the next line
+		for strings.HasSuffix(line, `\`) && scanner.Scan() {
+			n++
+			line = line[:len(line)-1] + strings.TrimSpace(scanner.Text())
+		}
+		switch {
+		case line == "" || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "["):
+			current = nil
+			key := strings.TrimSuffix(strings.TrimPrefix(line, "["), "]")
+			i := strings.Index(strings.ToLower(key), sessionsKey)
+			if i == -1 {
+				continue
+			}
+			name, err := url.PathUnescape(key[i+len(sessionsKey):])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			current = &Session{Name: name}
+			sessions = append(sessions, current)
+		case current != nil:
+			key, value, err := parseRegValue(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			current.set(key, value)
+		}
+	}
+	return sessions, scanner.Err()
+}
+
+// parseRegValue parses a line like "Name"="text" or "Name"=dword:0000001f.
+// Numbers are returned in decimal.
+func parseRegValue(line string) (string, string, error) {
+	key, rest, err := regString(line)
+	if err != nil {
+		return "", "", err
+	}
+	if !strings.HasPrefix(rest, "=") {
+		return "", "", errors.New("invalid value " + line)
+	}
+	rest = rest[1:]
+	switch {
+	case strings.HasPrefix(rest, `"`):
+		value, _, err := regString(rest)
+		return key, value, err
+	case strings.HasPrefix(rest, "dword:"):
+		n, err := strconv.ParseUint(rest[len("dword:"):], 16, 32)
+		return key, strconv.FormatUint(n, 10), err
+	}
+	// other types, e.g. hex:, are not used by pcm
+	return key, "", nil
+}
+
+// regString parses a quoted string at the start of s, returning it unescaped
+// and the rest of s.
+func regString(s string) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", errors.New("expected a quoted string: " + s)
+	}
+	var out []byte
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				out = append(out, s[i])
+			}
+		case '"':
+			return string(out), s[i+1:], nil
+		default:
+			out = append(out, s[i])
+		}
+	}
+	return "", "", errors.New("unterminated string: " + s)
+}
+
+// LoadDir reads the sessions saved by PuTTY on Unix, one file per session.
+func LoadDir(dir string) ([]*Session, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*Session
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		name, err := url.PathUnescape(f.Name())
+		if err != nil {
+			name = f.Name()
+		}
+		s, err := loadSessionFile(filepath.Join(dir, f.Name()), name)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// loadSessionFile reads a session file, with lines like "Key=Value".
+func loadSessionFile(path, name string) (*Session, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := &Session{Name: name}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "="); i != -1 {
+			s.set(line[:i], line[i+1:])
+		}
+	}
+	return s, scanner.Err()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/asciicast"
+	"github.com/cfstras/pcm/ssh"
+	"github.com/cfstras/pcm/types"
+)
+
+// recordingTerminal writes everything shown on a terminal into a recording.
+type recordingTerminal struct {
+	types.Terminal
+	rec         *asciicast.Writer
+	recordInput bool
+
+	sizeLock      sync.Mutex
+	width, height int
+}
+
+// startRecording creates a recording for conn in dir and removes old ones, so
+// that at most keep are left (if keep is > 0).
+func startRecording(conn *types.Connection, dir string, keep int,
+	t types.Terminal, recordInput bool) (*recordingTerminal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	name := sshAlias(conn.Path()) + "_" + start.Format("2006-01-02_15-04-05") + ".cast"
+	path := filepath.Join(dir, name)
+
+	w, h, err := t.GetSize()
+	if err != nil || w == 0 || h == 0 {
+		w, h = 80, 24
+	}
+	rec, err := asciicast.Create(path, asciicast.Header{
+		Width:  w,
+		Height: h,
+		Title:  conn.Path(),
+		Env:    map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+	})
+	if err != nil {
+		return nil, err
+	}
+	color.Yellowln("Recording to", path)
+	if keep > 0 {
+		if err := asciicast.Prune(dir, keep); err != nil {
+			color.Redln("Removing old recordings:", err)
+		}
+	}
+	return &recordingTerminal{Terminal: t, rec: rec, recordInput: recordInput,
+		width: w, height: h}, nil
+}
+
+func (r *recordingTerminal) Close() {
+	if err := r.rec.Close(); err != nil {
+		color.Redln("Recording:", err)
+	}
+}
+
+func (r *recordingTerminal) GetSize() (width, height int, err error) {
+	width, height, err = r.Terminal.GetSize()
+	if err != nil {
+		return
+	}
+	r.sizeLock.Lock()
+	if width != r.width || height != r.height {
+		r.width, r.height = width, height
+		r.rec.Resize(width, height)
+	}
+	r.sizeLock.Unlock()
+	return
+}
+
+func (r *recordingTerminal) Stdin() io.Reader {
+	if !r.recordInput {
+		return r.Terminal.Stdin()
+	}
+	return io.TeeReader(r.Terminal.Stdin(), recordFunc(r.rec.Input))
+}
+
+// RawStdin is the input for pcm's own prompts, like for passphrases, which is
+// never recorded.
+func (r *recordingTerminal) RawStdin() io.Reader {
+	return ssh.RawStdin(r.Terminal)
+}
+
+func (r *recordingTerminal) Stdout() io.Writer {
+	return io.MultiWriter(r.Terminal.Stdout(), recordFunc(r.rec.Output))
+}
+
+func (r *recordingTerminal) Stderr() io.Writer {
+	return io.MultiWriter(r.Terminal.Stderr(), recordFunc(r.rec.Output))
+}
+
+// recordFunc adapts a recording function to io.Writer
+type recordFunc func(data []byte)
+
+func (f recordFunc) Write(data []byte) (int, error) {
+	f(data)
+	return len(data), nil
+}
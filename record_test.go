@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cfstras/pcm/ssh"
+	"github.com/cfstras/pcm/types"
+)
+
+// pipeTerminal reads input and writes to output
+type pipeTerminal struct {
+	input  io.Reader
+	output bytes.Buffer
+}
+
+func (t *pipeTerminal) GetSize() (int, int, error) { return 80, 24, nil }
+func (t *pipeTerminal) Stdin() io.Reader           { return t.input }
+func (t *pipeTerminal) Stdout() io.Writer          { return &t.output }
+func (t *pipeTerminal) Stderr() io.Writer          { return &t.output }
+func (t *pipeTerminal) ExitRequests() <-chan bool  { return nil }
+func (t *pipeTerminal) Signals() <-chan os.Signal  { return nil }
+func (t *pipeTerminal) MakeRaw()                   {}
+func (t *pipeTerminal) RestoreRaw()                {}
+
+// pcm's own prompts are not recorded, even with the input.
+func TestRecordingPrompts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conn := &types.Connection{}
+	conn.Name, conn.Path_ = "srv", "/test/srv"
+	console := &pipeTerminal{input: strings.NewReader("hunter2\nls\n")}
+	rec, err := startRecording(conn, dir, 0, console, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// like a character set other than UTF-8 for the host
+	terminal := withCharset(rec, "latin1")
+
+	if pass, err := ssh.PasswordPrompt(terminal)("Passphrase: "); err != nil || pass != "hunter2" {
+		t.Fatalf("got %q, %v", pass, err)
+	}
+	// the session's input is recorded
+	line := make([]byte, 3)
+	if _, err := io.ReadFull(terminal.Stdin(), line); err != nil {
+		t.Fatal(err)
+	}
+	rec.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.cast"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("recordings %q, %v", files, err)
+	}
+	cast, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(cast, []byte("hunter2")) {
+		t.Errorf("passphrase recorded:\n%s", cast)
+	}
+	for _, want := range []string{"Passphrase: ", `"i","ls\n"`} {
+		if !bytes.Contains(cast, []byte(want)) {
+			t.Errorf("%q missing in\n%s", want, cast)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/asciicast"
+	"github.com/cfstras/pcm/util"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func init() {
+	subcommands["replay"] = subcommand{
+		usage: "replay [-speed 1] [-idle 2s] file.cast",
+		run:   replay,
+	}
+}
+
+// replay plays a recording. While playing, space pauses, "." steps through
+// a paused recording, "+" and "-" change the speed and q quits.
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := flags.Float64("speed", 1, "playback speed")
+	idle := flags.Duration("idle", 2*time.Second, "shorten pauses to at most this long, 0 to keep them")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *speed <= 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	path := replaceHome(flags.Arg(0))
+	f, err := os.Open(path)
+	p(err, "opening "+path)
+	defer f.Close()
+	rd, err := asciicast.NewReader(f)
+	p(err, "reading "+path)
+
+	started := time.Unix(rd.Header.Timestamp, 0).Format("2006-01-02 15:04:05")
+	color.Yellowln("Replaying", rd.Header.Title, "from", started,
+		"- space: pause, .: step, +/-: speed, q: quit")
+	if w, h, err := terminal.GetSize(int(os.Stdout.Fd())); err == nil &&
+		(w < rd.Header.Width || h < rd.Header.Height) {
+		color.Yellowln(fmt.Sprintf("The recording is %dx%d, this terminal is only %dx%d.",
+			rd.Header.Width, rd.Header.Height, w, h))
+	}
+
+	var keys chan byte
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		state, err := util.SetupTerminal()
+		p(err, "making terminal raw")
+		defer util.RestoreTerminal(state)
+		keys = make(chan byte)
+		go func() {
+			b := make([]byte, 1)
+			for {
+				if _, err := os.Stdin.Read(b); err != nil {
+					close(keys)
+					return
+				}
+				keys <- b[0]
+			}
+		}()
+	}
+
+	last := 0.0
+	paused := false
+	for {
+		e, err := rd.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			color.Redln("\r\nReading", path+":", err, "\r")
+			return
+		}
+		if e.Type != asciicast.Output {
+			continue
+		}
+		delay := time.Duration((e.Time - last) * float64(time.Second))
+		if *idle > 0 && delay > *idle {
+			delay = *idle
+		}
+		last = e.Time
+
+	wait:
+		for delay > 0 || paused {
+			var timer <-chan time.Time
+			if !paused {
+				timer = time.After(time.Duration(float64(delay) / *speed))
+			}
+			waitStart := time.Now()
+			select {
+			case <-timer:
+				break wait
+			case k, ok := <-keys:
+				if !paused {
+					delay -= time.Duration(float64(time.Since(waitStart)) * *speed)
+				}
+				if !ok {
+					keys = nil
+					continue
+				}
+				switch k {
+				case ' ':
+					paused = !paused
+				case '.':
+					if paused {
+						break wait
+					}
+				case '+':
+					*speed *= 2
+				case '-':
+					*speed /= 2
+				case 'q', 'C' & 0x1f:
+					fmt.Print("\r\n")
+					return
+				}
+			}
+		}
+		os.Stdout.WriteString(e.Data)
+	}
+	fmt.Print("\r\n")
+	color.Yellowln("End of recording.\r")
+}
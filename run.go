@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/ssh"
+	"github.com/cfstras/pcm/types"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func init() {
+	subcommands["run"] = subcommand{
+		usage: "run [-j 10] [-timeout 0] [-json] [-y] <search or glob> -- <command>",
+		run:   runCommand,
+	}
+}
+
+// runResult is what happened on one host
+type runResult struct {
+	Path     string  `json:"path"`
+	Host     string  `json:"host"`
+	ExitCode int     `json:"exit_code"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration"`
+	Stdout   *string `json:"stdout,omitempty"`
+	Stderr   *string `json:"stderr,omitempty"`
+}
+
+// runCommand runs a command on all matching connections in parallel.
+func runCommand(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	jobs := flags.Int("j", 10, "number of hosts to run on at the same time")
+	timeout := flags.Duration("timeout", 0, "give up on a host after this long, 0 for no limit")
+	asJSON := flags.Bool("json", false, "print the results as JSON, including the output")
+	yes := flags.Bool("y", false, "don't ask before running")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: pcm", subcommands["run"].usage)
+		flags.PrintDefaults()
+	}
+
+	var command []string
+	for i, a := range args {
+		if a == "--" {
+			args, command = args[:i], args[i+1:]
+			break
+		}
+	}
+	// flags may also come after the search
+	search := parseInterspersed(flags, args)
+	if len(search) != 1 || len(command) == 0 || *jobs < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	conf := loadConfiguration()
+	sshSettings.Config = &conf
+	conns := matchConnections(&conf, search[0])
+	if len(conns) == 0 {
+		color.Redln("Nothing found for", search[0])
+		os.Exit(1)
+	}
+
+	if !*yes && terminal.IsTerminal(int(os.Stdin.Fd())) {
+		color.Yellowln("Running on:")
+		for _, c := range conns {
+			fmt.Fprintln(os.Stderr, " ", c.Path())
+		}
+		color.Yellow(fmt.Sprintf("Run %q on %d hosts [Ny]? ", strings.Join(command, " "), len(conns)))
+		var answer string
+		fmt.Scanln(&answer)
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return
+		}
+	}
+
+	// messages about new host keys etc. stay out of the output
+	results := runOnAll(conns, strings.Join(command, " "), *jobs, *timeout, *asJSON, os.Stderr)
+
+	failed := false
+	for _, r := range results {
+		failed = failed || r.ExitCode != 0
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		p(enc.Encode(results), "writing results")
+	} else {
+		printRunSummary(results)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// matchConnections returns the SSH connections matching search, which is
+// either a glob for paths and names (like "/prod/web*") or a fuzzy search,
+// best matches first.
+func matchConnections(conf *types.Configuration, search string) []*types.Connection {
+	var conns []*types.Connection
+	distances := make(map[*types.Connection]int)
+	if strings.ContainsAny(search, "*?[") {
+		for p, c := range conf.AllConnections() {
+			if globMatch(search, p) || globMatch(search, strings.TrimPrefix(p, "/")) ||
+				globMatch(search, c.Name) {
+				conns = append(conns, c)
+			}
+		}
+	} else {
+		found, _ := filter(conf, search)
+		all := types.ListConnections(conf, true)
+		for word, dist := range found {
+			c := all[word]
+			conns = append(conns, c)
+			distances[c] = dist
+		}
+	}
+
+	result := conns[:0]
+	for _, c := range conns {
+		if c.Info.Protocol == "" || strings.EqualFold(c.Info.Protocol, "ssh") {
+			result = append(result, c)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if distances[result[i]] != distances[result[j]] {
+			return distances[result[i]] < distances[result[j]]
+		}
+		return result[i].Path() < result[j].Path()
+	})
+	return result
+}
+
+func globMatch(pattern, name string) bool {
+	ok, err := path.Match(pattern, name)
+	if err != nil {
+		p(err, "matching "+pattern)
+	}
+	return ok
+}
+
+// runOnAll runs command on conns, at most jobs at a time. Output is printed
+// with the path of the host in front, or collected into the results. Messages
+// about the connections and saving them go to messages, also with the path in
+// front.
+func runOnAll(conns []*types.Connection, command string, jobs int,
+	timeout time.Duration, collect bool, messages io.Writer) []runResult {
+	width := 0
+	for _, c := range conns {
+		if len(c.Path()) > width {
+			width = len(c.Path())
+		}
+	}
+	var outLock, saveLock sync.Mutex
+
+	results := make([]runResult, len(conns))
+	slots := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(r *runResult, c *types.Connection) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			r.Path, r.Host = c.Path(), c.Info.Host
+			prefix := fmt.Sprintf("%-*s | ", width, c.Path())
+			messageLines := &prefixWriter{out: messages, lock: &outLock, prefix: prefix}
+			defer messageLines.Flush()
+			save := func(changed *types.Connection) {
+				saveLock.Lock()
+				defer saveLock.Unlock()
+				saveConnTo(messageLines, sshSettings.Config, changed)
+			}
+			var stdout, stderr io.Writer
+			var stdoutBuf, stderrBuf bytes.Buffer
+			if collect {
+				stdout, stderr = &stdoutBuf, &stderrBuf
+			} else {
+				stdoutLines := &prefixWriter{out: os.Stdout, lock: &outLock, prefix: prefix}
+				stderrLines := &prefixWriter{out: os.Stderr, lock: &outLock, prefix: prefix}
+				defer stdoutLines.Flush()
+				defer stderrLines.Flush()
+				stdout, stderr = stdoutLines, stderrLines
+			}
+
+			ctx := context.Background()
+			if timeout > 0 {
+				var cancel func()
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			start := time.Now()
+			var err error
+			r.ExitCode, err = ssh.Run(ctx, c, sshSettings, command, stdout, stderr,
+				messageLines, save)
+			r.Duration = time.Since(start).Seconds()
+			if err != nil {
+				r.Error = err.Error()
+			}
+			if collect {
+				o, e := stdoutBuf.String(), stderrBuf.String()
+				r.Stdout, r.Stderr = &o, &e
+			}
+		}(&results[i], c)
+	}
+	wg.Wait()
+	return results
+}
+
+func printRunSummary(results []runResult) {
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tEXIT\tTIME\tERROR")
+	for _, r := range results {
+		status := fmt.Sprint(r.ExitCode)
+		if r.Error != "" {
+			status = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.2fs\t%s\n", r.Path, status, r.Duration, r.Error)
+	}
+	w.Flush()
+}
+
+// prefixWriter writes whole lines to out, each starting with prefix.
+type prefixWriter struct {
+	out    io.Writer
+	lock   *sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(data []byte) (int, error) {
+	w.buf = append(w.buf, data...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i == -1 {
+			break
+		}
+		w.writeLine(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+	return len(data), nil
+}
+
+// Flush writes an unfinished last line.
+func (w *prefixWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.writeLine(append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	io.WriteString(w.out, w.prefix)
+	w.out.Write(line)
+}
@@ -0,0 +1,33 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+func init() {
+	Register("exec", helper{})
+}
+
+// helper runs a program which prints the secret: "exec:/path/to/helper args"
+// runs the helper with the arguments, split at spaces, and uses the first line
+// of its output. The helper can ask questions on the terminal itself.
+type helper struct{}
+
+func (helper) Resolve(ref string, ask AskFunc) (string, error) {
+	args := strings.Fields(ref)
+	if len(args) == 0 {
+		return "", errors.New("no helper program given")
+	}
+	cmd := exec.Command(replaceHome(args[0]), args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("running %s: %v", args[0], err)
+	}
+	return firstLine(out), nil
+}
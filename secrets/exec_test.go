@@ -0,0 +1,34 @@
+// +build !windows
+
+package secrets
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestHelper(t *testing.T) {
+	dir := tempDir(t)
+	helper := filepath.Join(dir, "helper")
+	writeScript(t, helper, "#!/bin/sh\nprintf '%s-secret\\r\\nmore\\n' \"$1\"\n")
+
+	if s, err := Resolve("exec:"+helper+" db01", nil); err != nil || s != "db01-secret" {
+		t.Errorf("got %q, %v", s, err)
+	}
+
+	failing := filepath.Join(dir, "failing")
+	writeScript(t, failing, "#!/bin/sh\nexit 1\n")
+	if _, err := Resolve("exec:"+failing, nil); err == nil {
+		t.Error("no error from a failing helper")
+	}
+	if _, err := Resolve("exec:", nil); err == nil {
+		t.Error("no error without a helper")
+	}
+}
+
+func writeScript(t *testing.T, path, script string) {
+	if err := ioutil.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,54 @@
+package secrets
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/cfstras/pcm/keepass"
+)
+
+// How often the master password of a KeePass database is asked for before
+// giving up
+const masterPasswordTries = 3
+
+func init() {
+	Register("keepass", &keePass{databases: make(map[string]*keepass.Database)})
+}
+
+// keePass reads from KeePass databases: "keepass:/path/db.kdbx#Entry" uses the
+// password of the entry with the title, or group path, "Entry". The master
+// password is asked once per database.
+type keePass struct {
+	// opened databases, by path
+	databases map[string]*keepass.Database
+}
+
+func (k *keePass) Resolve(ref string, ask AskFunc) (string, error) {
+	i := strings.Index(ref, "#")
+	if i == -1 {
+		return "", errors.New("missing #entry")
+	}
+	path, name := replaceHome(ref[:i]), ref[i+1:]
+	db := k.databases[path]
+	if db == nil {
+		var err error
+		for try := 0; try < masterPasswordTries; try++ {
+			var password string
+			if password, err = ask("Password for " + path + ": "); err != nil {
+				return "", err
+			}
+			if db, err = keepass.Open(path, []byte(password)); err != keepass.ErrWrongPassword {
+				break
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+		k.databases[path] = db
+	}
+	entry, err := db.Find(name)
+	if err != nil {
+		return "", err
+	}
+	return entry.Fields["Password"], nil
+}
@@ -0,0 +1,54 @@
+package secrets
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeePass(t *testing.T) {
+	path, err := filepath.Abs(filepath.Join("..", "keepass", "testdata", "kdbx4-argon2d.kdbx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prompts int
+	answers := []string{"wrong", "master4"}
+	ask := func(prompt string) (string, error) {
+		if prompts == len(answers) {
+			return "", errors.New("asked too often")
+		}
+		prompts++
+		return answers[prompts-1], nil
+	}
+
+	if s, err := Resolve("keepass:"+path+"#Infra/db01", ask); err != nil || s != "db01-secret" {
+		t.Errorf("got %q, %v", s, err)
+	}
+	// the database stays open
+	if s, err := Resolve("keepass:"+path+"#web & co", ask); err != nil || s != "wéb-pass" {
+		t.Errorf("got %q, %v", s, err)
+	}
+	if prompts != 2 {
+		t.Errorf("asked %d times for the master password, want twice", prompts)
+	}
+	for _, ref := range []string{"keepass:" + path + "#db01", "keepass:" + path} {
+		if _, err := Resolve(ref, ask); err == nil {
+			t.Errorf("%s: no error", ref)
+		}
+	}
+}
+
+func TestKeePassGivesUp(t *testing.T) {
+	path := filepath.Join("..", "keepass", "testdata", "kdbx31-aes.kdbx")
+	prompts := 0
+	ask := func(string) (string, error) {
+		prompts++
+		return "wrong", nil
+	}
+	if _, err := Resolve("keepass:"+path+"#Infra/db01", ask); err == nil {
+		t.Error("no error")
+	}
+	if prompts != masterPasswordTries {
+		t.Errorf("asked %d times, want %d", prompts, masterPasswordTries)
+	}
+}
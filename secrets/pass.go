@@ -0,0 +1,46 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	Register("pass", passwordStore{})
+}
+
+// passwordStore reads from the store of pass, the standard unix password
+// manager: "pass:infra/db01" decrypts infra/db01.gpg in $PASSWORD_STORE_DIR or
+// ~/.password-store with gpg, and uses its first line. gpg asks for the
+// passphrase of its key itself, if its agent does not have it.
+type passwordStore struct{}
+
+func (passwordStore) Resolve(ref string, ask AskFunc) (string, error) {
+	dir := os.Getenv("PASSWORD_STORE_DIR")
+	if dir == "" {
+		dir = replaceHome("~/.password-store")
+	}
+	if ref == "" || strings.Contains("/"+ref+"/", "/../") {
+		return "", errors.New("invalid entry name " + ref)
+	}
+	path := filepath.Join(dir, filepath.FromSlash(ref)+".gpg")
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	gpg := "gpg2"
+	if _, err := exec.LookPath(gpg); err != nil {
+		gpg = "gpg"
+	}
+	cmd := exec.Command(gpg, "--decrypt", "--quiet", "--yes", path)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("decrypting %s: %v", path, err)
+	}
+	return firstLine(out), nil
+}
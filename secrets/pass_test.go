@@ -0,0 +1,51 @@
+// +build !windows
+
+package secrets
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gpg runs gpg with a throwaway home directory
+func gpg(t *testing.T, home string, stdin string, args ...string) {
+	cmd := exec.Command("gpg", append([]string{"--homedir", home, "--batch", "--quiet"},
+		args...)...)
+	cmd.Stdin = strings.NewReader(stdin)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gpg %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+func TestPasswordStore(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	home, store := tempDir(t), tempDir(t)
+	t.Cleanup(func() {
+		cmd := exec.Command("gpgconf", "--kill", "gpg-agent")
+		cmd.Env = append(os.Environ(), "GNUPGHOME="+home)
+		cmd.Run()
+	})
+	gpg(t, home, "", "--passphrase", "", "--quick-generate-key", "pcm-test@example.com",
+		"default", "default", "never")
+	if err := os.MkdirAll(filepath.Join(store, "infra"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	gpg(t, home, "db01-secret\nuser: admin\n", "--encrypt", "--recipient",
+		"pcm-test@example.com", "--output", filepath.Join(store, "infra", "db01.gpg"))
+	t.Setenv("GNUPGHOME", home)
+	t.Setenv("PASSWORD_STORE_DIR", store)
+
+	if s, err := Resolve("pass:infra/db01", nil); err != nil || s != "db01-secret" {
+		t.Errorf("got %q, %v", s, err)
+	}
+	for _, ref := range []string{"pass:infra/missing", "pass:../infra/db01", "pass:"} {
+		if _, err := Resolve(ref, nil); err == nil {
+			t.Errorf("%s: no error", ref)
+		}
+	}
+}
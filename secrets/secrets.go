@@ -0,0 +1,98 @@
+// Package secrets resolves passwords kept outside of connections.xml. A
+// password like "pass:infra/db01" is a reference, resolved by the resolver
+// registered for its scheme when the connection is opened. Resolved secrets
+// are kept in memory for the rest of the session, and never saved.
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// AskFunc asks the user for a secret, like the master password of a
+// database.
+type AskFunc func(prompt string) (string, error)
+
+// A Resolver looks up the secret a reference points to. ref is the reference
+// without its scheme.
+type Resolver interface {
+	Resolve(ref string, ask AskFunc) (string, error)
+}
+
+var (
+	mu        sync.Mutex
+	resolvers = make(map[string]Resolver)
+	// by reference
+	resolved = make(map[string]string)
+)
+
+// Register makes references starting with "<scheme>:" resolve with r.
+func Register(scheme string, r Resolver) {
+	mu.Lock()
+	defer mu.Unlock()
+	resolvers[scheme] = r
+}
+
+func split(s string) (scheme, ref string, ok bool) {
+	i := strings.Index(s, ":")
+	if i == -1 {
+		return "", "", false
+	}
+	scheme, ref = s[:i], s[i+1:]
+	_, ok = resolvers[scheme]
+	return scheme, ref, ok
+}
+
+// IsReference returns whether s refers to a secret elsewhere.
+func IsReference(s string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, _, ok := split(s)
+	return ok
+}
+
+// Resolve returns the secret s refers to, or s itself if it is no reference.
+// ask is used if the resolver needs to ask something, and may be nil if
+// nobody can be asked.
+func Resolve(s string, ask AskFunc) (string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	scheme, ref, ok := split(s)
+	if !ok {
+		return s, nil
+	}
+	if secret, ok := resolved[s]; ok {
+		return secret, nil
+	}
+	if ask == nil {
+		ask = func(string) (string, error) {
+			return "", errors.New("no terminal to ask on")
+		}
+	}
+	secret, err := resolvers[scheme].Resolve(ref, ask)
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %v", s, err)
+	}
+	resolved[s] = secret
+	return secret, nil
+}
+
+// firstLine returns the first line of the output of a program.
+func firstLine(out []byte) string {
+	line := strings.SplitN(string(out), "\n", 2)[0]
+	return strings.TrimSuffix(line, "\r")
+}
+
+func replaceHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home := os.Getenv("HOME")
+		if home == "" {
+			home = os.Getenv("USERPROFILE")
+		}
+		return home + path[1:]
+	}
+	return path
+}
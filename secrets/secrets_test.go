@@ -0,0 +1,51 @@
+package secrets
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "pcm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// counter resolves "count:<ref>" to ref, counting how often it was asked
+type counter struct{ calls int }
+
+func (c *counter) Resolve(ref string, ask AskFunc) (string, error) {
+	c.calls++
+	if ref == "fail" {
+		return "", errors.New("failed")
+	}
+	return ref, nil
+}
+
+func TestResolve(t *testing.T) {
+	c := &counter{}
+	Register("count", c)
+
+	if IsReference("plain:password") || !IsReference("count:x") {
+		t.Error("IsReference only knows registered schemes")
+	}
+	if s, err := Resolve("no reference", nil); err != nil || s != "no reference" {
+		t.Errorf("got %q, %v", s, err)
+	}
+	for i := 0; i < 2; i++ {
+		if s, err := Resolve("count:secret", nil); err != nil || s != "secret" {
+			t.Errorf("got %q, %v", s, err)
+		}
+	}
+	if c.calls != 1 {
+		t.Errorf("resolved %d times, want once", c.calls)
+	}
+	if _, err := Resolve("count:fail", nil); err == nil {
+		t.Error("no error")
+	}
+}
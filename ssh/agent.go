@@ -0,0 +1,357 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// How long a confirmation question waits for an answer before the use of the
+// key is refused
+const agentConfirmTimeout = time.Minute
+
+var (
+	errAgentLocked   = errors.New("agent: locked")
+	errAgentNotFound = errors.New("agent: key not found")
+	errAgentRefused  = errors.New("agent: use of key refused")
+)
+
+// ownAgent holds the keys pcm loaded itself, for all connections of this
+// process. It is used when no SSH agent is running.
+var ownAgent = &keyAgent{}
+
+// keyAgent is an SSH agent keeping its keys in memory only. Keys can expire
+// and can require a confirmation before each use, like with "ssh-add -t" and
+// "ssh-add -c".
+type keyAgent struct {
+	mu         sync.Mutex
+	keys       []*agentKey
+	locked     bool
+	passphrase []byte
+}
+
+type agentKey struct {
+	signer  ssh.Signer
+	comment string
+	// zero if the key does not expire
+	expires time.Time
+	confirm bool
+}
+
+// add puts a key into the agent, replacing it if it is there already. With a
+// lifetime of 0, it is kept until pcm exits.
+func (a *keyAgent) add(signer ssh.Signer, comment string, lifetime time.Duration, confirm bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.remove(signer.PublicKey())
+	k := &agentKey{signer: signer, comment: comment, confirm: confirm}
+	if lifetime > 0 {
+		k.expires = time.Now().Add(lifetime)
+	}
+	a.keys = append(a.keys, k)
+}
+
+// has returns whether the agent can use pub.
+func (a *keyAgent) has(pub ssh.PublicKey) bool {
+	return a.find(pub) != nil
+}
+
+func (a *keyAgent) find(pub ssh.PublicKey) *agentKey {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	blob := pub.Marshal()
+	for _, k := range a.current() {
+		if bytes.Equal(k.signer.PublicKey().Marshal(), blob) {
+			return k
+		}
+	}
+	return nil
+}
+
+// current drops the expired keys and returns the others, or none while the
+// agent is locked. a.mu must be held.
+func (a *keyAgent) current() []*agentKey {
+	now := time.Now()
+	var kept []*agentKey
+	for _, k := range a.keys {
+		if k.expires.IsZero() || now.Before(k.expires) {
+			kept = append(kept, k)
+		}
+	}
+	a.keys = kept
+	if a.locked {
+		return nil
+	}
+	return kept
+}
+
+// remove drops the keys for pub and returns whether there were any. a.mu must
+// be held.
+func (a *keyAgent) remove(pub ssh.PublicKey) bool {
+	blob := pub.Marshal()
+	var kept []*agentKey
+	for _, k := range a.keys {
+		if !bytes.Equal(k.signer.PublicKey().Marshal(), blob) {
+			kept = append(kept, k)
+		}
+	}
+	found := len(kept) != len(a.keys)
+	a.keys = kept
+	return found
+}
+
+func (a *keyAgent) List() ([]*agent.Key, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var list []*agent.Key
+	for _, k := range a.current() {
+		pub := k.signer.PublicKey()
+		list = append(list, &agent.Key{Format: pub.Type(), Blob: pub.Marshal(),
+			Comment: k.comment})
+	}
+	return list, nil
+}
+
+func (a *keyAgent) Add(key agent.AddedKey) error {
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if key.Certificate != nil {
+		if signer, err = ssh.NewCertSigner(key.Certificate, signer); err != nil {
+			return err
+		}
+	}
+	a.add(signer, key.Comment, time.Duration(key.LifetimeSecs)*time.Second,
+		key.ConfirmBeforeUse)
+	return nil
+}
+
+func (a *keyAgent) Remove(pub ssh.PublicKey) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return errAgentLocked
+	}
+	if !a.remove(pub) {
+		return errAgentNotFound
+	}
+	return nil
+}
+
+func (a *keyAgent) RemoveAll() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return errAgentLocked
+	}
+	a.keys = nil
+	return nil
+}
+
+func (a *keyAgent) Lock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return errAgentLocked
+	}
+	a.locked, a.passphrase = true, passphrase
+	return nil
+}
+
+func (a *keyAgent) Unlock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.locked {
+		return errors.New("agent: not locked")
+	}
+	if subtle.ConstantTimeCompare(passphrase, a.passphrase) != 1 {
+		return errors.New("agent: incorrect passphrase")
+	}
+	a.locked, a.passphrase = false, nil
+	return nil
+}
+
+// sessionAgent is the agent as one connection sees it: for its own logins,
+// forwarded to the host and on the agent socket. Keys that need a
+// confirmation are asked for on the connection's terminal.
+type sessionAgent struct {
+	*keyAgent
+	host string
+	ask  func(prompt string) bool
+}
+
+func (a *sessionAgent) Sign(pub ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	k := a.find(pub)
+	if k == nil {
+		return nil, errAgentNotFound
+	}
+	return a.sign(k, data)
+}
+
+func (a *sessionAgent) sign(k *agentKey, data []byte) (*ssh.Signature, error) {
+	if k.confirm && !a.ask(fmt.Sprintf("Allow use of key %s for %s [Ny]? ",
+		k.comment, a.host)) {
+		return nil, errAgentRefused
+	}
+	return k.signer.Sign(rand.Reader, data)
+}
+
+func (a *sessionAgent) Signers() ([]ssh.Signer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var signers []ssh.Signer
+	for _, k := range a.current() {
+		signers = append(signers, &agentSigner{a, k})
+	}
+	return signers, nil
+}
+
+// agentSigner signs with a key of pcm's own agent, asking first if needed.
+type agentSigner struct {
+	agent *sessionAgent
+	key   *agentKey
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.key.signer.PublicKey()
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.agent.sign(s.key, data)
+}
+
+// openAgent connects to the SSH agent at SSH_AUTH_SOCK, or uses pcm's own if
+// none is running.
+func (inst *instance) openAgent() {
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err == nil {
+			inst.agent = agent.NewClient(conn)
+			return
+		}
+		if !inst.settings.Batch {
+			inst.yellowln("Warning: no SSH-agent found, using pcm's own.\r")
+		}
+	}
+	inst.agent = &sessionAgent{keyAgent: ownAgent, host: inst.conn.Info.Name,
+		ask: inst.confirm}
+	inst.ownAgent = true
+}
+
+// addToAgent keeps a key that was used for a login in pcm's own agent, so it
+// can be forwarded and does not have to be unlocked again. The key file
+// forgets the decrypted key, so the passphrase is asked for again once the key
+// expired in the agent.
+func (inst *instance) addToAgent(k *keyFile) {
+	if !inst.ownAgent || ownAgent.has(k.pub) {
+		return
+	}
+	ownAgent.add(k.signer, k.path, inst.settings.AgentLifetime, inst.settings.AgentConfirm)
+	if k.decrypt != nil {
+		k.signer = nil
+	}
+}
+
+// loadAgent adds the keys that need no passphrase to pcm's own agent, before
+// forwarding it.
+func (inst *instance) loadAgent() {
+	for _, k := range inst.keys {
+		if k != nil && k.signer != nil {
+			inst.addToAgent(k)
+		}
+	}
+}
+
+// serveAgent exposes pcm's own agent on a unix socket in a private directory
+// until stop is called. The programs pcm starts get it in SSH_AUTH_SOCK; pcm's
+// own environment stays as it is.
+func (inst *instance) serveAgent() (stop func(), err error) {
+	dir, err := ioutil.TempDir("", "pcm-agent")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("agent.%d", os.Getpid()))
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(inst.agent, c)
+				c.Close()
+			}()
+		}
+	}()
+	inst.agentSocket = path
+	inst.yellowln("SSH agent socket:", path, "\r")
+	return func() {
+		inst.agentSocket = ""
+		listener.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// commandEnv returns the environment for programs pcm starts, nil for pcm's
+// own.
+func (inst *instance) commandEnv() []string {
+	if inst.agentSocket == "" {
+		return nil
+	}
+	return append(os.Environ(), "SSH_AUTH_SOCK="+inst.agentSocket)
+}
+
+// confirm asks a yes/no question. Once the session runs, the input loop
+// reads the answer; before that, it is read from the terminal directly.
+func (inst *instance) confirm(prompt string) bool {
+	if inst.settings.Batch {
+		return false
+	}
+	inst.asking.Lock()
+	defer inst.asking.Unlock()
+	yes := func(answer string) bool {
+		answer = strings.TrimSpace(strings.ToLower(answer))
+		return answer == "y" || answer == "yes"
+	}
+	if !inst.inputStarted.IsSet() {
+		answer, err := readAnswer(inst.terminal, prompt)
+		fmt.Fprint(inst.terminal.Stderr(), "\r\n")
+		return err == nil && yes(answer)
+	}
+
+	fmt.Fprint(inst.terminal.Stderr(), "\r\n"+prompt)
+	answers := make(chan string, 1)
+	inst.questions <- func(answer string) {
+		answers <- answer
+	}
+	select {
+	case answer := <-answers:
+		return yes(answer)
+	case <-time.After(agentConfirmTimeout):
+		select {
+		case <-inst.questions:
+		default:
+		}
+		fmt.Fprint(inst.terminal.Stderr(), "\r\n")
+		return false
+	}
+}
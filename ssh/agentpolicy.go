@@ -0,0 +1,139 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/types"
+)
+
+var errAgentRestricted = errors.New("agent: not allowed for forwarded agents")
+
+// restrictedAgent is the forwarded agent of a connection with a forwarding
+// policy. The host only sees the allowed keys and can't change the agent.
+type restrictedAgent struct {
+	inner  agent.Agent
+	policy *types.AgentPolicy
+	host   string
+	ask    func(prompt string) bool
+
+	mu   sync.Mutex
+	uses int
+}
+
+func (a *restrictedAgent) allowed(key *agent.Key) bool {
+	if len(a.policy.Keys) == 0 {
+		return true
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+	for _, k := range a.policy.Keys {
+		if k == fingerprint || k == key.Comment {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *restrictedAgent) List() ([]*agent.Key, error) {
+	keys, err := a.inner.List()
+	if err != nil {
+		return nil, err
+	}
+	var allowed []*agent.Key
+	for _, k := range keys {
+		if a.allowed(k) {
+			allowed = append(allowed, k)
+		}
+	}
+	return allowed, nil
+}
+
+func (a *restrictedAgent) Sign(pub ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	keys, err := a.List()
+	if err != nil {
+		return nil, err
+	}
+	var key *agent.Key
+	blob := pub.Marshal()
+	for _, k := range keys {
+		if bytes.Equal(k.Blob, blob) {
+			key = k
+		}
+	}
+	sig, err := a.sign(key, pub, data)
+	a.log(pub, key, err)
+	return sig, err
+}
+
+func (a *restrictedAgent) sign(key *agent.Key, pub ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	if key == nil {
+		return nil, errAgentNotFound
+	}
+	if a.policy.MaxUses > 0 && a.uses >= a.policy.MaxUses {
+		return nil, fmt.Errorf("agent: key used %d times already", a.uses)
+	}
+	if a.policy.Confirm && !a.ask(fmt.Sprintf("Allow use of key %s for %s [Ny]? ",
+		key.Comment, a.host)) {
+		return nil, errAgentRefused
+	}
+	a.uses++
+	return a.inner.Sign(pub, data)
+}
+
+// log appends a line about a signature request to the policy's log file.
+func (a *restrictedAgent) log(pub ssh.PublicKey, key *agent.Key, err error) {
+	if a.policy.Log == "" {
+		return
+	}
+	result := "signed"
+	if err != nil {
+		result = "refused: " + err.Error()
+	}
+	comment := ""
+	if key != nil {
+		comment = key.Comment
+	}
+	f, ferr := os.OpenFile(replaceHome(a.policy.Log),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if ferr != nil {
+		color.Yellowln("Warning: could not log agent use:", ferr, "\r")
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s %s %s %q %s\n", time.Now().Format(time.RFC3339), a.host,
+		ssh.FingerprintSHA256(pub), comment, result)
+}
+
+func (a *restrictedAgent) Signers() ([]ssh.Signer, error) {
+	return nil, errAgentRestricted
+}
+
+func (a *restrictedAgent) Add(key agent.AddedKey) error {
+	return errAgentRestricted
+}
+
+func (a *restrictedAgent) Remove(key ssh.PublicKey) error {
+	return errAgentRestricted
+}
+
+func (a *restrictedAgent) RemoveAll() error {
+	return errAgentRestricted
+}
+
+func (a *restrictedAgent) Lock(passphrase []byte) error {
+	return errAgentRestricted
+}
+
+func (a *restrictedAgent) Unlock(passphrase []byte) error {
+	return errAgentRestricted
+}
@@ -21,6 +21,7 @@ import (
 
 	context2 "context"
 
+	ct "github.com/daviddengcn/go-colortext"
 	"github.com/tevino/abool"
 
 	"github.com/cfstras/go-utils/color"
@@ -30,8 +31,31 @@ import (
 
 type answerHandler func(answer string)
 
+// Settings that apply to all connections, usually from command line flags
+type Settings struct {
+	AgentForwarding bool
+	// Identity files tried for every connection, after the connection's own.
+	// If empty, the OpenSSH defaults (~/.ssh/id_rsa etc.) are used.
+	IdentityFiles []string
+	// The tree jump hosts and proxies are looked up in
+	Config *types.Configuration
+	// Proxy for connections that have none, see types.Options.Proxy
+	Proxy string
+	// Only set up the port forwardings, without starting a shell
+	NoShell bool
+	// Never ask on the terminal, fail instead, and don't report which keys
+	// are used. For running commands on many hosts at once.
+	Batch bool
+	// For keys pcm's own SSH agent loads: how long to keep them (0 until pcm
+	// exits), and whether to ask before each use
+	AgentLifetime time.Duration
+	AgentConfirm  bool
+	// Expose pcm's own SSH agent on a unix socket while connected
+	AgentSocket bool
+}
+
 type instance struct {
-	agentForwarding bool
+	settings Settings
 
 	terminal types.Terminal
 	conn     *types.Connection
@@ -39,33 +63,68 @@ type instance struct {
 	// input
 	questions   chan answerHandler
 	saveChanges func(*types.Connection)
+	// key files, by path
+	keys map[string]*keyFile
+	// the SSH agent at SSH_AUTH_SOCK, or pcm's own
+	agent    agent.Agent
+	ownAgent bool
+	// the socket of pcm's own agent, for the programs pcm starts
+	agentSocket string
+	// asking serializes questions; once inputStarted, they are answered
+	// through the input loop
+	asking       sync.Mutex
+	inputStarted *abool.AtomicBool
+
+	forwards forwards
+	escapes  *escapeFilter
+	client   *ssh.Client
 
 	session *ssh.Session
 	changed bool
+	// exit status of the remote command or shell, 255 if there is none, like
+	// OpenSSH
+	exitStatus int
 
 	exitChan      chan bool
 	exitRequested *abool.AtomicBool
 }
 
-func Connect(conn *types.Connection, agentForwarding bool, terminal types.Terminal,
-	moreCommands func() *string, saveChanges func(*types.Connection)) bool {
+// Connect opens an interactive session to conn on terminal. It returns whether
+// conn was changed, e.g. by storing a new host key, and the exit status of the
+// session.
+func Connect(conn *types.Connection, settings Settings, terminal types.Terminal,
+	moreCommands func() *string, saveChanges func(*types.Connection)) (bool, int) {
+	inst := newInstance(conn, settings, terminal, saveChanges)
+	changed := inst.connect(moreCommands)
+	return changed, inst.exitStatus
+}
 
+func newInstance(conn *types.Connection, settings Settings, terminal types.Terminal,
+	saveChanges func(*types.Connection)) *instance {
 	inst := &instance{
-		agentForwarding: agentForwarding,
+		settings: settings,
 
 		terminal: terminal, conn: conn,
 		questions:   make(chan answerHandler, 1),
 		saveChanges: saveChanges,
+		keys:        make(map[string]*keyFile),
+
+		exitStatus: 255,
 
+		inputStarted:  abool.New(),
 		exitChan:      make(chan bool, 1),
 		exitRequested: abool.New(),
 	}
-	return inst.connect(moreCommands)
+	inst.openAgent()
+	return inst
 }
 
 type detectingSigner struct {
 	inner   ssh.Signer
 	didSign bool
+	// name to report, for keys not coming from the agent
+	name  string
+	quiet bool
 }
 
 func (s *detectingSigner) PublicKey() ssh.PublicKey {
@@ -73,6 +132,9 @@ func (s *detectingSigner) PublicKey() ssh.PublicKey {
 }
 
 func (s *detectingSigner) Filename() string {
+	if s.name != "" {
+		return s.name
+	}
 	asString := fmt.Sprintf(" %s", s.PublicKey())
 	split := strings.SplitN(asString, " ", 4)
 	if len(split) == 4 {
@@ -83,39 +145,76 @@ func (s *detectingSigner) Filename() string {
 }
 func (s *detectingSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
 	s.didSign = true
-	color.Greenln("Key used:", s.Filename(), "\r")
+	if !s.quiet {
+		color.Greenln("Key used:", s.Filename(), "\r")
+	}
 	return s.inner.Sign(rand, data)
 }
 
-func (inst *instance) openAgentSocket(sock string) (ssh.AuthMethod, *[]*detectingSigner) {
+// publicKeyAuth offers the keys from the SSH agent, followed by the given
+// identity files which are not in the agent. The go client only tries one
+// publickey method, so all keys have to be returned by the same callback.
+func (inst *instance) publicKeyAuth(files []*detectingSigner) (ssh.AuthMethod, *[]*detectingSigner) {
 	var wrappedSigners *[]*detectingSigner
 	wrappedSigners = &[]*detectingSigner{}
-	if sshAgent, err := net.Dial("unix", sock); err == nil {
-		return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
-			if inst.exitRequested.IsSet() {
-				return nil, errors.New("Exit")
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		if inst.exitRequested.IsSet() {
+			return nil, errors.New("Exit")
+		}
+		signers, err := inst.agent.Signers()
+		if err != nil {
+			return nil, err
+		}
+		if len(signers) == 0 && !inst.ownAgent {
+			inst.redln("Warning: no SSH keys in agent.")
+		}
+		keys := ""
+		inAgent := make(map[string]bool)
+		for i, s := range signers {
+			if keys != "" {
+				keys += "; "
 			}
-			signers, err := agent.NewClient(sshAgent).Signers()
-			if len(signers) == 0 {
-				color.Redln("Warning: no SSH keys in agent.")
-			} else {
-				keys := ""
-				for i, s := range signers {
-					if keys != "" {
-						keys += "; "
-					}
-					ws := &detectingSigner{s, false}
-					keys += ws.Filename()
-					*wrappedSigners = append(*wrappedSigners, ws)
-					signers[i] = ws // replace in interface list
-				}
-				color.Yellowln("SSH keys registered:", keys, "\r")
+			ws := &detectingSigner{inner: s, quiet: inst.settings.Batch}
+			if s, ok := s.(*agentSigner); ok {
+				ws.name = s.key.comment
+			}
+			keys += ws.Filename()
+			inAgent[string(s.PublicKey().Marshal())] = true
+			*wrappedSigners = append(*wrappedSigners, ws)
+			signers[i] = ws // replace in interface list
+		}
+		for _, ws := range files {
+			if inAgent[string(ws.PublicKey().Marshal())] {
+				continue
 			}
-			return signers, err
-		}), wrappedSigners
+			if keys != "" {
+				keys += "; "
+			}
+			keys += ws.Filename()
+			ws.quiet = inst.settings.Batch
+			*wrappedSigners = append(*wrappedSigners, ws)
+			signers = append(signers, ws)
+		}
+		if keys != "" && !inst.settings.Batch {
+			inst.yellowln("SSH keys registered:", keys, "\r")
+		}
+		return signers, nil
+	}), wrappedSigners
+}
+
+// yellowln, redln and greenln print a message in color, or without color and
+// line ends for a raw terminal to the stderr of the terminal in batch mode.
+func (inst *instance) yellowln(msg ...interface{}) { inst.colorln(ct.Yellow, msg...) }
+func (inst *instance) redln(msg ...interface{})    { inst.colorln(ct.Red, msg...) }
+func (inst *instance) greenln(msg ...interface{})  { inst.colorln(ct.Green, msg...) }
+
+func (inst *instance) colorln(c ct.Color, msg ...interface{}) {
+	if inst.settings.Batch {
+		line := strings.Replace(fmt.Sprintln(msg...), "\r", "", -1)
+		io.WriteString(inst.terminal.Stderr(), strings.TrimSpace(line)+"\n")
+		return
 	}
-	color.Yellowln("Warning: no SSH-agent found.")
-	return nil, nil
+	color.Colorln(c, msg...)
 }
 
 func (inst *instance) exit() {
@@ -124,23 +223,19 @@ func (inst *instance) exit() {
 }
 
 func (inst *instance) connect(moreCommands func() *string) bool {
-	config := &ssh.ClientConfig{
-		User:            inst.conn.Login.User,
-		Auth:            []ssh.AuthMethod{ssh.Password(inst.conn.Login.Password)},
-		HostKeyCallback: inst.hostKeyCallback,
-		Timeout:         20 * time.Second,
-	}
-	var detectingSigners *[]*detectingSigner
-	sock := os.Getenv("SSH_AUTH_SOCK")
-	if sock != "" {
-		agentAuth, signers := inst.openAgentSocket(sock)
-		if agentAuth != nil && signers != nil {
-			config.Auth = append(config.Auth, agentAuth)
-			detectingSigners = signers
+	if inst.settings.AgentSocket && inst.ownAgent {
+		stop, err := inst.serveAgent()
+		if err != nil {
+			inst.yellowln("Warning: could not open the agent socket:", err, "\r")
+		} else {
+			defer stop()
 		}
-	} else {
-		color.Redln("Warning: no SSH agent running.\r")
 	}
+	escapeChar, err := parseEscapeChar(inst.conn.Options.EscapeChar)
+	if err != nil {
+		inst.yellowln("Warning:", err, "\r")
+	}
+	inst.escapes = newEscapeFilter(escapeChar)
 
 	go func() {
 		for range inst.terminal.ExitRequests() {
@@ -151,14 +246,15 @@ func (inst *instance) connect(moreCommands func() *string) bool {
 	tcpConnected := abool.New()
 	signalWatcher := func(cancelFunc func()) {
 		for s := range inst.terminal.Signals() {
-			if !tcpConnected.IsSet() && (s == syscall.SIGINT || s == syscall.SIGTERM) {
-				color.Yellowln("Ctrl+C!")
+			if (!tcpConnected.IsSet() || inst.settings.NoShell) &&
+				(s == syscall.SIGINT || s == syscall.SIGTERM) {
+				inst.yellowln("Ctrl+C!")
 				cancelFunc()
 				inst.exit()
 			}
 			sshSignal, ok := signalMap[s]
 			if !ok {
-				color.Yellowln("Unknown signal", s)
+				inst.yellowln("Unknown signal", s)
 			} else if sshSignal != "" && inst.session != nil {
 				inst.session.Signal(sshSignal)
 			}
@@ -170,25 +266,18 @@ func (inst *instance) connect(moreCommands func() *string) bool {
 		}
 	}
 
-	addr := fmt.Sprint(inst.conn.Info.Host, ":", inst.conn.Info.Port)
-	d := net.Dialer{Timeout: config.Timeout}
 	context, cancel := context2.WithCancel(context2.Background())
 	go signalWatcher(cancel)
 
-	sshTCPconn, err := d.DialContext(context, "tcp", addr)
+	client, detectingSigners, err := inst.dial(context, inst.conn)
 	if err != nil {
-		color.Redln("Dialing to", addr, ":", err, "\r")
-		return inst.changed
-	}
-	if inst.exitRequested.IsSet() {
-		return inst.changed
-	}
-	c, sshChans, sshReqs, err := ssh.NewClientConn(sshTCPconn, addr, config)
-	if err != nil {
-		color.Redln("Opening SSH connection to", addr, ":", err, "\r")
+		if err != errExit {
+			inst.redln(err, "\r")
+		}
 		return inst.changed
 	}
-	client := ssh.NewClient(c, sshChans, sshReqs)
+	defer client.Close()
+	inst.client = client
 
 	if inst.exitRequested.IsSet() {
 		return inst.changed
@@ -196,15 +285,46 @@ func (inst *instance) connect(moreCommands func() *string) bool {
 
 	tcpConnected.Set()
 
-	if inst.agentForwarding && sock != "" { // agent forwarding
-		agent.ForwardToRemote(client, sock)
+	policy := inst.conn.Options.AgentForwarding
+	forwardAgent := inst.settings.AgentForwarding || policy != nil
+	if forwardAgent {
+		if inst.ownAgent {
+			inst.loadAgent()
+		}
+		switch {
+		case policy != nil:
+			agent.ForwardToAgent(client, &restrictedAgent{inner: inst.agent,
+				policy: policy, host: inst.conn.Info.Name, ask: inst.confirm})
+		case inst.ownAgent:
+			agent.ForwardToAgent(client, inst.agent)
+		default:
+			agent.ForwardToRemote(client, os.Getenv("SSH_AUTH_SOCK"))
+		}
+	}
+
+	forwarding := inst.startForwards(client, inst.conn.Options.Forwards)
+	defer inst.stopForwards()
+	if inst.settings.NoShell {
+		if !forwarding {
+			inst.redln("No port forwardings, exiting.\r")
+			return inst.changed
+		}
+		go func() {
+			client.Wait()
+			inst.redln("Connection closed.")
+			inst.exit()
+		}()
+		inst.yellowln("Forwarding ports, press Ctrl+C to stop.")
+		<-inst.exitChan
+		inst.exitStatus = 0
+		return inst.changed
 	}
 
 	// Each ClientConn can support multiple interactive sessions,
 	// represented by a Session.
 	inst.session, err = client.NewSession()
 	if err != nil {
-		color.Redln("Failed to create session:", err)
+		inst.redln("Failed to create session:", err)
 		return inst.changed
 	}
 	defer func() {
@@ -213,9 +333,20 @@ func (inst *instance) connect(moreCommands func() *string) bool {
 		session.Close()
 	}()
 
-	if inst.agentForwarding {
+	if forwardAgent {
 		agent.RequestAgentForwarding(inst.session)
 	}
+	if inst.conn.Options.X11 != "" {
+		if err := inst.requestX11(client, inst.session); err != nil {
+			inst.yellowln("X11 forwarding failed:", err, "\r")
+		}
+	}
+
+	for _, e := range inst.conn.Options.Env {
+		if err := inst.session.Setenv(e.Name, e.Value); err != nil {
+			inst.yellowln("The host did not accept", e.Name+":", err, "\r")
+		}
+	}
 
 	// Set up terminal modes
 	modes := ssh.TerminalModes{
@@ -225,8 +356,8 @@ func (inst *instance) connect(moreCommands func() *string) bool {
 	}
 
 	procExit := abool.New()
-	shellOutFunc := func(stdErrOut io.Reader, stdin io.Writer, name string, nextCommand func() *string,
-		startWait *sync.Cond) {
+	remoteClosed := abool.New()
+	shellOutFunc := func(stdErrOut io.Reader, name string, script *util.ScriptRunner) {
 		buf := make([]byte, 1024)
 		for {
 			if procExit.IsSet() {
@@ -234,7 +365,9 @@ func (inst *instance) connect(moreCommands func() *string) bool {
 			}
 			n, err := stdErrOut.Read(buf)
 			if err != nil {
+				script.Stop()
 				if err == io.EOF {
+					remoteClosed.Set()
 					inst.exit()
 					return
 				}
@@ -252,31 +385,20 @@ func (inst *instance) connect(moreCommands func() *string) bool {
 				fmt.Fprintln(inst.terminal.Stderr(), "ssh", name, "error", err)
 				return
 			}
-			//fmt.Fprint(inst.terminal.Stderr(), str)
-
-			str := string(buf[:n])
-			if strings.HasSuffix(str, "assword: ") || strings.HasSuffix(str, "$ ") ||
-				strings.HasSuffix(str, "# ") {
-				if answer := nextCommand(); answer != nil {
-					//fmt.Println("\r\n--- Got", str[len(str)-4:],
-					//	"- writing next cmd", *answer, "---\r")
-					//TODO wait for this to be sent
-					stdin.Write([]byte(*answer))
-					stdin.Write([]byte("\n"))
-				}
-			}
-
+			script.Output(buf[:n])
 		}
 	}
-	inFunc := func(sshStdin io.WriteCloser, startWait *sync.Cond) {
+	inFunc := func(sshStdin io.WriteCloser, script *util.ScriptRunner) {
 		inputBufChan := make(chan []byte, 32)
 		buffers := &sync.Pool{
 			New: func() interface{} { return make([]byte, 1024) },
 		}
 
+		inst.inputStarted.Set()
 		go func() {
 			writeRightNow := make([]byte, 0, 3)
-			var lastChars [3]byte
+			var question answerHandler
+			var answer []byte
 			for {
 				buf := buffers.Get().([]byte)
 				n, err := inst.terminal.Stdin().Read(buf)
@@ -285,57 +407,63 @@ func (inst *instance) connect(moreCommands func() *string) bool {
 				if err != nil && err != io.EOF {
 					fmt.Fprintln(inst.terminal.Stdout(), "my stdin got error", err)
 					inputBufChan <- nil
-					startWait.Broadcast()
+					script.Stop()
 					return
 				}
 				writeRightNow = writeRightNow[:0]
 				if err == io.EOF {
 					writeRightNow = append(writeRightNow, 'D'&0x1f)
 					inputBufChan <- nil
-					startWait.Broadcast()
+					script.Stop()
 					return
 				}
-				// ctrl+c, ctrl+d, ctrl+z
-				for _, c := range []byte{'C' & 0x1f, 'D' & 0x1f, 'Z' & 0x1f} {
-					if bytes.Contains(buf, []byte{c}) {
-						writeRightNow = append(writeRightNow, c)
+
+				// handle questions: the next line typed is the answer
+				if question == nil {
+					select {
+					case question = <-inst.questions:
+					default:
 					}
 				}
-
-				for i := len(buf) - 3; i < len(buf); i++ {
-					if i < 0 {
-						continue
+				for len(buf) > 0 && question != nil {
+					c := buf[0]
+					buf = buf[1:]
+					switch c {
+					case '\r', '\n', 'C' & 0x1f:
+						if c == 'C'&0x1f {
+							answer = answer[:0]
+						}
+						fmt.Fprint(inst.terminal.Stderr(), "\r\n")
+						question(string(answer))
+						question, answer = nil, nil
+					case 0x7f, '\b':
+						if len(answer) > 0 {
+							answer = answer[:len(answer)-1]
+							fmt.Fprint(inst.terminal.Stderr(), "\b \b")
+						}
+					default:
+						if c >= 0x20 {
+							answer = append(answer, c)
+							inst.terminal.Stderr().Write([]byte{c})
+						}
 					}
-					lastChars[0], lastChars[1], lastChars[2] = lastChars[1],
-						lastChars[2], buf[i]
 				}
-				if lastChars == [3]byte{'\r', '~', '.'} ||
-					lastChars == [3]byte{'C' & 0x1f, '~', '.'} ||
-					lastChars == [3]byte{'Z' & 0x1f, '~', '.'} {
-
-					color.Redln("\r\nGot ~C... aborting.\r")
+				if len(buf) == 0 {
+					continue
+				}
+				var quit bool
+				if buf, quit = inst.escapes.filter(buf, inst.escapeCommand); quit {
 					inputBufChan <- nil
-					startWait.Broadcast()
+					script.Stop()
 					return
 				}
-
-				// handle questions
-				if newLinePos := bytes.Index(buf, []byte{'\r'}); newLinePos != -1 {
-					// see if we have any answer handlers
-					select {
-					case handler := <-inst.questions:
-						answer := string(buf[:newLinePos])
-						handler(answer)
-						// munch the string
-						buf = buf[newLinePos+1:]
-						if len(buf) == 0 {
-							if cap(buf) > 256 {
-								buffers.Put(buf[:cap(buf)])
-							}
-							continue
-						}
-					default:
-						// do nothing
+				if len(buf) == 0 {
+					continue
+				}
+				// ctrl+c, ctrl+d, ctrl+z
+				for _, c := range []byte{'C' & 0x1f, 'D' & 0x1f, 'Z' & 0x1f} {
+					if bytes.Contains(buf, []byte{c}) {
+						writeRightNow = append(writeRightNow, c)
 					}
 				}
 
@@ -344,7 +472,7 @@ func (inst *instance) connect(moreCommands func() *string) bool {
 					if err != nil {
 						fmt.Fprintln(inst.terminal.Stderr(), "stdin got error", err)
 						inputBufChan <- nil
-						startWait.Broadcast()
+						script.Stop()
 						return
 					}
 				} else {
@@ -353,10 +481,8 @@ func (inst *instance) connect(moreCommands func() *string) bool {
 			}
 		}()
 
-		// wait for the start commands to finish
-		startWait.L.Lock()
-		startWait.Wait()
-		startWait.L.Unlock()
+		// wait for the login script to finish
+		<-script.Done()
 		for buf := range inputBufChan {
 			if buf == nil {
 				fmt.Fprintln(inst.terminal.Stderr(), "\rclosing stdin:", sshStdin.Close(), "\r")
@@ -383,71 +509,106 @@ func (inst *instance) connect(moreCommands func() *string) bool {
 		procExit.Set()
 	}()
 
-	startWait := sync.NewCond(&sync.Mutex{})
-	nextCommand := func(c *types.Connection, startWait *sync.Cond, moreCommands util.CommandFunc) util.CommandFunc {
-		passthrough := util.GetCommandFunc(inst.conn, startWait, moreCommands)
-		checkedAuths := false
-		return func() *string {
-			if !checkedAuths && detectingSigners != nil {
-				checkedAuths = true
-				//color.Yellowln("checking whether we used ssh key...\r")
-				for _, a := range *detectingSigners {
-					if a != nil && a.didSign {
-						//color.Yellowln("we did! -- using password as first 'command'\r")
-						return &inst.conn.Login.Password
-					} /* else {
-						color.Yellowln("nope:", a, "\r")
-					}*/
-				}
-			} /*else {
-				color.Yellowln("detectingSigners:", detectingSigners, "checkedAuths:", checkedAuths, "\r")
-			}*/
-			return passthrough()
-		}
-	}(inst.conn, startWait, moreCommands)
-
 	sshStdin, err := inst.session.StdinPipe()
 	if err != nil {
-		color.Redln("Error opening stdin pipe", err)
+		inst.redln("Error opening stdin pipe", err)
 		return inst.changed
 	}
 
 	sshStdout, err := inst.session.StdoutPipe()
 	if err != nil {
-		color.Redln("Error opening stdout pipe", err)
+		inst.redln("Error opening stdout pipe", err)
 		return inst.changed
 	}
 
 	sshStderr, err := inst.session.StderrPipe()
 	if err != nil {
-		color.Redln("Error opening stderr pipe", err)
+		inst.redln("Error opening stderr pipe", err)
 		return inst.changed
 	}
 
-	inst.terminal.MakeRaw()
-	defer inst.terminal.RestoreRaw()
+	login := inst.loginScript(detectingSigners)
+	util.ResolvePassword(inst.conn, login, PasswordPrompt(inst.terminal))
 
-	go inFunc(sshStdin, startWait)
-	go shellOutFunc(sshStdout, sshStdin, "stdout", nextCommand, startWait)
-	go shellOutFunc(sshStderr, sshStdin, "stderr", nextCommand, startWait)
+	// without a pty, the host doesn't echo and handle line editing
+	if !inst.conn.Options.NoPty {
+		inst.terminal.MakeRaw()
+		defer inst.terminal.RestoreRaw()
+	}
 
-	if err := inst.session.RequestPty("xterm", 80, 40, modes); err != nil {
-		color.Redln("request for pseudo terminal failed:", err)
-		return inst.changed
+	script := util.RunScript(inst.conn, login, sshStdin, moreCommands)
+	defer script.Stop()
+	go inFunc(sshStdin, script)
+	go shellOutFunc(sshStdout, "stdout", script)
+	go shellOutFunc(sshStderr, "stderr", script)
+
+	if !inst.conn.Options.NoPty {
+		term := inst.conn.Options.Term
+		if term == "" {
+			term = "xterm"
+		}
+		if err := inst.session.RequestPty(term, 80, 40, modes); err != nil {
+			inst.redln("request for pseudo terminal failed:", err)
+			return inst.changed
+		}
 	}
 
-	// Start remote shell
-	if err := inst.session.Shell(); err != nil {
-		color.Redln("failed to start shell:", err)
+	// Start remote shell, or the connection's command
+	if command := inst.conn.Options.RemoteCommand; command != "" {
+		err = inst.session.Start(command)
+	} else {
+		err = inst.session.Shell()
+	}
+	if err != nil {
+		inst.redln("failed to start shell:", err)
 		return inst.changed
 	}
-	inst.SendWindowSize()
+	if !inst.conn.Options.NoPty {
+		inst.SendWindowSize()
+	}
+	exitStatus := make(chan int, 1)
+	go func(session *ssh.Session) {
+		err := session.Wait()
+		if exitErr, ok := err.(*ssh.ExitError); ok && exitErr.Signal() == "" {
+			exitStatus <- exitErr.ExitStatus()
+		} else if err == nil {
+			exitStatus <- 0
+		}
+	}(inst.session)
 
 	<-inst.exitChan
 	procExit.Set()
+	if remoteClosed.IsSet() {
+		// the exit status comes after the end of the output
+		select {
+		case inst.exitStatus = <-exitStatus:
+		case <-time.After(time.Second):
+		}
+	}
 	return inst.changed
 }
 
+// loginScript returns the script to run after logging in. If a key was
+// used, the server may still ask for the password, which is then sent first.
+func (inst *instance) loginScript(detectingSigners *[]*detectingSigner) *types.Script {
+	script := inst.conn.LoginScript()
+	if detectingSigners == nil {
+		return script
+	}
+	for _, s := range *detectingSigners {
+		if s != nil && s.didSign {
+			password := types.Expect("", inst.conn.Timeout.PasswordTimeout, true)
+			password.Cases = []types.ScriptCase{
+				{Match: types.PasswordPattern, Steps: []types.ScriptStep{
+					types.SendSecret(types.AnswerPassword)}},
+				{Match: types.PromptPattern},
+			}
+			return &types.Script{Steps: append([]types.ScriptStep{password}, script.Steps...)}
+		}
+	}
+	return script
+}
+
 type winchMsg struct {
 	width  uint32
 	height uint32
@@ -460,62 +621,70 @@ func (inst *instance) SendWindowSize() {
 		return
 	}
 	if w, h, err := inst.terminal.GetSize(); err != nil {
-		color.Redln("Error getting term size:", err)
+		inst.redln("Error getting term size:", err)
 	} else {
 		msg := ssh.Marshal(&winchMsg{uint32(w), uint32(h), 0, 0})
 		_, err = inst.session.SendRequest("window-change", false, msg)
 		if err != nil {
-			color.Redln("Error sending winch:", err)
+			inst.redln("Error sending winch:", err)
 		}
 	}
 }
 
-func (inst *instance) hostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
-	oldPublicKey, err := hex.DecodeString(inst.conn.Options.SSHPublicKey)
-	if err != nil {
-		return errors.New("XML is corrupt: " + err.Error())
+// hostKeyCallback checks the host key against the one stored in conn, and
+// stores it if there is none yet. Connections which can't store one are checked
+// against known_hosts.
+func (inst *instance) hostKeyCallback(conn *types.Connection) ssh.HostKeyCallback {
+	if conn.KnownHosts != nil || conn.Path() == "" {
+		return inst.knownHostsCallback(conn)
 	}
-	newPublicKey := key.Marshal()
-	//TODO correctly marshal/unmarshal into xml
-
-	newPublicString := base64.StdEncoding.EncodeToString(newPublicKey)
-
-	if len(oldPublicKey) == 0 {
-		color.Yellowln("Registering new SSH Public Key", key.Type(),
-			newPublicString, "\r")
-		inst.conn.Options.SSHPublicKey = hex.EncodeToString(newPublicKey)
-		inst.saveChanges(inst.conn)
-		inst.changed = true
-		return nil
-	}
-
-	oldPublicString := base64.StdEncoding.EncodeToString(oldPublicKey)
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		oldPublicKey, err := hex.DecodeString(conn.Options.SSHPublicKey)
+		if err != nil {
+			return errors.New("XML is corrupt: " + err.Error())
+		}
+		newPublicKey := key.Marshal()
+		//TODO correctly marshal/unmarshal into xml
+
+		newPublicString := base64.StdEncoding.EncodeToString(newPublicKey)
+
+		if len(oldPublicKey) == 0 {
+			inst.yellowln("Registering new SSH Public Key for", conn.Info.Name+":", key.Type(),
+				newPublicString, "\r")
+			conn.Options.SSHPublicKey = hex.EncodeToString(newPublicKey)
+			inst.saveChanges(conn)
+			inst.changed = true
+			return nil
+		}
 
-	same := subtle.ConstantTimeCompare(newPublicKey, oldPublicKey)
-	if same == 1 {
-		return nil
-	}
-	color.Redln("-----POSSIBLE ATTACK-----",
-		"\r\nSSH key changed! expected:\r\n",
-		key.Type(), oldPublicString, "\r\ngot:\r\n", key.Type(), newPublicString,
-		"\r")
-	inst.terminal.Stderr().Write([]byte("Accept change [Ny]? "))
+		oldPublicString := base64.StdEncoding.EncodeToString(oldPublicKey)
 
-	buf := make([]byte, 128)
-	n, err := inst.terminal.Stdin().Read(buf)
-	if err != nil {
-		color.Yellowln("Error reading answer:", err)
-		return err
-	}
-	inst.terminal.Stderr().Write([]byte{'\r', '\n'})
-
-	text := strings.TrimSpace(strings.ToLower(string(buf[:n])))
-	if text == "y" || text == "yes" {
-		inst.conn.Options.SSHPublicKey = hex.EncodeToString(newPublicKey)
-		color.Yellowln("\rSaving new public key to connections.xml.\r")
-		inst.saveChanges(inst.conn)
-		inst.changed = true
-		return nil
+		same := subtle.ConstantTimeCompare(newPublicKey, oldPublicKey)
+		if same == 1 {
+			return nil
+		}
+		inst.redln("-----POSSIBLE ATTACK-----",
+			"\r\nSSH key changed! expected:\r\n",
+			key.Type(), oldPublicString, "\r\ngot:\r\n", key.Type(), newPublicString,
+			"\r")
+		inst.terminal.Stderr().Write([]byte("Accept change [Ny]? "))
+
+		buf := make([]byte, 128)
+		n, err := inst.terminal.Stdin().Read(buf)
+		if err != nil {
+			inst.yellowln("Error reading answer:", err)
+			return err
+		}
+		inst.terminal.Stderr().Write([]byte{'\r', '\n'})
+
+		text := strings.TrimSpace(strings.ToLower(string(buf[:n])))
+		if text == "y" || text == "yes" {
+			conn.Options.SSHPublicKey = hex.EncodeToString(newPublicKey)
+			inst.yellowln("\rSaving new public key to connections.xml.\r")
+			inst.saveChanges(conn)
+			inst.changed = true
+			return nil
+		}
+		return errors.New("Public key not accepted")
 	}
-	return errors.New("Public key not accepted")
 }
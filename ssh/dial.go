@@ -0,0 +1,330 @@
+package ssh
+
+import (
+	context2 "context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/cfstras/pcm/secrets"
+	"github.com/cfstras/pcm/types"
+)
+
+// Checked for jump hosts which are not connections of their own
+const knownHostsPath = "~/.ssh/known_hosts"
+
+var errExit = errors.New("Exit")
+
+const dialTimeout = 20 * time.Second
+
+// clientConfig returns the settings to log in to conn, and the key signers
+// offered to it.
+func (inst *instance) clientConfig(conn *types.Connection) (*ssh.ClientConfig, *[]*detectingSigner) {
+	config := &ssh.ClientConfig{
+		User:            conn.Login.User,
+		HostKeyCallback: inst.hostKeyCallback(conn),
+		Timeout:         dialTimeout,
+	}
+	keyboardInteractive := ssh.KeyboardInteractive(inst.keyboardInteractive(conn))
+	// with nothing stored to answer, it would only ask on the terminal
+	hasAnswers := conn.Login.Password != "" || conn.Login.TOTPSecret != "" ||
+		len(conn.Login.Answers) > 0
+	if hasAnswers {
+		config.Auth = append(config.Auth, keyboardInteractive)
+	}
+	askPassword := func() (string, error) {
+		return readPassword(inst.terminal, fmt.Sprintf("%s@%s's password: ",
+			conn.Login.User, conn.Info.Host))
+	}
+	if conn.Login.Password != "" {
+		config.Auth = append([]ssh.AuthMethod{ssh.PasswordCallback(func() (string, error) {
+			password, err := secrets.Resolve(conn.Login.Password, PasswordPrompt(inst.terminal))
+			if err != nil {
+				inst.redln(err, "\r")
+				return askPassword()
+			}
+			return password, nil
+		})}, config.Auth...)
+	}
+
+	identityFiles := append([]string{}, conn.Options.IdentityFiles...)
+	if len(inst.settings.IdentityFiles) > 0 {
+		identityFiles = append(identityFiles, inst.settings.IdentityFiles...)
+	} else {
+		identityFiles = append(identityFiles, defaultIdentityFiles...)
+	}
+	keyAuth, signers := inst.publicKeyAuth(inst.identitySigners(identityFiles))
+	config.Auth = append(config.Auth, keyAuth)
+	if conn.Login.Password == "" {
+		// ask last, after the keys had their chance
+		config.Auth = append(config.Auth, ssh.PasswordCallback(askPassword))
+	}
+	if !hasAnswers {
+		config.Auth = append(config.Auth, keyboardInteractive)
+	}
+	return config, signers
+}
+
+// dial opens the SSH connection to conn, tunnelled through its jump hosts.
+// Every hop checks its own host key and uses its own credentials. The returned
+// signers are the ones offered to conn itself.
+func (inst *instance) dial(ctx context2.Context, conn *types.Connection) (*ssh.Client, *[]*detectingSigner, error) {
+	chain, err := inst.jumpChain(conn, make(map[*types.Connection]bool))
+	if err != nil {
+		return nil, nil, err
+	}
+	return inst.dialChain(ctx, append(chain, conn))
+}
+
+// DialTCP opens a plain TCP connection to addr for conn, which uses another
+// protocol than SSH, through conn's jump hosts or proxy. Questions, e.g. about
+// the host keys of jump hosts, are asked on terminal.
+func DialTCP(ctx context2.Context, conn *types.Connection, addr string, settings Settings,
+	terminal types.Terminal, saveChanges func(*types.Connection)) (net.Conn, error) {
+	inst := newInstance(conn, settings, terminal, saveChanges)
+	chain, err := inst.jumpChain(conn, make(map[*types.Connection]bool))
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		c, err := inst.dialTransport(ctx, conn, addr, dialTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("Dialing to %s: %v", addr, err)
+		}
+		return c, nil
+	}
+
+	client, _, err := inst.dialChain(ctx, chain)
+	if err != nil {
+		return nil, err
+	}
+	inst.yellowln("Connecting to", conn.Info.Name, "via",
+		chain[len(chain)-1].Info.Name, "\r")
+	c, err := client.Dial("tcp", addr)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("Dialing to %s: %v", addr, err)
+	}
+	return &tunnelConn{c, client}, nil
+}
+
+// tunnelConn is a connection through jump hosts, which are closed with it.
+type tunnelConn struct {
+	net.Conn
+	client *ssh.Client
+}
+
+func (c *tunnelConn) Close() error {
+	err := c.Conn.Close()
+	c.client.Close()
+	return err
+}
+
+// dialChain opens SSH connections to each connection of chain, each through the
+// one before.
+func (inst *instance) dialChain(ctx context2.Context, chain []*types.Connection) (*ssh.Client, *[]*detectingSigner, error) {
+	var err error
+	var client *ssh.Client
+	var signers *[]*detectingSigner
+	for i, hop := range chain {
+		port := hop.Info.Port
+		if port == 0 {
+			port = 22
+		}
+		addr := net.JoinHostPort(hop.Info.Host, strconv.Itoa(int(port)))
+		config, hopSigners := inst.clientConfig(hop)
+
+		var tcpConn net.Conn
+		if client == nil {
+			tcpConn, err = inst.dialTransport(ctx, hop, addr, config.Timeout)
+		} else {
+			inst.yellowln("Connecting to", hop.Info.Name, "via",
+				chain[i-1].Info.Name, "\r")
+			tcpConn, err = client.Dial("tcp", addr)
+		}
+		if err != nil {
+			closeClient(client)
+			return nil, nil, fmt.Errorf("Dialing to %s: %v", addr, err)
+		}
+		if inst.exitRequested.IsSet() {
+			tcpConn.Close()
+			closeClient(client)
+			return nil, nil, errExit
+		}
+		c, chans, reqs, err := ssh.NewClientConn(tcpConn, addr, config)
+		if err != nil {
+			tcpConn.Close()
+			closeClient(client)
+			return nil, nil, fmt.Errorf("Opening SSH connection to %s: %v", addr, err)
+		}
+		next := ssh.NewClient(c, chans, reqs)
+		if client != nil {
+			// the tunnel goes away with the connection through it
+			prev := client
+			go func() {
+				next.Wait()
+				prev.Close()
+			}()
+		}
+		client, signers = next, hopSigners
+	}
+	return client, signers, nil
+}
+
+func closeClient(client *ssh.Client) {
+	if client != nil {
+		client.Close()
+	}
+}
+
+// JumpHosts resolves the jump hosts of conn with settings, in the order they
+// are connected to.
+func JumpHosts(conn *types.Connection, settings Settings) ([]*types.Connection, error) {
+	return (&instance{settings: settings}).jumpChain(conn, make(map[*types.Connection]bool))
+}
+
+// jumpChain resolves the jump hosts of conn in the order they are connected
+// to. Jump hosts can have jump hosts of their own, which come before them.
+func (inst *instance) jumpChain(conn *types.Connection,
+	visiting map[*types.Connection]bool) ([]*types.Connection, error) {
+
+	if visiting[conn] {
+		return nil, fmt.Errorf("jump hosts of %s form a loop", conn.Info.Name)
+	}
+	visiting[conn] = true
+	defer delete(visiting, conn)
+
+	var chain []*types.Connection
+	for _, spec := range conn.Options.JumpHosts {
+		hop, err := inst.resolveJumpHost(spec)
+		if err != nil {
+			return nil, err
+		}
+		hops, err := inst.jumpChain(hop, visiting)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(append(chain, hops...), hop)
+	}
+	return chain, nil
+}
+
+// resolveJumpHost finds the connection with the path spec, or else treats it as
+// [user@]host[:port].
+func (inst *instance) resolveJumpHost(spec string) (*types.Connection, error) {
+	spec = strings.TrimSpace(spec)
+	if inst.settings.Config != nil {
+		path := spec
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		if c, ok := inst.settings.Config.AllConnections()[path]; ok {
+			return c, nil
+		}
+	}
+	if strings.Contains(spec, "/") {
+		return nil, errors.New("jump host " + spec + " not found")
+	}
+
+	conn := &types.Connection{}
+	conn.Login.User = os.Getenv("USER")
+	if at := strings.LastIndex(spec, "@"); at != -1 {
+		conn.Login.User, spec = spec[:at], spec[at+1:]
+	}
+	conn.Info.Host = spec
+	conn.Info.Port = 22
+	if host, port, err := net.SplitHostPort(spec); err == nil {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, errors.New("invalid port in jump host " + spec)
+		}
+		conn.Info.Host, conn.Info.Port = host, uint16(p)
+	}
+	if conn.Info.Host == "" {
+		return nil, errors.New("invalid jump host " + spec)
+	}
+	conn.Info.Name = conn.Info.Host
+	return conn, nil
+}
+
+// knownHostsCallback checks the host key of a connection that has no place to
+// store one against the OpenSSH known_hosts files. Unknown keys can be added
+// there.
+func (inst *instance) knownHostsCallback(conn *types.Connection) ssh.HostKeyCallback {
+	var files []string
+	var alias string
+	if conn.KnownHosts != nil {
+		alias = conn.KnownHosts.Alias
+		for _, f := range conn.KnownHosts.Files {
+			files = append(files, replaceHome(f))
+		}
+	}
+	if len(files) == 0 {
+		files = []string{replaceHome(knownHostsPath)}
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if alias != "" {
+			// like OpenSSH, don't check the address either
+			_, port, _ := net.SplitHostPort(hostname)
+			hostname = net.JoinHostPort(alias, port)
+			remote = aliasAddr(hostname)
+		}
+		var existing []string
+		for _, f := range files {
+			if _, err := os.Stat(f); err == nil {
+				existing = append(existing, f)
+			}
+		}
+		if len(existing) > 0 {
+			check, err := knownhosts.New(existing...)
+			if err != nil {
+				return err
+			}
+			err = check(hostname, remote, key)
+			if err == nil {
+				return nil
+			}
+			if keyErr, ok := err.(*knownhosts.KeyError); !ok || len(keyErr.Want) > 0 {
+				inst.redln("-----POSSIBLE ATTACK-----\r\nSSH key of", hostname,
+					"does not match", strings.Join(existing, ", ")+":", err, "\r")
+				return err
+			}
+		}
+
+		path := files[0]
+		inst.yellowln("Unknown SSH Public Key for", conn.Info.Name+":",
+			key.Type(), ssh.FingerprintSHA256(key), "\r")
+		answer, err := readAnswer(inst.terminal, "Accept and add to "+path+" [Ny]? ")
+		fmt.Fprint(inst.terminal.Stderr(), "\r\n")
+		if err != nil {
+			return err
+		}
+		if answer = strings.TrimSpace(strings.ToLower(answer)); answer != "y" && answer != "yes" {
+			return errors.New("Public key not accepted")
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+		return err
+	}
+}
+
+// aliasAddr stands in for the address of a host checked by its HostKeyAlias
+type aliasAddr string
+
+func (a aliasAddr) Network() string { return "tcp" }
+func (a aliasAddr) String() string  { return string(a) }
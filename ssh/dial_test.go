@@ -0,0 +1,232 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/cfstras/pcm/types"
+)
+
+// testTerminal answers from input and collects what is written
+type testTerminal struct {
+	input  io.Reader
+	output bytes.Buffer
+}
+
+func newTestTerminal(input string) *testTerminal {
+	return &testTerminal{input: strings.NewReader(input)}
+}
+
+func (t *testTerminal) GetSize() (int, int, error) { return 80, 24, nil }
+func (t *testTerminal) Stdin() io.Reader           { return t.input }
+func (t *testTerminal) Stdout() io.Writer          { return &t.output }
+func (t *testTerminal) Stderr() io.Writer          { return &t.output }
+func (t *testTerminal) ExitRequests() <-chan bool  { return nil }
+func (t *testTerminal) Signals() <-chan os.Signal  { return nil }
+func (t *testTerminal) MakeRaw()                   {}
+func (t *testTerminal) RestoreRaw()                {}
+
+func testKey(t *testing.T) ssh.PublicKey {
+	return testSigner(t).PublicKey()
+}
+
+func testAddr(host string, port int) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: port}
+}
+
+func testSigner(t *testing.T) ssh.Signer {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "pcm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// importedConn returns a connection like one imported from ~/.ssh/config,
+// checked against the known_hosts file in dir
+func importedConn(dir string, alias string) *types.Connection {
+	conn := &types.Connection{}
+	conn.Name, conn.Info.Name = "srv", "srv"
+	conn.Path_ = "/--ssh_config--/srv"
+	conn.KnownHosts = &types.KnownHosts{Files: []string{filepath.Join(dir, "known_hosts")},
+		Alias: alias}
+	return conn
+}
+
+func TestKnownHostsChangedKey(t *testing.T) {
+	dir := tempDir(t)
+	known, other := testKey(t), testKey(t)
+	writeFile(t, filepath.Join(dir, "known_hosts"),
+		knownhosts.Line([]string{"srv.example.com"}, known)+"\n")
+
+	conn := importedConn(dir, "")
+	saved := false
+	inst := newInstance(conn, Settings{}, newTestTerminal(""),
+		func(*types.Connection) { saved = true })
+	check := inst.hostKeyCallback(conn)
+
+	if err := check("srv.example.com:22", testAddr("192.0.2.1", 22), known); err != nil {
+		t.Errorf("known key rejected: %v", err)
+	}
+	err := check("srv.example.com:22", testAddr("192.0.2.1", 22), other)
+	if _, ok := err.(*knownhosts.KeyError); !ok {
+		t.Errorf("changed key: got %v, want a knownhosts.KeyError", err)
+	}
+	if saved || conn.Options.SSHPublicKey != "" {
+		t.Error("the host key of an imported connection was stored in it")
+	}
+}
+
+func TestKnownHostsAlias(t *testing.T) {
+	dir := tempDir(t)
+	known, other := testKey(t), testKey(t)
+	writeFile(t, filepath.Join(dir, "known_hosts"),
+		knownhosts.Line([]string{knownhosts.Normalize("gateway:2222")}, known)+"\n")
+
+	conn := importedConn(dir, "gateway")
+	check := newInstance(conn, Settings{}, newTestTerminal(""), nil).hostKeyCallback(conn)
+	if err := check("10.1.2.3:2222", testAddr("10.1.2.3", 2222), known); err != nil {
+		t.Errorf("key known for the alias rejected: %v", err)
+	}
+	if err := check("10.1.2.3:2222", testAddr("10.1.2.3", 2222), other); err == nil {
+		t.Error("changed key accepted")
+	}
+}
+
+func TestKnownHostsUnknownKey(t *testing.T) {
+	dir := tempDir(t)
+	key := testKey(t)
+	conn := importedConn(dir, "")
+
+	term := newTestTerminal("n\n")
+	check := newInstance(conn, Settings{}, term, nil).hostKeyCallback(conn)
+	if err := check("srv:22", testAddr("192.0.2.1", 22), key); err == nil {
+		t.Error("unknown key accepted without asking")
+	}
+
+	check = newInstance(conn, Settings{}, newTestTerminal("y\n"), nil).hostKeyCallback(conn)
+	if err := check("srv:22", testAddr("192.0.2.1", 22), key); err != nil {
+		t.Fatalf("accepting the key: %v", err)
+	}
+	if err := check("srv:22", testAddr("192.0.2.1", 22), key); err != nil {
+		t.Errorf("added key rejected: %v", err)
+	}
+	if err := check("srv:22", testAddr("192.0.2.1", 22), testKey(t)); err == nil {
+		t.Error("changed key accepted after adding one")
+	}
+}
+
+// authServer accepts the key in testdata/ecdsa.pub and the password
+// "secret", and records the methods tried.
+func authServer(t *testing.T, c net.Conn, tried chan<- string) {
+	want, err := readPublicKey(filepath.Join("testdata", "ecdsa.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			tried <- "publickey"
+			if bytes.Equal(key.Marshal(), want.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+		PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			tried <- "password"
+			if string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		KeyboardInteractiveCallback: func(_ ssh.ConnMetadata,
+			client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			tried <- "keyboard-interactive"
+			_, err := client("", "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			return nil, errors.New("wrong password")
+		},
+	}
+	config.AddHostKey(testSigner(t))
+	if sc, _, _, err := ssh.NewServerConn(c, config); err == nil {
+		sc.Close()
+	}
+	close(tried)
+}
+
+// Keys are offered before anything is asked on the terminal.
+func TestAuthOrder(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	for _, test := range []struct {
+		name, password string
+		want           []string
+	}{
+		{"key", "", []string{"publickey"}},
+		{"stored password", "secret", []string{"password"}},
+	} {
+		conn := &types.Connection{}
+		conn.Info.Name, conn.Info.Host, conn.Login.User = "srv", "srv.example.com", "u"
+		conn.Login.Password = test.password
+		terminal := newTestTerminal("")
+		inst := newInstance(conn, Settings{IdentityFiles: []string{
+			filepath.Join("testdata", "ecdsa.pem")}}, terminal, nil)
+		config, _ := inst.clientConfig(conn)
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+
+		tried := make(chan string, 10)
+		addr := listen(t, func(c net.Conn) { authServer(t, c, tried) })
+		client, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _, _, err := ssh.NewClientConn(client, "srv.example.com:22", config)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else {
+			c.Close()
+		}
+		var got []string
+		for m := range tried {
+			got = append(got, m)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: tried %q, want %q", test.name, got, test.want)
+		}
+		if strings.Contains(strings.ToLower(terminal.output.String()), "password") {
+			t.Errorf("%s: asked on the terminal: %q", test.name, terminal.output.String())
+		}
+	}
+}
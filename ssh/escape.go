@@ -0,0 +1,280 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cfstras/pcm/types"
+	"github.com/cfstras/pcm/util"
+)
+
+// OpenSSH-style escape sequences, typed at the beginning of a line
+
+const defaultEscapeChar = '~'
+
+// Characters following the escape character that are commands
+const escapeCommands = ".?#CBR\x1a"
+
+// parseEscapeChar returns the escape character configured in s, or 0 if
+// escapes are disabled.
+func parseEscapeChar(s string) (byte, error) {
+	switch {
+	case s == "":
+		return defaultEscapeChar, nil
+	case s == "none":
+		return 0, nil
+	case len(s) == 1:
+		return s[0], nil
+	case len(s) == 2 && s[0] == '^':
+		if s[1] == '?' {
+			return 0x7f, nil
+		}
+		return s[1] & 0x1f, nil
+	}
+	return defaultEscapeChar, errors.New("invalid escape character " + s)
+}
+
+// escapeName returns how to type c, e.g. "^Z" for a control character
+func escapeName(c byte) string {
+	if c < 0x20 {
+		return "^" + string(c+'@')
+	} else if c == 0x7f {
+		return "^?"
+	}
+	return string(c)
+}
+
+// escapeFilter finds escape sequences in the input
+type escapeFilter struct {
+	char      byte
+	lineStart bool
+	pending   bool
+}
+
+func newEscapeFilter(char byte) *escapeFilter {
+	return &escapeFilter{char: char, lineStart: true}
+}
+
+// filter removes escape sequences from in and runs command for each one. It
+// stops when command returns true.
+func (e *escapeFilter) filter(in []byte, command func(c byte) bool) (out []byte, quit bool) {
+	out = make([]byte, 0, len(in)+1)
+	for _, b := range in {
+		if e.pending {
+			e.pending = false
+			if b == e.char {
+				// typed twice: send it once
+				out = append(out, b)
+				e.lineStart = false
+				continue
+			}
+			if strings.IndexByte(escapeCommands, b) != -1 {
+				if command(b) {
+					return out, true
+				}
+				continue
+			}
+			// not an escape sequence after all
+			out = append(out, e.char)
+		} else if e.char != 0 && e.lineStart && b == e.char {
+			e.pending = true
+			continue
+		}
+		out = append(out, b)
+		// after Ctrl+C and Ctrl+Z, the shell starts a new line as well
+		e.lineStart = b == '\r' || b == '\n' || b == 'C'&0x1f || b == 'Z'&0x1f
+	}
+	return out, false
+}
+
+// escapeCommand runs the escape command c and returns whether to disconnect.
+func (inst *instance) escapeCommand(c byte) bool {
+	esc := escapeName(inst.escapes.char)
+	out := inst.terminal.Stdout()
+	switch c {
+	case '.':
+		inst.redln("\r\nGot "+esc+". - aborting.", "\r")
+		return true
+	case '?':
+		help := strings.Replace(`
+Supported escape sequences:
+ ~.   - terminate connection
+ ~B   - send a BREAK to the remote system
+ ~C   - open a command line
+ ~R   - request rekey (not supported, the connection rekeys on its own)
+ ~^Z  - suspend pcm
+ ~#   - list forwarded ports
+ ~?   - this message
+ ~~   - send the escape character by typing it twice
+(Note that escapes are only recognized immediately after newline.)
+`, "~", esc, -1)
+		fmt.Fprint(out, strings.Replace(help, "\n", "\r\n", -1))
+	case '#':
+		inst.forwards.Lock()
+		fmt.Fprint(out, "\r\nForwarded ports:\r\n")
+		for _, f := range inst.forwards.list {
+			fmt.Fprintf(out, "  %s\r\n", f)
+		}
+		if len(inst.forwards.list) == 0 {
+			fmt.Fprint(out, "  none\r\n")
+		}
+		inst.forwards.Unlock()
+	case 'C':
+		inst.escapeCommandLine()
+	case 'B':
+		if inst.session == nil {
+			break
+		}
+		// RFC 4335, the length is in milliseconds
+		ok, err := inst.session.SendRequest("break", true,
+			ssh.Marshal(struct{ Length uint32 }{1000}))
+		if err != nil {
+			inst.redln("\r\nSending BREAK:", err, "\r")
+		} else if !ok {
+			inst.yellowln("\r\nThe server does not support BREAK.\r")
+		}
+	case 'R':
+		// golang.org/x/crypto/ssh has no way to ask for a rekey, it only rekeys
+		// on its own after enough data
+		inst.yellowln("\r\nRekeying on request is not supported, the connection rekeys on its own.\r")
+	case 'Z' & 0x1f:
+		fmt.Fprint(out, "\r\n")
+		inst.terminal.RestoreRaw()
+		err := util.Suspend()
+		inst.terminal.MakeRaw()
+		if err != nil {
+			inst.redln("Suspending:", err, "\r")
+		}
+		inst.SendWindowSize()
+	}
+	return false
+}
+
+// escapeCommandLine reads and runs a command to add or cancel port forwardings.
+func (inst *instance) escapeCommandLine() {
+	out := inst.terminal.Stdout()
+	fmt.Fprint(out, "\r\nssh> ")
+	line, err := readLineEcho(inst.terminal)
+	fmt.Fprint(out, "\r\n")
+	if err != nil {
+		inst.redln(err, "\r")
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	forwardTypes := map[string]string{"L": types.ForwardLocal,
+		"R": types.ForwardRemote, "D": types.ForwardDynamic}
+	cmd, arg := fields[0], strings.Join(fields[1:], " ")
+	if strings.HasPrefix(cmd, "-K") && len(cmd) >= 3 && forwardTypes[cmd[2:3]] != "" {
+		if len(cmd) > 3 {
+			arg = cmd[3:]
+		}
+		f := types.Forward{Type: forwardTypes[cmd[2:3]], Listen: arg}
+		if err := inst.cancelForward(f); err != nil {
+			inst.redln("Cancelling", arg+":", err, "\r")
+		} else {
+			inst.yellowln("Forwarding on", arg, "cancelled.\r")
+		}
+	} else if strings.HasPrefix(cmd, "-") && len(cmd) >= 2 && forwardTypes[cmd[1:2]] != "" {
+		if len(cmd) > 2 {
+			arg = strings.TrimSpace(cmd[2:] + " " + arg)
+		}
+		f, err := parseForward(forwardTypes[cmd[1:2]], arg)
+		if err == nil {
+			err = inst.addForward(inst.client, f)
+		}
+		if err != nil {
+			inst.redln("Forwarding", arg, "failed:", err, "\r")
+		} else {
+			inst.yellowln("Forwarding", forwardString(f), "\r")
+		}
+	} else {
+		fmt.Fprint(out, strings.Replace(`Commands:
+      -L[bind_address:]port:host:hostport    Request local forward
+      -R[bind_address:]port:host:hostport    Request remote forward
+      -D[bind_address:]port                  Request dynamic forward
+      -KL[bind_address:]port                 Cancel local forward
+      -KR[bind_address:]port                 Cancel remote forward
+      -KD[bind_address:]port                 Cancel dynamic forward
+`, "\n", "\r\n", -1))
+	}
+}
+
+// parseForward parses forwarding specifications as given to ssh -L, -R or -D.
+// Listen address and target may also be separated by a space.
+func parseForward(typ, spec string) (types.Forward, error) {
+	f := types.Forward{Type: typ}
+	if fields := strings.Fields(spec); len(fields) == 2 {
+		f.Listen, f.Target = fields[0], fields[1]
+	} else if typ == types.ForwardDynamic {
+		f.Listen = spec
+	} else {
+		parts := splitForward(spec)
+		switch {
+		case len(parts) == 2:
+			f.Listen, f.Target = parts[0], parts[1]
+		case len(parts) == 3 && strings.Contains(parts[2], "/"):
+			f.Listen, f.Target = parts[0]+":"+parts[1], parts[2]
+		case len(parts) == 3:
+			f.Listen, f.Target = parts[0], parts[1]+":"+parts[2]
+		case len(parts) == 4:
+			f.Listen, f.Target = parts[0]+":"+parts[1], parts[2]+":"+parts[3]
+		}
+	}
+	if f.Listen == "" || (typ != types.ForwardDynamic && f.Target == "") {
+		return f, errors.New("invalid forwarding " + spec)
+	}
+	return f, nil
+}
+
+// splitForward splits at colons which are not inside brackets
+func splitForward(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// readLineEcho reads a line from the raw terminal, echoing what is typed.
+func readLineEcho(t types.Terminal) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := t.Stdin().Read(b); err != nil {
+			return "", err
+		}
+		switch b[0] {
+		case '\r', '\n':
+			return string(line), nil
+		case 'C' & 0x1f, 0x1b: // Ctrl+C, Esc
+			return "", nil
+		case 0x7f, '\b':
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				fmt.Fprint(t.Stdout(), "\b \b")
+			}
+		default:
+			if b[0] >= 0x20 {
+				line = append(line, b[0])
+				t.Stdout().Write(b)
+			}
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package ssh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cfstras/pcm/types"
+)
+
+// A port forwarding that is currently listening
+type activeForward struct {
+	types.Forward
+	listener net.Listener
+}
+
+func (f *activeForward) String() string {
+	return forwardString(f.Forward)
+}
+
+// forwardString formats f like the OpenSSH command line option for it
+func forwardString(f types.Forward) string {
+	switch f.Type {
+	case types.ForwardLocal:
+		return "-L " + f.Listen + " " + f.Target
+	case types.ForwardRemote:
+		return "-R " + f.Listen + " " + f.Target
+	case types.ForwardDynamic:
+		return "-D " + f.Listen
+	}
+	return f.Type + " " + f.Listen + " " + f.Target
+}
+
+// forwards keeps the port forwardings of a connection
+type forwards struct {
+	sync.Mutex
+	list []*activeForward
+}
+
+// startForwards sets up all forwardings of the connection. Failures are
+// reported, but do not stop the others. It returns whether any could be set
+// up.
+func (inst *instance) startForwards(client *ssh.Client, list []types.Forward) bool {
+	ok := false
+	for _, f := range list {
+		if err := inst.addForward(client, f); err != nil {
+			inst.redln("Forwarding", forwardString(f), "failed:", err, "\r")
+		} else {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// addForward starts listening for f.
+func (inst *instance) addForward(client *ssh.Client, f types.Forward) error {
+	var ln net.Listener
+	var err error
+	switch f.Type {
+	case types.ForwardLocal, types.ForwardDynamic:
+		if f.Type == types.ForwardLocal && f.Target == "" {
+			return errors.New("no target given")
+		}
+		network, addr := forwardAddr(f.Listen)
+		if network == "unix" {
+			// like OpenSSH, don't remove old sockets
+			if _, err := os.Lstat(addr); err == nil {
+				return errors.New(addr + " exists already")
+			}
+		}
+		ln, err = net.Listen(network, addr)
+	case types.ForwardRemote:
+		if f.Target == "" {
+			return errors.New("no target given")
+		}
+		network, addr := forwardAddr(f.Listen)
+		ln, err = client.Listen(network, addr)
+	default:
+		return errors.New("unknown forwarding type " + f.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	active := &activeForward{f, ln}
+	inst.forwards.Lock()
+	inst.forwards.list = append(inst.forwards.list, active)
+	inst.forwards.Unlock()
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go inst.handleForward(client, active, c)
+		}
+	}()
+	return nil
+}
+
+// cancelForward stops listening for the forwarding matching type and listen
+// address of f.
+func (inst *instance) cancelForward(f types.Forward) error {
+	inst.forwards.Lock()
+	defer inst.forwards.Unlock()
+	for i, a := range inst.forwards.list {
+		if a.Type != f.Type {
+			continue
+		}
+		n1, addr1 := forwardAddr(a.Listen)
+		n2, addr2 := forwardAddr(f.Listen)
+		if a.Listen == f.Listen || (n1 == n2 && addr1 == addr2) {
+			inst.forwards.list = append(inst.forwards.list[:i],
+				inst.forwards.list[i+1:]...)
+			return a.listener.Close()
+		}
+	}
+	return errors.New("no such forwarding")
+}
+
+func (inst *instance) stopForwards() {
+	inst.forwards.Lock()
+	defer inst.forwards.Unlock()
+	for _, a := range inst.forwards.list {
+		a.listener.Close()
+	}
+	inst.forwards.list = nil
+}
+
+func (inst *instance) handleForward(client *ssh.Client, f *activeForward, c net.Conn) {
+	var target net.Conn
+	var err error
+	network, addr := forwardAddr(f.Target)
+	switch f.Type {
+	case types.ForwardLocal:
+		target, err = client.Dial(network, addr)
+	case types.ForwardRemote:
+		target, err = net.Dial(network, addr)
+	case types.ForwardDynamic:
+		// the client may send data right after its request
+		bc := &bufferedConn{c, bufio.NewReader(c)}
+		c = bc
+		target, err = socksConnect(bc, func(addr string) (net.Conn, error) {
+			return client.Dial("tcp", addr)
+		})
+	}
+	if err != nil {
+		inst.yellowln("Forwarding", f.String()+":", err, "\r")
+		c.Close()
+		return
+	}
+	pipe(c, target)
+}
+
+// forwardAddr returns network and address for a forwarding address, which is
+// a unix socket path or [host:]port. If no host is given, the forwarding is
+// only reachable from the same machine; "*" means all interfaces.
+func forwardAddr(s string) (string, string) {
+	if strings.Contains(s, "/") {
+		return "unix", s
+	}
+	if _, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return "tcp", net.JoinHostPort("localhost", s)
+	}
+	if host, port, err := net.SplitHostPort(s); err == nil && (host == "*" || host == "") {
+		return "tcp", net.JoinHostPort("0.0.0.0", port)
+	}
+	return "tcp", s
+}
+
+// pipe copies between a and b until both directions are done.
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyClose := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface {
+			CloseWrite() error
+		}); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go copyClose(a, b)
+	go copyClose(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+// socksConnect handles a SOCKS4, SOCKS4a or SOCKS5 CONNECT request on c, and
+// returns the connection opened with dial. What the client sent after the
+// request stays buffered in c.
+func socksConnect(c *bufferedConn, dial func(addr string) (net.Conn, error)) (net.Conn, error) {
+	rd := c.rd
+	version, err := rd.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch version {
+	case 4:
+		return socks4Connect(c, rd, dial)
+	case 5:
+		return socks5Connect(c, rd, dial)
+	}
+	return nil, fmt.Errorf("unknown SOCKS version %d", version)
+}
+
+func socks4Connect(c net.Conn, rd *bufio.Reader, dial func(addr string) (net.Conn, error)) (net.Conn, error) {
+	var req struct {
+		Command byte
+		Port    uint16
+		IP      [4]byte
+	}
+	if err := binary.Read(rd, binary.BigEndian, &req); err != nil {
+		return nil, err
+	}
+	if _, err := rd.ReadString(0); err != nil { // user id
+		return nil, err
+	}
+	host := net.IP(req.IP[:]).String()
+	if req.IP[0] == 0 && req.IP[1] == 0 && req.IP[2] == 0 && req.IP[3] != 0 {
+		// SOCKS4a: the host name follows
+		name, err := rd.ReadString(0)
+		if err != nil {
+			return nil, err
+		}
+		host = strings.TrimSuffix(name, "\x00")
+	}
+	reply := []byte{0, 0x5a, 0, 0, 0, 0, 0, 0}
+	var target net.Conn
+	var err error
+	if req.Command != 1 {
+		err = errors.New("unsupported SOCKS command")
+	} else {
+		target, err = dial(net.JoinHostPort(host, strconv.Itoa(int(req.Port))))
+	}
+	if err != nil {
+		reply[1] = 0x5b
+	}
+	c.Write(reply)
+	return target, err
+}
+
+func socks5Connect(c net.Conn, rd *bufio.Reader, dial func(addr string) (net.Conn, error)) (net.Conn, error) {
+	n, err := rd.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	methods := make([]byte, n)
+	if _, err := io.ReadFull(rd, methods); err != nil {
+		return nil, err
+	}
+	// only "no authentication"
+	if !strings.Contains(string(methods), "\x00") {
+		c.Write([]byte{5, 0xff})
+		return nil, errors.New("SOCKS client needs authentication")
+	}
+	c.Write([]byte{5, 0})
+
+	var req [4]byte
+	if _, err := io.ReadFull(rd, req[:]); err != nil {
+		return nil, err
+	}
+	var host string
+	switch req[3] {
+	case 1, 4:
+		ip := make([]byte, 4)
+		if req[3] == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(rd, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		l, err := rd.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, l)
+		if _, err := io.ReadFull(rd, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		return nil, errors.New("unknown SOCKS address type")
+	}
+	var port uint16
+	if err := binary.Read(rd, binary.BigEndian, &port); err != nil {
+		return nil, err
+	}
+
+	reply := []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	var target net.Conn
+	if req[1] != 1 {
+		reply[1] = 7 // command not supported
+		err = errors.New("unsupported SOCKS command")
+	} else if target, err = dial(net.JoinHostPort(host, strconv.Itoa(int(port)))); err != nil {
+		reply[1] = 5 // connection refused
+	}
+	c.Write(reply)
+	return target, err
+}
@@ -0,0 +1,57 @@
+package ssh
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// A SOCKS client may send its data right after the request, without waiting
+// for the reply.
+func TestSOCKSPipelined(t *testing.T) {
+	echo := echoServer(t)
+	requested := make(chan string, 1)
+	server := listen(t, func(c net.Conn) {
+		bc := &bufferedConn{c, bufio.NewReader(c)}
+		target, err := socksConnect(bc, func(addr string) (net.Conn, error) {
+			requested <- addr
+			return net.Dial("tcp", echo)
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		pipe(bc, target)
+	})
+
+	for _, test := range []struct {
+		name        string
+		request     string
+		replyLength int
+	}{
+		{"SOCKS4a", "\x04\x01\x00\x16\x00\x00\x00\x01user\x00srv.example.com\x00", 8},
+		{"SOCKS5", "\x05\x01\x00" + "\x05\x01\x00\x03\x0fsrv.example.com\x00\x16", 2 + 10},
+	} {
+		c, err := net.Dial("tcp", server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(c, test.request+"ping\n")
+		if addr := <-requested; addr != "srv.example.com:22" {
+			t.Errorf("%s: connected to %s", test.name, addr)
+		}
+		if _, err := io.ReadFull(c, make([]byte, test.replyLength)); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		br := bufio.NewReader(c)
+		for _, want := range []string{"hello\n", "ping\n"} {
+			if line, err := br.ReadString('\n'); err != nil || line != want {
+				t.Errorf("%s: got %q, %v; want %q", test.name, line, err, want)
+			}
+		}
+		c.Close()
+	}
+}
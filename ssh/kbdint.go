@@ -0,0 +1,101 @@
+package ssh
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cfstras/pcm/secrets"
+	"github.com/cfstras/pcm/types"
+	"github.com/cfstras/pcm/util"
+)
+
+// Used after the connection's own answers
+var defaultAnswers = []types.Answer{
+	{Question: `(?i)(verification|one[- ]?time|otp|token|authenticator|2fa|code)`,
+		Source: types.AnswerTOTP},
+	{Question: `(?i)pass(word|code|phrase)?`, Source: types.AnswerPassword},
+}
+
+// keyboardInteractive answers questions from the stored password, the TOTP
+// secret and the configured answers of conn. Everything else is asked on the
+// terminal.
+func (inst *instance) keyboardInteractive(conn *types.Connection) ssh.KeyboardInteractiveChallenge {
+	type rule struct {
+		re     *regexp.Regexp
+		answer types.Answer
+	}
+	var rules []rule
+	for _, a := range append(append([]types.Answer{}, conn.Login.Answers...), defaultAnswers...) {
+		re, err := regexp.Compile(a.Question)
+		if err != nil {
+			inst.yellowln("Warning: ignoring invalid question pattern", a.Question+":", err, "\r")
+			continue
+		}
+		rules = append(rules, rule{re, a})
+	}
+	// When the server asks again, the stored answer was probably wrong
+	answered := make(map[string]bool)
+
+	answer := func(question string) (string, bool) {
+		for _, r := range rules {
+			if !r.re.MatchString(question) {
+				continue
+			}
+			switch r.answer.Source {
+			case types.AnswerPassword:
+				if conn.Login.Password == "" {
+					continue
+				}
+				password, err := secrets.Resolve(conn.Login.Password, PasswordPrompt(inst.terminal))
+				if err != nil {
+					inst.redln(err, "\r")
+					continue
+				}
+				return password, true
+			case types.AnswerTOTP:
+				if conn.Login.TOTPSecret == "" {
+					continue
+				}
+				code, err := util.TOTP(conn.Login.TOTPSecret, time.Now())
+				if err != nil {
+					inst.redln("Generating one-time code:", err, "\r")
+					return "", false
+				}
+				inst.yellowln("Sending one-time code for", strings.TrimSpace(question), "\r")
+				return code, true
+			case types.AnswerText:
+				return r.answer.Value, true
+			default:
+				inst.yellowln("Warning: unknown answer source", r.answer.Source, "\r")
+			}
+		}
+		return "", false
+	}
+
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		if instruction != "" {
+			inst.yellowln(strings.TrimSpace(instruction), "\r")
+		}
+		answers := make([]string, len(questions))
+		for i, q := range questions {
+			if a, ok := answer(q); ok && !answered[q] {
+				answered[q] = true
+				answers[i] = a
+				continue
+			}
+			var err error
+			if echos[i] {
+				answers[i], err = readAnswer(inst.terminal, q)
+			} else {
+				answers[i], err = readPassword(inst.terminal, q)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return answers, nil
+	}
+}
@@ -0,0 +1,391 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/types"
+)
+
+var errWrongPassphrase = errors.New("wrong passphrase")
+
+// Identity files tried when none are configured, same as OpenSSH
+var defaultIdentityFiles = []string{
+	"~/.ssh/id_rsa", "~/.ssh/id_ecdsa", "~/.ssh/id_ed25519", "~/.ssh/id_dsa",
+}
+
+// A private key file. Encrypted keys are only decrypted (and the user asked for
+// the passphrase) once the server accepted the public key.
+type keyFile struct {
+	path string
+	pub  ssh.PublicKey
+	// decrypt is nil for unencrypted keys
+	decrypt func(passphrase []byte) (ssh.Signer, error)
+	signer  ssh.Signer
+}
+
+// loadKeyFile reads an OpenSSH (PEM or openssh-key-v1) or PuTTY (.ppk) private
+// key.
+func loadKeyFile(path string) (*keyFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte(ppkHeaderPrefix)) {
+		return parsePPK(path, data)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no key found in " + path)
+	}
+	k := &keyFile{path: path}
+	switch {
+	case block.Type == "OPENSSH PRIVATE KEY":
+		return k, k.parseOpenSSH(block.Bytes)
+	case strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED"):
+		k.decrypt = func(passphrase []byte) (ssh.Signer, error) {
+			s, err := ssh.ParsePrivateKeyWithPassphrase(data, passphrase)
+			if err == x509.IncorrectPasswordError {
+				return nil, errWrongPassphrase
+			}
+			return s, err
+		}
+		// without the public key, we have to decrypt before offering the key
+		k.pub, _ = readPublicKey(path + ".pub")
+	case block.Type == "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		k.signer, err = ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		k.signer, err = ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if k.signer != nil {
+		k.pub = k.signer.PublicKey()
+	}
+	return k, nil
+}
+
+func readPublicKey(path string) (ssh.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	return pub, err
+}
+
+// unlock decrypts the key, asking for the passphrase up to three times.
+func (k *keyFile) unlock(terminal types.Terminal) error {
+	if k.signer != nil {
+		return nil
+	}
+	for i := 0; i < 3; i++ {
+		pass, err := readPassword(terminal, "Enter passphrase for key '"+k.path+"': ")
+		if err != nil {
+			return err
+		}
+		k.signer, err = k.decrypt([]byte(pass))
+		if err == errWrongPassphrase {
+			color.Redln("Wrong passphrase.\r")
+			continue
+		} else if err != nil {
+			return err
+		}
+		k.pub = k.signer.PublicKey()
+		return nil
+	}
+	return errors.New("could not decrypt " + k.path)
+}
+
+// keyFileSigner offers the public key of a keyFile and only decrypts the
+// private key when a signature is needed.
+type keyFileSigner struct {
+	key      *keyFile
+	terminal types.Terminal
+	// called after the key was used, if not nil
+	used func(*keyFile)
+}
+
+func (s *keyFileSigner) PublicKey() ssh.PublicKey {
+	return s.key.pub
+}
+
+func (s *keyFileSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	if err := s.key.unlock(s.terminal); err != nil {
+		return nil, err
+	}
+	sig, err := s.key.signer.Sign(rand, data)
+	if err == nil && s.used != nil {
+		s.used(s.key)
+	}
+	return sig, err
+}
+
+// identitySigners loads the given key files. Missing files and keys that
+// cannot be read are skipped with a warning. Loaded keys are kept in inst.keys,
+// so each passphrase is only asked for once. Keys that signed a login are added
+// to the agent.
+func (inst *instance) identitySigners(paths []string) []*detectingSigner {
+	terminal, cache := inst.terminal, inst.keys
+	var signers []*detectingSigner
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		path = replaceHome(path)
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		k, ok := cache[path]
+		if !ok {
+			var err error
+			if k, err = loadKeyFile(path); err != nil {
+				inst.yellowln("Warning: could not load key", path+":", err, "\r")
+			} else if k.pub == nil {
+				if err := k.unlock(terminal); err != nil {
+					inst.yellowln("Warning: skipping key", path+":", err, "\r")
+					k = nil
+				}
+			}
+			cache[path] = k
+		}
+		if k == nil {
+			continue
+		}
+		signers = append(signers, &detectingSigner{
+			inner: &keyFileSigner{k, terminal, inst.addToAgent},
+			name:  path,
+		})
+	}
+	return signers
+}
+
+func replaceHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home := os.Getenv("HOME")
+		if home == "" {
+			home = os.Getenv("USERPROFILE")
+		}
+		return home + path[1:]
+	}
+	return path
+}
+
+// openssh-key-v1 format, see
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
+
+const openSSHMagic = "openssh-key-v1\x00"
+
+type openSSHKeyFile struct {
+	CipherName   string
+	KdfName      string
+	KdfOpts      string
+	NumKeys      uint32
+	PubKey       []byte
+	PrivKeyBlock []byte
+}
+
+func (k *keyFile) parseOpenSSH(data []byte) error {
+	if !bytes.HasPrefix(data, []byte(openSSHMagic)) {
+		return errors.New("invalid openssh private key format")
+	}
+	var w openSSHKeyFile
+	if err := ssh.Unmarshal(data[len(openSSHMagic):], &w); err != nil {
+		return err
+	}
+	if w.NumKeys != 1 {
+		return fmt.Errorf("unsupported number of keys: %d", w.NumKeys)
+	}
+	pub, err := ssh.ParsePublicKey(w.PubKey)
+	if err != nil {
+		return err
+	}
+	k.pub = pub
+
+	if w.CipherName == "none" {
+		k.signer, err = parseOpenSSHPrivateBlock(w.PrivKeyBlock)
+		return err
+	}
+	if w.KdfName != "bcrypt" {
+		return errors.New("unsupported key derivation " + w.KdfName)
+	}
+	var opts struct {
+		Salt   string
+		Rounds uint32
+	}
+	if err := ssh.Unmarshal([]byte(w.KdfOpts), &opts); err != nil {
+		return err
+	}
+	var keyLen int
+	switch w.CipherName {
+	case "aes128-ctr", "aes128-cbc":
+		keyLen = 16
+	case "aes192-ctr", "aes192-cbc":
+		keyLen = 24
+	case "aes256-ctr", "aes256-cbc":
+		keyLen = 32
+	default:
+		return errors.New("unsupported cipher " + w.CipherName)
+	}
+	mode := w.CipherName[len(w.CipherName)-3:]
+
+	k.decrypt = func(passphrase []byte) (ssh.Signer, error) {
+		derived := bcryptPBKDF(passphrase, []byte(opts.Salt), int(opts.Rounds),
+			keyLen+aes.BlockSize)
+		block, err := aes.NewCipher(derived[:keyLen])
+		if err != nil {
+			return nil, err
+		}
+		iv := derived[keyLen:]
+		if len(w.PrivKeyBlock)%aes.BlockSize != 0 {
+			return nil, errors.New("invalid encrypted key length")
+		}
+		plain := make([]byte, len(w.PrivKeyBlock))
+		if mode == "ctr" {
+			cipher.NewCTR(block, iv).XORKeyStream(plain, w.PrivKeyBlock)
+		} else {
+			cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, w.PrivKeyBlock)
+		}
+		return parseOpenSSHPrivateBlock(plain)
+	}
+	return nil
+}
+
+func parseOpenSSHPrivateBlock(data []byte) (ssh.Signer, error) {
+	// for encrypted keys, this is how a wrong passphrase shows
+	if len(data) < 8 || !bytes.Equal(data[0:4], data[4:8]) {
+		return nil, errWrongPassphrase
+	}
+	var pk1 struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Rest    []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(data, &pk1); err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch pk1.Keytype {
+	case ssh.KeyAlgoRSA:
+		var k struct {
+			N, E, D, Iqmp, P, Q *big.Int
+			Comment             string
+			Pad                 []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(pk1.Rest, &k); err != nil {
+			return nil, err
+		}
+		rsaKey := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: k.N, E: int(k.E.Int64())},
+			D:         k.D,
+			Primes:    []*big.Int{k.P, k.Q},
+		}
+		if err := rsaKey.Validate(); err != nil {
+			return nil, err
+		}
+		rsaKey.Precompute()
+		key = rsaKey
+	case ssh.KeyAlgoDSA:
+		var k struct {
+			P, Q, G, Y, X *big.Int
+			Comment       string
+			Pad           []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(pk1.Rest, &k); err != nil {
+			return nil, err
+		}
+		key = &dsa.PrivateKey{
+			PublicKey: dsa.PublicKey{
+				Parameters: dsa.Parameters{P: k.P, Q: k.Q, G: k.G},
+				Y:          k.Y,
+			},
+			X: k.X,
+		}
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		var k struct {
+			Curve   string
+			Pub     []byte
+			D       *big.Int
+			Comment string
+			Pad     []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(pk1.Rest, &k); err != nil {
+			return nil, err
+		}
+		ecKey, err := ecdsaKey(k.Curve, k.Pub, k.D)
+		if err != nil {
+			return nil, err
+		}
+		key = ecKey
+	case ssh.KeyAlgoED25519:
+		var k struct {
+			Pub     []byte
+			Priv    []byte
+			Comment string
+			Pad     []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(pk1.Rest, &k); err != nil {
+			return nil, err
+		}
+		if len(k.Priv) != ed25519.PrivateKeySize {
+			return nil, errors.New("private key unexpected length")
+		}
+		key = ed25519.PrivateKey(k.Priv)
+	default:
+		return nil, errors.New("unsupported key type " + pk1.Keytype)
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+func ecdsaKey(curveName string, pub []byte, d *big.Int) (*ecdsa.PrivateKey, error) {
+	var curve elliptic.Curve
+	switch curveName {
+	case "nistp256":
+		curve = elliptic.P256()
+	case "nistp384":
+		curve = elliptic.P384()
+	case "nistp521":
+		curve = elliptic.P521()
+	default:
+		return nil, errors.New("unsupported curve " + curveName)
+	}
+	x, y := elliptic.Unmarshal(curve, pub)
+	if x == nil {
+		return nil, errors.New("invalid ecdsa public key")
+	}
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+		D:         d,
+	}, nil
+}
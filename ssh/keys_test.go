@@ -0,0 +1,128 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The keys in testdata: each private key file holds the key of a .pub file.
+// Encrypted ones have the passphrase "correct horse".
+var testKeyFiles = []struct {
+	file, pub string
+	encrypted bool
+}{
+	{"ecdsa.pem", "ecdsa.pub", false},
+	{"ecdsa_pkcs8.pem", "ecdsa.pub", false},
+	{"id_ecdsa", "ecdsa.pub", false},
+	{"id_ecdsa_encrypted", "ecdsa.pub", true},
+	{"id_ed25519", "ed25519.pub", false},
+	{"rsa.pem", "rsa_encrypted.pem.pub", false},
+	{"rsa_encrypted.pem", "rsa_encrypted.pem.pub", true},
+	{"rsa-v2.ppk", "rsa_encrypted.pem.pub", false},
+	{"rsa-v2-encrypted.ppk", "rsa_encrypted.pem.pub", true},
+	{"ecdsa-v3.ppk", "ecdsa.pub", false},
+	{"ecdsa-v3-encrypted.ppk", "ecdsa.pub", true},
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	for _, test := range testKeyFiles {
+		want, err := readPublicKey(filepath.Join("testdata", test.pub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, err := loadKeyFile(filepath.Join("testdata", test.file))
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+			continue
+		}
+		// the public key is known before decrypting, to offer it
+		if k.pub == nil || !bytes.Equal(k.pub.Marshal(), want.Marshal()) {
+			t.Errorf("%s: wrong public key", test.file)
+		}
+		if (k.signer == nil) != test.encrypted {
+			t.Errorf("%s: encrypted is %v, want %v", test.file, k.signer == nil, test.encrypted)
+		}
+		if test.encrypted {
+			if _, err := k.decrypt([]byte("battery staple")); err != errWrongPassphrase {
+				t.Errorf("%s: wrong passphrase: got %v, want errWrongPassphrase", test.file, err)
+			}
+			if err := k.unlock(newTestTerminal("wrong\ncorrect horse\n")); err != nil {
+				t.Errorf("%s: %v", test.file, err)
+				continue
+			}
+		}
+		checkSigner(t, test.file, k.signer, want)
+	}
+}
+
+func checkSigner(t *testing.T, name string, signer ssh.Signer, want ssh.PublicKey) {
+	if !bytes.Equal(signer.PublicKey().Marshal(), want.Marshal()) {
+		t.Errorf("%s: the private key does not match the public key", name)
+		return
+	}
+	data := []byte("session data")
+	sig, err := signer.Sign(rand.Reader, data)
+	if err != nil {
+		t.Errorf("%s: signing: %v", name, err)
+	} else if err := want.Verify(data, sig); err != nil {
+		t.Errorf("%s: signature does not verify: %v", name, err)
+	}
+}
+
+func TestUnlockGivesUp(t *testing.T) {
+	k, err := loadKeyFile(filepath.Join("testdata", "ecdsa-v3-encrypted.ppk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.unlock(newTestTerminal("a\nb\nc\ncorrect horse\n")); err == nil {
+		t.Error("unlocked after three wrong passphrases")
+	}
+}
+
+func TestPPKCorrupt(t *testing.T) {
+	data := []byte("PuTTY-User-Key-File-2: ssh-rsa\r\nEncryption: none\r\n")
+	if _, err := readPPK(data); err == nil {
+		t.Error("incomplete file read")
+	}
+	data = []byte("PuTTY-User-Key-File-1: ssh-rsa\r\n")
+	if _, err := readPPK(data); err == nil {
+		t.Error("version 1 read")
+	}
+
+	// an unencrypted key with another comment fails the MAC
+	f, err := readPPK(mustRead(t, "ecdsa-v3.ppk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.comment = "changed"
+	if _, err := f.signer(nil); err == nil || err == errWrongPassphrase {
+		t.Errorf("changed file: got %v, want a MAC mismatch", err)
+	}
+}
+
+// The known answer test of OpenBSD's bcrypt_pbkdf
+func TestBcryptPBKDF(t *testing.T) {
+	want := "5bbf0cc293587f1c3635555c27796598d47e579071bf427e9d8fbe842aba34d9"
+	if got := hex.EncodeToString(bcryptPBKDF([]byte("password"), []byte("salt"), 4, 32)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// longer keys are interleaved from several blocks
+	long := bcryptPBKDF([]byte("password"), []byte("salt"), 4, 48)
+	if len(long) != 48 || bytes.Equal(long[:32], bcryptPBKDF([]byte("password"), []byte("salt"), 4, 32)) {
+		t.Errorf("48 byte key %x", long)
+	}
+}
+
+func mustRead(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
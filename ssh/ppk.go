@@ -0,0 +1,265 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cfstras/pcm/util/argon2"
+)
+
+// PuTTY private key files, version 2 and 3. See
+// https://the.earth.li/~sgtatham/putty/0.76/htmldoc/AppendixC.html
+
+const ppkHeaderPrefix = "PuTTY-User-Key-File-"
+
+type ppkFile struct {
+	version    int
+	algorithm  string
+	encryption string
+	comment    string
+	public     []byte
+	private    []byte
+	mac        []byte
+	headers    map[string]string
+}
+
+func parsePPK(path string, data []byte) (*keyFile, error) {
+	f, err := readPPK(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	pub, err := ssh.ParsePublicKey(f.public)
+	if err != nil {
+		return nil, err
+	}
+	k := &keyFile{path: path, pub: pub}
+	switch f.encryption {
+	case "none":
+		k.signer, err = f.signer(nil)
+		return k, err
+	case "aes256-cbc":
+		k.decrypt = f.signer
+		return k, nil
+	default:
+		return nil, errors.New("unsupported PPK encryption " + f.encryption)
+	}
+}
+
+func readPPK(data []byte) (*ppkFile, error) {
+	f := &ppkFile{headers: make(map[string]string)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	readLines := func(count string) ([]byte, error) {
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return nil, err
+		}
+		var b64 string
+		for i := 0; i < n && scanner.Scan(); i++ {
+			b64 += strings.TrimSpace(scanner.Text())
+		}
+		return base64.StdEncoding.DecodeString(b64)
+	}
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		split := strings.SplitN(line, ": ", 2)
+		if len(split) != 2 {
+			return nil, errors.New("invalid PPK line: " + line)
+		}
+		key, value := split[0], split[1]
+		var err error
+		switch {
+		case strings.HasPrefix(key, ppkHeaderPrefix):
+			f.version, err = strconv.Atoi(key[len(ppkHeaderPrefix):])
+			f.algorithm = value
+		case key == "Encryption":
+			f.encryption = value
+		case key == "Comment":
+			f.comment = value
+		case key == "Public-Lines":
+			f.public, err = readLines(value)
+		case key == "Private-Lines":
+			f.private, err = readLines(value)
+		case key == "Private-MAC":
+			f.mac, err = hex.DecodeString(value)
+		default:
+			f.headers[key] = value
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if f.version != 2 && f.version != 3 {
+		return nil, fmt.Errorf("unsupported PPK version %d", f.version)
+	}
+	if f.public == nil || f.private == nil || f.mac == nil {
+		return nil, errors.New("incomplete PPK file")
+	}
+	return f, nil
+}
+
+// keys derives cipher key, IV and MAC key from the passphrase.
+func (f *ppkFile) keys(passphrase []byte) (cipherKey, iv, macKey []byte, err error) {
+	if f.version == 2 {
+		digest := func(seq byte) []byte {
+			h := sha1.New()
+			h.Write([]byte{0, 0, 0, seq})
+			h.Write(passphrase)
+			return h.Sum(nil)
+		}
+		cipherKey = append(digest(0), digest(1)...)[:32]
+		iv = make([]byte, aes.BlockSize)
+		h := sha1.New()
+		h.Write([]byte("putty-private-key-file-mac-key"))
+		if f.encryption != "none" {
+			h.Write(passphrase)
+		}
+		return cipherKey, iv, h.Sum(nil), nil
+	}
+
+	if f.encryption == "none" {
+		return nil, nil, []byte{}, nil
+	}
+	salt, err := hex.DecodeString(f.headers["Argon2-Salt"])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var params [3]uint32
+	for i, name := range []string{"Argon2-Memory", "Argon2-Passes", "Argon2-Parallelism"} {
+		v, err := strconv.ParseUint(f.headers[name], 10, 32)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		params[i] = uint32(v)
+	}
+	memory, passes, parallelism := params[0], params[1], uint8(params[2])
+	modes := map[string]int{"Argon2d": argon2.Argon2d, "Argon2i": argon2.Argon2i,
+		"Argon2id": argon2.Argon2id}
+	mode, ok := modes[f.headers["Key-Derivation"]]
+	if !ok {
+		return nil, nil, nil, errors.New("unsupported key derivation " +
+			f.headers["Key-Derivation"])
+	}
+	derived := argon2.Key(mode, passphrase, salt, nil, nil, passes, memory,
+		parallelism, 80)
+	return derived[:32], derived[32:48], derived[48:], nil
+}
+
+// signer decrypts and verifies the private part.
+func (f *ppkFile) signer(passphrase []byte) (ssh.Signer, error) {
+	cipherKey, iv, macKey, err := f.keys(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	private := f.private
+	if f.encryption != "none" {
+		if len(private)%aes.BlockSize != 0 {
+			return nil, errors.New("invalid encrypted key length")
+		}
+		block, err := aes.NewCipher(cipherKey)
+		if err != nil {
+			return nil, err
+		}
+		private = make([]byte, len(f.private))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(private, f.private)
+	}
+
+	var mac hash.Hash
+	if f.version == 2 {
+		mac = hmac.New(sha1.New, macKey)
+	} else {
+		mac = hmac.New(sha256.New, macKey)
+	}
+	for _, field := range [][]byte{[]byte(f.algorithm), []byte(f.encryption),
+		[]byte(f.comment), f.public, private} {
+		mac.Write(ssh.Marshal(struct{ B []byte }{field}))
+	}
+	if !hmac.Equal(mac.Sum(nil), f.mac) {
+		if f.encryption != "none" {
+			return nil, errWrongPassphrase
+		}
+		return nil, errors.New("PPK file is corrupt (MAC mismatch)")
+	}
+
+	pub, err := ssh.ParsePublicKey(f.public)
+	if err != nil {
+		return nil, err
+	}
+	cryptoPub := pub.(ssh.CryptoPublicKey).CryptoPublicKey()
+
+	var key interface{}
+	switch pub := cryptoPub.(type) {
+	case *rsa.PublicKey:
+		var k struct {
+			D, P, Q, Iqmp *big.Int
+			Pad           []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(private, &k); err != nil {
+			return nil, err
+		}
+		rsaKey := &rsa.PrivateKey{PublicKey: *pub, D: k.D,
+			Primes: []*big.Int{k.P, k.Q}}
+		if err := rsaKey.Validate(); err != nil {
+			return nil, err
+		}
+		rsaKey.Precompute()
+		key = rsaKey
+	case *dsa.PublicKey:
+		var k struct {
+			X   *big.Int
+			Pad []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(private, &k); err != nil {
+			return nil, err
+		}
+		key = &dsa.PrivateKey{PublicKey: *pub, X: k.X}
+	case *ecdsa.PublicKey:
+		var k struct {
+			D   *big.Int
+			Pad []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(private, &k); err != nil {
+			return nil, err
+		}
+		key = &ecdsa.PrivateKey{PublicKey: *pub, D: k.D}
+	case ed25519.PublicKey:
+		var k struct {
+			Seed []byte
+			Pad  []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(private, &k); err != nil {
+			return nil, err
+		}
+		if len(k.Seed) != 32 {
+			return nil, errors.New("private key unexpected length")
+		}
+		key = ed25519.PrivateKey(append(k.Seed, pub...))
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", cryptoPub)
+	}
+	return ssh.NewSignerFromKey(key)
+}
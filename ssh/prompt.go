@@ -0,0 +1,73 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cfstras/pcm/types"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// A terminal that changes or records its input, like a recording, gives pcm's
+// own prompts the input as it comes in, e.g. the *os.File of the console.
+type rawInput interface {
+	RawStdin() io.Reader
+}
+
+// RawStdin returns the input of t for pcm's own prompts.
+func RawStdin(t types.Terminal) io.Reader {
+	if r, ok := t.(rawInput); ok {
+		return r.RawStdin()
+	}
+	return t.Stdin()
+}
+
+// readPassword asks for a secret on the terminal, without echoing it if the
+// terminal supports that.
+func readPassword(t types.Terminal, prompt string) (string, error) {
+	fmt.Fprint(t.Stderr(), prompt)
+	defer fmt.Fprint(t.Stderr(), "\r\n")
+	in := RawStdin(t)
+	if f, ok := in.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+		b, err := terminal.ReadPassword(int(f.Fd()))
+		return string(b), err
+	}
+	return readLine(in)
+}
+
+// PasswordPrompt returns a function asking for secrets on t, like the master
+// password of a database secrets are kept in.
+func PasswordPrompt(t types.Terminal) func(prompt string) (string, error) {
+	return func(prompt string) (string, error) {
+		return readPassword(t, prompt)
+	}
+}
+
+// readAnswer asks a question on the terminal and returns the answer line.
+func readAnswer(t types.Terminal, prompt string) (string, error) {
+	fmt.Fprint(t.Stderr(), prompt)
+	return readLine(RawStdin(t))
+}
+
+// readLine reads up to a line ending, one byte at a time so nothing after the
+// line is consumed.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' || b[0] == '\r' {
+				return string(line), nil
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return string(line), nil
+			}
+			return string(line), err
+		}
+	}
+}
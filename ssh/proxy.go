@@ -0,0 +1,271 @@
+package ssh
+
+import (
+	"bufio"
+	context2 "context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/cfstras/pcm/types"
+)
+
+func init() {
+	proxy.RegisterDialerType("http", newHTTPConnectDialer)
+	// the SOCKS5 dialer always lets the proxy resolve host names
+	proxy.RegisterDialerType("socks5h", func(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+		u2 := *u
+		u2.Scheme = "socks5"
+		return proxy.FromURL(&u2, forward)
+	})
+}
+
+// proxyFor returns the proxy setting for conn, falling back to the global one.
+func (inst *instance) proxyFor(conn *types.Connection) string {
+	var p string
+	if inst.settings.Config != nil {
+		p = inst.settings.Config.ProxyFor(conn)
+	} else {
+		p = conn.Options.Proxy
+	}
+	if p == "" {
+		p = inst.settings.Proxy
+	}
+	if p == types.ProxyNone {
+		return ""
+	}
+	return strings.TrimSpace(p)
+}
+
+// dialTransport opens the connection to conn at addr, directly or through its
+// proxy.
+func (inst *instance) dialTransport(ctx context2.Context, conn *types.Connection,
+	addr string, timeout time.Duration) (net.Conn, error) {
+
+	spec := inst.proxyFor(conn)
+	d := &net.Dialer{Timeout: timeout}
+	if spec == "" {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	if u, ok := ProxyURL(spec); ok {
+		dialer, err := proxy.FromURL(u, d)
+		if err != nil {
+			return nil, err
+		}
+		inst.yellowln("Connecting via proxy", u.Host, "\r")
+		return dialCancelable(ctx, func() (net.Conn, error) {
+			c, err := dialer.Dial("tcp", addr)
+			if err != nil {
+				return nil, fmt.Errorf("proxy %s: %v", u.Host, err)
+			}
+			return c, nil
+		})
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	return inst.proxyCommand(spec, host, port, conn.Login.User, addr)
+}
+
+// ProxyFor returns the proxy conn is connected through with settings, as
+// types.Options.Proxy, or "" for none.
+func ProxyFor(conn *types.Connection, settings Settings) string {
+	return (&instance{settings: settings}).proxyFor(conn)
+}
+
+// ProxyURL parses spec if it is the URL of a SOCKS5 or HTTP proxy rather than
+// a command.
+func ProxyURL(spec string) (*url.URL, bool) {
+	u, err := url.Parse(spec)
+	if err != nil || u.Host == "" ||
+		(u.Scheme != "socks5" && u.Scheme != "socks5h" && u.Scheme != "http") {
+		return nil, false
+	}
+	return u, true
+}
+
+// DialProxy connects to addr through the SOCKS5 or HTTP proxy at u.
+func DialProxy(u *url.URL, addr string) (net.Conn, error) {
+	dialer, err := proxy.FromURL(u, &net.Dialer{Timeout: dialTimeout})
+	if err != nil {
+		return nil, err
+	}
+	c, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %v", u.Host, err)
+	}
+	return c, nil
+}
+
+// dialCancelable runs dial, and gives up waiting for it when ctx is done.
+func dialCancelable(ctx context2.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := dial()
+		done <- result{c, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// HTTP proxies, using the CONNECT method
+type httpConnectDialer struct {
+	host    string
+	auth    string
+	forward proxy.Dialer
+}
+
+func newHTTPConnectDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	d := &httpConnectDialer{host: u.Host, forward: forward}
+	if u.Port() == "" {
+		d.host = net.JoinHostPort(u.Host, "8080")
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		d.auth = "Basic " + base64.StdEncoding.EncodeToString(
+			[]byte(u.User.Username()+":"+password))
+	}
+	return d, nil
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	c, err := d.forward.Dial(network, d.host)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	rd := bufio.NewReader(c)
+	resp, err := http.ReadResponse(rd, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, errors.New("CONNECT to " + addr + " failed: " + resp.Status)
+	}
+	// the server may already have sent something
+	return &bufferedConn{c, rd}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.rd.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// proxyCommand starts command like OpenSSH's ProxyCommand and talks to its
+// stdin and stdout. %h, %p and %r are replaced with host, port and user.
+func (inst *instance) proxyCommand(command, host, port, user, addr string) (net.Conn, error) {
+	command = strings.NewReplacer("%%", "%", "%h", host, "%p", port,
+		"%r", user).Replace(command)
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	cmd.Env, cmd.Stderr = inst.commandEnv(), inst.terminal.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	inst.yellowln("Connecting via command", command, "\r")
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("proxy command %s: %v", command, err)
+	}
+	return &commandConn{cmd: cmd, stdin: stdin, stdout: stdout,
+		addr: commandAddr(addr)}, nil
+}
+
+// A net.Conn to a proxy command
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.Reader
+	addr   commandAddr
+}
+
+func (c *commandConn) Read(b []byte) (int, error)  { return c.stdout.Read(b) }
+func (c *commandConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+func (c *commandConn) Close() error {
+	c.stdin.Close()
+	if c.cmd.Process != nil {
+		c.cmd.Process.Signal(os.Interrupt)
+		go func() {
+			time.Sleep(time.Second)
+			c.cmd.Process.Kill()
+		}()
+	}
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr                { return commandAddr("") }
+func (c *commandConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// The address a proxy command connects to
+type commandAddr string
+
+func (a commandAddr) Network() string { return "proxy-command" }
+func (a commandAddr) String() string  { return string(a) }
@@ -0,0 +1,292 @@
+package ssh
+
+import (
+	"bufio"
+	context2 "context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cfstras/pcm/types"
+)
+
+// listen runs serve for each connection to a new local listener, and returns
+// its address.
+func listen(t *testing.T, serve func(net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				serve(c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// echoServer greets and then echoes everything
+func echoServer(t *testing.T) string {
+	return listen(t, func(c net.Conn) {
+		io.WriteString(c, "hello\n")
+		io.Copy(c, c)
+	})
+}
+
+// socks5Server is a SOCKS5 proxy which only connects to the echo server at
+// target. It records the addresses it was asked for.
+type socks5Server struct {
+	user, password string
+	target         string
+	requested      chan string
+}
+
+func (s *socks5Server) serve(c net.Conn) {
+	br := bufio.NewReader(c)
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil
+		}
+		return b
+	}
+	greeting := read(2)
+	if greeting == nil || greeting[0] != 5 {
+		return
+	}
+	methods := string(read(int(greeting[1])))
+	if s.user == "" {
+		c.Write([]byte{5, 0})
+	} else if strings.Contains(methods, "\x02") {
+		c.Write([]byte{5, 2})
+		version := read(2)
+		user := string(read(int(version[1])))
+		password := string(read(int(read(1)[0])))
+		if user != s.user || password != s.password {
+			c.Write([]byte{1, 1})
+			return
+		}
+		c.Write([]byte{1, 0})
+	} else {
+		c.Write([]byte{5, 0xff})
+		return
+	}
+
+	request := read(4)
+	if request == nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		host = net.IP(read(4)).String()
+	case 3:
+		host = string(read(int(read(1)[0])))
+	case 4:
+		host = net.IP(read(16)).String()
+	}
+	port := binary.BigEndian.Uint16(read(2))
+	s.requested <- net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	target, err := net.Dial("tcp", s.target)
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	go io.Copy(target, br)
+	io.Copy(c, target)
+}
+
+// dialVia connects to addr with the proxy setting spec, like for a connection.
+func dialVia(spec, addr string) (net.Conn, error) {
+	conn := &types.Connection{}
+	conn.Login.User = "u"
+	conn.Options.Proxy = spec
+	inst := &instance{terminal: newTestTerminal("")}
+	ctx, cancel := context2.WithTimeout(context2.Background(), 5*time.Second)
+	defer cancel()
+	return inst.dialTransport(ctx, conn, addr, 5*time.Second)
+}
+
+// checkEcho checks c is connected to an echo server.
+func checkEcho(t *testing.T, name string, c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+	if line, err := br.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Errorf("%s: greeting %q, %v", name, line, err)
+		return
+	}
+	io.WriteString(c, "ping\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Errorf("%s: echo %q, %v", name, line, err)
+	}
+}
+
+func TestSOCKS5(t *testing.T) {
+	s := &socks5Server{target: echoServer(t), requested: make(chan string, 1)}
+	proxy := listen(t, s.serve)
+
+	for _, scheme := range []string{"socks5", "socks5h"} {
+		c, err := dialVia(scheme+"://"+proxy, "srv.example.com:22")
+		if err != nil {
+			t.Errorf("%s: %v", scheme, err)
+			continue
+		}
+		// the proxy resolves the host name
+		if addr := <-s.requested; addr != "srv.example.com:22" {
+			t.Errorf("%s: proxy asked for %s", scheme, addr)
+		}
+		checkEcho(t, scheme, c)
+	}
+}
+
+func TestSOCKS5Auth(t *testing.T) {
+	s := &socks5Server{user: "alice", password: "s3cret", target: echoServer(t),
+		requested: make(chan string, 1)}
+	proxy := listen(t, s.serve)
+
+	c, err := dialVia("socks5://alice:s3cret@"+proxy, "srv.example.com:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-s.requested
+	checkEcho(t, "socks5 with password", c)
+
+	if c, err := dialVia("socks5://alice:wrong@"+proxy, "srv.example.com:22"); err == nil {
+		c.Close()
+		t.Error("wrong proxy password accepted")
+	}
+}
+
+// httpProxy is an HTTP proxy which answers CONNECT, connecting to the echo
+// server at target. With auth set, it wants that Proxy-Authorization.
+func httpProxy(t *testing.T, target, auth string) string {
+	return listen(t, func(c net.Conn) {
+		br := bufio.NewReader(c)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		if req.Method != "CONNECT" || req.Host != "srv.example.com:22" {
+			io.WriteString(c, "HTTP/1.1 400 Bad Request\r\n\r\n")
+			return
+		}
+		if auth != "" && req.Header.Get("Proxy-Authorization") != auth {
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+				"Proxy-Authenticate: Basic realm=\"test\"\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		defer upstream.Close()
+		// the greeting of the server may come with the response
+		greeting := make([]byte, 6)
+		io.ReadFull(upstream, greeting)
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n"+string(greeting))
+		go io.Copy(upstream, br)
+		io.Copy(c, upstream)
+	})
+}
+
+func TestHTTPConnect(t *testing.T) {
+	proxy := httpProxy(t, echoServer(t), "")
+	c, err := dialVia("http://"+proxy, "srv.example.com:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, "http", c)
+}
+
+func TestHTTPConnectAuth(t *testing.T) {
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:s3cret"))
+	proxy := httpProxy(t, echoServer(t), auth)
+
+	c, err := dialVia("http://alice:s3cret@"+proxy, "srv.example.com:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, "http with password", c)
+
+	for _, spec := range []string{"http://" + proxy, "http://alice:wrong@" + proxy} {
+		_, err := dialVia(spec, "srv.example.com:22")
+		if err == nil || !strings.Contains(err.Error(), "407") {
+			t.Errorf("%s: got %v, want a 407 error", spec, err)
+		}
+	}
+}
+
+func TestProxyCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a unix shell")
+	}
+	c, err := dialVia("echo %r@%h:%p 100%%; exec cat", "srv.example.com:2222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RemoteAddr().String() != "srv.example.com:2222" {
+		t.Errorf("remote address %s", c.RemoteAddr())
+	}
+	br := bufio.NewReader(c)
+	if line, err := br.ReadString('\n'); err != nil || line != "u@srv.example.com:2222 100%\n" {
+		t.Errorf("got %q, %v", line, err)
+	}
+	io.WriteString(c, "ping\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Errorf("echo %q, %v", line, err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		c.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("closing did not stop the command")
+	}
+}
+
+// The agent socket is passed to proxy commands, not set for pcm.
+func TestProxyCommandAgentSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a unix shell")
+	}
+	before, set := os.LookupEnv("SSH_AUTH_SOCK")
+	inst := &instance{terminal: newTestTerminal(""), agentSocket: "/tmp/pcm-agent/agent.1"}
+	conn := &types.Connection{}
+	conn.Options.Proxy = `echo "$SSH_AUTH_SOCK"`
+	c, err := inst.dialTransport(context2.Background(), conn, "srv.example.com:22", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if line, err := bufio.NewReader(c).ReadString('\n'); err != nil || line != "/tmp/pcm-agent/agent.1\n" {
+		t.Errorf("got %q, %v", line, err)
+	}
+	if after, ok := os.LookupEnv("SSH_AUTH_SOCK"); after != before || ok != set {
+		t.Errorf("SSH_AUTH_SOCK of pcm changed to %q", after)
+	}
+}
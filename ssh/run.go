@@ -0,0 +1,79 @@
+package ssh
+
+import (
+	context2 "context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cfstras/pcm/types"
+)
+
+var errBatch = errors.New("can't ask for input when running non-interactively")
+
+// Run runs command on conn without a terminal, and returns its exit status.
+// The connection is closed when ctx is done. Questions that can't be answered
+// from conn (e.g. about a changed host key) make it fail. Messages about the
+// connection, like new host keys, are written to messages.
+func Run(ctx context2.Context, conn *types.Connection, settings Settings, command string,
+	stdout, stderr, messages io.Writer, saveChanges func(*types.Connection)) (int, error) {
+	settings.Batch = true
+	if messages == nil {
+		messages = ioutil.Discard
+	}
+	inst := newInstance(conn, settings, batchTerminal{messages}, saveChanges)
+
+	client, _, err := inst.dial(ctx, conn)
+	if err != nil {
+		return -1, err
+	}
+	defer client.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-done:
+		}
+	}()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return -1, err
+	}
+	defer session.Close()
+	session.Stdout, session.Stderr = stdout, stderr
+	err = session.Run(command)
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return exitErr.ExitStatus(), nil
+	} else if err != nil {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		return -1, err
+	}
+	return 0, nil
+}
+
+// batchTerminal is used when there is nobody to ask. Its stderr gets the
+// messages.
+type batchTerminal struct {
+	stderr io.Writer
+}
+
+func (batchTerminal) GetSize() (width, height int, err error) { return 80, 24, nil }
+func (batchTerminal) Stdin() io.Reader                        { return batchReader{} }
+func (batchTerminal) Stdout() io.Writer                       { return ioutil.Discard }
+func (t batchTerminal) Stderr() io.Writer                     { return t.stderr }
+func (batchTerminal) ExitRequests() <-chan bool               { return nil }
+func (batchTerminal) Signals() <-chan os.Signal               { return nil }
+func (batchTerminal) MakeRaw()                                {}
+func (batchTerminal) RestoreRaw()                             {}
+
+type batchReader struct{}
+
+func (batchReader) Read([]byte) (int, error) { return 0, errBatch }
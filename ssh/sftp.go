@@ -0,0 +1,40 @@
+package ssh
+
+import (
+	context2 "context"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cfstras/pcm/types"
+)
+
+// SFTP is a file transfer session on a connection.
+type SFTP struct {
+	*sftp.Client
+	client *ssh.Client
+}
+
+// OpenSFTP logs in to conn like Connect does, over its jump hosts and checking
+// the stored host key, and starts the SFTP subsystem. Questions, e.g. for
+// passwords, are asked on terminal.
+func OpenSFTP(conn *types.Connection, settings Settings, terminal types.Terminal,
+	saveChanges func(*types.Connection)) (*SFTP, error) {
+	inst := newInstance(conn, settings, terminal, saveChanges)
+	client, _, err := inst.dial(context2.Background(), conn)
+	if err != nil {
+		return nil, err
+	}
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &SFTP{Client: sftpClient, client: client}, nil
+}
+
+// Close ends the SFTP session and the connection.
+func (s *SFTP) Close() error {
+	s.Client.Close()
+	return s.client.Close()
+}
@@ -0,0 +1,262 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/types"
+)
+
+const x11AuthProtocol = "MIT-MAGIC-COOKIE-1"
+
+// how long a cookie for untrusted forwarding stays valid after the last X11
+// client using it quit, like OpenSSH's default ForwardX11Timeout
+const x11UntrustedTimeout = 1200
+
+// x11Request is the payload of "x11-req", RFC 4254 section 6.3.1
+type x11Request struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	ScreenNumber     uint32
+}
+
+// x11Display is the local X server that X11 channels are relayed to.
+type x11Display struct {
+	network, addr string
+	screen        uint32
+	// the real authentication, which replaces the fake cookie the host got
+	authProtocol string
+	authData     []byte
+	fakeCookie   []byte
+}
+
+// requestX11 asks the host to forward X11 connections of the session, and
+// relays them to $DISPLAY. The host only gets a fake cookie; the real one is
+// put in when a connection comes in.
+func (inst *instance) requestX11(client *ssh.Client, session *ssh.Session) error {
+	mode := inst.conn.Options.X11
+	if mode != types.X11Trusted && mode != types.X11Untrusted {
+		return errors.New("unknown mode " + mode)
+	}
+	display := os.Getenv("DISPLAY")
+	if display == "" {
+		return errors.New("DISPLAY is not set")
+	}
+	d, err := parseDisplay(display)
+	if err != nil {
+		return err
+	}
+	d.authProtocol, d.authData, err = xauthCookie(display, mode == types.X11Untrusted)
+	if err != nil {
+		return err
+	}
+	d.fakeCookie = make([]byte, 16)
+	if _, err := rand.Read(d.fakeCookie); err != nil {
+		return err
+	}
+
+	channels := client.HandleChannelOpen("x11")
+	if channels == nil {
+		return errors.New("X11 is forwarded already")
+	}
+	go func() {
+		for ch := range channels {
+			go d.relay(ch)
+		}
+	}()
+	ok, err := session.SendRequest("x11-req", true, ssh.Marshal(&x11Request{
+		AuthProtocol: x11AuthProtocol,
+		AuthCookie:   hex.EncodeToString(d.fakeCookie),
+		ScreenNumber: d.screen,
+	}))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("the host refused it")
+	}
+	return nil
+}
+
+// parseDisplay finds the X server for a DISPLAY value, "[host]:number[.screen]"
+// or a socket path like the one XQuartz uses.
+func parseDisplay(display string) (*x11Display, error) {
+	if strings.HasPrefix(display, "/") {
+		return &x11Display{network: "unix", addr: display}, nil
+	}
+	i := strings.LastIndex(display, ":")
+	if i == -1 {
+		return nil, errors.New("can't parse DISPLAY " + display)
+	}
+	host, number, screen := display[:i], display[i+1:], "0"
+	if j := strings.Index(number, "."); j != -1 {
+		number, screen = number[:j], number[j+1:]
+	}
+	n, err := strconv.ParseUint(number, 10, 16)
+	if err != nil {
+		return nil, errors.New("can't parse DISPLAY " + display)
+	}
+	s, err := strconv.ParseUint(screen, 10, 32)
+	if err != nil {
+		return nil, errors.New("can't parse DISPLAY " + display)
+	}
+	d := &x11Display{screen: uint32(s)}
+	if host == "" || host == "unix" {
+		d.network, d.addr = "unix", fmt.Sprintf("/tmp/.X11-unix/X%d", n)
+	} else {
+		d.network, d.addr = "tcp", net.JoinHostPort(host, strconv.Itoa(6000+int(n)))
+	}
+	return d, nil
+}
+
+// xauthCookie returns the cookie for display from xauth. For untrusted
+// forwarding, a new cookie is generated that the X server only gives
+// untrusted access. Without a cookie for a trusted display, connections are
+// passed on without authentication.
+func xauthCookie(display string, untrusted bool) (string, []byte, error) {
+	xauth := xauthPath()
+	list := []string{"list", display}
+	if untrusted {
+		dir, err := ioutil.TempDir("", "pcm-xauth")
+		if err != nil {
+			return "", nil, err
+		}
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "xauthfile")
+		out, err := exec.Command(xauth, "-f", file, "generate", display, x11AuthProtocol,
+			"untrusted", "timeout", strconv.Itoa(x11UntrustedTimeout)).CombinedOutput()
+		if err != nil {
+			// the last line says why, the others are about the new file
+			lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+			return "", nil, fmt.Errorf("xauth generate: %v: %s", err, lines[len(lines)-1])
+		}
+		list = []string{"-f", file, "list", display}
+	}
+
+	out, err := exec.Command(xauth, list...).Output()
+	if err != nil && untrusted {
+		return "", nil, fmt.Errorf("xauth list: %v", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[1] == x11AuthProtocol {
+			if data, err := hex.DecodeString(fields[2]); err == nil {
+				return x11AuthProtocol, data, nil
+			}
+		}
+	}
+	if untrusted {
+		return "", nil, errors.New("xauth generated no cookie")
+	}
+	return "", nil, nil
+}
+
+// xauthPath returns the xauth program, which is not in the PATH on some
+// systems.
+func xauthPath() string {
+	if path, err := exec.LookPath("xauth"); err == nil {
+		return path
+	}
+	for _, path := range []string{"/usr/X11R6/bin/xauth", "/opt/X11/bin/xauth"} {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return "xauth"
+}
+
+// relay connects an X11 channel from the host to the local X server.
+func (d *x11Display) relay(newChannel ssh.NewChannel) {
+	ch, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	defer ch.Close()
+
+	setup, err := d.replaceAuth(ch)
+	if err != nil {
+		color.Yellowln("X11:", err, "\r")
+		return
+	}
+	local, err := net.Dial(d.network, d.addr)
+	if err != nil {
+		color.Yellowln("X11:", err, "\r")
+		return
+	}
+	defer local.Close()
+	if _, err := local.Write(setup); err != nil {
+		color.Yellowln("X11:", err, "\r")
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ch, local)
+		ch.CloseWrite()
+		close(done)
+	}()
+	io.Copy(local, ch)
+	if cw, ok := local.(interface {
+		CloseWrite() error
+	}); ok {
+		cw.CloseWrite()
+	}
+	<-done
+}
+
+// replaceAuth reads the connection setup of an X11 client, checks that it
+// has the fake cookie and returns the setup with the real one instead.
+func (d *x11Display) replaceAuth(r io.Reader) ([]byte, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch header[0] {
+	case 'B':
+		order = binary.BigEndian
+	case 'l':
+		order = binary.LittleEndian
+	default:
+		return nil, errors.New("invalid connection setup")
+	}
+	nameLen, dataLen := int(order.Uint16(header[6:])), int(order.Uint16(header[8:]))
+	auth := make([]byte, pad4(nameLen)+pad4(dataLen))
+	if _, err := io.ReadFull(r, auth); err != nil {
+		return nil, err
+	}
+	name := string(auth[:nameLen])
+	data := auth[pad4(nameLen) : pad4(nameLen)+dataLen]
+	if name != x11AuthProtocol || subtle.ConstantTimeCompare(data, d.fakeCookie) != 1 {
+		return nil, errors.New("refused a connection with the wrong cookie")
+	}
+
+	order.PutUint16(header[6:], uint16(len(d.authProtocol)))
+	order.PutUint16(header[8:], uint16(len(d.authData)))
+	setup := append(header, make([]byte, pad4(len(d.authProtocol))+pad4(len(d.authData)))...)
+	copy(setup[12:], d.authProtocol)
+	copy(setup[12+pad4(len(d.authProtocol)):], d.authData)
+	return setup, nil
+}
+
+// pad4 rounds n up to a multiple of 4, as X11 pads strings.
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
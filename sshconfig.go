@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/sshconfig"
+	"github.com/cfstras/pcm/types"
+)
+
+const (
+	sshConfigRootName = "--ssh_config--"
+)
+
+var (
+	sshConfigPath string = "~/.ssh/config"
+)
+
+func importSSHConfig(conf *types.Configuration) error {
+	hosts, warnings, err := sshconfig.Load(sshConfigPath)
+	for _, w := range warnings {
+		color.Yellowln("Warning: skipping", w)
+	}
+	if err != nil {
+		return err
+	}
+	aliases := make(map[string]bool)
+	for _, h := range hosts {
+		aliases[h.Alias] = true
+	}
+
+	container := types.Container{}
+	container.Name = sshConfigRootName
+	for _, h := range hosts {
+		conn := types.Connection{}
+		conn.Info = types.Info{Name: h.Alias,
+			Protocol:    "SSH",
+			Host:        h.HostName,
+			Port:        h.Port,
+			Description: "from " + h.Source}
+		conn.Name = conn.Info.Name
+		conn.Login.User = h.User
+		if conn.Login.User == "" {
+			conn.Login.User = os.Getenv("USER")
+		}
+		conn.Options.IdentityFiles = h.IdentityFiles
+		if h.ProxyJump != "" {
+			for _, j := range strings.Split(h.ProxyJump, ",") {
+				j = strings.TrimSpace(j)
+				if aliases[j] {
+					// point to the imported connection, so its settings apply
+					j = "/" + sshConfigRootName + "/" + j
+				}
+				conn.Options.JumpHosts = append(conn.Options.JumpHosts, j)
+			}
+		}
+		for _, f := range h.LocalForwards {
+			if fw, ok := parseSSHConfigForward(f); ok {
+				conn.Options.Forwards = append(conn.Options.Forwards, fw)
+			}
+		}
+		if h.ForwardX11 && h.ForwardX11Trusted {
+			conn.Options.X11 = types.X11Trusted
+		} else if h.ForwardX11 {
+			conn.Options.X11 = types.X11Untrusted
+		}
+		conn.Options.RemoteCommand = h.RemoteCommand
+		for _, e := range h.SetEnv {
+			if i := strings.Index(e, "="); i > 0 {
+				conn.Options.Env = append(conn.Options.Env, types.EnvVar{Name: e[:i], Value: e[i+1:]})
+			}
+		}
+		conn.Options.NoPty = h.RequestTTY == "no"
+		conn.KnownHosts = &types.KnownHosts{Files: h.UserKnownHostsFiles, Alias: h.HostKeyAlias}
+		container.Connections = append(container.Connections, conn)
+	}
+	conf.Root.Containers = append(conf.Root.Containers, container)
+	return nil
+}
+
+// parses LocalForward arguments: "[bind_address:]port host:hostport"
+func parseSSHConfigForward(s string) (types.Forward, bool) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return types.Forward{}, false
+	}
+	return types.Forward{Type: types.ForwardLocal,
+		Listen: fields[0], Target: fields[1]}, true
+}
+
+// isImported returns whether the connection was not loaded from
+// connections.xml, but from another source which pcm cannot write to.
+func isImported(conn *types.Connection) bool {
+	for _, root := range []string{awsRootName, sshConfigRootName} {
+		if strings.HasPrefix(conn.Path(), "/"+root+"/") {
+			return true
+		}
+	}
+	return false
+}
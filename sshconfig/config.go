@@ -0,0 +1,382 @@
+// Package sshconfig reads the subset of OpenSSH client configuration files
+// (ssh_config(5)) that pcm can turn into connections.
+package sshconfig
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maximum nesting of Include directives, same as OpenSSH
+const maxIncludeDepth = 16
+
+// Host is the effective configuration for one Host alias.
+type Host struct {
+	Alias         string
+	HostName      string
+	Port          uint16
+	User          string
+	IdentityFiles []string
+	ProxyJump     string
+	// LocalForwards are kept in ssh_config syntax: "[bind:]port host:hostport"
+	LocalForwards []string
+
+	ForwardX11, ForwardX11Trusted bool
+
+	RemoteCommand string
+	// SetEnv entries, "NAME=value"
+	SetEnv     []string
+	RequestTTY string
+
+	// Where the host key is checked, see ssh_config(5)
+	UserKnownHostsFiles []string
+	HostKeyAlias        string
+
+	// File the alias was first declared in
+	Source string
+}
+
+type option struct {
+	key   string // lowercased
+	value string
+	// the unquoted arguments value was joined from
+	args []string
+}
+
+type block struct {
+	patterns []string
+	options  []option
+	source   string
+}
+
+type parser struct {
+	home     string
+	blocks   []*block
+	warnings []string
+}
+
+// Load parses the configuration file at path, following Include directives,
+// and returns one Host per concrete (non-wildcard) alias in order of
+// declaration. Lines and Includes that can't be read are skipped and listed in
+// warnings.
+func Load(path string) (hosts []Host, warnings []string, err error) {
+	p := &parser{home: homeDir()}
+	// options before the first Host line apply to all hosts
+	p.blocks = []*block{{patterns: []string{"*"}, source: path}}
+	if err := p.parseFile(path, 0); err != nil {
+		return nil, p.warnings, err
+	}
+	return p.hosts(), p.warnings, nil
+}
+
+func (p *parser) warn(path string, lineNo int, err error) {
+	p.warnings = append(p.warnings, fmt.Sprintf("%s:%d: %v", path, lineNo, err))
+}
+
+func (p *parser) parseFile(path string, depth int) error {
+	if depth > maxIncludeDepth {
+		return errors.New("too many nested Includes in " + path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	inManagedBlock := false
+	for scanner.Scan() {
+		lineNo++
+		// hosts written by pcm are already known, don't import them twice
+		switch strings.TrimSpace(scanner.Text()) {
+		case BeginMarker:
+			inManagedBlock = true
+		case EndMarker:
+			inManagedBlock = false
+			continue
+		}
+		if inManagedBlock {
+			continue
+		}
+		key, args, err := splitLine(scanner.Text())
+		if err != nil {
+			p.warn(path, lineNo, err)
+			if fields := strings.Fields(scanner.Text()); len(fields) > 0 &&
+				(strings.EqualFold(fields[0], "host") || strings.EqualFold(fields[0], "match")) {
+				// the options after it must not go to the block before
+				p.blocks = append(p.blocks, &block{source: path})
+			}
+			continue
+		}
+		if key == "" {
+			continue
+		}
+		switch key {
+		case "host":
+			p.blocks = append(p.blocks, &block{patterns: args, source: path})
+		case "match":
+			// Match criteria depend on runtime state we don't have; never apply.
+			p.blocks = append(p.blocks, &block{source: path})
+		case "include":
+			cur := p.blocks[len(p.blocks)-1]
+			for _, a := range args {
+				if err := p.include(a, depth); err != nil {
+					p.warn(path, lineNo, err)
+				}
+			}
+			// the Host or Match block around the Include goes on after it
+			if p.blocks[len(p.blocks)-1] != cur {
+				p.blocks = append(p.blocks, &block{patterns: cur.patterns, source: path})
+			}
+		default:
+			cur := p.blocks[len(p.blocks)-1]
+			cur.options = append(cur.options, option{key, strings.Join(args, " "), args})
+		}
+	}
+	return scanner.Err()
+}
+
+func (p *parser) include(pattern string, depth int) error {
+	pattern = p.expandTilde(pattern)
+	if !filepath.IsAbs(pattern) {
+		// relative includes are relative to ~/.ssh for user configs
+		pattern = filepath.Join(p.home, ".ssh", pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, m := range matches {
+		// the other files are still read
+		if err := p.parseFile(m, depth+1); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// hosts resolves the effective options for every concrete alias. As in
+// OpenSSH, the first obtained value for each option wins, except for options
+// that may be given multiple times.
+func (p *parser) hosts() []Host {
+	var result []Host
+	seen := make(map[string]bool)
+	for _, b := range p.blocks[1:] {
+		for _, alias := range b.patterns {
+			if seen[alias] || strings.HasPrefix(alias, "!") ||
+				strings.ContainsAny(alias, "*?") {
+				continue
+			}
+			seen[alias] = true
+			result = append(result, p.resolve(alias, b.source))
+		}
+	}
+	return result
+}
+
+func (p *parser) resolve(alias, source string) Host {
+	h := Host{Alias: alias, Source: source}
+	set := make(map[string]bool)
+	first := func(key string) bool {
+		if set[key] {
+			return false
+		}
+		set[key] = true
+		return true
+	}
+	for _, b := range p.blocks {
+		if !matchPatterns(b.patterns, alias) {
+			continue
+		}
+		for _, o := range b.options {
+			switch o.key {
+			case "hostname":
+				if first(o.key) {
+					h.HostName = strings.Replace(o.value, "%h", alias, -1)
+				}
+			case "port":
+				if first(o.key) {
+					if port, err := strconv.ParseUint(o.value, 10, 16); err == nil {
+						h.Port = uint16(port)
+					}
+				}
+			case "user":
+				if first(o.key) {
+					h.User = o.value
+				}
+			case "proxyjump":
+				if first(o.key) {
+					h.ProxyJump = o.value
+				}
+			case "identityfile":
+				h.IdentityFiles = append(h.IdentityFiles, p.expandTilde(o.value))
+			case "localforward":
+				h.LocalForwards = append(h.LocalForwards, o.value)
+			case "forwardx11":
+				if first(o.key) {
+					h.ForwardX11 = strings.EqualFold(o.value, "yes")
+				}
+			case "forwardx11trusted":
+				if first(o.key) {
+					h.ForwardX11Trusted = strings.EqualFold(o.value, "yes")
+				}
+			case "remotecommand":
+				if first(o.key) {
+					h.RemoteCommand = o.value
+				}
+			case "setenv":
+				h.SetEnv = append(h.SetEnv, o.args...)
+			case "requesttty":
+				if first(o.key) {
+					h.RequestTTY = strings.ToLower(o.value)
+				}
+			case "userknownhostsfile":
+				if first(o.key) {
+					for _, f := range o.args {
+						if f != "none" {
+							h.UserKnownHostsFiles = append(h.UserKnownHostsFiles, p.expandTilde(f))
+						}
+					}
+				}
+			case "hostkeyalias":
+				if first(o.key) {
+					h.HostKeyAlias = o.value
+				}
+			}
+		}
+	}
+	if h.HostName == "" {
+		h.HostName = alias
+	}
+	if h.Port == 0 {
+		h.Port = 22
+	}
+	if h.ProxyJump == "none" {
+		h.ProxyJump = ""
+	}
+	return h
+}
+
+func (p *parser) expandTilde(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return p.home + path[1:]
+	}
+	return path
+}
+
+// splitLine returns the lowercased keyword and its arguments. Comments and
+// empty lines return an empty keyword.
+func splitLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end == -1 {
+		return "", nil, errors.New("missing argument for " + line)
+	}
+	key := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+	args, err := splitArgs(rest)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(args) == 0 {
+		return "", nil, errors.New("missing argument for " + key)
+	}
+	return key, args, nil
+}
+
+// splitArgs splits on whitespace, honoring double quotes.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var cur []byte
+	inQuotes, hasArg := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+			hasArg = true
+		case !inQuotes && (c == ' ' || c == '\t'):
+			if hasArg {
+				args = append(args, string(cur))
+				cur, hasArg = cur[:0], false
+			}
+		case !inQuotes && c == '#':
+			i = len(s)
+		default:
+			cur = append(cur, c)
+			hasArg = true
+		}
+	}
+	if inQuotes {
+		return nil, errors.New("unterminated quote")
+	}
+	if hasArg {
+		args = append(args, string(cur))
+	}
+	return args, nil
+}
+
+// matchPatterns implements the Host pattern-list semantics: any positive
+// match selects the block, unless a negated pattern matches too.
+func matchPatterns(patterns []string, host string) bool {
+	matched := false
+	for _, pat := range patterns {
+		if strings.HasPrefix(pat, "!") {
+			if matchWildcard(pat[1:], host) {
+				return false
+			}
+		} else if matchWildcard(pat, host) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchWildcard matches '*' and '?' the way ssh_config does (no character
+// classes, no special meaning for '/').
+func matchWildcard(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchWildcard(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || !strings.EqualFold(pattern[:1], s[:1]) {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+func homeDir() string {
+	if home := os.Getenv("HOME"); home != "" {
+		return home
+	}
+	return os.Getenv("USERPROFILE")
+}
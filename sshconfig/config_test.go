@@ -0,0 +1,106 @@
+package sshconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// configWriter returns a function which writes a file into a temporary
+// directory and returns its path.
+func configWriter(t *testing.T) func(name, content string) string {
+	dir, err := ioutil.TempDir("", "pcm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+}
+
+// An Include inside a Host or Match block: the included file starts in it,
+// and the block goes on after the included Host lines.
+func TestIncludeKeepsBlock(t *testing.T) {
+	write := configWriter(t)
+	inner := write("inner.conf", "HostName a.example.com\nHost b\n  User inner\n")
+	never := write("never.conf", "Host c\n  HostName c.example.com\n")
+	config := write("config", "Host a\n  User outer\n  Include "+inner+"\n  Port 2200\n"+
+		"Match exec true\n  Include "+never+"\n  User matched\n")
+
+	hosts, warnings, err := Load(config)
+	if err != nil || len(warnings) > 0 {
+		t.Fatal(err, warnings)
+	}
+	want := []Host{
+		{Alias: "a", HostName: "a.example.com", Port: 2200, User: "outer", Source: config},
+		{Alias: "b", HostName: "b", Port: 22, User: "inner", Source: inner},
+		{Alias: "c", HostName: "c.example.com", Port: 22, Source: never},
+	}
+	if len(hosts) != len(want) {
+		t.Fatalf("got %d hosts: %+v", len(hosts), hosts)
+	}
+	for i, w := range want {
+		h := hosts[i]
+		got := Host{Alias: h.Alias, HostName: h.HostName, Port: h.Port, User: h.User, Source: h.Source}
+		if !reflect.DeepEqual(got, w) {
+			t.Errorf("got %+v, want %+v", got, w)
+		}
+	}
+}
+
+// Lines and Includes that can't be read are skipped with a warning, the rest
+// of the file is still used.
+func TestBadLines(t *testing.T) {
+	write := configWriter(t)
+	deep := write("deep.conf", "")
+	write("deep.conf", "Include "+deep+"\nHost deep\n")
+	// an Include that can't be read
+	unreadable := filepath.Join(filepath.Dir(deep), "dir.conf")
+	if err := os.Mkdir(unreadable, 0700); err != nil {
+		t.Fatal(err)
+	}
+	config := write("config", "Host a\n  ForwardAgent\n  User \"unterminated\n"+
+		"  HostName a.example.com\n  Include "+unreadable+"\n  Include "+deep+"\n"+
+		"Host \"b\n  User wrong\nHost c\n  User right\n")
+
+	hosts, warnings, err := Load(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		config + ":2: missing argument for ForwardAgent",
+		config + ":3: unterminated quote",
+		config + ":5: ",
+		deep + ":1: too many nested Includes",
+		config + ":7: unterminated quote",
+	} {
+		found := false
+		for _, w := range warnings {
+			found = found || strings.HasPrefix(w, want)
+		}
+		if !found {
+			t.Errorf("no warning %q in %q", want, warnings)
+		}
+	}
+	got := make(map[string]Host)
+	for _, h := range hosts {
+		got[h.Alias] = h
+	}
+	if h := got["a"]; h.HostName != "a.example.com" || h.User != "" {
+		t.Errorf("got %+v", h)
+	}
+	if h := got["c"]; h.User != "right" {
+		t.Errorf("got %+v", h)
+	}
+	if _, ok := got["deep"]; !ok {
+		t.Errorf("hosts of the nested Includes missing in %+v", hosts)
+	}
+}
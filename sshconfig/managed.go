@@ -0,0 +1,56 @@
+package sshconfig
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Markers around the part of a config file that is generated by pcm
+const (
+	BeginMarker = "# BEGIN pcm managed block - changes here will be overwritten"
+	EndMarker   = "# END pcm managed block"
+)
+
+// ReplaceManagedBlock returns existing with the managed block replaced by
+// content. If there is no managed block yet, it is put at the top: ssh uses the
+// first value it finds, so a Host * further up would override the hosts in it.
+func ReplaceManagedBlock(existing []byte, content string) []byte {
+	block := BeginMarker + "\n" + content
+	if !strings.HasSuffix(block, "\n") {
+		block += "\n"
+	}
+	// what follows the block applies to all hosts again
+	block += "Host *\n" + EndMarker + "\n"
+
+	lines := bytes.SplitAfter(existing, []byte("\n"))
+	var out bytes.Buffer
+	begin, end := -1, -1
+	for i, l := range lines {
+		switch strings.TrimSpace(string(l)) {
+		case BeginMarker:
+			if begin == -1 {
+				begin = i
+			}
+		case EndMarker:
+			if begin != -1 && end == -1 {
+				end = i
+			}
+		}
+	}
+	if begin == -1 || end == -1 {
+		out.WriteString(block)
+		if len(existing) > 0 {
+			out.WriteString("\n")
+			out.Write(existing)
+		}
+		return out.Bytes()
+	}
+	for _, l := range lines[:begin] {
+		out.Write(l)
+	}
+	out.WriteString(block)
+	for _, l := range lines[end+1:] {
+		out.Write(l)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,24 @@
+package sshconfig
+
+import "testing"
+
+func TestReplaceManagedBlock(t *testing.T) {
+	block := BeginMarker + "\nHost web\n  HostName web.example.com\nHost *\n" + EndMarker + "\n"
+
+	// a new block goes first, so Host * of the user doesn't override it
+	existing := "ServerAliveInterval 30\nHost *\n  User nobody\n"
+	got := string(ReplaceManagedBlock([]byte(existing), "Host web\n  HostName web.example.com\n"))
+	if want := block + "\n" + existing; got != want {
+		t.Errorf("new block: got\n%s\nwant\n%s", got, want)
+	}
+	if got := string(ReplaceManagedBlock(nil, "Host web\n  HostName web.example.com")); got != block {
+		t.Errorf("empty file: got\n%s\nwant\n%s", got, block)
+	}
+
+	// an existing block is replaced where it is
+	existing = "Host *\n  User nobody\n\n" + BeginMarker + "\nHost old\n" + EndMarker + "\nHost other\n"
+	got = string(ReplaceManagedBlock([]byte(existing), "Host web\n  HostName web.example.com\n"))
+	if want := "Host *\n  User nobody\n\n" + block + "Host other\n"; got != want {
+		t.Errorf("existing block: got\n%s\nwant\n%s", got, want)
+	}
+}
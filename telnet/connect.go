@@ -0,0 +1,223 @@
+// Package telnet has the clients for connections using the Telnet and RAW
+// protocols, which many network devices and console servers speak.
+package telnet
+
+import (
+	"bytes"
+	context2 "context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/ssh"
+	"github.com/cfstras/pcm/types"
+	"github.com/cfstras/pcm/util"
+)
+
+// Protocols, as in PuTTYCM's <protocol>
+const (
+	ProtocolTelnet = "Telnet"
+	ProtocolRaw    = "RAW"
+)
+
+// Ctrl+] closes the connection, like in the telnet command
+const quitChar = ']' & 0x1f
+
+// Handles returns whether conn uses a protocol of this package.
+func Handles(conn *types.Connection) bool {
+	return strings.EqualFold(conn.Info.Protocol, ProtocolTelnet) ||
+		strings.EqualFold(conn.Info.Protocol, ProtocolRaw)
+}
+
+// Connect opens an interactive session to conn on terminal, over telnet or,
+// for the RAW protocol, a plain TCP connection. Jump hosts and proxies work
+// like for SSH. The login script runs like with SSH, after the login and
+// password prompts are answered. It returns 0 when the host closed the
+// connection, and 255 if it could not be opened.
+func Connect(conn *types.Connection, settings ssh.Settings, terminal types.Terminal,
+	moreCommands func() *string, saveChanges func(*types.Connection)) int {
+	raw := strings.EqualFold(conn.Info.Protocol, ProtocolRaw)
+	port := conn.Info.Port
+	if port == 0 && !raw {
+		port = 23
+	}
+	addr := net.JoinHostPort(conn.Info.Host, strconv.Itoa(int(port)))
+
+	context, cancel := context2.WithCancel(context2.Background())
+	defer cancel()
+	connected := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case s := <-terminal.Signals():
+				if s == syscall.SIGINT || s == syscall.SIGTERM {
+					color.Yellowln("Ctrl+C!")
+					cancel()
+					return
+				}
+			case <-connected:
+				return
+			}
+		}
+	}()
+	tcpConn, err := ssh.DialTCP(context, conn, addr, settings, terminal, saveChanges)
+	close(connected)
+	if err != nil {
+		if context.Err() == nil {
+			color.Redln(err, "\r")
+		}
+		return 255
+	}
+	defer tcpConn.Close()
+
+	s := &session{conn: conn, terminal: terminal, raw: raw}
+	if raw {
+		s.rw = tcpConn
+	} else {
+		term := conn.Options.Term
+		if term == "" {
+			term = "xterm"
+		}
+		width, height, _ := terminal.GetSize()
+		if s.telnet, err = newConn(tcpConn, term, width, height); err != nil {
+			color.Redln(err, "\r")
+			return 255
+		}
+		s.rw = s.telnet
+	}
+	s.run(tcpConn, moreCommands)
+	return 0
+}
+
+type session struct {
+	conn     *types.Connection
+	terminal types.Terminal
+	raw      bool
+	// telnet is nil for the RAW protocol
+	telnet *conn
+	rw     io.ReadWriter
+}
+
+// run relays between the terminal and the host until either side closes.
+func (s *session) run(c io.Closer, moreCommands func() *string) {
+	login := loginScript(s.conn)
+	util.ResolvePassword(s.conn, login, ssh.PasswordPrompt(s.terminal))
+
+	s.terminal.MakeRaw()
+	defer s.terminal.RestoreRaw()
+	color.Yellowln("Connected, press Ctrl+] to quit.\r")
+
+	script := util.RunScript(s.conn, login, s.rw, moreCommands)
+	defer script.Stop()
+
+	closed := make(chan struct{}, 3)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		s.output(script)
+		closed <- struct{}{}
+	}()
+	go func() {
+		s.input(script)
+		closed <- struct{}{}
+	}()
+	go func() {
+		for {
+			select {
+			case sig := <-s.terminal.Signals():
+				if sig == util.GetSigwinch() && s.telnet != nil {
+					if width, height, err := s.terminal.GetSize(); err == nil {
+						s.telnet.SetSize(width, height)
+					}
+				}
+			case <-s.terminal.ExitRequests():
+				closed <- struct{}{}
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+	<-closed
+	c.Close()
+	color.Yellowln("\r\nConnection closed.\r")
+}
+
+func (s *session) output(script *util.ScriptRunner) {
+	defer script.Stop()
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.rw.Read(buf)
+		if n > 0 {
+			s.terminal.Stdout().Write(buf[:n])
+			script.Output(buf[:n])
+		}
+		if err != nil {
+			if err != io.EOF && !isClosed(err) {
+				fmt.Fprintln(s.terminal.Stderr(), "\r\nread error:", err, "\r")
+			}
+			return
+		}
+	}
+}
+
+// input sends what is typed once the login script is done. Unless the host
+// echoes it, it is echoed locally. Ctrl+] ends the session.
+func (s *session) input(script *util.ScriptRunner) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := s.terminal.Stdin().Read(buf)
+		if err != nil {
+			return
+		}
+		in := buf[:n]
+		if bytes.IndexByte(in, quitChar) != -1 {
+			return
+		}
+		// wait for the login script to finish
+		<-script.Done()
+		in = util.TransformInput(in)
+		if s.raw || !s.telnet.remoteEcho() {
+			s.terminal.Stdout().Write(bytes.Replace(in, []byte{'\r'}, []byte{'\r', '\n'}, -1))
+		}
+		// Enter is sent as a line ending, except in binary mode
+		if s.raw || !s.telnet.binaryOut() {
+			in = bytes.Replace(in, []byte{'\r'}, []byte{'\r', '\n'}, -1)
+		}
+		if _, err := s.rw.Write(in); err != nil {
+			return
+		}
+	}
+}
+
+func isClosed(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// Matches the login prompt of most devices
+const loginPattern = `(?i)(login|user ?name): ?$`
+
+// loginScript answers the login and password prompts with the connection's
+// credentials, then runs its own script.
+func loginScript(c *types.Connection) *types.Script {
+	script := c.LoginScript()
+	if c.Login.User == "" && c.Login.Password == "" {
+		return script
+	}
+	sendPassword := []types.ScriptStep{types.SendSecret(types.AnswerPassword)}
+	login := types.Expect("", c.Timeout.ConnectionTimeout+c.Timeout.LoginTimeout, true)
+	if c.Login.User != "" {
+		password := types.Expect("", c.Timeout.PasswordTimeout, true)
+		password.Cases = []types.ScriptCase{{Match: types.PasswordPattern, Steps: sendPassword}}
+		login.Cases = append(login.Cases, types.ScriptCase{Match: loginPattern,
+			Steps: []types.ScriptStep{types.Send(c.Login.User), password}})
+	}
+	login.Cases = append(login.Cases,
+		types.ScriptCase{Match: types.PasswordPattern, Steps: sendPassword},
+		types.ScriptCase{Match: types.PromptPattern})
+	return &types.Script{Steps: append([]types.ScriptStep{login}, script.Steps...)}
+}
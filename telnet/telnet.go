@@ -0,0 +1,294 @@
+package telnet
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// Commands and options, see RFC 854 and the RFCs of each option
+const (
+	se   = 240
+	sb   = 250
+	will = 251
+	wont = 252
+	do   = 253
+	dont = 254
+	iac  = 255
+
+	optBinary = 0  // RFC 856
+	optEcho   = 1  // RFC 857
+	optSGA    = 3  // suppress go ahead, RFC 858
+	optTTYPE  = 24 // terminal type, RFC 1091
+	optNAWS   = 31 // window size, RFC 1073
+
+	ttypeIs   = 0
+	ttypeSend = 1
+)
+
+// conn speaks telnet over a connection. Reading returns the data without the
+// commands, which are answered; writing escapes the data.
+type conn struct {
+	rw   io.ReadWriter
+	in   *bufio.Reader
+	term string
+
+	mu sync.Mutex
+	// options agreed on for our side and the host's side
+	us, him map[byte]bool
+	// options we asked to enable, which the host hasn't answered yet (RFC 1143)
+	wantUs, wantHim map[byte]bool
+	// the window size to send, once the host agreed to NAWS
+	width, height int
+	// keeps a CR at the end of a read, to drop the NUL after it
+	pendingCR bool
+}
+
+// newConn starts the negotiation: pcm offers to send the terminal type and
+// window size, and asks for binary mode and no go aheads. The options are only
+// used once the host agrees.
+func newConn(rw io.ReadWriter, term string, width, height int) (*conn, error) {
+	c := &conn{rw: rw, in: bufio.NewReader(rw), term: term,
+		us: make(map[byte]bool), him: make(map[byte]bool),
+		wantUs: make(map[byte]bool), wantHim: make(map[byte]bool),
+		width: width, height: height}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, opt := range []byte{optTTYPE, optNAWS, optBinary} {
+		c.wantUs[opt] = true
+		if err := c.command(will, opt); err != nil {
+			return nil, err
+		}
+	}
+	for _, opt := range []byte{optSGA, optBinary} {
+		c.wantHim[opt] = true
+		if err := c.command(do, opt); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// remoteEcho returns whether the host echoes what is typed.
+func (c *conn) remoteEcho() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.him[optEcho]
+}
+
+func (c *conn) command(cmd, opt byte) error {
+	_, err := c.rw.Write([]byte{iac, cmd, opt})
+	return err
+}
+
+// Read returns the next data from the host, handling commands in between.
+func (c *conn) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if n > 0 && c.in.Buffered() == 0 {
+			break
+		}
+		b, err := c.in.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		if c.pendingCR {
+			c.pendingCR = false
+			if b == 0 && !c.binaryIn() {
+				continue
+			}
+		}
+		if b == '\r' {
+			c.pendingCR = true
+		}
+		if b != iac {
+			p[n] = b
+			n++
+			continue
+		}
+		cmd, err := c.in.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		switch cmd {
+		case iac:
+			p[n] = iac
+			n++
+		case will, wont, do, dont:
+			opt, err := c.in.ReadByte()
+			if err != nil {
+				return n, err
+			}
+			if err := c.negotiate(cmd, opt); err != nil {
+				return n, err
+			}
+		case sb:
+			if err := c.subnegotiation(); err != nil {
+				return n, err
+			}
+		}
+		// other commands (NOP, GA, ...) are ignored
+	}
+	return n, nil
+}
+
+func (c *conn) binaryIn() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.him[optBinary]
+}
+
+func (c *conn) binaryOut() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.us[optBinary]
+}
+
+// negotiate answers a request to enable or disable an option. Answers are
+// only sent when the state changes, and answers to our own requests are not
+// answered again, so requests can't loop.
+func (c *conn) negotiate(cmd, opt byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch cmd {
+	case will:
+		if c.him[opt] {
+			return nil
+		}
+		if c.wantHim[opt] {
+			delete(c.wantHim, opt)
+			c.him[opt] = true
+			return nil
+		}
+		if opt != optEcho && opt != optSGA && opt != optBinary {
+			return c.command(dont, opt)
+		}
+		c.him[opt] = true
+		return c.command(do, opt)
+	case wont:
+		if c.wantHim[opt] {
+			// refused
+			delete(c.wantHim, opt)
+			return nil
+		}
+		if !c.him[opt] {
+			return nil
+		}
+		c.him[opt] = false
+		return c.command(dont, opt)
+	case do:
+		if !c.us[opt] {
+			if c.wantUs[opt] {
+				delete(c.wantUs, opt)
+				c.us[opt] = true
+			} else if opt != optTTYPE && opt != optNAWS && opt != optBinary && opt != optSGA {
+				return c.command(wont, opt)
+			} else {
+				c.us[opt] = true
+				if err := c.command(will, opt); err != nil {
+					return err
+				}
+			}
+		}
+		if opt == optNAWS {
+			return c.sendSize()
+		}
+	case dont:
+		if c.wantUs[opt] {
+			delete(c.wantUs, opt)
+			return nil
+		}
+		if !c.us[opt] {
+			return nil
+		}
+		c.us[opt] = false
+		return c.command(wont, opt)
+	}
+	return nil
+}
+
+// subnegotiation reads the parameters of an option up to IAC SE and answers
+// requests for the terminal type.
+func (c *conn) subnegotiation() error {
+	var data []byte
+	for {
+		b, err := c.in.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == iac {
+			if b, err = c.in.ReadByte(); err != nil {
+				return err
+			}
+			if b == se {
+				break
+			}
+		}
+		data = append(data, b)
+	}
+	if len(data) == 2 && data[0] == optTTYPE && data[1] == ttypeSend {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		msg := append([]byte{iac, sb, optTTYPE, ttypeIs}, escape([]byte(c.term))...)
+		_, err := c.rw.Write(append(msg, iac, se))
+		return err
+	}
+	return nil
+}
+
+// SetSize sends the window size, if the host wants it.
+func (c *conn) SetSize(width, height int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.width, c.height = width, height
+	return c.sendSize()
+}
+
+// sendSize sends the window size if NAWS is enabled. c.mu must be held.
+func (c *conn) sendSize() error {
+	if !c.us[optNAWS] || c.width <= 0 || c.height <= 0 {
+		return nil
+	}
+	size := []byte{byte(c.width >> 8), byte(c.width), byte(c.height >> 8), byte(c.height)}
+	msg := append([]byte{iac, sb, optNAWS}, escape(size)...)
+	_, err := c.rw.Write(append(msg, iac, se))
+	return err
+}
+
+// Write sends data to the host. Outside of binary mode, line endings are sent
+// as CR LF and a single CR as CR NUL, as the network virtual terminal needs.
+func (c *conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := escape(p)
+	if !c.us[optBinary] {
+		var nvt []byte
+		for i, b := range out {
+			switch {
+			case b == '\n' && (i == 0 || out[i-1] != '\r'):
+				nvt = append(nvt, '\r', '\n')
+			case b == '\r' && (i == len(out)-1 || out[i+1] != '\n'):
+				nvt = append(nvt, '\r', 0)
+			default:
+				nvt = append(nvt, b)
+			}
+		}
+		out = nvt
+	}
+	if _, err := c.rw.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// escape doubles IAC bytes in data.
+func escape(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b == iac {
+			out = append(out, iac)
+		}
+		out = append(out, b)
+	}
+	return out
+}
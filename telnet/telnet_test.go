@@ -0,0 +1,167 @@
+package telnet
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// host is the other end of a conn, reading and writing raw telnet.
+type host struct {
+	t *testing.T
+	net.Conn
+	// data read by the conn
+	data chan []byte
+}
+
+// startConn returns a conn talking to a host, after the host got the
+// conn's requests.
+func startConn(t *testing.T) (*conn, *host) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	h := &host{t, server, make(chan []byte, 16)}
+
+	started := make(chan *conn)
+	go func() {
+		c, err := newConn(client, "xterm", 80, 24)
+		if err != nil {
+			t.Error(err)
+		}
+		started <- c
+	}()
+	h.expect(iac, will, optTTYPE, iac, will, optNAWS, iac, will, optBinary,
+		iac, do, optSGA, iac, do, optBinary)
+	c := <-started
+
+	go func() {
+		for {
+			buf := make([]byte, 64)
+			n, err := c.Read(buf)
+			if err != nil {
+				close(h.data)
+				return
+			}
+			h.data <- buf[:n]
+		}
+	}()
+	return c, h
+}
+
+func (h *host) send(b ...byte) {
+	h.t.Helper()
+	if _, err := h.Write(b); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// expect reads what the conn sends.
+func (h *host) expect(want ...byte) {
+	h.t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(h, got); err != nil {
+		h.t.Fatalf("reading %q: %v", want, err)
+	}
+	if !bytes.Equal(got, want) {
+		h.t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// received checks what the conn returns from Read.
+func (h *host) received(want string) {
+	h.t.Helper()
+	var got []byte
+	for len(got) < len(want) {
+		select {
+		case b, ok := <-h.data:
+			if !ok {
+				h.t.Fatalf("closed after %q, want %q", got, want)
+			}
+			got = append(got, b...)
+		case <-time.After(5 * time.Second):
+			h.t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	if string(got) != want {
+		h.t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// write writes p with c while the host reads it.
+func write(t *testing.T, c *conn, p string) {
+	go func() {
+		if _, err := c.Write([]byte(p)); err != nil {
+			t.Error(err)
+		}
+	}()
+}
+
+func TestNegotiation(t *testing.T) {
+	c, h := startConn(t)
+
+	// nothing is agreed on until the host answers
+	write(t, c, "a\rb\n\xff")
+	h.expect('a', '\r', 0, 'b', '\r', '\n', iac, iac)
+	h.send('x', '\r', 0, 'y', iac, iac)
+	h.received("x\ry\xff")
+
+	h.send(iac, will, optBinary, iac, do, optBinary, iac, will, optSGA,
+		iac, do, optNAWS, iac, will, optEcho, iac, do, 99, iac, will, 99)
+	// the answers to our own requests are not answered again
+	h.expect(iac, sb, optNAWS, 0, 80, 0, 24, iac, se,
+		iac, do, optEcho, iac, wont, 99, iac, dont, 99)
+	if !c.remoteEcho() {
+		t.Error("host doesn't echo")
+	}
+
+	// in binary mode, only IAC is escaped
+	write(t, c, "a\rb\n\xff")
+	h.expect('a', '\r', 'b', '\n', iac, iac)
+	h.send('x', '\r', 0, 'y')
+	h.received("x\r\x00y")
+
+	h.send(iac, sb, optTTYPE, ttypeSend, iac, se)
+	h.expect(append(append([]byte{iac, sb, optTTYPE, ttypeIs}, "xterm"...), iac, se)...)
+
+	go func() {
+		if err := c.SetSize(300, 255); err != nil {
+			t.Error(err)
+		}
+	}()
+	h.expect(iac, sb, optNAWS, 1, 44, 0, iac, iac, iac, se)
+
+	h.send(iac, wont, optEcho)
+	h.expect(iac, dont, optEcho)
+	h.send(iac, dont, optBinary)
+	h.expect(iac, wont, optBinary)
+	write(t, c, "\r")
+	h.expect('\r', 0)
+}
+
+// A host refusing the requests: the options stay off and the refusals are not
+// answered.
+func TestRefused(t *testing.T) {
+	c, h := startConn(t)
+
+	h.send(iac, dont, optBinary, iac, wont, optBinary, iac, dont, optNAWS, iac, wont, optSGA)
+	go func() {
+		if err := c.SetSize(100, 50); err != nil {
+			t.Error(err)
+		}
+	}()
+	write(t, c, "\r")
+	h.expect('\r', 0)
+	h.send('x', '\r', 0, 'y')
+	h.received("x\ry")
+
+	// the host can still ask for them later
+	h.send(iac, will, optBinary)
+	h.expect(iac, do, optBinary)
+	h.send('x', '\r', 0, 'y')
+	h.received("x\r\x00y")
+}
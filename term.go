@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/cfstras/go-utils/math"
@@ -11,7 +12,9 @@ import (
 	"github.com/renstrom/fuzzysearch/fuzzy"
 )
 
-func selectConnection(conf *types.Configuration, input string) *types.Connection {
+// selectConnection shows the connection tree. It returns the connection to use,
+// or all connections marked with Tab, or nil if the user quit.
+func selectConnection(conf *types.Configuration, input string) []*types.Connection {
 	if err := ui.Init(); err != nil {
 		panic(err)
 	}
@@ -35,16 +38,18 @@ func selectConnection(conf *types.Configuration, input string) *types.Connection
 	searchView.Border.Label = " Search "
 
 	connectButton := ui.NewPar(" Connect ")
+	filesButton := ui.NewPar(" Files ")
 
 	menuView := ui.NewRow(
-		ui.NewCol(12, 0, connectButton),
+		ui.NewCol(7, 0, connectButton),
+		ui.NewCol(5, 0, filesButton),
 	)
 
 	selectedButton := 0
-	buttons := []*ui.Par{connectButton}
+	buttons := []*ui.Par{connectButton, filesButton}
 
 	selectButtons := func() {
-		selectedButton %= len(buttons)
+		selectedButton = (selectedButton + len(buttons)) % len(buttons)
 		for i, v := range buttons {
 			if i == selectedButton {
 				v.TextBgColor = ui.ColorBlue
@@ -61,12 +66,13 @@ func selectConnection(conf *types.Configuration, input string) *types.Connection
 		ui.NewRow(
 			ui.NewCol(12, 0, debugView)),
 		ui.NewRow(
-			ui.NewCol(8, 0, searchView),
-			ui.NewCol(4, 0, menuView)))
+			ui.NewCol(7, 0, searchView),
+			ui.NewCol(5, 0, menuView)))
 
 	heights := func() {
 		searchView.Height = 3
 		connectButton.Height = searchView.Height
+		filesButton.Height = searchView.Height
 		menuView.Height = searchView.Height
 		debugView.Height = 6
 		treeView.Height = ui.TermHeight() - searchView.Height - debugView.Height
@@ -144,7 +150,15 @@ func selectConnection(conf *types.Configuration, input string) *types.Connection
 				n := connectionsIndex[treeView.CurrentSelection]
 				if c, ok := n.(*types.Connection); ok {
 					if buttons[selectedButton] == connectButton {
-						return c
+						if marked := markedConnections(conf); len(marked) > 0 {
+							return marked
+						}
+						return []*types.Connection{conf.AllConnections()[c.Path()]}
+					} else if buttons[selectedButton] == filesButton {
+						browseFiles(conf, conf.AllConnections()[c.Path()], events)
+						heights()
+						ui.Body.Width = ui.TermWidth()
+						ui.Body.Align()
 					}
 				} else if c, ok := n.(*types.Container); ok {
 					if c.Expanded {
@@ -155,6 +169,22 @@ func selectConnection(conf *types.Configuration, input string) *types.Connection
 					drawTree(treeView, connectionsIndex, distances, pathToIndexMap, filteredRoot)
 				}
 
+			} else if ev.Key == ui.KeyTab {
+				n := connectionsIndex[treeView.CurrentSelection]
+				if c, ok := n.(*types.Connection); ok {
+					// the filtered tree is a copy
+					c.Marked = !c.Marked
+					conf.AllConnections()[c.Path()].Marked = c.Marked
+					if marked := len(markedConnections(conf)); marked > 0 {
+						connectButton.Text = fmt.Sprintf(" Connect to %d ", marked)
+					} else {
+						connectButton.Text = " Connect "
+					}
+					drawTree(treeView, connectionsIndex, distances, pathToIndexMap, filteredRoot)
+				}
+				if treeView.CurrentSelection < len(treeView.Items)-1 {
+					treeView.CurrentSelection++
+				}
 			} else if ev.Key == ui.KeyEsc || ev.Key == ui.KeyCtrlC {
 				return nil
 			} else if ev.Ch >= ' ' && ev.Ch <= '~' {
@@ -196,6 +226,18 @@ func selectConnection(conf *types.Configuration, input string) *types.Connection
 	}
 }
 
+// markedConnections returns the connections marked for cluster mode, by path
+func markedConnections(conf *types.Configuration) []*types.Connection {
+	var marked []*types.Connection
+	for _, c := range conf.AllConnections() {
+		if c.Marked {
+			marked = append(marked, c)
+		}
+	}
+	sort.Slice(marked, func(i, j int) bool { return marked[i].Path() < marked[j].Path() })
+	return marked
+}
+
 func filterTree(conf *types.Configuration, distances map[string]int) *types.Container {
 	if distances == nil {
 		return &conf.Root
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/ssh"
+	"github.com/cfstras/pcm/types"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func init() {
+	subcommands["get"] = subcommand{
+		usage: "get [-r] [-resume] <connection> <remote path>... <local path>",
+		run:   func(args []string) { copyCommand("get", args) },
+	}
+	subcommands["put"] = subcommand{
+		usage: "put [-r] [-resume] <connection> <local path>... <remote path>",
+		run:   func(args []string) { copyCommand("put", args) },
+	}
+	subcommands["sync"] = subcommand{
+		usage: "sync [-down] [-delete] [-n] [-resume] <connection> <local dir> <remote dir>",
+		run:   syncCommand,
+	}
+}
+
+// copyCommand copies files from ("get") or to ("put") a host, like scp.
+func copyCommand(name string, args []string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	recursive := flags.Bool("r", false, "copy directories recursively")
+	resume := flags.Bool("resume", false, "continue partially copied files instead of starting over")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: pcm", subcommands[name].usage)
+		flags.PrintDefaults()
+	}
+	args = parseInterspersed(flags, args)
+	if len(args) < 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	session := openSFTP(args[0])
+	defer session.Close()
+	t := &transfer{resume: *resume, progress: terminal.IsTerminal(int(os.Stderr.Fd()))}
+	if name == "get" {
+		t.src, t.dst = remoteFS{session}, localFS{}
+	} else {
+		t.src, t.dst = localFS{}, remoteFS{session}
+	}
+
+	sources, dest := args[1:len(args)-1], t.dst.Clean(args[len(args)-1])
+	destInfo, err := t.dst.Stat(dest)
+	intoDir := err == nil && destInfo.IsDir()
+	if len(sources) > 1 && !intoDir {
+		color.Redln(dest, "is not a directory")
+		os.Exit(1)
+	}
+	start := time.Now()
+	for _, src := range sources {
+		src = t.src.Clean(src)
+		info, err := t.src.Stat(src)
+		if err != nil {
+			t.fail(err)
+			continue
+		}
+		if info.IsDir() && !*recursive {
+			t.fail(errors.New(src + " is a directory, use -r to copy it"))
+			continue
+		}
+		target := dest
+		if intoDir {
+			target = t.dst.Join(dest, t.src.Base(src))
+		}
+		t.copy(src, target, info)
+	}
+	if !t.summary(time.Since(start)) {
+		os.Exit(1)
+	}
+}
+
+// syncCommand makes a directory on a host the same as a local one, or the
+// other way around, copying only what changed.
+func syncCommand(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	down := flags.Bool("down", false, "copy from the host to the local directory instead")
+	remove := flags.Bool("delete", false, "delete files that are not in the source directory")
+	dryRun := flags.Bool("n", false, "only show what would be done")
+	resume := flags.Bool("resume", false, "continue partially copied files instead of starting over")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: pcm", subcommands["sync"].usage)
+		flags.PrintDefaults()
+	}
+	args = parseInterspersed(flags, args)
+	if len(args) != 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	session := openSFTP(args[0])
+	defer session.Close()
+	t := &transfer{sync: true, delete: *remove, dryRun: *dryRun, resume: *resume,
+		progress: terminal.IsTerminal(int(os.Stderr.Fd()))}
+	src, dst := args[1], args[2]
+	t.src, t.dst = localFS{}, remoteFS{session}
+	if *down {
+		src, dst = dst, src
+		t.src, t.dst = t.dst, t.src
+	}
+	src, dst = t.src.Clean(src), t.dst.Clean(dst)
+
+	start := time.Now()
+	if info, err := t.src.Stat(src); err != nil {
+		t.fail(err)
+	} else if !info.IsDir() {
+		t.fail(errors.New(src + " is not a directory"))
+	} else {
+		t.copy(src, dst, info)
+	}
+	if !t.summary(time.Since(start)) {
+		os.Exit(1)
+	}
+}
+
+// openSFTP finds the connection for search and starts an SFTP session on it.
+func openSFTP(search string) *ssh.SFTP {
+	conf := loadConfiguration()
+	sshSettings.Config = &conf
+	conn := findConnection(&conf, search)
+	console := &consoleTerminal{exit: make(chan bool)}
+	session, err := ssh.OpenSFTP(conn, sshSettings, console, func(c *types.Connection) {
+		saveConn(&conf, c)
+	})
+	if err != nil {
+		color.Redln(conn.Path()+":", err)
+		os.Exit(1)
+	}
+	return session
+}
+
+// findConnection returns the one SSH connection matching search, preferring
+// exact paths and names. Otherwise, the candidates are listed and pcm exits.
+func findConnection(conf *types.Configuration, search string) *types.Connection {
+	conns := matchConnections(conf, search)
+	var exact []*types.Connection
+	for _, c := range conns {
+		if c.Path() == search || c.Path() == "/"+search || c.Name == search {
+			exact = append(exact, c)
+		}
+	}
+	if len(exact) == 1 {
+		return exact[0]
+	}
+	if len(conns) == 1 {
+		return conns[0]
+	}
+	if len(conns) == 0 {
+		color.Redln("Nothing found for", search)
+	} else {
+		color.Redln(search, "matches more than one connection:")
+		for _, c := range conns {
+			fmt.Fprintln(os.Stderr, " ", c.Path())
+		}
+	}
+	os.Exit(1)
+	return nil
+}
+
+// parseInterspersed parses flags, which may also come after the other
+// arguments, and returns the other arguments.
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var rest []string
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			return rest
+		}
+		rest = append(rest, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// transfer copies files and directories between two file systems, keeping
+// permissions and modification times.
+type transfer struct {
+	src, dst fileSystem
+
+	// only copy files that differ in size or modification time
+	sync bool
+	// remove files from the destination that are not in the source
+	delete   bool
+	dryRun   bool
+	resume   bool
+	progress bool
+
+	files, failed int
+	bytes         int64
+}
+
+func (t *transfer) fail(err error) {
+	t.failed++
+	color.Redln(err)
+}
+
+func (t *transfer) copy(src, dst string, info os.FileInfo) {
+	switch {
+	case info.IsDir():
+		t.copyDir(src, dst, info)
+	case info.Mode().IsRegular():
+		if err := t.copyFile(src, dst, info); err != nil {
+			t.fail(err)
+		}
+	case info.Mode()&os.ModeSymlink != 0:
+		color.Yellowln("Skipping symlink", src)
+	default:
+		color.Yellowln("Skipping", src+", it is not a regular file")
+	}
+}
+
+func (t *transfer) copyDir(src, dst string, info os.FileInfo) {
+	if dstInfo, err := t.dst.Stat(dst); os.IsNotExist(err) {
+		if t.dryRun {
+			fmt.Println("create", dst)
+		} else if err := t.dst.Mkdir(dst); err != nil {
+			t.fail(err)
+			return
+		}
+	} else if err != nil {
+		t.fail(err)
+		return
+	} else if !dstInfo.IsDir() {
+		t.fail(errors.New(dst + " exists and is not a directory"))
+		return
+	}
+
+	entries, err := t.src.ReadDir(src)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	names := make(map[string]bool)
+	for _, e := range entries {
+		names[e.Name()] = true
+		t.copy(t.src.Join(src, e.Name()), t.dst.Join(dst, e.Name()), e)
+	}
+	if t.delete {
+		t.deleteExtra(dst, names)
+	}
+	if !t.dryRun {
+		// after the contents, which change the modification time
+		t.setAttributes(dst, info)
+	}
+}
+
+// deleteExtra removes everything in dir that is not in keep.
+func (t *transfer) deleteExtra(dir string, keep map[string]bool) {
+	entries, err := t.dst.ReadDir(dir)
+	if err != nil {
+		if !t.dryRun || !os.IsNotExist(err) {
+			t.fail(err)
+		}
+		return
+	}
+	for _, e := range entries {
+		if keep[e.Name()] {
+			continue
+		}
+		name := t.dst.Join(dir, e.Name())
+		if e.IsDir() {
+			t.deleteExtra(name, nil)
+		}
+		fmt.Println("delete", name)
+		if !t.dryRun {
+			if err := t.dst.Remove(name); err != nil {
+				t.fail(err)
+			}
+		}
+	}
+}
+
+func (t *transfer) copyFile(src, dst string, info os.FileInfo) error {
+	var offset int64
+	if dstInfo, err := t.dst.Stat(dst); err == nil {
+		if dstInfo.IsDir() {
+			return errors.New(dst + " is a directory")
+		}
+		if t.sync && dstInfo.Size() == info.Size() &&
+			dstInfo.ModTime().Unix() == info.ModTime().Unix() {
+			return nil
+		}
+		if t.resume && dstInfo.Size() < info.Size() {
+			offset = dstInfo.Size()
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if t.dryRun {
+		fmt.Println("copy", src)
+		return nil
+	}
+
+	in, err := t.src.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := t.dst.Create(dst, offset == 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if offset > 0 {
+		if _, err := in.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := out.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	p := &progress{name: src, size: info.Size(), done: offset, startDone: offset,
+		start: time.Now(), show: t.progress}
+	_, err = copyWithProgress(out, in, p)
+	p.finish(err == nil)
+	t.bytes += p.done - offset
+	if err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	t.files++
+	t.setAttributes(dst, info)
+	return nil
+}
+
+func (t *transfer) setAttributes(name string, info os.FileInfo) {
+	if err := t.dst.Chmod(name, info.Mode().Perm()); err != nil {
+		color.Yellowln("Warning:", err)
+	}
+	if err := t.dst.Chtimes(name, info.ModTime(), info.ModTime()); err != nil {
+		color.Yellowln("Warning:", err)
+	}
+}
+
+// summary shows how much was copied and returns false if anything failed.
+func (t *transfer) summary(took time.Duration) bool {
+	if t.dryRun {
+		return t.failed == 0
+	}
+	msg := fmt.Sprintf("%d files, %s in %s", t.files, formatBytes(t.bytes),
+		took.Round(time.Millisecond))
+	if t.failed > 0 {
+		color.Redln(msg+",", t.failed, "errors")
+		return false
+	}
+	color.Greenln(msg)
+	return true
+}
+
+// copyWithProgress copies from in to out, letting the remote side send or
+// receive several packets at once.
+func copyWithProgress(out io.Writer, in io.Reader, p *progress) (int64, error) {
+	if from, ok := out.(io.ReaderFrom); ok {
+		if _, local := out.(*os.File); !local {
+			return from.ReadFrom(&progressReader{in, p})
+		}
+	}
+	if to, ok := in.(io.WriterTo); ok {
+		if _, local := in.(*os.File); !local {
+			return to.WriteTo(&progressWriter{out, p})
+		}
+	}
+	return io.Copy(&progressWriter{out, p}, in)
+}
+
+// progress shows how far a file is copied on one line of the terminal.
+type progress struct {
+	name        string
+	size, done  int64
+	start, last time.Time
+	startDone   int64
+	show        bool
+}
+
+func (p *progress) add(n int) {
+	p.done += int64(n)
+	if p.show && time.Since(p.last) > 200*time.Millisecond {
+		p.last = time.Now()
+		p.print()
+	}
+}
+
+func (p *progress) print() {
+	percent := int64(100)
+	if p.size > 0 {
+		percent = p.done * 100 / p.size
+	}
+	rate := float64(p.done-p.startDone) / time.Since(p.start).Seconds()
+	name := p.name
+	if len([]rune(name)) > 40 {
+		name = "…" + string([]rune(name)[len([]rune(name))-39:])
+	}
+	fmt.Fprintf(os.Stderr, "\r%-40s %3d%% %10s %10s/s ", name, percent,
+		formatBytes(p.done), formatBytes(int64(rate)))
+}
+
+func (p *progress) finish(ok bool) {
+	if p.show {
+		p.print()
+		fmt.Fprintln(os.Stderr)
+	} else if ok {
+		fmt.Fprintln(os.Stderr, p.name, formatBytes(p.done))
+	}
+}
+
+type progressReader struct {
+	io.Reader
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.p.add(n)
+	return n, err
+}
+
+type progressWriter struct {
+	io.Writer
+	p *progress
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.p.add(n)
+	return n, err
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// file is an open file on either side of a transfer.
+type file interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+}
+
+// fileSystem is the local disk or a host.
+type fileSystem interface {
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	Open(name string) (file, error)
+	// Create opens name for writing, creating it if needed.
+	Create(name string, truncate bool) (file, error)
+	Mkdir(name string) error
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Remove(name string) error
+	Rename(oldname, newname string) error
+
+	Clean(name string) string
+	Join(elem ...string) string
+	Base(name string) string
+}
+
+type localFS struct{}
+
+func (localFS) Stat(name string) (os.FileInfo, error)      { return os.Stat(name) }
+func (localFS) ReadDir(name string) ([]os.FileInfo, error) { return ioutil.ReadDir(name) }
+func (localFS) Open(name string) (file, error)             { return os.Open(name) }
+func (localFS) Create(name string, truncate bool) (file, error) {
+	flags := os.O_WRONLY | os.O_CREATE
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	return os.OpenFile(name, flags, 0666)
+}
+func (localFS) Mkdir(name string) error                   { return os.Mkdir(name, 0777) }
+func (localFS) Chmod(name string, mode os.FileMode) error { return os.Chmod(name, mode) }
+func (localFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+func (localFS) Remove(name string) error             { return os.Remove(name) }
+func (localFS) Rename(oldname, newname string) error { return os.Rename(oldname, newname) }
+func (localFS) Clean(name string) string             { return filepath.Clean(replaceHome(name)) }
+func (localFS) Join(elem ...string) string           { return filepath.Join(elem...) }
+func (localFS) Base(name string) string              { return filepath.Base(name) }
+
+// remoteFS is a host, with relative paths starting at the home directory.
+type remoteFS struct {
+	session *ssh.SFTP
+}
+
+func (r remoteFS) Stat(name string) (os.FileInfo, error) {
+	info, err := r.session.Stat(name)
+	return info, pathError("stat", name, err)
+}
+func (r remoteFS) ReadDir(name string) ([]os.FileInfo, error) {
+	infos, err := r.session.ReadDir(name)
+	return infos, pathError("readdir", name, err)
+}
+func (r remoteFS) Open(name string) (file, error) {
+	f, err := r.session.Open(name)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return f, nil
+}
+func (r remoteFS) Create(name string, truncate bool) (file, error) {
+	flags := os.O_WRONLY | os.O_CREATE
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	f, err := r.session.OpenFile(name, flags)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return f, nil
+}
+func (r remoteFS) Mkdir(name string) error {
+	return pathError("mkdir", name, r.session.Mkdir(name))
+}
+func (r remoteFS) Chmod(name string, mode os.FileMode) error {
+	return pathError("chmod", name, r.session.Chmod(name, mode))
+}
+func (r remoteFS) Chtimes(name string, atime, mtime time.Time) error {
+	return pathError("chtimes", name, r.session.Chtimes(name, atime, mtime))
+}
+func (r remoteFS) Remove(name string) error {
+	return pathError("remove", name, r.session.Remove(name))
+}
+func (r remoteFS) Rename(oldname, newname string) error {
+	return pathError("rename", oldname, r.session.Rename(oldname, newname))
+}
+func (remoteFS) Clean(name string) string {
+	if name == "~" {
+		return "."
+	}
+	return path.Clean(strings.TrimPrefix(name, "~/"))
+}
+func (remoteFS) Join(elem ...string) string { return path.Join(elem...) }
+func (remoteFS) Base(name string) string    { return path.Base(name) }
+
+// pathError adds the remote path to err, like the os package does for local
+// paths.
+func pathError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: "remote " + name, Err: err}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A destination as big as the source is only complete if sync says so.
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		sync      bool
+		dst, want string
+		sameTime  bool
+	}{
+		{"partial", false, "hello", "hello world", false},
+		{"same size", false, "hello earth", "hello world", false},
+		{"same size and time", true, "hello earth", "hello earth", true},
+		{"same size, other time", true, "hello earth", "hello world", false},
+		{"bigger", false, "hello world!", "hello world", false},
+	} {
+		dst := filepath.Join(dir, "dst")
+		if err := ioutil.WriteFile(dst, []byte(test.dst), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if test.sameTime {
+			if err := os.Chtimes(dst, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tr := &transfer{src: localFS{}, dst: localFS{}, sync: test.sync, resume: true}
+		if err := tr.copyFile(src, dst, info); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got, err := ioutil.ReadFile(dst); err != nil || string(got) != test.want {
+			t.Errorf("%s: got %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
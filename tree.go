@@ -88,7 +88,11 @@ func treeDescend(target *[]string, index map[int]types.Node, pathToIndexMap map[
 		if pathToIndexMap != nil {
 			pathToIndexMap[conn.Path()] = len(*target)
 		}
-		str := prefix + nodeSym + "─ " + conn.Name
+		mark := "─ "
+		if conn.Marked {
+			mark = "─ ● "
+		}
+		str := prefix + nodeSym + mark + conn.Name
 		conn.TreeView = str
 
 		spaces := width - len([]rune(str)) - len([]rune(conn.StatusInfo))
@@ -0,0 +1,130 @@
+package types
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// Script is a pcm extension: steps run on the session right after logging in.
+// Connections without one get a script sending Command1-5, see LoginScript.
+type Script struct {
+	Steps []ScriptStep `xml:",any"`
+}
+
+// Names of the step elements
+const (
+	StepSend   = "send"
+	StepExpect = "expect"
+)
+
+// ScriptStep is a <send> or <expect> element.
+//
+// <send> sends its text followed by the connection's end of line character,
+// or only the text if Raw is set. With Secret set to AnswerPassword or
+// AnswerTOTP, the password or the current one-time code is sent instead.
+//
+// <expect> waits until the output matches the regular expression in its text
+// or, if it has <case> elements, the first one that matches, and then runs the
+// steps of that case. Timeout is the number of milliseconds without new output
+// after which waiting stops; it defaults to the connection's CommandTimeout.
+// Then, the script ends, unless Optional is set.
+type ScriptStep struct {
+	XMLName  xml.Name
+	Text     string       `xml:",chardata"`
+	Secret   string       `xml:"secret,attr,omitempty"`
+	Raw      bool         `xml:"raw,attr,omitempty"`
+	Timeout  int          `xml:"timeout,attr,omitempty"`
+	Optional bool         `xml:"optional,attr,omitempty"`
+	Cases    []ScriptCase `xml:"case"`
+}
+
+func (s *ScriptStep) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type step ScriptStep // without this method
+	if err := d.DecodeElement((*step)(s), &start); err != nil {
+		return err
+	}
+	if len(s.Cases) > 0 {
+		// only whitespace between the cases
+		s.Text = ""
+	}
+	return nil
+}
+
+// ScriptCase is one alternative of an <expect>
+type ScriptCase struct {
+	Match string       `xml:"match,attr"`
+	Steps []ScriptStep `xml:",any"`
+}
+
+// Regular expressions for the end of a shell prompt and a password prompt
+const (
+	PromptPattern   = `(?:[$#%>] |assword: ?)$`
+	PasswordPattern = `assword: ?$`
+)
+
+// Send returns a step sending text
+func Send(text string) ScriptStep {
+	return ScriptStep{XMLName: xml.Name{Local: StepSend}, Text: text}
+}
+
+// SendSecret returns a step sending the password or one-time code
+func SendSecret(source string) ScriptStep {
+	return ScriptStep{XMLName: xml.Name{Local: StepSend}, Secret: source}
+}
+
+// Expect returns a step waiting for pattern
+func Expect(pattern string, timeout int, optional bool) ScriptStep {
+	return ScriptStep{XMLName: xml.Name{Local: StepExpect}, Text: pattern,
+		Timeout: timeout, Optional: optional}
+}
+
+// Patterns returns the regular expressions of an <expect>, one per case.
+func (s *ScriptStep) Patterns() []string {
+	if len(s.Cases) == 0 {
+		return []string{s.Text}
+	}
+	patterns := make([]string, len(s.Cases))
+	for i, c := range s.Cases {
+		patterns[i] = c.Match
+	}
+	return patterns
+}
+
+func (s ScriptStep) String() string {
+	switch s.XMLName.Local {
+	case StepSend:
+		if s.Secret != "" {
+			return "send " + s.Secret
+		}
+		return fmt.Sprintf("send %q", s.Text)
+	case StepExpect:
+		str := "expect /" + strings.Join(s.Patterns(), "/ or /") + "/"
+		if s.Timeout != 0 {
+			str += fmt.Sprintf(" for %dms", s.Timeout)
+		}
+		if s.Optional {
+			str += " (optional)"
+		}
+		return str
+	}
+	return "unknown step <" + s.XMLName.Local + ">"
+}
+
+// LoginScript returns the script of c. Without one, Command1-5 are sent at
+// the shell prompt, or like PuTTYCM does, after CommandTimeout passes without
+// seeing one.
+func (c *Connection) LoginScript() *Script {
+	if c.Script != nil {
+		return c.Script
+	}
+	script := &Script{}
+	for _, cmd := range []string{c.Commands.Command1, c.Commands.Command2,
+		c.Commands.Command3, c.Commands.Command4, c.Commands.Command5} {
+		if strings.TrimSpace(cmd) != "" {
+			script.Steps = append(script.Steps,
+				Expect(PromptPattern, c.Timeout.CommandTimeout, true), Send(cmd))
+		}
+	}
+	return script
+}
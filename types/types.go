@@ -1,6 +1,9 @@
 package types
 
-import "encoding/xml"
+import (
+	"encoding/xml"
+	"strings"
+)
 
 type Configuration struct {
 	XMLName xml.Name  `xml:"configuration"`
@@ -24,6 +27,8 @@ type _node struct {
 	Path_      string `xml:"-"`
 	TreeView   string `xml:"-"`
 	StatusInfo string `xml:"-"`
+	// selected for cluster mode
+	Marked bool `xml:"-"`
 }
 
 type Node interface {
@@ -36,6 +41,9 @@ type Container struct {
 	Expanded    bool         `xml:"expanded,attr"`
 	Containers  []Container  `xml:"container"`
 	Connections []Connection `xml:"connection"`
+
+	// pcm extension: proxy for all connections inside, see Options.Proxy
+	Proxy string `xml:"proxy,attr,omitempty"`
 }
 
 type Connection struct {
@@ -47,6 +55,23 @@ type Connection struct {
 	Timeout  Timeout `xml:"timeout"`
 	Commands Command `xml:"command"`
 	Options  Options `xml:"options"`
+
+	// pcm extension, replaces Commands
+	Script *Script `xml:"script,omitempty"`
+
+	// Set for connections not loaded from connections.xml, which have no place
+	// to store their host key: it is checked against OpenSSH's known_hosts
+	// instead.
+	KnownHosts *KnownHosts `xml:"-"`
+}
+
+// Where the host key of a connection is looked up, like OpenSSH's
+// UserKnownHostsFile and HostKeyAlias
+type KnownHosts struct {
+	// ~/.ssh/known_hosts if empty. New keys are added to the first one.
+	Files []string
+	// Looked up instead of the host name
+	Alias string
 }
 
 func (n *_node) Path() string {
@@ -66,6 +91,26 @@ type Login struct {
 	User     string `xml:"login"`
 	Password string `xml:"password"`
 	Prompt   string `xml:"prompt"`
+
+	// The following are pcm extensions, not known to PuTTYCM
+	// Base32 TOTP secret (RFC 6238), or an otpauth:// URI
+	TOTPSecret string   `xml:"totp_secret,omitempty"`
+	Answers    []Answer `xml:"answer,omitempty"`
+}
+
+const (
+	AnswerPassword = "password"
+	AnswerTOTP     = "totp"
+	AnswerText     = "text"
+)
+
+// Answer to keyboard-interactive questions matching the regular expression
+// Question. Source says where the answer comes from; for AnswerText, it is
+// Value.
+type Answer struct {
+	Question string `xml:"question,attr"`
+	Source   string `xml:"source,attr"`
+	Value    string `xml:"value,attr,omitempty"`
 }
 
 // Timeouts are in milliseconds
@@ -90,6 +135,105 @@ type Options struct {
 	PostCommands bool   `xml:"postcommands"`
 	EndlineChar  int    `xml:"endlinechar"`
 	SSHPublicKey string `xml:"ssh_public_key,omitempty"`
+
+	// The following are pcm extensions, not known to PuTTYCM
+	IdentityFiles []string `xml:"identity_file,omitempty"`
+	// Paths of other connections (or [user@]host[:port]) to connect through
+	JumpHosts []string  `xml:"jump_host,omitempty"`
+	Forwards  []Forward `xml:"forward,omitempty"`
+	// socks5://[user:pass@]host:port, http://[user:pass@]host:port, a command
+	// to use like OpenSSH's ProxyCommand, or "none"
+	Proxy string `xml:"proxy,omitempty"`
+	// Starts escape sequences at the beginning of a line: a single character,
+	// "^X" for a control character, or "none". Defaults to "~".
+	EscapeChar string `xml:"escape_char,omitempty"`
+	// Forwards X11 to the local $DISPLAY: "trusted" (like ssh -Y) or
+	// "untrusted" (like ssh -X). Empty for none.
+	X11 string `xml:"x11,omitempty"`
+	// Run instead of the login shell, like the command given to ssh
+	RemoteCommand string `xml:"remote_command,omitempty"`
+	// Environment variables to send, if the host accepts them (see AcceptEnv
+	// in sshd_config)
+	Env []EnvVar `xml:"env,omitempty"`
+	// TERM for the pseudo terminal, "xterm" if empty
+	Term string `xml:"term,omitempty"`
+	// Don't request a pseudo terminal, like ssh -T
+	NoPty bool `xml:"no_pty,omitempty"`
+	// Character set of the host, e.g. "ISO-8859-1" or "CP437". UTF-8 if
+	// empty.
+	Charset string `xml:"charset,omitempty"`
+	// Forwards the SSH agent, restricted by the policy. Without one, -A
+	// forwards the whole agent.
+	AgentForwarding *AgentPolicy `xml:"agent_forwarding,omitempty"`
+}
+
+// What the host may do with the forwarded SSH agent
+type AgentPolicy struct {
+	// Keys the host sees, by SHA256 fingerprint ("SHA256:...") or comment.
+	// All keys if empty.
+	Keys []string `xml:"key,omitempty"`
+	// Refuse signing after this many signatures, 0 for no limit
+	MaxUses int `xml:"max_uses,attr,omitempty"`
+	// Ask on the terminal before each signature
+	Confirm bool `xml:"confirm,attr,omitempty"`
+	// File to append a line to for each signature request
+	Log string `xml:"log,attr,omitempty"`
+}
+
+// An environment variable sent to the host
+type EnvVar struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// ProxyNone disables a proxy set further up the tree
+const ProxyNone = "none"
+
+const (
+	X11Trusted   = "trusted"
+	X11Untrusted = "untrusted"
+)
+
+const (
+	ForwardLocal   = "local"
+	ForwardRemote  = "remote"
+	ForwardDynamic = "dynamic"
+)
+
+// A port forwarding. Listen and Target are either host:port pairs (host may be
+// omitted in Listen) or unix socket paths.
+type Forward struct {
+	Type   string `xml:"type,attr"`
+	Listen string `xml:"listen,attr"`
+	Target string `xml:"target,attr,omitempty"`
+}
+
+// ProxyFor returns the proxy setting for conn: its own, or the one of the
+// closest container having one. conn must have its path set.
+func (c *Configuration) ProxyFor(conn *Connection) string {
+	if conn.Options.Proxy != "" {
+		return conn.Options.Proxy
+	}
+	proxy := c.Root.Proxy
+	node := &c.Root
+	segments := strings.Split(strings.TrimPrefix(conn.Path(), "/"), "/")
+	for _, name := range segments[:len(segments)-1] {
+		var next *Container
+		for i := range node.Containers {
+			if node.Containers[i].Name == name {
+				next = &node.Containers[i]
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+		if node.Proxy != "" {
+			proxy = node.Proxy
+		}
+	}
+	return proxy
 }
 
 // lists all connections of config into a path->connection mapping
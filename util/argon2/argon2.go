@@ -0,0 +1,263 @@
+// Package argon2 implements the Argon2d, Argon2i and Argon2id key derivation
+// functions (RFC 9106, version 0x13).
+//
+// golang.org/x/crypto/argon2 lacks Argon2d, which KeePass uses, and its
+// vendored blake2b assembly does not link with current Go versions.
+package argon2
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// Argon2 variants, values as used in the algorithm and by KeePass
+const (
+	Argon2d  = 0
+	Argon2i  = 1
+	Argon2id = 2
+)
+
+const (
+	version     = 0x13
+	blockLength = 128
+	syncPoints  = 4
+)
+
+type block [blockLength]uint64
+
+// Key derives a key of keyLen bytes. memory is in KiB.
+func Key(mode int, password, salt, secret, data []byte, time, memory uint32,
+	threads uint8, keyLen uint32) []byte {
+
+	if time < 1 {
+		panic("argon2: number of rounds too small")
+	}
+	if threads < 1 {
+		panic("argon2: parallelism degree too low")
+	}
+	h0 := initHash(mode, password, salt, secret, data, time, memory,
+		uint32(threads), keyLen)
+
+	memory = memory / (syncPoints * uint32(threads)) * (syncPoints * uint32(threads))
+	if memory < 2*syncPoints*uint32(threads) {
+		memory = 2 * syncPoints * uint32(threads)
+	}
+	B := initBlocks(h0, memory, uint32(threads))
+	processBlocks(B, time, memory, uint32(threads), mode)
+	return extractKey(B, memory, uint32(threads), keyLen)
+}
+
+func initHash(mode int, password, salt, secret, data []byte,
+	time, memory, threads, keyLen uint32) []byte {
+
+	var params [24]byte
+	binary.LittleEndian.PutUint32(params[0:4], threads)
+	binary.LittleEndian.PutUint32(params[4:8], keyLen)
+	binary.LittleEndian.PutUint32(params[8:12], memory)
+	binary.LittleEndian.PutUint32(params[12:16], time)
+	binary.LittleEndian.PutUint32(params[16:20], version)
+	binary.LittleEndian.PutUint32(params[20:24], uint32(mode))
+	in := [][]byte{params[:]}
+	for _, b := range [][]byte{password, salt, secret, data} {
+		var l [4]byte
+		binary.LittleEndian.PutUint32(l[:], uint32(len(b)))
+		in = append(in, l[:], b)
+	}
+	// room for the block index and lane
+	return append(blake2bSum(blake2bSize, in...), make([]byte, 8)...)
+}
+
+func initBlocks(h0 []byte, memory, threads uint32) []block {
+	var block0 [1024]byte
+	B := make([]block, memory)
+	for lane := uint32(0); lane < threads; lane++ {
+		j := lane * (memory / threads)
+		binary.LittleEndian.PutUint32(h0[blake2bSize+4:], lane)
+		for i := uint32(0); i < 2; i++ {
+			binary.LittleEndian.PutUint32(h0[blake2bSize:], i)
+			blake2bLong(block0[:], h0)
+			for k := range B[j+i] {
+				B[j+i][k] = binary.LittleEndian.Uint64(block0[k*8:])
+			}
+		}
+	}
+	return B
+}
+
+func processBlocks(B []block, time, memory, threads uint32, mode int) {
+	lanes := memory / threads
+	segments := lanes / syncPoints
+
+	processSegment := func(n, slice, lane uint32, wg *sync.WaitGroup) {
+		defer wg.Done()
+		dataIndependent := mode == Argon2i ||
+			(mode == Argon2id && n == 0 && slice < syncPoints/2)
+		var addresses, in, zero block
+		if dataIndependent {
+			in[0] = uint64(n)
+			in[1] = uint64(lane)
+			in[2] = uint64(slice)
+			in[3] = uint64(memory)
+			in[4] = uint64(time)
+			in[5] = uint64(mode)
+		}
+
+		index := uint32(0)
+		if n == 0 && slice == 0 {
+			index = 2 // the first two blocks are already there
+			if dataIndependent {
+				in[6]++
+				processBlock(&addresses, &in, &zero, false)
+				processBlock(&addresses, &addresses, &zero, false)
+			}
+		}
+
+		offset := lane*lanes + slice*segments + index
+		var random uint64
+		for index < segments {
+			prev := offset - 1
+			if index == 0 && slice == 0 {
+				prev += lanes // last block in lane
+			}
+			if dataIndependent {
+				if index%blockLength == 0 {
+					in[6]++
+					processBlock(&addresses, &in, &zero, false)
+					processBlock(&addresses, &addresses, &zero, false)
+				}
+				random = addresses[index%blockLength]
+			} else {
+				random = B[prev][0]
+			}
+			newOffset := indexAlpha(random, lanes, segments, threads, n, slice, lane, index)
+			processBlock(&B[offset], &B[prev], &B[newOffset], n > 0)
+			index, offset = index+1, offset+1
+		}
+	}
+
+	for n := uint32(0); n < time; n++ {
+		for slice := uint32(0); slice < syncPoints; slice++ {
+			var wg sync.WaitGroup
+			for lane := uint32(0); lane < threads; lane++ {
+				wg.Add(1)
+				go processSegment(n, slice, lane, &wg)
+			}
+			wg.Wait()
+		}
+	}
+}
+
+func extractKey(B []block, memory, threads, keyLen uint32) []byte {
+	lanes := memory / threads
+	for lane := uint32(0); lane < threads-1; lane++ {
+		for i, v := range B[(lane*lanes)+lanes-1] {
+			B[memory-1][i] ^= v
+		}
+	}
+	var last [1024]byte
+	for i, v := range B[memory-1] {
+		binary.LittleEndian.PutUint64(last[i*8:], v)
+	}
+	key := make([]byte, keyLen)
+	blake2bLong(key, last[:])
+	return key
+}
+
+func indexAlpha(rand uint64, lanes, segments, threads, n, slice, lane, index uint32) uint32 {
+	refLane := uint32(rand>>32) % threads
+	if n == 0 && slice == 0 {
+		refLane = lane
+	}
+	m, s := 3*segments, ((slice+1)%syncPoints)*segments
+	if lane == refLane {
+		m += index
+	}
+	if n == 0 {
+		m, s = slice*segments, 0
+		if slice == 0 || lane == refLane {
+			m += index
+		}
+	}
+	if index == 0 || lane == refLane {
+		m--
+	}
+	p := rand & 0xFFFFFFFF
+	p = (p * p) >> 32
+	p = (p * uint64(m)) >> 32
+	return refLane*lanes + uint32((uint64(s)+uint64(m)-(p+1))%uint64(lanes))
+}
+
+// blake2bLong is the variable-length hash function H' of the specification.
+func blake2bLong(out []byte, in []byte) {
+	var outLen [4]byte
+	binary.LittleEndian.PutUint32(outLen[:], uint32(len(out)))
+	if len(out) <= blake2bSize {
+		copy(out, blake2bSum(len(out), outLen[:], in))
+		return
+	}
+	v := blake2bSum(blake2bSize, outLen[:], in)
+	for len(out) > blake2bSize {
+		copy(out, v[:32])
+		out = out[32:]
+		if len(out) > blake2bSize {
+			v = blake2bSum(blake2bSize, v)
+		} else {
+			v = blake2bSum(len(out), v)
+		}
+	}
+	copy(out, v)
+}
+
+// processBlock is the compression function G. With xor, the result is xored
+// into out, as required from the second pass on.
+func processBlock(out, in1, in2 *block, xor bool) {
+	var t block
+	for i := range t {
+		t[i] = in1[i] ^ in2[i]
+	}
+	r := t
+	for i := 0; i < blockLength; i += 16 {
+		blamka(&r[i+0], &r[i+1], &r[i+2], &r[i+3],
+			&r[i+4], &r[i+5], &r[i+6], &r[i+7],
+			&r[i+8], &r[i+9], &r[i+10], &r[i+11],
+			&r[i+12], &r[i+13], &r[i+14], &r[i+15])
+	}
+	for i := 0; i < blockLength/8; i += 2 {
+		blamka(&r[i], &r[i+1], &r[16+i], &r[16+i+1],
+			&r[32+i], &r[32+i+1], &r[48+i], &r[48+i+1],
+			&r[64+i], &r[64+i+1], &r[80+i], &r[80+i+1],
+			&r[96+i], &r[96+i+1], &r[112+i], &r[112+i+1])
+	}
+	for i := range r {
+		if xor {
+			out[i] ^= t[i] ^ r[i]
+		} else {
+			out[i] = t[i] ^ r[i]
+		}
+	}
+}
+
+// blamka is the BLAKE2b round with the multiplication-hardened G function.
+func blamka(v00, v01, v02, v03, v04, v05, v06, v07,
+	v08, v09, v10, v11, v12, v13, v14, v15 *uint64) {
+
+	gb(v00, v04, v08, v12)
+	gb(v01, v05, v09, v13)
+	gb(v02, v06, v10, v14)
+	gb(v03, v07, v11, v15)
+	gb(v00, v05, v10, v15)
+	gb(v01, v06, v11, v12)
+	gb(v02, v07, v08, v13)
+	gb(v03, v04, v09, v14)
+}
+
+func gb(a, b, c, d *uint64) {
+	*a += *b + 2*uint64(uint32(*a))*uint64(uint32(*b))
+	*d = rotr(*d^*a, 32)
+	*c += *d + 2*uint64(uint32(*c))*uint64(uint32(*d))
+	*b = rotr(*b^*c, 24)
+	*a += *b + 2*uint64(uint32(*a))*uint64(uint32(*b))
+	*d = rotr(*d^*a, 16)
+	*c += *d + 2*uint64(uint32(*c))*uint64(uint32(*d))
+	*b = rotr(*b^*c, 63)
+}
@@ -0,0 +1,296 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/cfstras/go-utils/color"
+	"github.com/cfstras/pcm/secrets"
+	"github.com/cfstras/pcm/types"
+)
+
+// CommandFunc returns another command to run, or nil if there are no more.
+type CommandFunc func() *string
+
+// How much of the output is kept to match against
+const scriptBufferSize = 4096
+
+// Timeout of expect steps if neither the step nor the connection set one
+const defaultExpectTimeout = 10 * time.Second
+
+var (
+	errScriptTimeout = errors.New("timeout")
+	errScriptStopped = errors.New("stopped")
+)
+
+// ScriptRunner runs a login script against the output of a session.
+type ScriptRunner struct {
+	conn  *types.Connection
+	stdin io.Writer
+
+	lock      sync.Mutex
+	output    []byte
+	strip     escapeStripper
+	newOutput chan struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// RunScript starts running script, sending input to stdin. Afterwards,
+// commands returned by more are sent at the shell prompt.
+func RunScript(conn *types.Connection, script *types.Script, stdin io.Writer,
+	more CommandFunc) *ScriptRunner {
+	r := &ScriptRunner{
+		conn:      conn,
+		stdin:     stdin,
+		newOutput: make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		if !r.run(script.Steps) {
+			return
+		}
+		for cmd := more(); cmd != nil; cmd = more() {
+			if !r.run([]types.ScriptStep{types.Expect(types.PromptPattern,
+				conn.Timeout.CommandTimeout, true), types.Send(*cmd)}) {
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// Output adds data written by the session. Escape sequences, e.g. for
+// colours, are removed before matching.
+func (r *ScriptRunner) Output(data []byte) {
+	r.lock.Lock()
+	r.output = r.strip.append(r.output, data)
+	if len(r.output) > scriptBufferSize {
+		r.output = append(r.output[:0], r.output[len(r.output)-scriptBufferSize:]...)
+	}
+	r.lock.Unlock()
+	select {
+	case r.newOutput <- struct{}{}:
+	default:
+	}
+}
+
+// Stop ends the script early.
+func (r *ScriptRunner) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+// Done is closed when the script has ended.
+func (r *ScriptRunner) Done() <-chan struct{} {
+	return r.done
+}
+
+// run runs steps and returns whether the script goes on.
+func (r *ScriptRunner) run(steps []types.ScriptStep) bool {
+	for _, s := range steps {
+		switch s.XMLName.Local {
+		case types.StepSend:
+			if err := r.send(s); err != nil {
+				color.Redln("Script:", s.String()+":", err, "\r")
+				return false
+			}
+		case types.StepExpect:
+			i, err := r.expect(s)
+			if err == errScriptStopped {
+				return false
+			} else if err == errScriptTimeout && s.Optional {
+				continue
+			} else if err != nil {
+				color.Yellowln("\r\nScript stopped:", s.String()+":", err, "\r")
+				return false
+			}
+			if len(s.Cases) > 0 && !r.run(s.Cases[i].Steps) {
+				return false
+			}
+		default:
+			color.Redln("Script:", s.String(), "\r")
+			return false
+		}
+	}
+	return true
+}
+
+// ResolvePassword resolves the password of conn if it is kept elsewhere and
+// script may send it. Call it before the terminal is made raw, so questions
+// can be asked; the script then finds the password resolved.
+func ResolvePassword(conn *types.Connection, script *types.Script, ask secrets.AskFunc) {
+	if !secrets.IsReference(conn.Login.Password) || !SendsSecret(script, types.AnswerPassword) {
+		return
+	}
+	if _, err := secrets.Resolve(conn.Login.Password, ask); err != nil {
+		color.Redln(err)
+	}
+}
+
+// SendsSecret returns whether script sends the secret, one of
+// types.AnswerPassword and types.AnswerTOTP.
+func SendsSecret(script *types.Script, secret string) bool {
+	return sendsSecret(script.Steps, secret)
+}
+
+func sendsSecret(steps []types.ScriptStep, secret string) bool {
+	for _, s := range steps {
+		if s.Secret == secret {
+			return true
+		}
+		for _, c := range s.Cases {
+			if sendsSecret(c.Steps, secret) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *ScriptRunner) send(s types.ScriptStep) error {
+	text := s.Text
+	switch s.Secret {
+	case "":
+	case types.AnswerPassword:
+		password, err := secrets.Resolve(r.conn.Login.Password, nil)
+		if err != nil {
+			return err
+		}
+		text = password
+	case types.AnswerTOTP:
+		code, err := TOTP(r.conn.Login.TOTPSecret, time.Now())
+		if err != nil {
+			return err
+		}
+		text = code
+	default:
+		return errors.New("unknown secret " + s.Secret)
+	}
+	if !s.Raw {
+		text += Endline(r.conn)
+	}
+	_, err := io.WriteString(r.stdin, text)
+	return err
+}
+
+// expect waits for one of the patterns of s and returns its index. The
+// output up to the end of the match is consumed.
+func (r *ScriptRunner) expect(s types.ScriptStep) (int, error) {
+	var patterns []*regexp.Regexp
+	for _, p := range s.Patterns() {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return -1, err
+		}
+		patterns = append(patterns, re)
+	}
+	timeout := time.Duration(s.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = time.Duration(r.conn.Timeout.CommandTimeout) * time.Millisecond
+	}
+	if timeout == 0 {
+		timeout = defaultExpectTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		r.lock.Lock()
+		for i, re := range patterns {
+			if loc := re.FindIndex(r.output); loc != nil {
+				r.output = r.output[loc[1]:]
+				r.lock.Unlock()
+				return i, nil
+			}
+		}
+		r.lock.Unlock()
+
+		select {
+		case <-r.newOutput:
+			// the timeout counts from the last output
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(timeout)
+		case <-timer.C:
+			return -1, errScriptTimeout
+		case <-r.stop:
+			return -1, errScriptStopped
+		}
+	}
+}
+
+// Endline returns the end of line to send for c
+func Endline(c *types.Connection) string {
+	if c.Options.EndlineChar == '\r' {
+		return "\r"
+	}
+	return "\n"
+}
+
+// escapeStripper removes terminal escape sequences from output, keeping its
+// state between writes.
+type escapeStripper struct {
+	state int
+}
+
+const (
+	stripText = iota
+	stripEscape
+	stripCharset // ESC ( B and similar
+	stripCSI     // ESC [ ... final byte
+	stripString  // OSC and others, until BEL or ESC \
+	stripStringEscape
+)
+
+func (e *escapeStripper) append(out, in []byte) []byte {
+	for _, b := range in {
+		switch e.state {
+		case stripText:
+			if b == 0x1b {
+				e.state = stripEscape
+			} else {
+				out = append(out, b)
+			}
+		case stripEscape:
+			switch {
+			case b == '[':
+				e.state = stripCSI
+			case b == ']' || b == 'P' || b == 'X' || b == '^' || b == '_':
+				e.state = stripString
+			case b >= 0x20 && b <= 0x2f:
+				e.state = stripCharset
+			default:
+				e.state = stripText
+			}
+		case stripCharset:
+			e.state = stripText
+		case stripCSI:
+			if b >= 0x40 && b <= 0x7e {
+				e.state = stripText
+			}
+		case stripString:
+			if b == 0x07 {
+				e.state = stripText
+			} else if b == 0x1b {
+				e.state = stripStringEscape
+			}
+		case stripStringEscape:
+			if b == '\\' {
+				e.state = stripText
+			} else {
+				e.state = stripString
+			}
+		}
+	}
+	return out
+}
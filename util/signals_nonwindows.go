@@ -3,10 +3,36 @@
 package util
 
 import (
+	"errors"
 	"os"
+	"os/signal"
 	"syscall"
+	"time"
 )
 
 func GetSigwinch() os.Signal {
 	return syscall.SIGWINCH
 }
+
+// Suspend stops the process like Ctrl+Z would, and returns once it continues.
+func Suspend() error {
+	cont := make(chan os.Signal, 1)
+	signal.Notify(cont, syscall.SIGCONT)
+	defer signal.Stop(cont)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTSTP); err != nil {
+		return err
+	}
+	// without job control, the signal is ignored
+	select {
+	case <-cont:
+		return nil
+	case <-time.After(time.Second):
+		// we might have just been continued after a while
+		select {
+		case <-cont:
+			return nil
+		case <-time.After(200 * time.Millisecond):
+			return errors.New("process was not stopped")
+		}
+	}
+}
@@ -2,8 +2,16 @@
 
 package util
 
-import "os"
+import (
+	"errors"
+	"os"
+)
 
 func GetSigwinch() os.Signal {
 	return nil
 }
+
+// Suspend is not possible on windows
+func Suspend() error {
+	return errors.New("suspending is not supported on windows")
+}
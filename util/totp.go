@@ -0,0 +1,88 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TOTP returns the time-based one-time password (RFC 6238) for secret at time
+// t. secret is either a base32 string, as shown by most services, or an
+// otpauth://totp/ URI which may also specify digits, period and algorithm.
+func TOTP(secret string, t time.Time) (string, error) {
+	digits, period := 6, int64(30)
+	algorithm := sha1.New
+	if strings.HasPrefix(secret, "otpauth://") {
+		u, err := url.Parse(secret)
+		if err != nil {
+			return "", err
+		}
+		q := u.Query()
+		secret = q.Get("secret")
+		if d := q.Get("digits"); d != "" {
+			if digits, err = strconv.Atoi(d); err != nil || digits < 1 || digits > 9 {
+				return "", errors.New("invalid digits in otpauth URI")
+			}
+		}
+		if p := q.Get("period"); p != "" {
+			if period, err = strconv.ParseInt(p, 10, 64); err != nil || period <= 0 {
+				return "", errors.New("invalid period in otpauth URI")
+			}
+		}
+		switch strings.ToUpper(q.Get("algorithm")) {
+		case "", "SHA1":
+		case "SHA256":
+			algorithm = sha256.New
+		case "SHA512":
+			algorithm = sha512.New
+		default:
+			return "", errors.New("unsupported algorithm " + q.Get("algorithm"))
+		}
+	}
+
+	key, err := decodeBase32Secret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(t.Unix()/period), digits, algorithm), nil
+}
+
+// hotp implements RFC 4226
+func hotp(key []byte, counter uint64, digits int, algorithm func() hash.Hash) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(algorithm, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+func decodeBase32Secret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	secret = strings.TrimRight(secret, "=")
+	if secret == "" {
+		return nil, errors.New("empty TOTP secret")
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return nil, errors.New("invalid TOTP secret: " + err.Error())
+	}
+	return key, nil
+}
@@ -0,0 +1,213 @@
+// Package vault encrypts connections.xml, or just the secrets in it, with a key
+// derived from a passphrase.
+//
+// Keys are derived with scrypt (N=2^15, r=8, p=1) from the passphrase and a
+// random salt; data is encrypted with ChaCha20-Poly1305. An encrypted file
+// starts with a header line holding the format version and salt, followed by
+// the base64 of nonce and ciphertext. An encrypted value is
+// "pcm1:<salt>:<nonce and ciphertext>", both in base64; it is bound to the
+// path of its connection and the name of its field.
+package vault
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	fileMagic   = "pcm-encrypted "
+	fileVersion = "v1"
+	valuePrefix = "pcm1:"
+
+	saltSize = 16
+	keySize  = chacha20poly1305.KeySize
+)
+
+var (
+	ErrWrongPassphrase = errors.New("wrong passphrase, or the data was changed")
+	errFormat          = errors.New("invalid encrypted data")
+)
+
+// A Key encrypts and decrypts data. Everything encrypted with a key carries its
+// salt, so the key can be derived again from the passphrase.
+type Key struct {
+	salt []byte
+	key  []byte
+	aead cipher.AEAD
+}
+
+// NewKey derives a key from passphrase with a new random salt.
+func NewKey(passphrase []byte) (*Key, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return DeriveKey(passphrase, salt)
+}
+
+// DeriveKey derives the key for passphrase and salt. This takes a moment, on
+// purpose.
+func DeriveKey(passphrase, salt []byte) (*Key, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, keySize)
+	if err != nil {
+		return nil, err
+	}
+	return RestoreKey(salt, key)
+}
+
+// RestoreKey returns the key with the raw key material of Bytes, as kept by a
+// key cache.
+func RestoreKey(salt, key []byte) (*Key, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{salt: salt, key: key, aead: aead}, nil
+}
+
+// Salt returns the salt the key was derived with.
+func (k *Key) Salt() []byte {
+	return k.salt
+}
+
+// Bytes returns the raw key.
+func (k *Key) Bytes() []byte {
+	return k.key
+}
+
+func (k *Key) seal(plain, additional []byte) []byte {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return k.aead.Seal(nonce, nonce, plain, additional)
+}
+
+func (k *Key) open(sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < k.aead.NonceSize() {
+		return nil, errFormat
+	}
+	n := k.aead.NonceSize()
+	plain, err := k.aead.Open(nil, sealed[:n], sealed[n:], additional)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plain, nil
+}
+
+// IsEncryptedFile returns whether data is an encrypted file.
+func IsEncryptedFile(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(fileMagic))
+}
+
+// fileHeader returns the header line and the body of an encrypted file.
+func fileHeader(data []byte) (header []byte, body []byte, err error) {
+	i := bytes.IndexByte(data, '\n')
+	if !IsEncryptedFile(data) || i == -1 {
+		return nil, nil, errFormat
+	}
+	return data[:i+1], data[i+1:], nil
+}
+
+// FileSalt returns the salt of the key an encrypted file was encrypted with.
+func FileSalt(data []byte) ([]byte, error) {
+	header, _, err := fileHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(header))
+	if len(fields) != 3 {
+		return nil, errFormat
+	}
+	if fields[1] != fileVersion {
+		return nil, fmt.Errorf("unsupported encryption format %s", fields[1])
+	}
+	return base64.StdEncoding.DecodeString(fields[2])
+}
+
+// EncryptFile encrypts the contents of a file.
+func (k *Key) EncryptFile(plain []byte) []byte {
+	header := fileMagic + fileVersion + " " + base64.StdEncoding.EncodeToString(k.salt) + "\n"
+	body := base64.StdEncoding.EncodeToString(k.seal(plain, []byte(header)))
+	out := bytes.NewBufferString(header)
+	for len(body) > 76 {
+		out.WriteString(body[:76] + "\n")
+		body = body[76:]
+	}
+	out.WriteString(body + "\n")
+	return out.Bytes()
+}
+
+// DecryptFile decrypts a file encrypted with EncryptFile.
+func (k *Key) DecryptFile(data []byte) ([]byte, error) {
+	header, body, err := fileHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	if err != nil {
+		return nil, errFormat
+	}
+	return k.open(sealed, header)
+}
+
+// IsEncryptedValue returns whether s was encrypted with EncryptValue.
+func IsEncryptedValue(s string) bool {
+	return strings.HasPrefix(s, valuePrefix)
+}
+
+func splitValue(s string) (salt []byte, sealed []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(s, valuePrefix), ":")
+	if !IsEncryptedValue(s) || len(parts) != 2 {
+		return nil, nil, errFormat
+	}
+	if salt, err = base64.StdEncoding.DecodeString(parts[0]); err != nil {
+		return nil, nil, errFormat
+	}
+	if sealed, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+		return nil, nil, errFormat
+	}
+	return salt, sealed, nil
+}
+
+// ValueSalt returns the salt of the key an encrypted value was encrypted
+// with.
+func ValueSalt(s string) ([]byte, error) {
+	salt, _, err := splitValue(s)
+	return salt, err
+}
+
+// valueData returns the additional data authenticated with a value, so it
+// can't be copied to another connection or field.
+func valueData(path, field string) []byte {
+	return []byte(valuePrefix + path + "\x00" + field)
+}
+
+// EncryptValue encrypts a single value, like a password, kept in field of the
+// connection at path.
+func (k *Key) EncryptValue(plain, path, field string) string {
+	return valuePrefix + base64.StdEncoding.EncodeToString(k.salt) + ":" +
+		base64.StdEncoding.EncodeToString(k.seal([]byte(plain), valueData(path, field)))
+}
+
+// DecryptValue decrypts a value encrypted with EncryptValue for the same path
+// and field.
+func (k *Key) DecryptValue(s, path, field string) (string, error) {
+	salt, sealed, err := splitValue(s)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(salt, k.salt) {
+		return "", ErrWrongPassphrase
+	}
+	plain, err := k.open(sealed, valueData(path, field))
+	return string(plain), err
+}
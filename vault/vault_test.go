@@ -0,0 +1,150 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T, passphrase string) *Key {
+	k, err := NewKey([]byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestFile(t *testing.T) {
+	k := testKey(t, "correct horse")
+	plain := []byte("<configuration>\n  <password>secret</password>\n</configuration>\n")
+	sealed := k.EncryptFile(plain)
+	if !IsEncryptedFile(sealed) || bytes.Contains(sealed, []byte("secret")) {
+		t.Fatalf("not encrypted:\n%s", sealed)
+	}
+	if IsEncryptedFile(plain) {
+		t.Error("plain text taken for an encrypted file")
+	}
+
+	salt, err := FileSalt(sealed)
+	if err != nil || !bytes.Equal(salt, k.Salt()) {
+		t.Fatalf("salt %x, %v; want %x", salt, err, k.Salt())
+	}
+	// the key is derived again from the passphrase and the salt in the file
+	again, err := DeriveKey([]byte("correct horse"), salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := again.DecryptFile(sealed); err != nil || !bytes.Equal(out, plain) {
+		t.Errorf("got %q, %v", out, err)
+	}
+	if bytes.Equal(k.EncryptFile(plain), sealed) {
+		t.Error("the nonce was reused")
+	}
+}
+
+func TestValue(t *testing.T) {
+	k := testKey(t, "correct horse")
+	sealed := k.EncryptValue("secret", "/net/db", "password")
+	if !IsEncryptedValue(sealed) || strings.Contains(sealed, "secret") {
+		t.Fatalf("not encrypted: %s", sealed)
+	}
+	if IsEncryptedValue("secret") {
+		t.Error("plain text taken for an encrypted value")
+	}
+	salt, err := ValueSalt(sealed)
+	if err != nil || !bytes.Equal(salt, k.Salt()) {
+		t.Fatalf("salt %x, %v; want %x", salt, err, k.Salt())
+	}
+	// as the key cache keeps it
+	restored, err := RestoreKey(k.Salt(), k.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := restored.DecryptValue(sealed, "/net/db", "password"); err != nil || out != "secret" {
+		t.Errorf("got %q, %v", out, err)
+	}
+	empty := k.EncryptValue("", "/net/db", "password")
+	if out, err := k.DecryptValue(empty, "/net/db", "password"); err != nil || out != "" {
+		t.Errorf("empty value: got %q, %v", out, err)
+	}
+}
+
+func TestWrongPassphrase(t *testing.T) {
+	k := testKey(t, "correct horse")
+	file, value := k.EncryptFile([]byte("plain")), k.EncryptValue("secret", "/net/db", "password")
+	wrong, err := DeriveKey([]byte("battery staple"), k.Salt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.DecryptFile(file); err != ErrWrongPassphrase {
+		t.Errorf("file: got %v, want ErrWrongPassphrase", err)
+	}
+	if _, err := wrong.DecryptValue(value, "/net/db", "password"); err != ErrWrongPassphrase {
+		t.Errorf("value: got %v, want ErrWrongPassphrase", err)
+	}
+	// a key with another salt, like after a rekey
+	if _, err := testKey(t, "correct horse").DecryptValue(value, "/net/db", "password"); err != ErrWrongPassphrase {
+		t.Errorf("other salt: got %v, want ErrWrongPassphrase", err)
+	}
+}
+
+func TestTampered(t *testing.T) {
+	k := testKey(t, "correct horse")
+	file := k.EncryptFile([]byte("<configuration />"))
+	header, body, err := fileHeader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed[len(sealed)/2] ^= 1
+	tampered := append(append([]byte{}, header...),
+		base64.StdEncoding.EncodeToString(sealed)+"\n"...)
+	if _, err := k.DecryptFile(tampered); err != ErrWrongPassphrase {
+		t.Errorf("changed ciphertext: got %v, want ErrWrongPassphrase", err)
+	}
+	// the header is authenticated too
+	changed := bytes.Replace(file, []byte(fileVersion+" "), []byte(fileVersion+"  "), 1)
+	if _, err := k.DecryptFile(changed); err != ErrWrongPassphrase {
+		t.Errorf("changed header: got %v, want ErrWrongPassphrase", err)
+	}
+
+	value := k.EncryptValue("secret", "/net/db", "password")
+	salt, sealedValue, err := splitValue(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedValue[len(sealedValue)-1] ^= 1
+	tamperedValue := valuePrefix + base64.StdEncoding.EncodeToString(salt) + ":" +
+		base64.StdEncoding.EncodeToString(sealedValue)
+	if _, err := k.DecryptValue(tamperedValue, "/net/db", "password"); err != ErrWrongPassphrase {
+		t.Errorf("changed value: got %v, want ErrWrongPassphrase", err)
+	}
+	// a value copied to another connection or field
+	for _, to := range [][2]string{{"/net/web", "password"}, {"/net/db", "totp_secret"}} {
+		if _, err := k.DecryptValue(value, to[0], to[1]); err != ErrWrongPassphrase {
+			t.Errorf("moved to %q: got %v, want ErrWrongPassphrase", to, err)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	k := testKey(t, "correct horse")
+	for _, file := range []string{"pcm-encrypted v1 AAAA", "pcm-encrypted v1 AAAA\n!!!\n",
+		"pcm-encrypted v1 AAAA\nAAAA\n"} {
+		if _, err := k.DecryptFile([]byte(file)); err == nil {
+			t.Errorf("%q: no error", file)
+		}
+	}
+	if _, err := FileSalt([]byte("pcm-encrypted v2 AAAA\n")); err == nil {
+		t.Error("unknown version accepted")
+	}
+	for _, value := range []string{"pcm1:", "pcm1:AAAA", "pcm1:!!:AAAA", "pcm1:AAAA:!!"} {
+		if _, err := k.DecryptValue(value, "/net/db", "password"); err == nil {
+			t.Errorf("%q: no error", value)
+		}
+	}
+}
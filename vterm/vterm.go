@@ -0,0 +1,574 @@
+// Package vterm emulates enough of a VT100/xterm to show a shell or a
+// full-screen program in a part of the real terminal.
+package vterm
+
+import (
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// Colors are 0-7 for the normal and 8-15 for the bright ANSI colors
+const DefaultColor = -1
+
+// Attr is how a cell is drawn
+type Attr struct {
+	Fg, Bg    int
+	Bold      bool
+	Underline bool
+	Reverse   bool
+}
+
+var defaultAttr = Attr{Fg: DefaultColor, Bg: DefaultColor}
+
+// Cell is one character on the screen
+type Cell struct {
+	Ch rune
+	Attr
+}
+
+// Screen is the state of an emulated terminal. It is safe for concurrent use.
+type Screen struct {
+	// Respond is called with answers to queries, like the cursor position.
+	// They have to be sent back as input.
+	Respond func([]byte)
+
+	lock          sync.Mutex
+	width, height int
+	cells         [][]Cell
+	// the normal screen, while the alternate one is shown
+	saved [][]Cell
+
+	x, y          int
+	wrapNext      bool
+	attr          Attr
+	savedX        int
+	savedY        int
+	savedAttr     Attr
+	top, bottom   int // scroll region, inclusive
+	cursorVisible bool
+	autoWrap      bool
+
+	state   int
+	params  []byte
+	utf8Buf []byte
+}
+
+// Parser states
+const (
+	stateText = iota
+	stateEscape
+	stateSkipOne // charset designation and similar
+	stateCSI
+	stateString // OSC, DCS etc., until BEL or ESC \
+	stateStringEscape
+)
+
+// New returns a screen of the given size.
+func New(width, height int) *Screen {
+	s := &Screen{}
+	s.reset(width, height)
+	return s
+}
+
+func (s *Screen) reset(width, height int) {
+	s.width, s.height = max(width, 1), max(height, 1)
+	s.cells = newCells(s.width, s.height)
+	s.saved = nil
+	s.x, s.y, s.wrapNext = 0, 0, false
+	s.attr, s.savedAttr = defaultAttr, defaultAttr
+	s.savedX, s.savedY = 0, 0
+	s.top, s.bottom = 0, s.height-1
+	s.cursorVisible, s.autoWrap = true, true
+}
+
+func newCells(width, height int) [][]Cell {
+	cells := make([][]Cell, height)
+	for y := range cells {
+		cells[y] = blankLine(width, defaultAttr)
+	}
+	return cells
+}
+
+func blankLine(width int, attr Attr) []Cell {
+	line := make([]Cell, width)
+	for x := range line {
+		line[x] = Cell{' ', Attr{Fg: attr.Fg, Bg: attr.Bg}}
+	}
+	return line
+}
+
+// Size returns width and height of the screen.
+func (s *Screen) Size() (int, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.width, s.height
+}
+
+// Resize changes the size, keeping the content at the top left, or the lines
+// above the cursor if the screen gets lower.
+func (s *Screen) Resize(width, height int) {
+	width, height = max(width, 1), max(height, 1)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if width == s.width && height == s.height {
+		return
+	}
+	resize := func(cells [][]Cell) [][]Cell {
+		if cells == nil {
+			return nil
+		}
+		if shift := s.y - (height - 1); shift > 0 {
+			cells = cells[shift:]
+		}
+		out := newCells(width, height)
+		for y := 0; y < height && y < len(cells); y++ {
+			copy(out[y], cells[y])
+		}
+		return out
+	}
+	if shift := s.y - (height - 1); shift > 0 {
+		s.y -= shift
+	}
+	s.cells, s.saved = resize(s.cells), resize(s.saved)
+	s.width, s.height = width, height
+	s.x = min(s.x, width-1)
+	s.top, s.bottom = 0, height-1
+	s.wrapNext = false
+}
+
+// Cell returns the cell at x, y.
+func (s *Screen) Cell(x, y int) Cell {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if y < 0 || y >= s.height || x < 0 || x >= s.width {
+		return Cell{' ', defaultAttr}
+	}
+	return s.cells[y][x]
+}
+
+// Cursor returns the cursor position and whether it is shown.
+func (s *Screen) Cursor() (x, y int, visible bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.x, s.y, s.cursorVisible
+}
+
+// Write interprets the output of a program.
+func (s *Screen) Write(data []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, b := range data {
+		s.handle(b)
+	}
+	return len(data), nil
+}
+
+func (s *Screen) handle(b byte) {
+	switch s.state {
+	case stateText:
+		s.text(b)
+	case stateEscape:
+		s.escape(b)
+	case stateSkipOne:
+		s.state = stateText
+	case stateCSI:
+		if b >= 0x40 && b <= 0x7e {
+			s.state = stateText
+			s.csi(b)
+		} else if b == 0x1b {
+			s.state = stateEscape
+		} else {
+			s.params = append(s.params, b)
+		}
+	case stateString:
+		if b == 0x07 {
+			s.state = stateText
+		} else if b == 0x1b {
+			s.state = stateStringEscape
+		}
+	case stateStringEscape:
+		if b == '\\' {
+			s.state = stateText
+		} else {
+			s.state = stateString
+		}
+	}
+}
+
+func (s *Screen) text(b byte) {
+	if len(s.utf8Buf) > 0 || b >= 0x80 {
+		s.utf8Buf = append(s.utf8Buf, b)
+		if !utf8.FullRune(s.utf8Buf) {
+			return
+		}
+		r, _ := utf8.DecodeRune(s.utf8Buf)
+		s.utf8Buf = s.utf8Buf[:0]
+		s.put(r)
+		return
+	}
+	switch b {
+	case 0x1b:
+		s.state = stateEscape
+		s.params = s.params[:0]
+	case '\r':
+		s.x, s.wrapNext = 0, false
+	case '\n', '\v', '\f':
+		s.lineFeed()
+	case '\b':
+		if s.x > 0 {
+			s.x--
+		}
+		s.wrapNext = false
+	case '\t':
+		s.x = min((s.x/8+1)*8, s.width-1)
+	default:
+		if b >= 0x20 && b != 0x7f {
+			s.put(rune(b))
+		}
+	}
+}
+
+func (s *Screen) put(r rune) {
+	if s.wrapNext {
+		s.x, s.wrapNext = 0, false
+		s.lineFeed()
+	}
+	s.cells[s.y][s.x] = Cell{r, s.attr}
+	if s.x < s.width-1 {
+		s.x++
+	} else if s.autoWrap {
+		s.wrapNext = true
+	}
+}
+
+func (s *Screen) lineFeed() {
+	s.wrapNext = false
+	if s.y == s.bottom {
+		s.scrollUp(1)
+	} else if s.y < s.height-1 {
+		s.y++
+	}
+}
+
+func (s *Screen) reverseIndex() {
+	if s.y == s.top {
+		s.scrollDown(1)
+	} else if s.y > 0 {
+		s.y--
+	}
+}
+
+// scrollUp moves the lines of the scroll region up by n
+func (s *Screen) scrollUp(n int) {
+	s.deleteLines(s.top, n)
+}
+
+// scrollDown moves the lines of the scroll region down by n
+func (s *Screen) scrollDown(n int) {
+	s.insertLines(s.top, n)
+}
+
+// insertLines inserts n blank lines at y, inside the scroll region
+func (s *Screen) insertLines(y, n int) {
+	if y < s.top || y > s.bottom {
+		return
+	}
+	n = min(n, s.bottom-y+1)
+	copy(s.cells[y+n:s.bottom+1], s.cells[y:s.bottom+1-n])
+	for i := y; i < y+n; i++ {
+		s.cells[i] = blankLine(s.width, s.attr)
+	}
+}
+
+// deleteLines removes n lines at y, inside the scroll region
+func (s *Screen) deleteLines(y, n int) {
+	if y < s.top || y > s.bottom {
+		return
+	}
+	n = min(n, s.bottom-y+1)
+	copy(s.cells[y:s.bottom+1-n], s.cells[y+n:s.bottom+1])
+	for i := s.bottom + 1 - n; i <= s.bottom; i++ {
+		s.cells[i] = blankLine(s.width, s.attr)
+	}
+}
+
+func (s *Screen) escape(b byte) {
+	s.state = stateText
+	switch b {
+	case '[':
+		s.state = stateCSI
+		s.params = s.params[:0]
+	case ']', 'P', 'X', '^', '_':
+		s.state = stateString
+	case '(', ')', '*', '+', '#', '%':
+		s.state = stateSkipOne
+	case '7':
+		s.saveCursor()
+	case '8':
+		s.restoreCursor()
+	case 'D':
+		s.lineFeed()
+	case 'E':
+		s.x = 0
+		s.lineFeed()
+	case 'M':
+		s.reverseIndex()
+	case 'c':
+		s.reset(s.width, s.height)
+	}
+}
+
+func (s *Screen) saveCursor() {
+	s.savedX, s.savedY, s.savedAttr = s.x, s.y, s.attr
+}
+
+func (s *Screen) restoreCursor() {
+	s.x, s.y, s.attr = min(s.savedX, s.width-1), min(s.savedY, s.height-1), s.savedAttr
+	s.wrapNext = false
+}
+
+// csi runs a control sequence, with its parameters in s.params
+func (s *Screen) csi(final byte) {
+	private := byte(0)
+	params := s.params
+	if len(params) > 0 && (params[0] == '?' || params[0] == '>' || params[0] == '=') {
+		private, params = params[0], params[1:]
+	}
+	var args []int
+	num, hasNum := 0, false
+	for _, c := range params {
+		switch {
+		case c >= '0' && c <= '9':
+			num = num*10 + int(c-'0')
+			hasNum = true
+		case c == ';' || c == ':':
+			args = append(args, num)
+			num, hasNum = 0, false
+		}
+	}
+	if hasNum || len(args) > 0 {
+		args = append(args, num)
+	}
+	arg := func(i, def int) int {
+		if i < len(args) && args[i] != 0 {
+			return args[i]
+		}
+		return def
+	}
+
+	s.wrapNext = false
+	switch final {
+	case 'A':
+		s.y = max(s.y-arg(0, 1), 0)
+	case 'B', 'e':
+		s.y = min(s.y+arg(0, 1), s.height-1)
+	case 'C', 'a':
+		s.x = min(s.x+arg(0, 1), s.width-1)
+	case 'D':
+		s.x = max(s.x-arg(0, 1), 0)
+	case 'E':
+		s.x, s.y = 0, min(s.y+arg(0, 1), s.height-1)
+	case 'F':
+		s.x, s.y = 0, max(s.y-arg(0, 1), 0)
+	case 'G', '`':
+		s.x = clamp(arg(0, 1)-1, 0, s.width-1)
+	case 'd':
+		s.y = clamp(arg(0, 1)-1, 0, s.height-1)
+	case 'H', 'f':
+		s.y = clamp(arg(0, 1)-1, 0, s.height-1)
+		s.x = clamp(arg(1, 1)-1, 0, s.width-1)
+	case 'J':
+		s.eraseDisplay(arg(0, 0))
+	case 'K':
+		s.eraseLine(arg(0, 0))
+	case 'L':
+		s.insertLines(s.y, arg(0, 1))
+	case 'M':
+		s.deleteLines(s.y, arg(0, 1))
+	case 'P':
+		n := min(arg(0, 1), s.width-s.x)
+		line := s.cells[s.y]
+		copy(line[s.x:], line[s.x+n:])
+		s.blank(line[s.width-n:])
+	case '@':
+		n := min(arg(0, 1), s.width-s.x)
+		line := s.cells[s.y]
+		copy(line[s.x+n:], line[s.x:s.width-n])
+		s.blank(line[s.x : s.x+n])
+	case 'X':
+		s.blank(s.cells[s.y][s.x:min(s.x+arg(0, 1), s.width)])
+	case 'S':
+		s.scrollUp(arg(0, 1))
+	case 'T':
+		if private == 0 {
+			s.scrollDown(arg(0, 1))
+		}
+	case 'r':
+		top, bottom := arg(0, 1)-1, arg(1, s.height)-1
+		if top < bottom && bottom < s.height {
+			s.top, s.bottom = top, bottom
+			s.x, s.y = 0, 0
+		}
+	case 's':
+		s.saveCursor()
+	case 'u':
+		s.restoreCursor()
+	case 'm':
+		if private == 0 {
+			s.sgr(args)
+		}
+	case 'h', 'l':
+		if private == '?' {
+			for _, mode := range args {
+				s.setMode(mode, final == 'h')
+			}
+		}
+	case 'n':
+		if private == 0 && arg(0, 0) == 6 {
+			s.respond("\x1b[" + strconv.Itoa(s.y+1) + ";" + strconv.Itoa(s.x+1) + "R")
+		} else if private == 0 && arg(0, 0) == 5 {
+			s.respond("\x1b[0n")
+		}
+	case 'c':
+		if private == 0 {
+			s.respond("\x1b[?1;2c")
+		}
+	}
+}
+
+func (s *Screen) respond(answer string) {
+	if s.Respond != nil {
+		s.Respond([]byte(answer))
+	}
+}
+
+func (s *Screen) blank(cells []Cell) {
+	for i := range cells {
+		cells[i] = Cell{' ', Attr{Fg: s.attr.Fg, Bg: s.attr.Bg}}
+	}
+}
+
+func (s *Screen) eraseDisplay(mode int) {
+	switch mode {
+	case 0:
+		s.eraseLine(0)
+		for y := s.y + 1; y < s.height; y++ {
+			s.blank(s.cells[y])
+		}
+	case 1:
+		s.eraseLine(1)
+		for y := 0; y < s.y; y++ {
+			s.blank(s.cells[y])
+		}
+	case 2, 3:
+		for y := range s.cells {
+			s.blank(s.cells[y])
+		}
+	}
+}
+
+func (s *Screen) eraseLine(mode int) {
+	line := s.cells[s.y]
+	switch mode {
+	case 0:
+		s.blank(line[s.x:])
+	case 1:
+		s.blank(line[:s.x+1])
+	case 2:
+		s.blank(line)
+	}
+}
+
+func (s *Screen) setMode(mode int, on bool) {
+	switch mode {
+	case 7:
+		s.autoWrap = on
+	case 25:
+		s.cursorVisible = on
+	case 47, 1047, 1049:
+		if on && s.saved == nil {
+			if mode == 1049 {
+				s.saveCursor()
+			}
+			s.saved = s.cells
+			s.cells = newCells(s.width, s.height)
+		} else if !on && s.saved != nil {
+			s.cells, s.saved = s.saved, nil
+			if mode == 1049 {
+				s.restoreCursor()
+			}
+		}
+	}
+}
+
+// sgr sets the attributes for the following text
+func (s *Screen) sgr(args []int) {
+	if len(args) == 0 {
+		args = []int{0}
+	}
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; {
+		case a == 0:
+			s.attr = defaultAttr
+		case a == 1:
+			s.attr.Bold = true
+		case a == 4:
+			s.attr.Underline = true
+		case a == 7:
+			s.attr.Reverse = true
+		case a == 22:
+			s.attr.Bold = false
+		case a == 24:
+			s.attr.Underline = false
+		case a == 27:
+			s.attr.Reverse = false
+		case a >= 30 && a <= 37:
+			s.attr.Fg = a - 30
+		case a == 39:
+			s.attr.Fg = DefaultColor
+		case a >= 40 && a <= 47:
+			s.attr.Bg = a - 40
+		case a == 49:
+			s.attr.Bg = DefaultColor
+		case a >= 90 && a <= 97:
+			s.attr.Fg = a - 90 + 8
+		case a >= 100 && a <= 107:
+			s.attr.Bg = a - 100 + 8
+		case a == 38 || a == 48:
+			// 256 colors or RGB, only the first 16 colors are kept
+			color := DefaultColor
+			if i+2 < len(args) && args[i+1] == 5 {
+				if args[i+2] < 16 {
+					color = args[i+2]
+				}
+				i += 2
+			} else if i+4 < len(args) && args[i+1] == 2 {
+				i += 4
+			}
+			if a == 38 {
+				s.attr.Fg = color
+			} else {
+				s.attr.Bg = color
+			}
+		}
+	}
+}
+
+func clamp(v, lo, hi int) int {
+	return max(lo, min(v, hi))
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
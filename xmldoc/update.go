@@ -0,0 +1,254 @@
+package xmldoc
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+)
+
+// Update applies the changes between base and updated, two versions of the
+// document element encoded from a model, to the document. Only what changed is
+// encoded again. Whatever is in the document but not in base is left alone, as
+// it is not part of the model.
+//
+// Elements are matched up by name, name attribute and position among the
+// elements with both.
+func (doc *Document) Update(base, updated *Node) {
+	doc.update(doc.Root, base, updated, "")
+}
+
+func (doc *Document) update(n, base, updated *Node, indent string) {
+	for _, a := range updated.Attrs {
+		if v, ok := base.Attr(a.Name.Local); ok && v == a.Value {
+			continue
+		}
+		if v, ok := n.Attr(a.Name.Local); ok && v == a.Value {
+			continue
+		}
+		n.setAttr(a.Name.Local, a.Value)
+	}
+	for _, a := range base.Attrs {
+		if _, ok := updated.Attr(a.Name.Local); !ok {
+			n.removeAttr(a.Name.Local)
+		}
+	}
+
+	docElements, baseElements := keys(n.Elements()), keys(base.Elements())
+	updatedElements := keys(updated.Elements())
+	for k := range baseElements {
+		if _, ok := updatedElements[k]; !ok && docElements[k] != nil {
+			n.remove(docElements[k])
+		}
+	}
+	newline, inner := doc.newline, indent+doc.indent
+	if i, ok := childIndent(n); ok {
+		inner = i
+	} else if len(n.Elements()) > 0 {
+		// all on one line
+		newline, inner = "", ""
+	}
+	var prev *Node
+	updatedKeys := elementKeys(updated.Elements())
+	for i, u := range updated.Elements() {
+		k := updatedKeys[i]
+		c, b := docElements[k], baseElements[k]
+		switch {
+		case c != nil && b != nil:
+			doc.update(c, b, u, inner)
+		case c != nil:
+			doc.update(c, &Node{Name: u.Name}, u, inner)
+		case b != nil && equal(b, u):
+			// left out of the document, and still unchanged
+			continue
+		default:
+			c = doc.fresh(u, newline, inner)
+			doc.insert(n, prev, c, newline, indent, inner)
+		}
+		prev = c
+	}
+
+	if text := updated.Content(); text != base.Content() && text != n.Content() &&
+		len(updated.Elements()) == 0 {
+		n.setText(text)
+	}
+}
+
+// equal returns whether the elements a and b, from a model, are the same.
+func equal(a, b *Node) bool {
+	if a.Name != b.Name || len(a.Attrs) != len(b.Attrs) || a.Content() != b.Content() {
+		return false
+	}
+	for _, attr := range a.Attrs {
+		if v, ok := b.Attr(attr.Name.Local); !ok || v != attr.Value {
+			return false
+		}
+	}
+	ae, be := a.Elements(), b.Elements()
+	if len(ae) != len(be) {
+		return false
+	}
+	for i := range ae {
+		if !equal(ae[i], be[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// keys returns elements by their key.
+func keys(elements []*Node) map[string]*Node {
+	m := make(map[string]*Node, len(elements))
+	for i, k := range elementKeys(elements) {
+		m[k] = elements[i]
+	}
+	return m
+}
+
+// elementKeys returns the key of each of the sibling elements, which
+// identifies it among them: its name, name attribute and how many siblings
+// before it have both.
+func elementKeys(elements []*Node) []string {
+	seen := make(map[string]int, len(elements))
+	keys := make([]string, len(elements))
+	for i, e := range elements {
+		v, _ := e.Attr("name")
+		id := e.Name + "\x00" + v
+		keys[i] = id + "\x00" + strconv.Itoa(seen[id])
+		seen[id]++
+	}
+	return keys
+}
+
+func (n *Node) setAttr(name, value string) {
+	n.raw = ""
+	for i, a := range n.Attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			n.Attrs[i].Value = value
+			return
+		}
+	}
+	n.Attrs = append(n.Attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+func (n *Node) removeAttr(name string) {
+	for i, a := range n.Attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			n.raw = ""
+			n.Attrs = append(n.Attrs[:i:i], n.Attrs[i+1:]...)
+			return
+		}
+	}
+}
+
+// setText replaces the text in n.
+func (n *Node) setText(text string) {
+	var children []*Node
+	for _, c := range n.Children {
+		if c.kind != textNode {
+			children = append(children, c)
+		}
+	}
+	if text != "" {
+		children = append(children, &Node{kind: textNode, Text: text})
+	} else {
+		// write <name /> like for added elements
+		n.raw = ""
+	}
+	n.Children = children
+}
+
+// remove removes the child element c, and the whitespace before it.
+func (n *Node) remove(c *Node) {
+	for i, child := range n.Children {
+		if child != c {
+			continue
+		}
+		start := i
+		if i > 0 && isSpace(n.Children[i-1]) {
+			start--
+		}
+		n.Children = append(n.Children[:start:start], n.Children[i+1:]...)
+		return
+	}
+}
+
+// insert adds the child element c after prev, or before the other elements if
+// prev is nil, on a line of its own unless newline is empty.
+func (doc *Document) insert(n, prev, c *Node, newline, indent, inner string) {
+	var space []*Node
+	if newline != "" {
+		s := newline + inner
+		space = []*Node{{kind: textNode, Text: s, raw: s}}
+	}
+	elements := n.Elements()
+	if len(elements) == 0 {
+		n.Children = append(append(n.Children, space...), c)
+		if newline != "" {
+			s := newline + indent
+			n.Children = append(n.Children, &Node{kind: textNode, Text: s, raw: s})
+		}
+		return
+	}
+	at, add := index(n.Children, elements[0]), append([]*Node{c}, space...)
+	if prev != nil {
+		at, add = index(n.Children, prev)+1, append(space, c)
+	}
+	n.Children = append(n.Children[:at:at], append(add, n.Children[at:]...)...)
+}
+
+// fresh copies the element u from a model, adding line breaks and indentation
+// unless newline is empty.
+func (doc *Document) fresh(u *Node, newline, indent string) *Node {
+	c := &Node{Name: u.Name, Attrs: append(u.Attrs[:0:0], u.Attrs...)}
+	elements := u.Elements()
+	if len(elements) == 0 {
+		if text := u.Content(); text != "" {
+			c.Children = []*Node{{kind: textNode, Text: text}}
+		}
+		return c
+	}
+	inner := indent + doc.indent
+	if newline == "" {
+		inner = ""
+	}
+	for _, e := range elements {
+		doc.insert(c, lastElement(c), doc.fresh(e, newline, inner), newline, indent, inner)
+	}
+	return c
+}
+
+func lastElement(n *Node) *Node {
+	elements := n.Elements()
+	if len(elements) == 0 {
+		return nil
+	}
+	return elements[len(elements)-1]
+}
+
+func index(nodes []*Node, n *Node) int {
+	for i, c := range nodes {
+		if c == n {
+			return i
+		}
+	}
+	return len(nodes)
+}
+
+func isSpace(n *Node) bool {
+	return n.kind == textNode && strings.TrimSpace(n.Text) == ""
+}
+
+// childIndent returns the indentation of the child elements of n, if they are
+// on lines of their own.
+func childIndent(n *Node) (string, bool) {
+	for i, c := range n.Children {
+		if c.kind != elementNode || i == 0 || !isSpace(n.Children[i-1]) {
+			continue
+		}
+		s := n.Children[i-1].Text
+		if j := strings.LastIndex(s, "\n"); j != -1 {
+			return s[j+1:], true
+		}
+	}
+	return "", false
+}
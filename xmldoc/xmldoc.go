@@ -0,0 +1,254 @@
+// Package xmldoc keeps an XML document as it was read, so it can be written
+// back with just the changes encoded again. Elements and attributes nobody
+// modelled, comments, formatting and the text encoding stay as they were.
+package xmldoc
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// A Document is a parsed XML document.
+type Document struct {
+	// The document element
+	Root *Node
+	// Everything at the top level, including Root
+	nodes []*Node
+
+	// nil for UTF-8
+	encoding encoding.Encoding
+	bom      []byte
+	// used for added elements
+	newline, indent string
+}
+
+type nodeKind int
+
+const (
+	elementNode nodeKind = iota
+	textNode
+	// comments, processing instructions and directives
+	markupNode
+)
+
+// A Node is an element, text, or other markup like a comment.
+type Node struct {
+	// Name of an element, empty for other nodes
+	Name     string
+	Attrs    []xml.Attr
+	Children []*Node
+	// Unescaped character data of a text node
+	Text string
+
+	kind nodeKind
+	// The start tag of an element, or all of another node, as read. Empty if
+	// the node was changed or added.
+	raw string
+	// The end tag of an element as read, empty if the element closed itself
+	rawEnd string
+}
+
+// Parse reads a document in UTF-8 or UTF-16, with or without a byte order
+// mark.
+func Parse(data []byte) (*Document, error) {
+	doc := &Document{newline: "\n", indent: "  "}
+	text, err := doc.decodeText(data)
+	if err != nil {
+		return nil, err
+	}
+	d := xml.NewDecoder(strings.NewReader(text))
+	// the text is UTF-8 already, whatever the declaration says
+	d.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	var stack []*Node
+	add := func(n *Node) {
+		if len(stack) == 0 {
+			doc.nodes = append(doc.nodes, n)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, n)
+		}
+	}
+	var offset int64
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		raw := text[offset:d.InputOffset()]
+		offset = d.InputOffset()
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &Node{Name: name(t.Name), Attrs: append([]xml.Attr{}, t.Attr...), raw: raw}
+			if len(stack) == 0 {
+				if doc.Root != nil {
+					return nil, errors.New("more than one document element")
+				}
+				doc.Root = n
+			}
+			add(n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) == 0 || stack[len(stack)-1].Name != name(t.Name) {
+				return nil, errors.New("unexpected end element " + name(t.Name))
+			}
+			stack[len(stack)-1].rawEnd = raw
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			add(&Node{kind: textNode, Text: string(t), raw: raw})
+		default:
+			add(&Node{kind: markupNode, raw: raw})
+		}
+	}
+	if doc.Root == nil || len(stack) > 0 {
+		return nil, errors.New("incomplete document")
+	}
+
+	if strings.Contains(text, "\r\n") {
+		doc.newline = "\r\n"
+	}
+	if indent, ok := childIndent(doc.Root); ok && indent != "" {
+		doc.indent = indent
+	}
+	return doc, nil
+}
+
+func name(n xml.Name) string {
+	if n.Space != "" {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
+
+func (doc *Document) decodeText(data []byte) (string, error) {
+	utf16 := func(e unicode.Endianness) encoding.Encoding {
+		return unicode.UTF16(e, unicode.IgnoreBOM)
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		doc.encoding, doc.bom = utf16(unicode.LittleEndian), data[:2]
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		doc.encoding, doc.bom = utf16(unicode.BigEndian), data[:2]
+	case bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}):
+		doc.bom = data[:3]
+	case bytes.HasPrefix(data, []byte{'<', 0}):
+		doc.encoding = utf16(unicode.LittleEndian)
+	case bytes.HasPrefix(data, []byte{0, '<'}):
+		doc.encoding = utf16(unicode.BigEndian)
+	}
+	data = data[len(doc.bom):]
+	doc.bom = append([]byte{}, doc.bom...)
+	if doc.encoding == nil {
+		if !utf8.Valid(data) {
+			return "", errors.New("invalid UTF-8")
+		}
+		return string(data), nil
+	}
+	text, err := doc.encoding.NewDecoder().Bytes(data)
+	return string(text), err
+}
+
+// Decode decodes the document into v, like xml.Unmarshal.
+func (doc *Document) Decode(v interface{}) error {
+	d := xml.NewDecoder(strings.NewReader(doc.String()))
+	d.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	return d.Decode(v)
+}
+
+// String returns the document as text.
+func (doc *Document) String() string {
+	var b bytes.Buffer
+	for _, n := range doc.nodes {
+		n.write(&b)
+	}
+	return b.String()
+}
+
+// Bytes returns the document in the encoding it was read in. Unchanged
+// documents come out as they were read.
+func (doc *Document) Bytes() ([]byte, error) {
+	out := []byte(doc.String())
+	if doc.encoding != nil {
+		var err error
+		if out, err = doc.encoding.NewEncoder().Bytes(out); err != nil {
+			return nil, err
+		}
+	}
+	return append(append([]byte{}, doc.bom...), out...), nil
+}
+
+func (n *Node) write(b *bytes.Buffer) {
+	switch {
+	case n.kind == textNode && n.raw == "":
+		xml.EscapeText(b, []byte(n.Text))
+	case n.kind != elementNode:
+		b.WriteString(n.raw)
+	case n.raw != "" && (n.rawEnd != "" || len(n.Children) == 0):
+		b.WriteString(n.raw)
+		for _, c := range n.Children {
+			c.write(b)
+		}
+		b.WriteString(n.rawEnd)
+	default:
+		b.WriteString("<" + n.Name)
+		for _, a := range n.Attrs {
+			b.WriteString(" " + name(a.Name) + `="`)
+			xml.EscapeText(b, []byte(a.Value))
+			b.WriteString(`"`)
+		}
+		if len(n.Children) == 0 {
+			b.WriteString(" />")
+			return
+		}
+		b.WriteString(">")
+		for _, c := range n.Children {
+			c.write(b)
+		}
+		b.WriteString("</" + n.Name + ">")
+	}
+}
+
+// Elements returns the child elements of n.
+func (n *Node) Elements() []*Node {
+	var elements []*Node
+	for _, c := range n.Children {
+		if c.kind == elementNode {
+			elements = append(elements, c)
+		}
+	}
+	return elements
+}
+
+// Attr returns the value of the attribute name of n.
+func (n *Node) Attr(name string) (string, bool) {
+	for _, a := range n.Attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// Content returns the text directly in n.
+func (n *Node) Content() string {
+	var text string
+	for _, c := range n.Children {
+		if c.kind == textNode {
+			text += c.Text
+		}
+	}
+	return text
+}
@@ -0,0 +1,153 @@
+package xmldoc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/unicode"
+)
+
+// model is testdata/connections.xml like a model encodes it: without the
+// comments, the unknown elements and attributes, and the formatting.
+const model = `<configuration version="0.7.1.136" savepassword="True">
+<root type="database" name="connections" expanded="True">
+<container type="folder" name="servers" expanded="True">
+<connection type="PuTTY" name="web"><connection_info><name>web</name>` +
+	`<host>web.example.com</host><port>22</port><session>Default Settings</session>` +
+	`</connection_info></connection>
+<connection type="PuTTY" name="db"><connection_info><name>db</name>` +
+	`<host>db.example.com</host><port>2222</port><session>Default Settings</session>` +
+	`</connection_info></connection>
+<connection type="PuTTY" name="db"><connection_info><name>db</name>` +
+	`<host>db-standby.example.com</host><port>2222</port></connection_info></connection>
+</container>
+</root>
+</configuration>`
+
+func readTestFile(t *testing.T) ([]byte, *Document) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "connections.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, doc
+}
+
+func parseModel(t *testing.T, s string) *Node {
+	doc, err := Parse([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc.Root
+}
+
+func utf16(t *testing.T, s string) []byte {
+	b, err := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder().Bytes([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// updated returns the document as bytes after updating it from base to
+// updated.
+func updated(t *testing.T, doc *Document, base, updated string) []byte {
+	doc.Update(parseModel(t, base), parseModel(t, updated))
+	out, err := doc.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestUnchanged(t *testing.T) {
+	data, doc := readTestFile(t)
+	if out, err := doc.Bytes(); err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("read and written again: %v\n%s", err, out)
+	}
+	if out := updated(t, doc, model, model); !bytes.Equal(out, data) {
+		t.Errorf("updated without changes:\n%s", out)
+	}
+
+	var v struct {
+		Hosts []string `xml:"root>container>connection>connection_info>host"`
+	}
+	if err := doc.Decode(&v); err != nil || len(v.Hosts) != 3 || v.Hosts[0] != "web.example.com" {
+		t.Errorf("decoded %q, %v", v.Hosts, err)
+	}
+}
+
+// A change only touches the element it is in.
+func TestUpdateOne(t *testing.T) {
+	data, doc := readTestFile(t)
+	changed := strings.Replace(model, "<port>22</port>", "<port>2200</port>", 1)
+	want := bytes.Replace(data, utf16(t, "<port>22</port>"), utf16(t, "<port>2200</port>"), 1)
+	if out := updated(t, doc, model, changed); !bytes.Equal(out, want) {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+
+	// the second of two connections with the same name
+	_, doc = readTestFile(t)
+	changed = strings.Replace(model, "db-standby.example.com", "db2.example.com", 1)
+	want = bytes.Replace(data, utf16(t, "db-standby.example.com"), utf16(t, "db2.example.com"), 1)
+	if out := updated(t, doc, model, changed); !bytes.Equal(out, want) {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+
+	_, doc = readTestFile(t)
+	changed = strings.Replace(model, `expanded="True">`+"\n<connection", `expanded="False">`+"\n<connection", 1)
+	want = bytes.Replace(data, utf16(t, `expanded="True" pcm:color="blue"`),
+		utf16(t, `expanded="False" pcm:color="blue"`), 1)
+	if out := updated(t, doc, model, changed); !bytes.Equal(out, want) {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestUpdateAddRemove(t *testing.T) {
+	data, doc := readTestFile(t)
+	web := model[strings.Index(model, `<connection type="PuTTY" name="web">`):strings.Index(model,
+		`<connection type="PuTTY" name="db">`)]
+	changed := strings.Replace(model, web, "", 1)
+	changed = strings.Replace(changed, "</container>",
+		`<connection type="PuTTY" name="new"><connection_info><name>new</name></connection_info></connection>`+
+			"\n</container>", 1)
+	out := updated(t, doc, model, changed)
+
+	for _, s := range []string{"<!-- written by PuTTY Connection Manager -->", "<!-- the servers -->",
+		`pcm:color="blue"`, "db-standby.example.com"} {
+		if !bytes.Contains(out, utf16(t, s)) {
+			t.Errorf("%q lost", s)
+		}
+	}
+	if bytes.Contains(out, utf16(t, "web.example.com")) || bytes.Contains(out, utf16(t, "unknown_setting")) {
+		t.Error("web not removed")
+	}
+	want := "      </connection>\r\n" +
+		"      <connection type=\"PuTTY\" name=\"new\">\r\n" +
+		"        <connection_info>\r\n" +
+		"          <name>new</name>\r\n" +
+		"        </connection_info>\r\n" +
+		"      </connection>\r\n" +
+		"    </container>"
+	if !bytes.Contains(out, utf16(t, want)) {
+		t.Errorf("new connection not added in the style of the file:\n%s", out)
+	}
+	if !bytes.HasPrefix(out, data[:2]) {
+		t.Error("byte order mark lost")
+	}
+}
+
+func TestElementKeys(t *testing.T) {
+	root := parseModel(t, `<r><a name="x"/><a/><a name="x"/><b name="x"/><a/></r>`)
+	want := []string{"a\x00x\x000", "a\x00\x000", "a\x00x\x001", "b\x00x\x000", "a\x00\x001"}
+	got := elementKeys(root.Elements())
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}